@@ -5,21 +5,33 @@ import (
 	"context"
 	"flag"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
 
 	"github.com/shineum/smtp-proxy-lite/internal/config"
+	"github.com/shineum/smtp-proxy-lite/internal/logging"
 	"github.com/shineum/smtp-proxy-lite/internal/provider"
 	"github.com/shineum/smtp-proxy-lite/internal/provider/graph"
+	"github.com/shineum/smtp-proxy-lite/internal/provider/mailjet"
 	"github.com/shineum/smtp-proxy-lite/internal/provider/ses"
+	"github.com/shineum/smtp-proxy-lite/internal/provider/slack"
+	"github.com/shineum/smtp-proxy-lite/internal/provider/sparkpost"
 	"github.com/shineum/smtp-proxy-lite/internal/provider/stdout"
+	"github.com/shineum/smtp-proxy-lite/internal/queue"
 	"github.com/shineum/smtp-proxy-lite/internal/smtp"
 	smtptls "github.com/shineum/smtp-proxy-lite/internal/tls"
+	"github.com/shineum/smtp-proxy-lite/internal/tracing"
 )
 
 func main() {
 	configPath := flag.String("config", "", "path to YAML configuration file (optional)")
+	dumpConfig := flag.Bool("dump-config", false, "print the effective configuration as YAML (secrets redacted) and exit")
 	flag.Parse()
 
 	// Load configuration
@@ -28,46 +40,213 @@ func main() {
 		slog.Error("failed to load configuration", "error", err)
 		os.Exit(1)
 	}
+	if err := cfg.Validate(); err != nil {
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(1)
+	}
+
+	if *dumpConfig {
+		out, err := cfg.DumpYAML()
+		if err != nil {
+			slog.Error("failed to dump configuration", "error", err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(out)
+		return
+	}
 
 	// Setup structured logging
-	setupLogger(cfg.Logging.Level)
+	logging.Setup(os.Stdout, cfg.Logging.Level, cfg.Logging.Format)
 
 	// Load or generate TLS certificates
-	tlsConfig, err := smtptls.LoadOrGenerateTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	minVersion, ok := smtptls.ParseMinVersion(cfg.TLS.MinVersion)
+	if !ok {
+		slog.Warn("invalid TLS minimum version, using 1.2", "tls_min_version", cfg.TLS.MinVersion)
+	}
+	cipherSuites, err := smtptls.ParseCipherSuites(cfg.TLS.CipherSuites)
+	if err != nil {
+		slog.Error("failed to setup TLS", "error", err)
+		os.Exit(1)
+	}
+	tlsOpts := smtptls.Options{
+		CertFile:     cfg.TLS.CertFile,
+		KeyFile:      cfg.TLS.KeyFile,
+		MinVersion:   minVersion,
+		CipherSuites: cipherSuites,
+	}
+	var acmeManager *autocert.Manager
+	var certReloader *smtptls.CertReloader
+	if cfg.ACMEEnabled() {
+		acmeManager = smtptls.NewACMEManager(cfg.TLS.ACMEDomain, cfg.TLS.ACMECacheDir, cfg.TLS.ACMEEmail)
+		tlsOpts.ACME = acmeManager
+		tlsOpts.ACMEDomain = cfg.TLS.ACMEDomain
+	} else if cfg.TLS.CertFile != "" && cfg.TLS.KeyFile != "" {
+		// File-based certificates are reloadable on SIGHUP
+		certReloader, err = smtptls.NewCertReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			slog.Error("failed to setup TLS", "error", err)
+			os.Exit(1)
+		}
+		tlsOpts.Reloader = certReloader
+	}
+
+	tlsConfig, err := smtptls.LoadOrGenerateTLS(tlsOpts)
 	if err != nil {
 		slog.Error("failed to setup TLS", "error", err)
 		os.Exit(1)
 	}
 
 	tlsMode := "self-signed"
-	if cfg.TLS.CertFile != "" && cfg.TLS.KeyFile != "" {
+	switch {
+	case acmeManager != nil:
+		tlsMode = "acme"
+	case cfg.TLS.CertFile != "" && cfg.TLS.KeyFile != "":
 		tlsMode = "file"
 	}
 
+	// Cancelled on SIGTERM/SIGINT; stops the server and provider goroutines
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Export a trace of each message; without it the tracer is a no-op
+	if cfg.Tracing.Enabled {
+		shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing.Endpoint)
+		if err != nil {
+			slog.Error("failed to setup tracing", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("tracing enabled", "endpoint", cfg.Tracing.Endpoint)
+		defer func() {
+			// Flush the spans of the last messages before exiting
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := shutdownTracing(flushCtx); err != nil {
+				slog.Warn("failed to flush traces", "error", err)
+			}
+		}()
+	}
+
 	// Select email delivery provider
-	prov := selectProvider(cfg)
+	prov := selectProvider(ctx, cfg)
+	if cfg.SMTP.AliasesFile != "" {
+		aliases, err := provider.LoadAliasFile(cfg.SMTP.AliasesFile)
+		if err != nil {
+			slog.Error("failed to load aliases", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("recipient alias expansion enabled",
+			"aliases_file", cfg.SMTP.AliasesFile,
+			"aliases", len(aliases),
+		)
+		prov = provider.NewRecipientExpander(prov, aliases)
+	}
+	if cfg.DedupEnabled() {
+		slog.Info("duplicate delivery suppression enabled",
+			"headers", cfg.Dedup.Headers,
+			"ttl", cfg.Dedup.TTL,
+		)
+		prov = provider.NewDeduplicator(prov, cfg.Dedup.Headers, cfg.Dedup.TTL)
+	}
+
+	// Spool transient delivery failures for background retry
+	var spool *queue.Spool
+	if cfg.QueueEnabled() {
+		spool, err = queue.New(queue.Config{
+			Dir:           cfg.Queue.Dir,
+			DeadLetterDir: cfg.Queue.DeadLetterDir,
+			Provider:      prov,
+			MaxAttempts:   cfg.Queue.MaxAttempts,
+			RetryDelay:    cfg.Queue.RetryDelay,
+			Workers:       cfg.Queue.Workers,
+		})
+		if err != nil {
+			slog.Error("failed to open retry queue", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("retry queue enabled",
+			"dir", cfg.Queue.Dir,
+			"max_attempts", cfg.Queue.MaxAttempts,
+			"workers", cfg.Queue.Workers,
+		)
+	}
+
+	if cfg.Delivery.Async {
+		slog.Info("asynchronous delivery enabled",
+			"queue_backed", spool != nil,
+			"workers", cfg.Delivery.Workers,
+			"queue_size", cfg.Delivery.QueueSize,
+		)
+	}
 
 	// Create SMTP server
+	var users []smtp.User
+	if cfg.SMTP.UsersFile != "" {
+		users, err = smtp.LoadUsersFile(cfg.SMTP.UsersFile)
+		if err != nil {
+			slog.Error("failed to load users", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("file-based SMTP AUTH users loaded",
+			"users_file", cfg.SMTP.UsersFile,
+			"users", len(users),
+		)
+	}
+
+	var greylist smtp.Greylister
+	if cfg.SMTP.Greylist {
+		greylist = smtp.NewMemoryGreylist(cfg.SMTP.GreylistDelay, cfg.SMTP.GreylistTTL)
+		slog.Info("greylisting enabled",
+			"delay", cfg.SMTP.GreylistDelay,
+			"ttl", cfg.SMTP.GreylistTTL,
+		)
+	}
+
 	server := smtp.New(smtp.ServerConfig{
 		ListenAddr:   cfg.SMTP.Listen,
-		Hostname:     "localhost",
+		TLSListen:    cfg.SMTP.TLSListen,
+		Hostname:     cfg.SMTP.Hostname,
+		Banner:       cfg.SMTP.Banner,
 		Provider:     prov,
 		TLSConfig:    tlsConfig,
+		ClientCAFile: cfg.TLS.ClientCAFile,
 		AuthUsername: cfg.SMTP.Username,
 		AuthPassword: cfg.SMTP.Password,
+		Users:        users,
+
+		RequireTLSForAuth:  cfg.SMTP.RequireTLSAuth,
+		MaxAuthAttempts:    cfg.SMTP.MaxAuthAttempts,
+		AuthBanThreshold:   cfg.SMTP.AuthBanThreshold,
+		AuthBanWindow:      cfg.SMTP.AuthBanWindow,
+		AuthBanDuration:    cfg.SMTP.AuthBanDuration,
+		MaxReceivedHeaders: cfg.SMTP.MaxReceivedHeaders,
+		MaxRecipients:      cfg.SMTP.MaxRecipients,
+		MaxTransactions:    cfg.SMTP.MaxTransactions,
+		ProxyProtocol:      cfg.SMTP.ProxyProtocol,
+		ReusePort:          cfg.SMTP.ReusePort,
+		MaxLineLength:      cfg.SMTP.MaxLineLength,
+		CommandTimeout:     cfg.SMTP.CommandTimeout,
+		MaxSessionDuration: cfg.SMTP.MaxSessionDuration,
+
+		AllowedRecipientDomains: cfg.SMTP.AllowedRcptDomains,
+		DeniedRecipientDomains:  cfg.SMTP.DeniedRcptDomains,
+		AllowedSenders:          cfg.SMTP.AllowedSenders,
+		Greylist:                greylist,
+
+		Queue:             spool,
+		AsyncDelivery:     cfg.Delivery.Async,
+		DeliveryWorkers:   cfg.Delivery.Workers,
+		DeliveryQueueSize: cfg.Delivery.QueueSize,
 	})
 
 	slog.Info("starting smtp-proxy-lite",
 		"listen", cfg.SMTP.Listen,
+		"smtps_listen", cfg.SMTP.TLSListen,
 		"provider", prov.Name(),
 		"auth_enabled", cfg.AuthEnabled(),
 		"tls_mode", tlsMode,
 	)
 
 	// Setup graceful shutdown
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
 
@@ -77,15 +256,122 @@ func main() {
 		cancel()
 	}()
 
+	// Reload the configuration file and TLS certificates on SIGHUP
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+
+	go func() {
+		current := cfg
+		for range hupCh {
+			if *configPath != "" {
+				current = reloadConfig(*configPath, current, server)
+			} else {
+				slog.Info("received SIGHUP, no configuration file to reload")
+			}
+
+			if certReloader == nil {
+				slog.Info("received SIGHUP, no reloadable TLS certificate configured")
+				continue
+			}
+			if err := certReloader.Reload(); err != nil {
+				slog.Error("failed to reload TLS certificate, keeping current certificate", "error", err)
+				continue
+			}
+			slog.Info("reloaded TLS certificate", "cert_file", cfg.TLS.CertFile)
+		}
+	}()
+
+	// ACME HTTP-01 challenges must be answered on port 80 of the domain
+	if acmeManager != nil {
+		go serveACMEChallenges(ctx, cfg.TLS.ACMEHTTPListen, acmeManager.HTTPHandler(nil))
+	}
+
+	queueDone := make(chan struct{})
+	if spool != nil {
+		go func() {
+			defer close(queueDone)
+			spool.Run(ctx)
+		}()
+	} else {
+		close(queueDone)
+	}
+
 	// Start the server (blocks until context is cancelled)
 	if err := server.ListenAndServe(ctx); err != nil {
 		slog.Error("server error", "error", err)
 		os.Exit(1)
 	}
+	<-queueDone
 
 	slog.Info("smtp-proxy-lite stopped")
 }
 
+// serveACMEChallenges runs the HTTP server that answers ACME HTTP-01
+// challenges until the context is cancelled.
+func serveACMEChallenges(ctx context.Context, addr string, handler http.Handler) {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	slog.Info("serving ACME HTTP-01 challenges", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("ACME challenge server error", "error", err)
+	}
+}
+
+// reloadConfig re-reads the configuration file and applies the settings that
+// can change at runtime: the log level, SMTP AUTH credentials and
+// per-session limits. Changes to any other setting need a restart and are
+// logged and ignored. If the new file is invalid, the current configuration
+// is kept. It returns the configuration in effect afterwards.
+func reloadConfig(path string, current *config.Config, server *smtp.Server) *config.Config {
+	next, err := config.LoadFromFile(path)
+	if err == nil {
+		err = next.Validate()
+	}
+	if err != nil {
+		slog.Error("failed to reload configuration, keeping current configuration", "error", err)
+		return current
+	}
+
+	applied := *current
+	applied.Logging.Level = next.Logging.Level
+	applied.SMTP.Username = next.SMTP.Username
+	applied.SMTP.Password = next.SMTP.Password
+	applied.SMTP.MaxAuthAttempts = next.SMTP.MaxAuthAttempts
+	applied.SMTP.MaxReceivedHeaders = next.SMTP.MaxReceivedHeaders
+	applied.SMTP.MaxRecipients = next.SMTP.MaxRecipients
+	applied.SMTP.MaxTransactions = next.SMTP.MaxTransactions
+	for _, field := range applied.Diff(next) {
+		slog.Warn("configuration change requires a restart, ignoring", "field", field)
+	}
+
+	logging.SetLevel(applied.Logging.Level)
+	server.SetCredentials(applied.SMTP.Username, applied.SMTP.Password)
+	server.SetLimits(smtp.Limits{
+		MaxAuthAttempts:    applied.SMTP.MaxAuthAttempts,
+		MaxReceivedHeaders: applied.SMTP.MaxReceivedHeaders,
+		MaxRecipients:      applied.SMTP.MaxRecipients,
+		MaxTransactions:    applied.SMTP.MaxTransactions,
+	})
+
+	slog.Info("reloaded configuration",
+		"config", path,
+		"log_level", applied.Logging.Level,
+		"auth_enabled", applied.AuthEnabled(),
+		"max_recipients", applied.SMTP.MaxRecipients,
+		"max_transactions", applied.SMTP.MaxTransactions,
+	)
+	return &applied
+}
+
 // loadConfig loads configuration from the specified path (YAML + env override)
 // or from environment variables only if no path is given.
 func loadConfig(path string) (*config.Config, error) {
@@ -95,35 +381,61 @@ func loadConfig(path string) (*config.Config, error) {
 	return config.Load()
 }
 
-// setupLogger configures the global slog logger with JSON output and the
-// specified log level.
-func setupLogger(level string) {
-	var logLevel slog.Level
-
-	switch level {
-	case "debug":
-		logLevel = slog.LevelDebug
-	case "info":
-		logLevel = slog.LevelInfo
-	case "warn":
-		logLevel = slog.LevelWarn
-	case "error":
-		logLevel = slog.LevelError
-	default:
-		logLevel = slog.LevelInfo
+// selectProvider chooses the email delivery backend based on configuration.
+// If the PROVIDER env var is set, it takes precedence. A comma-separated list
+// (e.g. "ses,graph") builds a failover chain tried in order.
+// Otherwise, it falls back to auto-detection (Graph if configured, else stdout).
+// In a dry run the backend only builds and logs messages. The configured
+// content policy middleware wraps the result, so it applies to dry runs too.
+func selectProvider(ctx context.Context, cfg *config.Config) provider.Provider {
+	prov := newBackend(ctx, cfg)
+	if cfg.DryRun {
+		slog.Warn("dry run enabled: messages are built and logged but not sent")
+		prov = provider.NewDryRun(prov)
 	}
+	return provider.Wrap(prov, policyMiddleware(cfg)...)
+}
 
-	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
-		Level: logLevel,
-	})
-	slog.SetDefault(slog.New(handler))
+// newBackend creates the configured provider, or a failover chain for a
+// comma-separated list of providers.
+func newBackend(ctx context.Context, cfg *config.Config) provider.Provider {
+	if !strings.Contains(cfg.Provider, ",") {
+		return newProvider(ctx, cfg, cfg.Provider)
+	}
+
+	var providers []provider.Provider
+	for _, name := range strings.Split(cfg.Provider, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			slog.Error("empty provider name in provider list", "provider", cfg.Provider)
+			os.Exit(1)
+		}
+		providers = append(providers, newProvider(ctx, cfg, name))
+	}
+
+	chain := provider.NewChain(providers...)
+	slog.Info("using provider failover chain", "providers", chain.Name())
+	return chain
 }
 
-// selectProvider chooses the email delivery backend based on configuration.
-// If the PROVIDER env var is set, it takes precedence.
-// Otherwise, it falls back to auto-detection (Graph if configured, else stdout).
-func selectProvider(cfg *config.Config) provider.Provider {
-	switch cfg.Provider {
+// policyMiddleware returns the content policy checks enabled in cfg.
+func policyMiddleware(cfg *config.Config) []provider.Middleware {
+	var middlewares []provider.Middleware
+	if len(cfg.Policy.DeniedExtensions) > 0 {
+		slog.Info("attachment extension denylist enabled", "extensions", cfg.Policy.DeniedExtensions)
+		middlewares = append(middlewares, provider.DenyAttachmentExtensions(cfg.Policy.DeniedExtensions))
+	}
+	if cfg.Policy.MaxAttachments > 0 {
+		slog.Info("attachment count limit enabled", "max_attachments", cfg.Policy.MaxAttachments)
+		middlewares = append(middlewares, provider.MaxAttachments(cfg.Policy.MaxAttachments))
+	}
+	return middlewares
+}
+
+// newProvider creates the named email delivery backend. An empty name
+// auto-detects the provider from the configured credentials.
+func newProvider(ctx context.Context, cfg *config.Config, name string) provider.Provider {
+	switch name {
 	case "ses":
 		if !cfg.SESConfigured() {
 			slog.Error("SES provider selected but SES_REGION and SES_SENDER are required")
@@ -134,10 +446,15 @@ func selectProvider(cfg *config.Config) provider.Provider {
 			"sender", cfg.SES.Sender,
 		)
 		p, err := ses.New(context.Background(), ses.SESProviderConfig{
-			Region:          cfg.SES.Region,
-			AccessKeyID:     cfg.SES.AccessKeyID,
-			SecretAccessKey: cfg.SES.SecretAccessKey,
-			Sender:          cfg.SES.Sender,
+			Region:           cfg.SES.Region,
+			AccessKeyID:      cfg.SES.AccessKeyID,
+			SecretAccessKey:  cfg.SES.SecretAccessKey,
+			Sender:           cfg.SES.Sender,
+			PreserveFrom:     cfg.PreserveFrom,
+			ConfigurationSet: cfg.SES.ConfigurationSet,
+			Tags:             cfg.SES.Tags,
+			MaxRetries:       &cfg.ProviderMaxRetries,
+			RetryBaseDelay:   cfg.ProviderRetryBaseDelay,
 		})
 		if err != nil {
 			slog.Error("failed to create SES provider", "error", err)
@@ -153,11 +470,69 @@ func selectProvider(cfg *config.Config) provider.Provider {
 		slog.Info("using Microsoft Graph provider",
 			"sender", cfg.Graph.Sender,
 		)
-		return graph.New(graph.GraphProviderConfig{
-			TenantID:     cfg.Graph.TenantID,
-			ClientID:     cfg.Graph.ClientID,
-			ClientSecret: cfg.Graph.ClientSecret,
-			Sender:       cfg.Graph.Sender,
+		p := graph.New(graph.GraphProviderConfig{
+			TenantID:            cfg.Graph.TenantID,
+			ClientID:            cfg.Graph.ClientID,
+			ClientSecret:        cfg.Graph.ClientSecret,
+			Sender:              cfg.Graph.Sender,
+			PreserveFrom:        cfg.PreserveFrom,
+			SaveToSentItems:     cfg.Graph.SaveToSentItems,
+			AllowSenderOverride: cfg.Graph.AllowSenderOverride,
+			AllowedSenders:      cfg.Graph.AllowedSenders,
+			AuthorityHost:       cfg.Graph.AuthorityHost,
+			BaseURL:             cfg.Graph.BaseURL,
+			Scope:               cfg.Graph.Scope,
+			MaxRetries:          &cfg.ProviderMaxRetries,
+			RetryBaseDelay:      cfg.ProviderRetryBaseDelay,
+		})
+		if cfg.Graph.BackgroundTokenRefresh {
+			p.StartTokenRefresh(ctx)
+		}
+		return p
+
+	case "mailjet":
+		if !cfg.MailjetConfigured() {
+			slog.Error("Mailjet provider selected but MAILJET_API_KEY, MAILJET_SECRET_KEY, and MAILJET_SENDER are required")
+			os.Exit(1)
+		}
+		slog.Info("using Mailjet provider",
+			"sender", cfg.Mailjet.Sender,
+		)
+		return mailjet.New(mailjet.MailjetProviderConfig{
+			APIKey:         cfg.Mailjet.APIKey,
+			SecretKey:      cfg.Mailjet.SecretKey,
+			Sender:         cfg.Mailjet.Sender,
+			PreserveFrom:   cfg.PreserveFrom,
+			MaxRetries:     &cfg.ProviderMaxRetries,
+			RetryBaseDelay: cfg.ProviderRetryBaseDelay,
+		})
+
+	case "sparkpost":
+		if !cfg.SparkPostConfigured() {
+			slog.Error("SparkPost provider selected but SPARKPOST_API_KEY and SPARKPOST_SENDER are required")
+			os.Exit(1)
+		}
+		slog.Info("using SparkPost provider",
+			"sender", cfg.SparkPost.Sender,
+			"base_url", cfg.SparkPost.BaseURL,
+		)
+		return sparkpost.New(sparkpost.SparkPostProviderConfig{
+			APIKey:         cfg.SparkPost.APIKey,
+			Sender:         cfg.SparkPost.Sender,
+			BaseURL:        cfg.SparkPost.BaseURL,
+			PreserveFrom:   cfg.PreserveFrom,
+			MaxRetries:     &cfg.ProviderMaxRetries,
+			RetryBaseDelay: cfg.ProviderRetryBaseDelay,
+		})
+
+	case "slack":
+		if !cfg.SlackConfigured() {
+			slog.Error("Slack provider selected but SLACK_WEBHOOK_URL is required")
+			os.Exit(1)
+		}
+		slog.Info("using Slack webhook provider")
+		return slack.New(slack.SlackProviderConfig{
+			WebhookURL: cfg.Slack.WebhookURL,
 		})
 
 	case "stdout":
@@ -170,12 +545,25 @@ func selectProvider(cfg *config.Config) provider.Provider {
 			slog.Info("using Microsoft Graph provider (auto-detected)",
 				"sender", cfg.Graph.Sender,
 			)
-			return graph.New(graph.GraphProviderConfig{
-				TenantID:     cfg.Graph.TenantID,
-				ClientID:     cfg.Graph.ClientID,
-				ClientSecret: cfg.Graph.ClientSecret,
-				Sender:       cfg.Graph.Sender,
+			p := graph.New(graph.GraphProviderConfig{
+				TenantID:            cfg.Graph.TenantID,
+				ClientID:            cfg.Graph.ClientID,
+				ClientSecret:        cfg.Graph.ClientSecret,
+				Sender:              cfg.Graph.Sender,
+				PreserveFrom:        cfg.PreserveFrom,
+				SaveToSentItems:     cfg.Graph.SaveToSentItems,
+				AllowSenderOverride: cfg.Graph.AllowSenderOverride,
+				AllowedSenders:      cfg.Graph.AllowedSenders,
+				AuthorityHost:       cfg.Graph.AuthorityHost,
+				BaseURL:             cfg.Graph.BaseURL,
+				Scope:               cfg.Graph.Scope,
+				MaxRetries:          &cfg.ProviderMaxRetries,
+				RetryBaseDelay:      cfg.ProviderRetryBaseDelay,
 			})
+			if cfg.Graph.BackgroundTokenRefresh {
+				p.StartTokenRefresh(ctx)
+			}
+			return p
 		}
 		if cfg.SESConfigured() {
 			slog.Info("using AWS SES provider (auto-detected)",
@@ -183,10 +571,15 @@ func selectProvider(cfg *config.Config) provider.Provider {
 				"sender", cfg.SES.Sender,
 			)
 			p, err := ses.New(context.Background(), ses.SESProviderConfig{
-				Region:          cfg.SES.Region,
-				AccessKeyID:     cfg.SES.AccessKeyID,
-				SecretAccessKey: cfg.SES.SecretAccessKey,
-				Sender:          cfg.SES.Sender,
+				Region:           cfg.SES.Region,
+				AccessKeyID:      cfg.SES.AccessKeyID,
+				SecretAccessKey:  cfg.SES.SecretAccessKey,
+				Sender:           cfg.SES.Sender,
+				PreserveFrom:     cfg.PreserveFrom,
+				ConfigurationSet: cfg.SES.ConfigurationSet,
+				Tags:             cfg.SES.Tags,
+				MaxRetries:       &cfg.ProviderMaxRetries,
+				RetryBaseDelay:   cfg.ProviderRetryBaseDelay,
 			})
 			if err != nil {
 				slog.Error("failed to create SES provider", "error", err)
@@ -198,7 +591,7 @@ func selectProvider(cfg *config.Config) provider.Provider {
 		return stdout.New()
 
 	default:
-		slog.Error("unknown provider", "provider", cfg.Provider)
+		slog.Error("unknown provider", "provider", name)
 		os.Exit(1)
 		return nil
 	}
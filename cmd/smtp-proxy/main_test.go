@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/shineum/smtp-proxy-lite/internal/config"
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+	"github.com/shineum/smtp-proxy-lite/internal/provider"
+	"github.com/shineum/smtp-proxy-lite/internal/smtp"
+)
+
+func TestSelectProvider_DryRunAppliesPolicy(t *testing.T) {
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	cfg := &config.Config{Provider: "graph", DryRun: true}
+	cfg.Graph.TenantID = "tenant"
+	cfg.Graph.ClientID = "client"
+	cfg.Graph.ClientSecret = "secret"
+	cfg.Graph.Sender = "sender@example.com"
+	cfg.Policy.DeniedExtensions = []string{"exe"}
+	cfg.Policy.MaxAttachments = 1
+	prov := selectProvider(context.Background(), cfg)
+
+	tests := []struct {
+		name        string
+		attachments []string
+		wantReject  bool
+	}{
+		{"allowed", []string{"report.pdf"}, false},
+		{"denied extension", []string{"setup.exe"}, true},
+		{"too many attachments", []string{"a.pdf", "b.pdf"}, true},
+	}
+
+	for _, tt := range tests {
+		buf.Reset()
+		msg := &email.Email{To: []string{"user@example.com"}, Subject: "Report", TextBody: "Attached"}
+		for _, name := range tt.attachments {
+			msg.Attachments = append(msg.Attachments, email.Attachment{Filename: name, ContentType: "application/octet-stream", Content: []byte("data")})
+		}
+
+		err := prov.Send(context.Background(), msg)
+		if tt.wantReject {
+			var policyErr *provider.PolicyError
+			if !errors.As(err, &policyErr) {
+				t.Errorf("%s: Send: got %v, want a policy error", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Send: unexpected error: %v", tt.name, err)
+		}
+		// The dry run still builds the Graph request behind the policy checks
+		if output := buf.String(); !strings.Contains(output, `"request":{"message":`) {
+			t.Errorf("%s: dry run did not log a Graph request, got: %s", tt.name, output)
+		}
+	}
+}
+
+func TestReloadConfig_AppliesOnlyReloadableSettings(t *testing.T) {
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(yaml string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(yaml), 0644); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+	}
+
+	writeConfig("smtp:\n  listen: \":2525\"\n  max_recipients: 10\n")
+	current, err := config.LoadFromFile(path)
+	if err != nil {
+		t.Fatalf("LoadFromFile: %v", err)
+	}
+	server := smtp.New(smtp.ServerConfig{Provider: provider.NewMemory()})
+
+	writeConfig("smtp:\n  listen: \":3025\"\n  max_recipients: 20\n  allowed_senders: [\"*@example.com\"]\n")
+	got := reloadConfig(path, current, server)
+
+	if got.SMTP.MaxRecipients != 20 {
+		t.Errorf("SMTP.MaxRecipients: got %d, want 20", got.SMTP.MaxRecipients)
+	}
+	// Settings that need a restart keep their running values
+	if got.SMTP.Listen != ":2525" {
+		t.Errorf("SMTP.Listen: got %q, want %q", got.SMTP.Listen, ":2525")
+	}
+	if got.SMTP.AllowedSenders != nil {
+		t.Errorf("SMTP.AllowedSenders: got %v, want none", got.SMTP.AllowedSenders)
+	}
+
+	var warned []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if strings.Contains(line, "configuration change requires a restart") {
+			_, field, _ := strings.Cut(line, `"field":"`)
+			field, _, _ = strings.Cut(field, `"`)
+			warned = append(warned, field)
+		}
+	}
+	if want := []string{"smtp.listen", "smtp.allowed_senders"}; !reflect.DeepEqual(warned, want) {
+		t.Errorf("restart warnings: got %v, want %v", warned, want)
+	}
+}
@@ -3,10 +3,18 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
+	"net"
+	"net/mail"
+	"net/url"
 	"os"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -14,22 +22,139 @@ import (
 // defaultMaxMessageSize is 25 MB in bytes.
 const defaultMaxMessageSize = 26214400
 
+// defaultBanner is the default text after the hostname in the SMTP greeting.
+const defaultBanner = "ESMTP smtp-proxy-lite"
+
+// defaultAuthBanWindow and defaultAuthBanDuration are the default period
+// over which AUTH failures from an IP are counted and the default time a
+// banned IP is refused.
+const (
+	defaultAuthBanWindow   = 10 * time.Minute
+	defaultAuthBanDuration = 15 * time.Minute
+)
+
+// defaultGreylistDelay and defaultGreylistTTL are the default wait before a
+// greylisted delivery is accepted on retry and the default time a triplet
+// is remembered.
+const (
+	defaultGreylistDelay = 5 * time.Minute
+	defaultGreylistTTL   = 24 * time.Hour
+)
+
+// defaultMaxRecipients is the default number of RCPT TO addresses accepted
+// per message.
+const defaultMaxRecipients = 100
+
+// minLineLength is the RFC 5321 command line length limit, which is also
+// the default and the smallest value accepted.
+const minLineLength = 512
+
+// defaultCommandTimeout is the default time allowed to read each SMTP
+// command line.
+const defaultCommandTimeout = 60 * time.Second
+
+// defaultMaxSessionDuration is the default total lifetime of an SMTP
+// session.
+const defaultMaxSessionDuration = 30 * time.Minute
+
+// defaultQueueMaxAttempts is the default number of delivery attempts for a
+// queued message before it is dead-lettered.
+const defaultQueueMaxAttempts = 10
+
+// defaultQueueWorkers is the default number of queue delivery workers.
+const defaultQueueWorkers = 2
+
+// defaultDeliveryWorkers is the default number of asynchronous delivery
+// workers.
+const defaultDeliveryWorkers = 4
+
+// defaultDeliveryQueueSize is the default number of accepted messages that
+// may wait for an asynchronous delivery worker.
+const defaultDeliveryQueueSize = 100
+
+// defaultProviderMaxRetries is the default number of provider retries after
+// a transient failure.
+const defaultProviderMaxRetries = 3
+
 // Config holds the complete application configuration.
 type Config struct {
-	Provider string        `yaml:"provider"`
-	SMTP     SMTPConfig    `yaml:"smtp"`
-	Graph    GraphConfig   `yaml:"graph"`
-	SES      SESConfig     `yaml:"ses"`
-	TLS      TLSConfig     `yaml:"tls"`
-	Logging  LoggingConfig `yaml:"logging"`
+	Provider string `yaml:"provider"`
+
+	// PreserveFrom makes providers send with the message's own From
+	// address rather than the configured sender.
+	PreserveFrom bool `yaml:"preserve_from"`
+
+	// ProviderMaxRetries and ProviderRetryBaseDelay control how the API
+	// providers retry transient failures; the delay doubles on each retry.
+	// Zero retries sends each message once.
+	ProviderMaxRetries     int           `yaml:"provider_max_retries"`
+	ProviderRetryBaseDelay time.Duration `yaml:"provider_retry_base_delay"`
+
+	// DryRun builds and logs each provider request without sending it.
+	DryRun bool `yaml:"dry_run"`
+
+	SMTP      SMTPConfig      `yaml:"smtp"`
+	Graph     GraphConfig     `yaml:"graph"`
+	SES       SESConfig       `yaml:"ses"`
+	Mailjet   MailjetConfig   `yaml:"mailjet"`
+	SparkPost SparkPostConfig `yaml:"sparkpost"`
+	Slack     SlackConfig     `yaml:"slack"`
+	TLS       TLSConfig       `yaml:"tls"`
+	Dedup     DedupConfig     `yaml:"dedup"`
+	Queue     QueueConfig     `yaml:"queue"`
+	Delivery  DeliveryConfig  `yaml:"delivery"`
+	Policy    PolicyConfig    `yaml:"policy"`
+	Logging   LoggingConfig   `yaml:"logging"`
+	Tracing   TracingConfig   `yaml:"tracing"`
 }
 
 // SMTPConfig holds SMTP server configuration.
 type SMTPConfig struct {
-	Listen         string `yaml:"listen"`
-	Username       string `yaml:"username"`
-	Password       string `yaml:"password"`
-	MaxMessageSize int64  `yaml:"max_message_size"`
+	Listen             string   `yaml:"listen"`
+	TLSListen          string   `yaml:"tls_listen"`
+	Hostname           string   `yaml:"hostname"`
+	Banner             string   `yaml:"banner"`
+	Username           string   `yaml:"username"`
+	Password           string   `yaml:"password"`
+	MaxMessageSize     ByteSize `yaml:"max_message_size"`
+	MaxReceivedHeaders int      `yaml:"max_received_headers"`
+	MaxRecipients      int      `yaml:"max_recipients"`
+	MaxTransactions    int      `yaml:"max_transactions"`
+	RequireTLSAuth     bool     `yaml:"require_tls_auth"`
+	MaxAuthAttempts    int      `yaml:"max_auth_attempts"`
+	AliasesFile        string   `yaml:"aliases_file"`
+	UsersFile          string   `yaml:"users_file"`
+	MaxLineLength      int      `yaml:"max_line_length"`
+	ProxyProtocol      bool     `yaml:"proxy_protocol"`
+	ReusePort          bool     `yaml:"reuse_port"`
+
+	// AuthBanThreshold bans a client IP after this many AUTH failures
+	// within AuthBanWindow, refusing its connections for AuthBanDuration.
+	// Zero disables banning.
+	AuthBanThreshold int           `yaml:"auth_ban_threshold"`
+	AuthBanWindow    time.Duration `yaml:"auth_ban_window"`
+	AuthBanDuration  time.Duration `yaml:"auth_ban_duration"`
+
+	// CommandTimeout bounds the wait for each command line;
+	// MaxSessionDuration caps the whole session however active it is.
+	CommandTimeout     time.Duration `yaml:"command_timeout"`
+	MaxSessionDuration time.Duration `yaml:"max_session_duration"`
+
+	// AllowedRcptDomains and DeniedRcptDomains restrict the recipient
+	// domains accepted at RCPT TO. An empty allowlist, or "*", allows all.
+	AllowedRcptDomains []string `yaml:"allowed_rcpt_domains,omitempty"`
+	DeniedRcptDomains  []string `yaml:"denied_rcpt_domains,omitempty"`
+
+	// AllowedSenders restricts MAIL FROM to these addresses or "*@domain"
+	// patterns. Empty allows any sender.
+	AllowedSenders []string `yaml:"allowed_senders,omitempty"`
+
+	// Greylist refuses each new (client IP, sender, recipient) triplet of
+	// unauthenticated clients with 451 until it is retried GreylistDelay
+	// later. Triplets are forgotten GreylistTTL after they were last seen.
+	Greylist      bool          `yaml:"greylist"`
+	GreylistDelay time.Duration `yaml:"greylist_delay"`
+	GreylistTTL   time.Duration `yaml:"greylist_ttl"`
 }
 
 // GraphConfig holds Microsoft Graph API configuration.
@@ -38,6 +163,25 @@ type GraphConfig struct {
 	ClientID     string `yaml:"client_id"`
 	ClientSecret string `yaml:"client_secret"`
 	Sender       string `yaml:"sender"`
+
+	// SaveToSentItems keeps a copy of each sent message in the sender
+	// mailbox's Sent Items folder.
+	SaveToSentItems bool `yaml:"save_to_sent_items"`
+
+	// AllowSenderOverride sends from the mailbox in a message's From
+	// address when it matches AllowedSenders (addresses or "*@domain").
+	AllowSenderOverride bool     `yaml:"allow_sender_override"`
+	AllowedSenders      []string `yaml:"allowed_senders,omitempty"`
+
+	// AuthorityHost, BaseURL and Scope select the Azure cloud; the
+	// defaults are the global cloud's.
+	AuthorityHost string `yaml:"authority_host"`
+	BaseURL       string `yaml:"base_url"`
+	Scope         string `yaml:"scope"`
+
+	// BackgroundTokenRefresh renews the OAuth2 token before it expires
+	// instead of on the first send after expiry.
+	BackgroundTokenRefresh bool `yaml:"background_token_refresh"`
 }
 
 // SESConfig holds AWS SES configuration.
@@ -46,25 +190,112 @@ type SESConfig struct {
 	AccessKeyID     string `yaml:"access_key_id"`
 	SecretAccessKey string `yaml:"secret_access_key"`
 	Sender          string `yaml:"sender"`
+
+	// ConfigurationSet is the SES configuration set to send with, for
+	// event publishing and IP pools.
+	ConfigurationSet string `yaml:"configuration_set"`
+
+	// Tags are "name=value" message tags added to every message.
+	Tags []string `yaml:"tags,omitempty"`
+}
+
+// MailjetConfig holds Mailjet Send API configuration.
+type MailjetConfig struct {
+	APIKey    string `yaml:"api_key"`
+	SecretKey string `yaml:"secret_key"`
+	Sender    string `yaml:"sender"`
 }
 
-// TLSConfig holds TLS certificate file paths.
+// SparkPostConfig holds SparkPost Transmissions API configuration.
+type SparkPostConfig struct {
+	APIKey string `yaml:"api_key"`
+	Sender string `yaml:"sender"`
+
+	// BaseURL is the API root; EU accounts use
+	// https://api.eu.sparkpost.com/api/v1.
+	BaseURL string `yaml:"base_url"`
+}
+
+// SlackConfig holds Slack incoming webhook configuration.
+type SlackConfig struct {
+	WebhookURL string `yaml:"webhook_url"`
+}
+
+// TLSConfig holds TLS certificate settings: either certificate file paths
+// or an ACME (Let's Encrypt) domain for automatic certificates. ClientCAFile
+// enables client certificate authentication (mutual TLS).
 type TLSConfig struct {
-	CertFile string `yaml:"cert_file"`
-	KeyFile  string `yaml:"key_file"`
+	CertFile       string   `yaml:"cert_file"`
+	KeyFile        string   `yaml:"key_file"`
+	ClientCAFile   string   `yaml:"client_ca_file"`
+	MinVersion     string   `yaml:"min_version"`
+	CipherSuites   []string `yaml:"cipher_suites,omitempty"`
+	ACMEDomain     string   `yaml:"acme_domain"`
+	ACMEEmail      string   `yaml:"acme_email"`
+	ACMECacheDir   string   `yaml:"acme_cache_dir"`
+	ACMEHTTPListen string   `yaml:"acme_http_listen"`
+}
+
+// DedupConfig holds duplicate-delivery suppression settings. Messages are
+// keyed by the first header in Headers that is present; an empty list
+// disables deduplication.
+type DedupConfig struct {
+	Headers []string      `yaml:"headers"`
+	TTL     time.Duration `yaml:"ttl"`
+}
+
+// QueueConfig holds the retry queue settings. Messages whose delivery fails
+// transiently are spooled in Dir and retried in the background; an empty
+// Dir disables the queue. DeadLetterDir defaults to Dir/dead.
+type QueueConfig struct {
+	Dir           string        `yaml:"dir"`
+	DeadLetterDir string        `yaml:"dead_letter_dir"`
+	MaxAttempts   int           `yaml:"max_attempts"`
+	RetryDelay    time.Duration `yaml:"retry_delay"`
+	Workers       int           `yaml:"workers"`
+}
+
+// DeliveryConfig holds the asynchronous delivery settings. With Async,
+// messages are accepted before they are sent: to the retry queue if one is
+// configured, otherwise to QueueSize in-memory slots drained by Workers.
+type DeliveryConfig struct {
+	Async     bool `yaml:"async"`
+	Workers   int  `yaml:"workers"`
+	QueueSize int  `yaml:"queue_size"`
+}
+
+// PolicyConfig holds the content policy checked before delivery. Messages
+// with an attachment extension in DeniedExtensions, or more than
+// MaxAttachments attachments (zero for no limit), are rejected with 550.
+type PolicyConfig struct {
+	DeniedExtensions []string `yaml:"denied_extensions,omitempty"`
+	MaxAttachments   int      `yaml:"max_attachments"`
 }
 
 // LoggingConfig holds logging configuration.
 type LoggingConfig struct {
-	Level string `yaml:"level"`
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+// TracingConfig holds OpenTelemetry tracing settings. When Enabled, spans
+// are exported over OTLP/HTTP to Endpoint, a base URL such as
+// http://collector:4318; empty Endpoint uses the exporter's default.
+type TracingConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Endpoint string `yaml:"endpoint"`
 }
 
 // Load loads configuration from environment variables with sensible defaults.
-// Environment variables always take precedence.
+// Environment variables always take precedence. Unparseable values (e.g. a
+// non-numeric SMTP_MAX_MESSAGE_SIZE) are returned as an error unless
+// CONFIG_STRICT=false.
 func Load() (*Config, error) {
 	cfg := &Config{}
 	cfg.applyDefaults()
-	cfg.applyEnvVars()
+	if err := cfg.applyEnvVarsChecked(); err != nil {
+		return nil, err
+	}
 	return cfg, nil
 }
 
@@ -83,9 +314,17 @@ func LoadFromFile(path string) (*Config, error) {
 	if err := yaml.Unmarshal(data, cfg); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
+	if cfg.SMTP.Hostname == "" {
+		cfg.SMTP.Hostname = defaultHostname()
+	}
+	if cfg.SMTP.Banner == "" {
+		cfg.SMTP.Banner = defaultBanner
+	}
 
 	// Environment variables always override YAML values
-	cfg.applyEnvVars()
+	if err := cfg.applyEnvVarsChecked(); err != nil {
+		return nil, err
+	}
 
 	return cfg, nil
 }
@@ -103,28 +342,385 @@ func (c *Config) SESConfigured() bool {
 	return c.SES.Region != "" && c.SES.Sender != ""
 }
 
-// AuthEnabled returns true if both SMTP username and password are set.
+// MailjetConfigured returns true if the Mailjet API keys and sender are set.
+func (c *Config) MailjetConfigured() bool {
+	return c.Mailjet.APIKey != "" && c.Mailjet.SecretKey != "" && c.Mailjet.Sender != ""
+}
+
+// SparkPostConfigured returns true if the SparkPost API key and sender are set.
+func (c *Config) SparkPostConfigured() bool {
+	return c.SparkPost.APIKey != "" && c.SparkPost.Sender != ""
+}
+
+// SlackConfigured returns true if a Slack webhook URL is set.
+func (c *Config) SlackConfigured() bool {
+	return c.Slack.WebhookURL != ""
+}
+
+// DedupEnabled returns true if duplicate-delivery suppression is configured.
+func (c *Config) DedupEnabled() bool {
+	return len(c.Dedup.Headers) > 0
+}
+
+// QueueEnabled returns true if the retry queue is configured.
+func (c *Config) QueueEnabled() bool {
+	return c.Queue.Dir != ""
+}
+
+// ACMEEnabled returns true if automatic ACME certificates are configured.
+func (c *Config) ACMEEnabled() bool {
+	return c.TLS.ACMEDomain != ""
+}
+
+// AuthEnabled returns true if both SMTP username and password are set, or
+// a users file is configured.
 func (c *Config) AuthEnabled() bool {
-	return c.SMTP.Username != "" && c.SMTP.Password != ""
+	return (c.SMTP.Username != "" && c.SMTP.Password != "") || c.SMTP.UsersFile != ""
+}
+
+// logLevels lists the accepted Logging.Level values.
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// logFormats lists the accepted Logging.Format values.
+var logFormats = []string{"json", "text"}
+
+// Validate checks the configuration for values that would prevent the proxy
+// from starting or delivering mail: malformed listen addresses, a
+// non-positive message size limit, invalid sender addresses for the selected
+// providers, and unknown log levels. All problems found are reported
+// together.
+func (c *Config) Validate() error {
+	var errs []error
+
+	listen := splitList(c.SMTP.Listen)
+	if len(listen) == 0 {
+		listen = []string{c.SMTP.Listen}
+	}
+	for _, addr := range listen {
+		if err := validateListenAddr(addr); err != nil {
+			errs = append(errs, fmt.Errorf("smtp.listen: %w", err))
+		}
+	}
+	if c.SMTP.TLSListen != "" {
+		if err := validateListenAddr(c.SMTP.TLSListen); err != nil {
+			errs = append(errs, fmt.Errorf("smtp.tls_listen: %w", err))
+		}
+	}
+	if strings.ContainsAny(c.SMTP.Banner, "\r\n") {
+		errs = append(errs, fmt.Errorf("smtp.banner: must not contain line breaks"))
+	}
+	if c.SMTP.MaxMessageSize <= 0 {
+		errs = append(errs, fmt.Errorf("smtp.max_message_size: must be greater than 0, got %d", c.SMTP.MaxMessageSize))
+	}
+	if c.SMTP.GreylistDelay <= 0 {
+		errs = append(errs, fmt.Errorf("smtp.greylist_delay: must be greater than 0, got %s", c.SMTP.GreylistDelay))
+	}
+	if c.SMTP.GreylistTTL <= c.SMTP.GreylistDelay {
+		errs = append(errs, fmt.Errorf("smtp.greylist_ttl: must be longer than smtp.greylist_delay (%s), got %s", c.SMTP.GreylistDelay, c.SMTP.GreylistTTL))
+	}
+	if c.SMTP.MaxAuthAttempts < 0 {
+		errs = append(errs, fmt.Errorf("smtp.max_auth_attempts: must not be negative, got %d", c.SMTP.MaxAuthAttempts))
+	}
+	if c.SMTP.MaxReceivedHeaders < 0 {
+		errs = append(errs, fmt.Errorf("smtp.max_received_headers: must not be negative, got %d", c.SMTP.MaxReceivedHeaders))
+	}
+	if c.SMTP.AuthBanThreshold < 0 {
+		errs = append(errs, fmt.Errorf("smtp.auth_ban_threshold: must not be negative, got %d", c.SMTP.AuthBanThreshold))
+	}
+	if c.SMTP.AuthBanWindow <= 0 {
+		errs = append(errs, fmt.Errorf("smtp.auth_ban_window: must be greater than 0, got %s", c.SMTP.AuthBanWindow))
+	}
+	if c.SMTP.AuthBanDuration <= 0 {
+		errs = append(errs, fmt.Errorf("smtp.auth_ban_duration: must be greater than 0, got %s", c.SMTP.AuthBanDuration))
+	}
+	if c.SMTP.MaxRecipients <= 0 {
+		errs = append(errs, fmt.Errorf("smtp.max_recipients: must be greater than 0, got %d", c.SMTP.MaxRecipients))
+	}
+	if c.SMTP.MaxTransactions < 0 {
+		errs = append(errs, fmt.Errorf("smtp.max_transactions: must not be negative, got %d", c.SMTP.MaxTransactions))
+	}
+	if c.SMTP.MaxLineLength < minLineLength {
+		errs = append(errs, fmt.Errorf("smtp.max_line_length: must be at least %d, got %d", minLineLength, c.SMTP.MaxLineLength))
+	}
+	if c.SMTP.CommandTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("smtp.command_timeout: must be greater than 0, got %s", c.SMTP.CommandTimeout))
+	}
+	if c.SMTP.MaxSessionDuration <= 0 {
+		errs = append(errs, fmt.Errorf("smtp.max_session_duration: must be greater than 0, got %s", c.SMTP.MaxSessionDuration))
+	}
+	if c.ProviderMaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("provider_max_retries: must not be negative, got %d", c.ProviderMaxRetries))
+	}
+	if c.ProviderRetryBaseDelay <= 0 {
+		errs = append(errs, fmt.Errorf("provider_retry_base_delay: must be greater than 0, got %s", c.ProviderRetryBaseDelay))
+	}
+
+	// Explicitly selected providers need a valid sender; with auto-detection
+	// only senders that are set are checked.
+	selected := make(map[string]bool)
+	for _, name := range strings.Split(c.Provider, ",") {
+		selected[strings.TrimSpace(name)] = true
+	}
+	if selected["graph"] || c.Graph.Sender != "" {
+		if err := validateSender(c.Graph.Sender); err != nil {
+			errs = append(errs, fmt.Errorf("graph.sender: %w", err))
+		}
+	}
+	if err := validateHTTPSURL(c.Graph.AuthorityHost); err != nil {
+		errs = append(errs, fmt.Errorf("graph.authority_host: %w", err))
+	}
+	if err := validateHTTPSURL(c.Graph.BaseURL); err != nil {
+		errs = append(errs, fmt.Errorf("graph.base_url: %w", err))
+	}
+	if c.Graph.AllowSenderOverride && len(c.Graph.AllowedSenders) == 0 {
+		errs = append(errs, fmt.Errorf("graph.allowed_senders: required when graph.allow_sender_override is set"))
+	}
+	if selected["ses"] || c.SES.Sender != "" {
+		if err := validateSender(c.SES.Sender); err != nil {
+			errs = append(errs, fmt.Errorf("ses.sender: %w", err))
+		}
+	}
+	if selected["mailjet"] || c.Mailjet.Sender != "" {
+		if err := validateSender(c.Mailjet.Sender); err != nil {
+			errs = append(errs, fmt.Errorf("mailjet.sender: %w", err))
+		}
+	}
+	if selected["sparkpost"] || c.SparkPost.Sender != "" {
+		if err := validateSender(c.SparkPost.Sender); err != nil {
+			errs = append(errs, fmt.Errorf("sparkpost.sender: %w", err))
+		}
+	}
+	if err := validateHTTPSURL(c.SparkPost.BaseURL); err != nil {
+		errs = append(errs, fmt.Errorf("sparkpost.base_url: %w", err))
+	}
+	if c.Slack.WebhookURL != "" {
+		if err := validateHTTPSURL(c.Slack.WebhookURL); err != nil {
+			errs = append(errs, fmt.Errorf("slack.webhook_url: %w", err))
+		}
+	} else if selected["slack"] {
+		errs = append(errs, fmt.Errorf("slack.webhook_url: required when the provider is selected"))
+	}
+
+	if c.Queue.MaxAttempts <= 0 {
+		errs = append(errs, fmt.Errorf("queue.max_attempts: must be greater than 0, got %d", c.Queue.MaxAttempts))
+	}
+	if c.Queue.RetryDelay <= 0 {
+		errs = append(errs, fmt.Errorf("queue.retry_delay: must be greater than 0, got %s", c.Queue.RetryDelay))
+	}
+	if c.Queue.Workers <= 0 {
+		errs = append(errs, fmt.Errorf("queue.workers: must be greater than 0, got %d", c.Queue.Workers))
+	}
+
+	if c.Delivery.Workers <= 0 {
+		errs = append(errs, fmt.Errorf("delivery.workers: must be greater than 0, got %d", c.Delivery.Workers))
+	}
+	if c.Delivery.QueueSize <= 0 {
+		errs = append(errs, fmt.Errorf("delivery.queue_size: must be greater than 0, got %d", c.Delivery.QueueSize))
+	}
+
+	if c.Policy.MaxAttachments < 0 {
+		errs = append(errs, fmt.Errorf("policy.max_attachments: must not be negative, got %d", c.Policy.MaxAttachments))
+	}
+
+	if !slices.Contains(logLevels, c.Logging.Level) {
+		errs = append(errs, fmt.Errorf("logging.level: must be one of %s, got %q",
+			strings.Join(logLevels, ", "), c.Logging.Level))
+	}
+	if !slices.Contains(logFormats, c.Logging.Format) {
+		errs = append(errs, fmt.Errorf("logging.format: must be one of %s, got %q",
+			strings.Join(logFormats, ", "), c.Logging.Format))
+	}
+
+	if c.Tracing.Endpoint != "" {
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("tracing.endpoint: %q is not an http or https URL", c.Tracing.Endpoint))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateListenAddr checks that addr is a host:port pair with a valid port.
+func validateListenAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port in address %q", addr)
+	}
+	return nil
+}
+
+// validateHTTPSURL checks that raw is an absolute https URL.
+func validateHTTPSURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("%q is not an https URL", raw)
+	}
+	return nil
+}
+
+// validateSender checks that sender is a bare email address.
+func validateSender(sender string) error {
+	if sender == "" {
+		return fmt.Errorf("required when the provider is selected")
+	}
+	addr, err := mail.ParseAddress(sender)
+	if err != nil || addr.Address != sender {
+		return fmt.Errorf("%q is not a valid email address", sender)
+	}
+	return nil
+}
+
+// redactedValue replaces secret values in dumped configuration.
+const redactedValue = "REDACTED"
+
+// DumpYAML returns the effective configuration as YAML with secrets
+// (passwords, client secrets, secret keys) redacted. Empty secrets are left
+// empty so it remains clear which ones are unset.
+func (c *Config) DumpYAML() ([]byte, error) {
+	redacted := *c
+	redact(&redacted.SMTP.Password)
+	redact(&redacted.Graph.ClientSecret)
+	redact(&redacted.SES.SecretAccessKey)
+	redact(&redacted.Mailjet.SecretKey)
+	redact(&redacted.SparkPost.APIKey)
+	redact(&redacted.Slack.WebhookURL)
+
+	data, err := yaml.Marshal(&redacted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal config: %w", err)
+	}
+	return data, nil
+}
+
+// redact replaces a non-empty secret with redactedValue.
+func redact(secret *string) {
+	if *secret != "" {
+		*secret = redactedValue
+	}
+}
+
+// Diff returns the YAML keys of the settings that differ between c and
+// other, such as "smtp.listen", in the order they are declared.
+func (c *Config) Diff(other *Config) []string {
+	return diffFields(reflect.ValueOf(*c), reflect.ValueOf(*other), "")
+}
+
+// diffFields compares two structs of the same type field by field,
+// descending into nested structs, and returns the keys that differ.
+func diffFields(a, b reflect.Value, prefix string) []string {
+	var changed []string
+	for i := range a.NumField() {
+		field := a.Type().Field(i)
+		key, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		if field.Type.Kind() == reflect.Struct {
+			changed = append(changed, diffFields(a.Field(i), b.Field(i), key)...)
+		} else if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			changed = append(changed, key)
+		}
+	}
+	return changed
 }
 
 // applyDefaults sets sensible default values for all configuration fields.
 func (c *Config) applyDefaults() {
+	c.ProviderMaxRetries = defaultProviderMaxRetries
+	c.ProviderRetryBaseDelay = time.Second
 	c.SMTP.Listen = ":2525"
+	c.SMTP.Hostname = defaultHostname()
+	c.SMTP.Banner = defaultBanner
 	c.SMTP.MaxMessageSize = defaultMaxMessageSize
+	c.SMTP.MaxRecipients = defaultMaxRecipients
+	c.SMTP.AuthBanWindow = defaultAuthBanWindow
+	c.SMTP.AuthBanDuration = defaultAuthBanDuration
+	c.SMTP.GreylistDelay = defaultGreylistDelay
+	c.SMTP.GreylistTTL = defaultGreylistTTL
+	c.SMTP.MaxLineLength = minLineLength
+	c.SMTP.CommandTimeout = defaultCommandTimeout
+	c.SMTP.MaxSessionDuration = defaultMaxSessionDuration
+	c.Graph.SaveToSentItems = true
+	c.Graph.AuthorityHost = "https://login.microsoftonline.com"
+	c.Graph.BaseURL = "https://graph.microsoft.com/v1.0"
+	c.Graph.Scope = "https://graph.microsoft.com/.default"
+	c.SparkPost.BaseURL = "https://api.sparkpost.com/api/v1"
+	c.Dedup.TTL = 24 * time.Hour
+	c.Queue.MaxAttempts = defaultQueueMaxAttempts
+	c.Queue.RetryDelay = time.Minute
+	c.Queue.Workers = defaultQueueWorkers
+	c.Delivery.Workers = defaultDeliveryWorkers
+	c.Delivery.QueueSize = defaultDeliveryQueueSize
+	c.TLS.ACMECacheDir = "acme-cache"
+	c.TLS.ACMEHTTPListen = ":80"
 	c.Logging.Level = "info"
+	c.Logging.Format = "json"
+}
+
+// defaultHostname returns the machine's hostname, or "localhost" if it
+// cannot be determined.
+func defaultHostname() string {
+	if name, err := os.Hostname(); err == nil && name != "" {
+		return name
+	}
+	return "localhost"
 }
 
 // applyEnvVars overrides configuration with environment variable values.
-// Only non-empty environment variables override existing values.
-func (c *Config) applyEnvVars() {
+// Only non-empty environment variables override existing values. Values that
+// fail to parse leave the current setting unchanged and are reported in the
+// returned error.
+func (c *Config) applyEnvVars() error {
+	var errs []error
+
 	if v := os.Getenv("PROVIDER"); v != "" {
 		c.Provider = strings.ToLower(v)
 	}
+	if v := os.Getenv("PRESERVE_FROM"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			c.PreserveFrom = b
+		} else {
+			errs = append(errs, envError("PRESERVE_FROM", v, "a boolean"))
+		}
+	}
+	if v := os.Getenv("DRY_RUN"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			c.DryRun = b
+		} else {
+			errs = append(errs, envError("DRY_RUN", v, "a boolean"))
+		}
+	}
+	if v := os.Getenv("PROVIDER_MAX_RETRIES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			c.ProviderMaxRetries = n
+		} else {
+			errs = append(errs, envError("PROVIDER_MAX_RETRIES", v, "an integer"))
+		}
+	}
+	if v := os.Getenv("PROVIDER_RETRY_BASE_DELAY"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			c.ProviderRetryBaseDelay = d
+		} else {
+			errs = append(errs, envError("PROVIDER_RETRY_BASE_DELAY", v, "a duration"))
+		}
+	}
 
 	if v := os.Getenv("SMTP_LISTEN"); v != "" {
 		c.SMTP.Listen = v
 	}
+	if v := os.Getenv("SMTP_HOSTNAME"); v != "" {
+		c.SMTP.Hostname = v
+	}
+	if v := os.Getenv("SMTP_BANNER"); v != "" {
+		c.SMTP.Banner = v
+	}
+	if v := os.Getenv("SMTPS_LISTEN"); v != "" {
+		c.SMTP.TLSListen = v
+	}
 	if v := os.Getenv("SMTP_USERNAME"); v != "" {
 		c.SMTP.Username = v
 	}
@@ -132,8 +728,137 @@ func (c *Config) applyEnvVars() {
 		c.SMTP.Password = v
 	}
 	if v := os.Getenv("SMTP_MAX_MESSAGE_SIZE"); v != "" {
-		if size, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if size, err := ParseByteSize(v); err == nil {
 			c.SMTP.MaxMessageSize = size
+		} else {
+			errs = append(errs, envError("SMTP_MAX_MESSAGE_SIZE", v, "a size such as 26214400 or 25MB"))
+		}
+	}
+	if v := os.Getenv("SMTP_REQUIRE_TLS_AUTH"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			c.SMTP.RequireTLSAuth = b
+		} else {
+			errs = append(errs, envError("SMTP_REQUIRE_TLS_AUTH", v, "a boolean"))
+		}
+	}
+	if v := os.Getenv("MAX_AUTH_ATTEMPTS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			c.SMTP.MaxAuthAttempts = n
+		} else {
+			errs = append(errs, envError("MAX_AUTH_ATTEMPTS", v, "an integer"))
+		}
+	}
+	if v := os.Getenv("AUTH_BAN_THRESHOLD"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			c.SMTP.AuthBanThreshold = n
+		} else {
+			errs = append(errs, envError("AUTH_BAN_THRESHOLD", v, "an integer"))
+		}
+	}
+	if v := os.Getenv("AUTH_BAN_WINDOW"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			c.SMTP.AuthBanWindow = d
+		} else {
+			errs = append(errs, envError("AUTH_BAN_WINDOW", v, "a duration"))
+		}
+	}
+	if v := os.Getenv("AUTH_BAN_DURATION"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			c.SMTP.AuthBanDuration = d
+		} else {
+			errs = append(errs, envError("AUTH_BAN_DURATION", v, "a duration"))
+		}
+	}
+	if v := os.Getenv("ALIASES_FILE"); v != "" {
+		c.SMTP.AliasesFile = v
+	}
+	if v := os.Getenv("SMTP_USERS_FILE"); v != "" {
+		c.SMTP.UsersFile = v
+	}
+	if v := os.Getenv("SMTP_MAX_RECEIVED_HEADERS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			c.SMTP.MaxReceivedHeaders = n
+		} else {
+			errs = append(errs, envError("SMTP_MAX_RECEIVED_HEADERS", v, "an integer"))
+		}
+	}
+	if v := os.Getenv("ALLOWED_RCPT_DOMAINS"); v != "" {
+		c.SMTP.AllowedRcptDomains = splitList(v)
+	}
+	if v := os.Getenv("DENIED_RCPT_DOMAINS"); v != "" {
+		c.SMTP.DeniedRcptDomains = splitList(v)
+	}
+	if v := os.Getenv("ALLOWED_SENDERS"); v != "" {
+		c.SMTP.AllowedSenders = splitList(v)
+	}
+	if v := os.Getenv("SMTP_MAX_RCPT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			c.SMTP.MaxRecipients = n
+		} else {
+			errs = append(errs, envError("SMTP_MAX_RCPT", v, "an integer"))
+		}
+	}
+	if v := os.Getenv("SMTP_MAX_TRANSACTIONS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			c.SMTP.MaxTransactions = n
+		} else {
+			errs = append(errs, envError("SMTP_MAX_TRANSACTIONS", v, "an integer"))
+		}
+	}
+	if v := os.Getenv("PROXY_PROTOCOL"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			c.SMTP.ProxyProtocol = b
+		} else {
+			errs = append(errs, envError("PROXY_PROTOCOL", v, "a boolean"))
+		}
+	}
+	if v := os.Getenv("SMTP_REUSEPORT"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			c.SMTP.ReusePort = b
+		} else {
+			errs = append(errs, envError("SMTP_REUSEPORT", v, "a boolean"))
+		}
+	}
+	if v := os.Getenv("SMTP_GREYLIST"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			c.SMTP.Greylist = b
+		} else {
+			errs = append(errs, envError("SMTP_GREYLIST", v, "a boolean"))
+		}
+	}
+	if v := os.Getenv("SMTP_GREYLIST_DELAY"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			c.SMTP.GreylistDelay = d
+		} else {
+			errs = append(errs, envError("SMTP_GREYLIST_DELAY", v, "a duration"))
+		}
+	}
+	if v := os.Getenv("SMTP_GREYLIST_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			c.SMTP.GreylistTTL = d
+		} else {
+			errs = append(errs, envError("SMTP_GREYLIST_TTL", v, "a duration"))
+		}
+	}
+	if v := os.Getenv("SMTP_MAX_LINE_LENGTH"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			c.SMTP.MaxLineLength = n
+		} else {
+			errs = append(errs, envError("SMTP_MAX_LINE_LENGTH", v, "an integer"))
+		}
+	}
+	if v := os.Getenv("SMTP_COMMAND_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			c.SMTP.CommandTimeout = d
+		} else {
+			errs = append(errs, envError("SMTP_COMMAND_TIMEOUT", v, "a duration"))
+		}
+	}
+	if v := os.Getenv("SMTP_MAX_SESSION_DURATION"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			c.SMTP.MaxSessionDuration = d
+		} else {
+			errs = append(errs, envError("SMTP_MAX_SESSION_DURATION", v, "a duration"))
 		}
 	}
 
@@ -149,6 +874,39 @@ func (c *Config) applyEnvVars() {
 	if v := os.Getenv("GRAPH_SENDER"); v != "" {
 		c.Graph.Sender = v
 	}
+	if v := os.Getenv("GRAPH_SAVE_TO_SENT_ITEMS"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			c.Graph.SaveToSentItems = b
+		} else {
+			errs = append(errs, envError("GRAPH_SAVE_TO_SENT_ITEMS", v, "a boolean"))
+		}
+	}
+	if v := os.Getenv("GRAPH_ALLOW_SENDER_OVERRIDE"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			c.Graph.AllowSenderOverride = b
+		} else {
+			errs = append(errs, envError("GRAPH_ALLOW_SENDER_OVERRIDE", v, "a boolean"))
+		}
+	}
+	if v := os.Getenv("GRAPH_ALLOWED_SENDERS"); v != "" {
+		c.Graph.AllowedSenders = splitList(v)
+	}
+	if v := os.Getenv("GRAPH_AUTHORITY_HOST"); v != "" {
+		c.Graph.AuthorityHost = v
+	}
+	if v := os.Getenv("GRAPH_BASE_URL"); v != "" {
+		c.Graph.BaseURL = v
+	}
+	if v := os.Getenv("GRAPH_SCOPE"); v != "" {
+		c.Graph.Scope = v
+	}
+	if v := os.Getenv("GRAPH_BACKGROUND_TOKEN_REFRESH"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			c.Graph.BackgroundTokenRefresh = b
+		} else {
+			errs = append(errs, envError("GRAPH_BACKGROUND_TOKEN_REFRESH", v, "a boolean"))
+		}
+	}
 
 	if v := os.Getenv("SES_REGION"); v != "" {
 		c.SES.Region = v
@@ -162,6 +920,36 @@ func (c *Config) applyEnvVars() {
 	if v := os.Getenv("SES_SENDER"); v != "" {
 		c.SES.Sender = v
 	}
+	if v := os.Getenv("SES_CONFIGURATION_SET"); v != "" {
+		c.SES.ConfigurationSet = v
+	}
+	if v := os.Getenv("SES_TAGS"); v != "" {
+		c.SES.Tags = splitList(v)
+	}
+
+	if v := os.Getenv("MAILJET_API_KEY"); v != "" {
+		c.Mailjet.APIKey = v
+	}
+	if v := os.Getenv("MAILJET_SECRET_KEY"); v != "" {
+		c.Mailjet.SecretKey = v
+	}
+	if v := os.Getenv("MAILJET_SENDER"); v != "" {
+		c.Mailjet.Sender = v
+	}
+
+	if v := os.Getenv("SPARKPOST_API_KEY"); v != "" {
+		c.SparkPost.APIKey = v
+	}
+	if v := os.Getenv("SPARKPOST_SENDER"); v != "" {
+		c.SparkPost.Sender = v
+	}
+	if v := os.Getenv("SPARKPOST_BASE_URL"); v != "" {
+		c.SparkPost.BaseURL = v
+	}
+
+	if v := os.Getenv("SLACK_WEBHOOK_URL"); v != "" {
+		c.Slack.WebhookURL = v
+	}
 
 	if v := os.Getenv("TLS_CERT_FILE"); v != "" {
 		c.TLS.CertFile = v
@@ -169,8 +957,160 @@ func (c *Config) applyEnvVars() {
 	if v := os.Getenv("TLS_KEY_FILE"); v != "" {
 		c.TLS.KeyFile = v
 	}
+	if v := os.Getenv("TLS_CLIENT_CA_FILE"); v != "" {
+		c.TLS.ClientCAFile = v
+	}
+	if v := os.Getenv("TLS_MIN_VERSION"); v != "" {
+		c.TLS.MinVersion = v
+	}
+	if v := os.Getenv("TLS_CIPHER_SUITES"); v != "" {
+		c.TLS.CipherSuites = splitList(v)
+	}
+	if v := os.Getenv("ACME_DOMAIN"); v != "" {
+		c.TLS.ACMEDomain = v
+	}
+	if v := os.Getenv("ACME_EMAIL"); v != "" {
+		c.TLS.ACMEEmail = v
+	}
+	if v := os.Getenv("ACME_CACHE_DIR"); v != "" {
+		c.TLS.ACMECacheDir = v
+	}
+	if v := os.Getenv("ACME_HTTP_LISTEN"); v != "" {
+		c.TLS.ACMEHTTPListen = v
+	}
+
+	if v := os.Getenv("DEDUP_HEADERS"); v != "" {
+		c.Dedup.Headers = splitList(v)
+	}
+	if v := os.Getenv("DEDUP_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			c.Dedup.TTL = d
+		} else {
+			errs = append(errs, envError("DEDUP_TTL", v, "a duration"))
+		}
+	}
+
+	if v := os.Getenv("QUEUE_DIR"); v != "" {
+		c.Queue.Dir = v
+	}
+	if v := os.Getenv("QUEUE_DEAD_LETTER_DIR"); v != "" {
+		c.Queue.DeadLetterDir = v
+	}
+	if v := os.Getenv("QUEUE_MAX_ATTEMPTS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			c.Queue.MaxAttempts = n
+		} else {
+			errs = append(errs, envError("QUEUE_MAX_ATTEMPTS", v, "an integer"))
+		}
+	}
+	if v := os.Getenv("QUEUE_RETRY_DELAY"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			c.Queue.RetryDelay = d
+		} else {
+			errs = append(errs, envError("QUEUE_RETRY_DELAY", v, "a duration"))
+		}
+	}
+	if v := os.Getenv("QUEUE_WORKERS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			c.Queue.Workers = n
+		} else {
+			errs = append(errs, envError("QUEUE_WORKERS", v, "an integer"))
+		}
+	}
+
+	if v := os.Getenv("ASYNC_DELIVERY"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			c.Delivery.Async = b
+		} else {
+			errs = append(errs, envError("ASYNC_DELIVERY", v, "a boolean"))
+		}
+	}
+	if v := os.Getenv("DELIVERY_WORKERS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			c.Delivery.Workers = n
+		} else {
+			errs = append(errs, envError("DELIVERY_WORKERS", v, "an integer"))
+		}
+	}
+	if v := os.Getenv("DELIVERY_QUEUE_SIZE"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			c.Delivery.QueueSize = n
+		} else {
+			errs = append(errs, envError("DELIVERY_QUEUE_SIZE", v, "an integer"))
+		}
+	}
+
+	if v := os.Getenv("POLICY_DENIED_EXTENSIONS"); v != "" {
+		c.Policy.DeniedExtensions = splitList(v)
+	}
+	if v := os.Getenv("POLICY_MAX_ATTACHMENTS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			c.Policy.MaxAttachments = n
+		} else {
+			errs = append(errs, envError("POLICY_MAX_ATTACHMENTS", v, "an integer"))
+		}
+	}
 
 	if v := os.Getenv("LOG_LEVEL"); v != "" {
 		c.Logging.Level = strings.ToLower(v)
 	}
+	if v := os.Getenv("LOG_FORMAT"); v != "" {
+		c.Logging.Format = strings.ToLower(v)
+	}
+
+	if v := os.Getenv("OTEL_ENABLED"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			c.Tracing.Enabled = b
+		} else {
+			errs = append(errs, envError("OTEL_ENABLED", v, "a boolean"))
+		}
+	}
+	if v := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); v != "" {
+		c.Tracing.Endpoint = v
+	}
+
+	return errors.Join(errs...)
+}
+
+// envError describes an environment variable whose value cannot be parsed.
+func envError(name, value, expected string) error {
+	return fmt.Errorf("%s: invalid value %q, expected %s", name, value, expected)
+}
+
+// strictEnv reports whether unparseable environment variables are fatal.
+// CONFIG_STRICT=false restores the lenient behavior of ignoring them (with
+// a warning) and keeping the previous value.
+func strictEnv() bool {
+	if v := os.Getenv("CONFIG_STRICT"); v != "" {
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b
+		}
+	}
+	return true
+}
+
+// applyEnvVarsChecked applies environment overrides and, in strict mode,
+// returns any parse errors. In lenient mode they are logged and ignored.
+func (c *Config) applyEnvVarsChecked() error {
+	err := c.applyEnvVars()
+	if err == nil {
+		return nil
+	}
+	if strictEnv() {
+		return fmt.Errorf("invalid environment configuration: %w", err)
+	}
+	slog.Warn("ignoring invalid environment variables", "error", err)
+	return nil
+}
+
+// splitList splits a comma-separated environment value into trimmed,
+// non-empty items.
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ByteSize is a size in bytes that can be written with a unit suffix in
+// configuration (e.g. "25MB"). Units are binary: K/KB = 1024 bytes,
+// M/MB = 1024^2 and G/GB = 1024^3, so "25MB" equals 26214400. A plain
+// integer is taken as bytes.
+type ByteSize int64
+
+// sizeUnits maps accepted (upper-cased) unit suffixes to their multiplier.
+var sizeUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"K":   1 << 10,
+	"KB":  1 << 10,
+	"KIB": 1 << 10,
+	"M":   1 << 20,
+	"MB":  1 << 20,
+	"MIB": 1 << 20,
+	"G":   1 << 30,
+	"GB":  1 << 30,
+	"GIB": 1 << 30,
+}
+
+// ParseByteSize converts a size such as "25MB", "10M", "512KB" or "1048576"
+// to bytes. Units are case-insensitive and binary (see ByteSize); unknown
+// units are rejected.
+func ParseByteSize(s string) (ByteSize, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return !unicode.IsDigit(r) })
+	if i == -1 {
+		i = len(s)
+	}
+	if i == 0 {
+		return 0, fmt.Errorf("invalid size %q: must start with a number", s)
+	}
+
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", s, err)
+	}
+
+	unit := strings.ToUpper(strings.TrimSpace(s[i:]))
+	multiplier, ok := sizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q: unknown unit %q (use B, KB, MB or GB)", s, s[i:])
+	}
+	if n > (1<<63-1)/multiplier {
+		return 0, fmt.Errorf("invalid size %q: too large", s)
+	}
+
+	return ByteSize(n * multiplier), nil
+}
+
+// UnmarshalYAML accepts either a plain integer or a string with a unit.
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	size, err := ParseByteSize(value.Value)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseByteSize(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		input string
+		want  ByteSize
+	}{
+		{"25MB", 25 * 1024 * 1024},
+		{"10M", 10 * 1024 * 1024},
+		{"1048576", 1048576},
+		{"512KB", 512 * 1024},
+		{"512kb", 512 * 1024},
+		{"1GiB", 1 << 30},
+		{"100B", 100},
+		{" 25 MB ", 25 * 1024 * 1024},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseByteSize(tt.input)
+		if err != nil {
+			t.Errorf("ParseByteSize(%q): unexpected error: %v", tt.input, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseByteSize(%q): got %d, want %d", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestParseByteSize_Invalid(t *testing.T) {
+	t.Parallel()
+
+	for _, input := range []string{"25XB", "", "MB", "-5MB", "1.5MB", "9999999999999GB"} {
+		if got, err := ParseByteSize(input); err == nil {
+			t.Errorf("ParseByteSize(%q): got %d, want error", input, got)
+		}
+	}
+}
+
+func TestByteSize_UnmarshalYAML(t *testing.T) {
+	t.Parallel()
+
+	var cfg struct {
+		Plain    ByteSize `yaml:"plain"`
+		Suffixed ByteSize `yaml:"suffixed"`
+	}
+	if err := yaml.Unmarshal([]byte("plain: 26214400\nsuffixed: 10MB\n"), &cfg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Plain != 26214400 {
+		t.Errorf("plain: got %d, want %d", cfg.Plain, 26214400)
+	}
+	if cfg.Suffixed != 10*1024*1024 {
+		t.Errorf("suffixed: got %d, want %d", cfg.Suffixed, 10*1024*1024)
+	}
+
+	if err := yaml.Unmarshal([]byte("plain: 25XB\n"), &cfg); err == nil {
+		t.Error("expected error for invalid unit, got nil")
+	}
+}
@@ -13,8 +13,23 @@ type Email struct {
 	Attachments []Attachment
 	RawHeaders  map[string][]string
 	MessageID   string
+
+	// Sender is the Sender header: the mailbox that sent the message on
+	// behalf of the From author, or empty when the message has none.
+	Sender string
+
+	// Importance is ImportanceLow, ImportanceNormal or ImportanceHigh, or
+	// empty when the message does not specify one.
+	Importance string
 }
 
+// Message importance levels, as used by the Importance header.
+const (
+	ImportanceLow    = "low"
+	ImportanceNormal = "normal"
+	ImportanceHigh   = "high"
+)
+
 // Attachment represents a file attached to an email message.
 type Attachment struct {
 	Filename    string
@@ -0,0 +1,264 @@
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxLineLength is the line length header folding aims to stay within
+// (RFC 5322 section 2.1.1).
+const maxLineLength = 78
+
+// base64LineLength is the maximum length of a base64 encoded line (RFC 2045).
+const base64LineLength = 76
+
+// xPriority maps each importance level to its X-Priority header value.
+var xPriority = map[string]string{
+	ImportanceHigh:   "1 (Highest)",
+	ImportanceNormal: "3 (Normal)",
+	ImportanceLow:    "5 (Lowest)",
+}
+
+// entity is a MIME entity: its content headers and encoded body.
+type entity struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// Serialize renders the email as an RFC 5322 message with a MIME body.
+//
+// The body structure depends on which parts are present: a single text or
+// HTML body is sent as-is, text and HTML together become
+// multipart/alternative, and attachments wrap the body in multipart/mixed.
+// Attachment-only messages carry an empty text/plain part so the message
+// always has a body. Text is quoted-printable encoded and attachments are
+// base64 encoded.
+//
+// Bcc recipients are not written. Importance is written as both the
+// Importance and X-Priority headers. The Date header is taken from RawHeaders
+// if present, otherwise the current time is used.
+func Serialize(msg *Email) ([]byte, error) {
+	return SerializeWithHeaders(msg, nil)
+}
+
+// SerializeWithHeaders is like Serialize, but also writes the header fields
+// in extra, sorted by name, after the generated ones. extra should not
+// repeat headers that Serialize writes itself.
+func SerializeWithHeaders(msg *Email, extra map[string][]string) ([]byte, error) {
+	body, err := buildBody(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+
+	if msg.From != "" {
+		writeHeader(&buf, "From", formatAddressList([]string{msg.From}))
+	}
+	if msg.Sender != "" {
+		writeHeader(&buf, "Sender", formatAddressList([]string{msg.Sender}))
+	}
+	if len(msg.To) > 0 {
+		writeHeader(&buf, "To", formatAddressList(msg.To))
+	}
+	if len(msg.Cc) > 0 {
+		writeHeader(&buf, "Cc", formatAddressList(msg.Cc))
+	}
+	writeHeader(&buf, "Subject", mime.QEncoding.Encode("UTF-8", msg.Subject))
+
+	date := time.Now().Format(time.RFC1123Z)
+	if values := msg.RawHeaders["Date"]; len(values) > 0 && values[0] != "" {
+		date = values[0]
+	}
+	writeHeader(&buf, "Date", date)
+
+	if msg.MessageID != "" {
+		writeHeader(&buf, "Message-ID", msg.MessageID)
+	}
+	if priority, ok := xPriority[msg.Importance]; ok {
+		writeHeader(&buf, "Importance", msg.Importance)
+		writeHeader(&buf, "X-Priority", priority)
+	}
+	names := make([]string, 0, len(extra))
+	for name := range extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range extra[name] {
+			writeHeader(&buf, name, value)
+		}
+	}
+	writeHeader(&buf, "MIME-Version", "1.0")
+
+	for _, key := range []string{"Content-Type", "Content-Transfer-Encoding"} {
+		if v := body.header.Get(key); v != "" {
+			writeHeader(&buf, key, v)
+		}
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body.body)
+
+	return buf.Bytes(), nil
+}
+
+// buildBody builds the top-level MIME entity for the message content.
+func buildBody(msg *Email) (entity, error) {
+	var content entity
+	var err error
+
+	switch {
+	case msg.TextBody != "" && msg.HtmlBody != "":
+		content, err = buildMultipart("alternative", []entity{
+			textEntity("text/plain", msg.TextBody),
+			textEntity("text/html", msg.HtmlBody),
+		})
+		if err != nil {
+			return entity{}, err
+		}
+	case msg.HtmlBody != "":
+		content = textEntity("text/html", msg.HtmlBody)
+	default:
+		// Also covers attachment-only messages, which still get an (empty)
+		// text part so the multipart/mixed structure always carries a body.
+		content = textEntity("text/plain", msg.TextBody)
+	}
+
+	if len(msg.Attachments) == 0 {
+		return content, nil
+	}
+
+	parts := []entity{content}
+	for _, att := range msg.Attachments {
+		parts = append(parts, attachmentEntity(att))
+	}
+	return buildMultipart("mixed", parts)
+}
+
+// textEntity builds a quoted-printable UTF-8 text part.
+func textEntity(mediaType, text string) entity {
+	var body bytes.Buffer
+	qp := quotedprintable.NewWriter(&body)
+	qp.Write([]byte(text))
+	qp.Close()
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", mime.FormatMediaType(mediaType, map[string]string{"charset": "UTF-8"}))
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	return entity{header: header, body: body.Bytes()}
+}
+
+// attachmentEntity builds a base64 encoded attachment part. Non-ASCII
+// filenames are encoded per RFC 2231.
+func attachmentEntity(att Attachment) entity {
+	params := map[string]string{}
+	if att.Filename != "" {
+		params["name"] = att.Filename
+	}
+	contentType := mime.FormatMediaType(att.ContentType, params)
+	if contentType == "" {
+		contentType = mime.FormatMediaType("application/octet-stream", params)
+	}
+
+	disposition := "attachment"
+	if att.Filename != "" {
+		disposition = mime.FormatMediaType("attachment", map[string]string{"filename": att.Filename})
+	}
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Transfer-Encoding", "base64")
+	header.Set("Content-Disposition", disposition)
+	return entity{header: header, body: []byte(encodeBase64WithLineBreaks(att.Content))}
+}
+
+// buildMultipart combines parts into a multipart entity of the given
+// subtype (e.g. "mixed" or "alternative").
+func buildMultipart(subtype string, parts []entity) (entity, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	for _, p := range parts {
+		pw, err := writer.CreatePart(p.header)
+		if err != nil {
+			return entity{}, fmt.Errorf("failed to create %s part: %w", subtype, err)
+		}
+		if _, err := pw.Write(p.body); err != nil {
+			return entity{}, fmt.Errorf("failed to write %s part: %w", subtype, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return entity{}, fmt.Errorf("failed to close %s body: %w", subtype, err)
+	}
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", mime.FormatMediaType("multipart/"+subtype,
+		map[string]string{"boundary": writer.Boundary()}))
+	return entity{header: header, body: body.Bytes()}, nil
+}
+
+// formatAddressList formats addresses for an address header, encoding
+// non-ASCII display names as RFC 2047 encoded-words. Addresses that fail
+// to parse are written unchanged.
+func formatAddressList(addrs []string) string {
+	formatted := make([]string, 0, len(addrs))
+	for _, raw := range addrs {
+		addr, err := mail.ParseAddress(raw)
+		switch {
+		case err != nil:
+			formatted = append(formatted, raw)
+		case addr.Name == "":
+			formatted = append(formatted, addr.Address)
+		default:
+			formatted = append(formatted, addr.String())
+		}
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// writeHeader writes a header field, folding it at spaces so lines stay
+// within maxLineLength where possible (RFC 5322 section 2.2.3). Line breaks
+// in the value are replaced to prevent header injection.
+func writeHeader(buf *bytes.Buffer, name, value string) {
+	value = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(value)
+
+	buf.WriteString(name)
+	buf.WriteString(":")
+	lineLen := len(name) + 1
+	wordsOnLine := 0
+
+	for _, word := range strings.Split(value, " ") {
+		if wordsOnLine > 0 && lineLen+1+len(word) > maxLineLength {
+			buf.WriteString("\r\n")
+			lineLen = 0
+		}
+		buf.WriteString(" ")
+		buf.WriteString(word)
+		lineLen += 1 + len(word)
+		wordsOnLine++
+	}
+	buf.WriteString("\r\n")
+}
+
+// encodeBase64WithLineBreaks encodes bytes to base64 with 76-character line breaks per RFC 2045.
+func encodeBase64WithLineBreaks(data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var lines []string
+	for i := 0; i < len(encoded); i += base64LineLength {
+		end := i + base64LineLength
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		lines = append(lines, encoded[i:end])
+	}
+	return strings.Join(lines, "\r\n")
+}
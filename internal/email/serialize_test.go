@@ -0,0 +1,452 @@
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// node is a decoded MIME entity used to compare message structure.
+type node struct {
+	MediaType string
+	Filename  string
+	Content   string
+	Children  []node
+}
+
+// parseMessage parses serialized output back into its headers and MIME tree.
+func parseMessage(t *testing.T, raw []byte) (mail.Header, node) {
+	t.Helper()
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("failed to parse serialized message: %v\n%s", err, raw)
+	}
+	return msg.Header, parseEntity(t, msg.Header.Get("Content-Type"),
+		msg.Header.Get("Content-Transfer-Encoding"), "", msg.Body)
+}
+
+func parseEntity(t *testing.T, contentType, encoding, disposition string, body io.Reader) node {
+	t.Helper()
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatalf("invalid Content-Type %q: %v", contentType, err)
+	}
+	n := node{MediaType: mediaType}
+
+	if disposition != "" {
+		_, dparams, err := mime.ParseMediaType(disposition)
+		if err != nil {
+			t.Fatalf("invalid Content-Disposition %q: %v", disposition, err)
+		}
+		n.Filename = dparams["filename"]
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			// NextRawPart keeps the Content-Transfer-Encoding header so it
+			// can be checked here.
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("failed to read part: %v", err)
+			}
+			n.Children = append(n.Children, parseEntity(t,
+				part.Header.Get("Content-Type"),
+				part.Header.Get("Content-Transfer-Encoding"),
+				part.Header.Get("Content-Disposition"),
+				part,
+			))
+		}
+		return n
+	}
+
+	var decoded []byte
+	switch encoding {
+	case "quoted-printable":
+		decoded, err = io.ReadAll(quotedprintable.NewReader(body))
+	case "base64":
+		decoded, err = io.ReadAll(base64.NewDecoder(base64.StdEncoding, body))
+	default:
+		t.Fatalf("unexpected Content-Transfer-Encoding %q for %s", encoding, mediaType)
+	}
+	if err != nil {
+		t.Fatalf("failed to decode %s body: %v", mediaType, err)
+	}
+	n.Content = string(decoded)
+	return n
+}
+
+func TestSerialize_BodyStructure(t *testing.T) {
+	t.Parallel()
+
+	pdf := Attachment{Filename: "doc.pdf", ContentType: "application/pdf", Content: []byte("%PDF-1.4")}
+	csv := Attachment{Filename: "data.csv", ContentType: "text/csv", Content: []byte("a,b,c")}
+
+	textNode := node{MediaType: "text/plain", Content: "Hello"}
+	htmlNode := node{MediaType: "text/html", Content: "<p>Hello</p>"}
+	pdfNode := node{MediaType: "application/pdf", Filename: "doc.pdf", Content: "%PDF-1.4"}
+	csvNode := node{MediaType: "text/csv", Filename: "data.csv", Content: "a,b,c"}
+	alternative := node{MediaType: "multipart/alternative", Children: []node{textNode, htmlNode}}
+
+	tests := []struct {
+		name string
+		msg  Email
+		want node
+	}{
+		{
+			name: "text only",
+			msg:  Email{TextBody: "Hello"},
+			want: textNode,
+		},
+		{
+			name: "html only",
+			msg:  Email{HtmlBody: "<p>Hello</p>"},
+			want: htmlNode,
+		},
+		{
+			name: "text and html",
+			msg:  Email{TextBody: "Hello", HtmlBody: "<p>Hello</p>"},
+			want: alternative,
+		},
+		{
+			name: "empty body",
+			msg:  Email{},
+			want: node{MediaType: "text/plain"},
+		},
+		{
+			name: "text with attachment",
+			msg:  Email{TextBody: "Hello", Attachments: []Attachment{pdf}},
+			want: node{MediaType: "multipart/mixed", Children: []node{textNode, pdfNode}},
+		},
+		{
+			name: "html with attachment",
+			msg:  Email{HtmlBody: "<p>Hello</p>", Attachments: []Attachment{pdf}},
+			want: node{MediaType: "multipart/mixed", Children: []node{htmlNode, pdfNode}},
+		},
+		{
+			name: "text and html with attachments",
+			msg:  Email{TextBody: "Hello", HtmlBody: "<p>Hello</p>", Attachments: []Attachment{pdf, csv}},
+			want: node{MediaType: "multipart/mixed", Children: []node{alternative, pdfNode, csvNode}},
+		},
+		{
+			name: "attachment only",
+			msg:  Email{Attachments: []Attachment{csv}},
+			want: node{MediaType: "multipart/mixed", Children: []node{{MediaType: "text/plain"}, csvNode}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			raw, err := Serialize(&tt.msg)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			header, got := parseMessage(t, raw)
+			if header.Get("MIME-Version") != "1.0" {
+				t.Errorf("MIME-Version: got %q, want %q", header.Get("MIME-Version"), "1.0")
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("structure mismatch:\n got: %+v\nwant: %+v\nraw:\n%s", got, tt.want, raw)
+			}
+		})
+	}
+}
+
+func TestSerialize_Headers(t *testing.T) {
+	t.Parallel()
+
+	msg := &Email{
+		From:      "Sender <sender@example.com>",
+		Sender:    "assistant@example.com",
+		To:        []string{"to@example.com", "Second <second@example.com>"},
+		Cc:        []string{"cc@example.com"},
+		Bcc:       []string{"hidden@example.com"},
+		Subject:   "Quarterly report",
+		TextBody:  "body",
+		MessageID: "<msg-123@example.com>",
+		RawHeaders: map[string][]string{
+			"Date": {"Mon, 02 Jan 2006 15:04:05 -0700"},
+		},
+	}
+
+	raw, err := Serialize(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	header, _ := parseMessage(t, raw)
+	checks := map[string]string{
+		"From":       `"Sender" <sender@example.com>`,
+		"Sender":     "assistant@example.com",
+		"To":         `to@example.com, "Second" <second@example.com>`,
+		"Cc":         "cc@example.com",
+		"Subject":    "Quarterly report",
+		"Date":       "Mon, 02 Jan 2006 15:04:05 -0700",
+		"Message-Id": "<msg-123@example.com>",
+	}
+	for key, want := range checks {
+		if got := header.Get(key); got != want {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+	}
+
+	if strings.Contains(string(raw), "hidden@example.com") {
+		t.Error("Bcc recipient leaked into serialized message")
+	}
+}
+
+func TestSerializeWithHeaders(t *testing.T) {
+	t.Parallel()
+
+	extra := map[string][]string{
+		"X-Campaign-Id":    {"spring-2024"},
+		"List-Unsubscribe": {"<mailto:unsub@example.com>", "<https://example.com/unsub>"},
+	}
+	raw, err := SerializeWithHeaders(&Email{TextBody: "body"}, extra)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	header, _ := parseMessage(t, raw)
+	if got := header.Get("X-Campaign-Id"); got != "spring-2024" {
+		t.Errorf("X-Campaign-Id: got %q, want %q", got, "spring-2024")
+	}
+	if got := header["List-Unsubscribe"]; len(got) != 2 {
+		t.Errorf("List-Unsubscribe: got %v, want both values", got)
+	}
+	if got := header.Get("Mime-Version"); got != "1.0" {
+		t.Errorf("MIME-Version: got %q, want %q", got, "1.0")
+	}
+}
+
+func TestSerialize_Importance(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		importance string
+		priority   string
+	}{
+		{ImportanceHigh, "1 (Highest)"},
+		{ImportanceNormal, "3 (Normal)"},
+		{ImportanceLow, "5 (Lowest)"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		raw, err := Serialize(&Email{TextBody: "body", Importance: tt.importance})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		header, _ := parseMessage(t, raw)
+		if got := header.Get("Importance"); got != tt.importance {
+			t.Errorf("Importance: got %q, want %q", got, tt.importance)
+		}
+		if got := header.Get("X-Priority"); got != tt.priority {
+			t.Errorf("X-Priority for %q: got %q, want %q", tt.importance, got, tt.priority)
+		}
+	}
+}
+
+func TestSerialize_DefaultDate(t *testing.T) {
+	t.Parallel()
+
+	raw, err := Serialize(&Email{TextBody: "body"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	header, _ := parseMessage(t, raw)
+	if _, err := header.Date(); err != nil {
+		t.Errorf("Date header not parseable: %v", err)
+	}
+}
+
+func TestSerialize_EncodedWords(t *testing.T) {
+	t.Parallel()
+
+	msg := &Email{
+		From:     "Jürgen Müller <juergen@example.com>",
+		To:       []string{"to@example.com"},
+		Subject:  "Grüße aus Köln",
+		TextBody: "Schöne Grüße",
+		Attachments: []Attachment{
+			{Filename: "Bericht – März.pdf", ContentType: "application/pdf", Content: []byte("x")},
+		},
+	}
+
+	raw, err := Serialize(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Headers must be pure ASCII on the wire
+	headerEnd := bytes.Index(raw, []byte("\r\n\r\n"))
+	for _, b := range raw[:headerEnd] {
+		if b > 0x7e {
+			t.Fatalf("non-ASCII byte in headers:\n%s", raw[:headerEnd])
+		}
+	}
+
+	header, body := parseMessage(t, raw)
+	dec := new(mime.WordDecoder)
+
+	subject, err := dec.DecodeHeader(header.Get("Subject"))
+	if err != nil {
+		t.Fatalf("failed to decode Subject: %v", err)
+	}
+	if subject != msg.Subject {
+		t.Errorf("Subject: got %q, want %q", subject, msg.Subject)
+	}
+
+	from, err := mail.ParseAddress(header.Get("From"))
+	if err != nil {
+		t.Fatalf("failed to parse From: %v", err)
+	}
+	if from.Name != "Jürgen Müller" || from.Address != "juergen@example.com" {
+		t.Errorf("From: got %q <%s>, want %q <%s>", from.Name, from.Address, "Jürgen Müller", "juergen@example.com")
+	}
+
+	if got := body.Children[0].Content; got != msg.TextBody {
+		t.Errorf("TextBody: got %q, want %q", got, msg.TextBody)
+	}
+	if got := body.Children[1].Filename; got != msg.Attachments[0].Filename {
+		t.Errorf("attachment filename: got %q, want %q", got, msg.Attachments[0].Filename)
+	}
+}
+
+func TestSerialize_HeaderFolding(t *testing.T) {
+	t.Parallel()
+
+	var to []string
+	for i := 0; i < 10; i++ {
+		to = append(to, "recipient"+strings.Repeat("x", i)+"@example.com")
+	}
+	msg := &Email{
+		To:       to,
+		Subject:  strings.Repeat("long subject words ", 10),
+		TextBody: "body",
+	}
+
+	raw, err := Serialize(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	headerEnd := bytes.Index(raw, []byte("\r\n\r\n"))
+	for _, line := range strings.Split(string(raw[:headerEnd]), "\r\n") {
+		if len(line) > maxLineLength {
+			t.Errorf("header line exceeds %d chars (%d): %q", maxLineLength, len(line), line)
+		}
+	}
+
+	header, _ := parseMessage(t, raw)
+	got, err := header.AddressList("To")
+	if err != nil {
+		t.Fatalf("failed to parse folded To header: %v", err)
+	}
+	if len(got) != len(to) {
+		t.Errorf("To: got %d addresses, want %d", len(got), len(to))
+	}
+	if header.Get("Subject") != strings.TrimSpace(msg.Subject) {
+		t.Errorf("Subject: got %q, want %q", header.Get("Subject"), strings.TrimSpace(msg.Subject))
+	}
+}
+
+func TestSerialize_HeaderInjection(t *testing.T) {
+	t.Parallel()
+
+	msg := &Email{
+		Subject:  "Hello\r\nBcc: victim@example.com",
+		TextBody: "body",
+	}
+
+	raw, err := Serialize(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	header, _ := parseMessage(t, raw)
+	if got := header.Get("Bcc"); got != "" {
+		t.Errorf("Subject line break injected a header: Bcc=%q", got)
+	}
+}
+
+func TestSerialize_LongTextLines(t *testing.T) {
+	t.Parallel()
+
+	text := strings.Repeat("a", 200) + "\r\nsecond line"
+	raw, err := Serialize(&Email{TextBody: text})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > 76 {
+			t.Errorf("body line exceeds 76 chars (%d): %q", len(line), line)
+		}
+	}
+
+	_, body := parseMessage(t, raw)
+	if body.Content != text {
+		t.Errorf("TextBody round-trip: got %q, want %q", body.Content, text)
+	}
+}
+
+func TestSerialize_AttachmentDefaults(t *testing.T) {
+	t.Parallel()
+
+	msg := &Email{
+		Attachments: []Attachment{{Content: []byte{0x00, 0xff, 0x10}}},
+	}
+
+	raw, err := Serialize(msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, body := parseMessage(t, raw)
+	att := body.Children[1]
+	if att.MediaType != "application/octet-stream" {
+		t.Errorf("attachment media type: got %q, want %q", att.MediaType, "application/octet-stream")
+	}
+	if att.Content != string(msg.Attachments[0].Content) {
+		t.Errorf("attachment content: got %x, want %x", att.Content, msg.Attachments[0].Content)
+	}
+}
+
+func TestEncodeBase64WithLineBreaks(t *testing.T) {
+	t.Parallel()
+
+	// Create data that produces a long base64 string
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	encoded := encodeBase64WithLineBreaks(data)
+	lines := strings.Split(encoded, "\r\n")
+	for i, line := range lines {
+		if i < len(lines)-1 && len(line) != 76 {
+			t.Errorf("line %d length: got %d, want 76", i, len(line))
+		}
+		if len(line) > 76 {
+			t.Errorf("line %d exceeds 76 chars: got %d", i, len(line))
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// Package logging configures the process-wide structured logger.
+package logging
+
+import (
+	"io"
+	"log/slog"
+)
+
+// level is the level of the global logger. It is shared by every handler
+// created by Setup, so SetLevel takes effect immediately without replacing
+// the logger.
+var level slog.LevelVar
+
+// Setup installs a logger writing to w in the given format as the slog
+// default, at the given level name.
+func Setup(w io.Writer, levelName, format string) {
+	SetLevel(levelName)
+	slog.SetDefault(slog.New(NewHandler(w, format)))
+}
+
+// NewHandler returns a handler writing to w at the global level. format
+// "text" selects slog's key=value output for local development; anything
+// else selects JSON.
+func NewHandler(w io.Writer, format string) slog.Handler {
+	opts := &slog.HandlerOptions{Level: &level}
+	if format == "text" {
+		return slog.NewTextHandler(w, opts)
+	}
+	return slog.NewJSONHandler(w, opts)
+}
+
+// SetLevel changes the level of the global logger at runtime.
+func SetLevel(levelName string) {
+	level.Set(ParseLevel(levelName))
+}
+
+// ParseLevel maps a configured level name ("debug", "info", "warn" or
+// "error") to a slog.Level, defaulting to info.
+func ParseLevel(levelName string) slog.Level {
+	switch levelName {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
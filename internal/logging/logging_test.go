@@ -0,0 +1,82 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// useBuffer installs the global logger writing to a buffer and restores the
+// previous default logger when the test ends.
+func useBuffer(t *testing.T, levelName string) *bytes.Buffer {
+	t.Helper()
+
+	prev := slog.Default()
+	t.Cleanup(func() {
+		slog.SetDefault(prev)
+		SetLevel("info")
+	})
+
+	var buf bytes.Buffer
+	Setup(&buf, levelName, "json")
+	return &buf
+}
+
+func TestSetLevel_EnablesDebugAtRuntime(t *testing.T) {
+	buf := useBuffer(t, "info")
+
+	slog.Debug("before change")
+	if strings.Contains(buf.String(), "before change") {
+		t.Errorf("debug record emitted at info level: %s", buf.String())
+	}
+
+	SetLevel("debug")
+	slog.Debug("after change")
+	if !strings.Contains(buf.String(), "after change") {
+		t.Errorf("debug record not emitted after SetLevel(debug): %q", buf.String())
+	}
+}
+
+func TestNewHandler_Format(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{format: "json", want: "*slog.JSONHandler"},
+		{format: "text", want: "*slog.TextHandler"},
+		{format: "", want: "*slog.JSONHandler"},
+	}
+
+	for _, tt := range tests {
+		h := NewHandler(&bytes.Buffer{}, tt.format)
+		if got := fmt.Sprintf("%T", h); got != tt.want {
+			t.Errorf("NewHandler(%q): got %s, want %s", tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		in   string
+		want slog.Level
+	}{
+		{in: "debug", want: slog.LevelDebug},
+		{in: "info", want: slog.LevelInfo},
+		{in: "warn", want: slog.LevelWarn},
+		{in: "error", want: slog.LevelError},
+		{in: "", want: slog.LevelInfo},
+		{in: "verbose", want: slog.LevelInfo},
+	}
+
+	for _, tt := range tests {
+		if got := ParseLevel(tt.in); got != tt.want {
+			t.Errorf("ParseLevel(%q): got %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
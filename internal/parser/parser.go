@@ -2,13 +2,18 @@
 package parser
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"mime"
 	"mime/multipart"
+	"net/http"
 	"net/mail"
 	"strings"
 
@@ -35,11 +40,13 @@ func Parse(raw []byte) (*email.Email, error) {
 
 	// Extract standard header fields
 	result.From = msg.Header.Get("From")
+	result.Sender = msg.Header.Get("Sender")
 	result.Subject = msg.Header.Get("Subject")
 	result.MessageID = msg.Header.Get("Message-Id")
 	result.To = parseAddressList(msg.Header.Get("To"))
 	result.Cc = parseAddressList(msg.Header.Get("Cc"))
 	result.Bcc = parseAddressList(msg.Header.Get("Bcc"))
+	result.Importance = parseImportance(msg.Header)
 
 	contentType := msg.Header.Get("Content-Type")
 	if contentType == "" {
@@ -66,7 +73,8 @@ func Parse(raw []byte) (*email.Email, error) {
 		if boundary == "" {
 			return nil, fmt.Errorf("multipart message missing boundary")
 		}
-		if err := parseMultipart(msg.Body, boundary, result); err != nil {
+		budget := int64(maxDecompressedSize)
+		if err := parseMultipart(msg.Body, boundary, result, &budget); err != nil {
 			return nil, fmt.Errorf("failed to parse multipart message: %w", err)
 		}
 	} else {
@@ -90,9 +98,40 @@ func Parse(raw []byte) (*email.Email, error) {
 	return result, nil
 }
 
+// parseImportance returns the message importance from the Importance header,
+// falling back to X-Priority ("1"-"2" high, "3" normal, "4"-"5" low).
+// Unrecognized values yield an empty importance.
+func parseImportance(header mail.Header) string {
+	switch strings.ToLower(strings.TrimSpace(header.Get("Importance"))) {
+	case email.ImportanceHigh:
+		return email.ImportanceHigh
+	case email.ImportanceNormal:
+		return email.ImportanceNormal
+	case email.ImportanceLow:
+		return email.ImportanceLow
+	}
+
+	// X-Priority values often carry a comment, e.g. "1 (Highest)"
+	priority := strings.TrimSpace(header.Get("X-Priority"))
+	if priority == "" {
+		return ""
+	}
+	switch priority[0] {
+	case '1', '2':
+		return email.ImportanceHigh
+	case '3':
+		return email.ImportanceNormal
+	case '4', '5':
+		return email.ImportanceLow
+	}
+	return ""
+}
+
 // parseMultipart processes a multipart MIME message body, extracting text/plain,
-// text/html parts and attachments.
-func parseMultipart(body io.Reader, boundary string, result *email.Email) error {
+// text/html parts and attachments. budget is the number of bytes the
+// message's compressed parts may still expand to, shared with nested parts;
+// exceeding it fails the whole message.
+func parseMultipart(body io.Reader, boundary string, result *email.Email, budget *int64) error {
 	reader := multipart.NewReader(body, boundary)
 
 	for {
@@ -128,7 +167,10 @@ func parseMultipart(body io.Reader, boundary string, result *email.Email) error
 				slog.Warn("nested multipart missing boundary, skipping")
 				continue
 			}
-			if err := parseMultipart(part, nestedBoundary, result); err != nil {
+			if err := parseMultipart(part, nestedBoundary, result, budget); err != nil {
+				if errors.Is(err, errDecompressedTooLarge) {
+					return err
+				}
 				slog.Warn("failed to parse nested multipart",
 					"error", err,
 				)
@@ -136,8 +178,11 @@ func parseMultipart(body io.Reader, boundary string, result *email.Email) error
 			continue
 		}
 
-		content, err := readPartContent(part)
+		content, err := readPartContent(part, budget)
 		if err != nil {
+			if errors.Is(err, errDecompressedTooLarge) {
+				return err
+			}
 			slog.Warn("failed to read part content",
 				"content_type", mediaType,
 				"error", err,
@@ -149,7 +194,7 @@ func parseMultipart(body io.Reader, boundary string, result *email.Email) error
 			filename := extractFilename(part, params)
 			result.Attachments = append(result.Attachments, email.Attachment{
 				Filename:    filename,
-				ContentType: mediaType,
+				ContentType: attachmentType(mediaType, content),
 				Content:     content,
 			})
 			continue
@@ -170,7 +215,7 @@ func parseMultipart(body io.Reader, boundary string, result *email.Email) error
 			if filename != "" {
 				result.Attachments = append(result.Attachments, email.Attachment{
 					Filename:    filename,
-					ContentType: mediaType,
+					ContentType: attachmentType(mediaType, content),
 					Content:     content,
 				})
 			} else {
@@ -185,34 +230,137 @@ func parseMultipart(body io.Reader, boundary string, result *email.Email) error
 	return nil
 }
 
-// readPartContent reads the full content of a MIME part, handling
-// Content-Transfer-Encoding (base64, quoted-printable).
-func readPartContent(part *multipart.Part) ([]byte, error) {
-	encoding := part.Header.Get("Content-Transfer-Encoding")
-	encoding = strings.ToLower(strings.TrimSpace(encoding))
+// genericTypes are declared attachment types that say nothing about the
+// content, as some clients send for every attachment.
+var genericTypes = map[string]bool{
+	"application/octet-stream": true,
+	"application/unknown":      true,
+	"binary/octet-stream":      true,
+}
 
-	raw, err := io.ReadAll(part)
+// attachmentType returns the media type to record for an attachment. A
+// specific declared type is kept; a generic one is replaced by the type
+// sniffed from the content, if that is more specific.
+func attachmentType(declared string, content []byte) string {
+	if !genericTypes[declared] || len(content) == 0 {
+		return declared
+	}
+	// DetectContentType reads at most the first 512 bytes
+	sniffed, _, err := mime.ParseMediaType(http.DetectContentType(content))
+	if err != nil || genericTypes[sniffed] {
+		return declared
+	}
+	return sniffed
+}
+
+// readPartContent reads the full content of a MIME part, handling
+// Content-Transfer-Encoding (base64, quoted-printable) and then a gzip or
+// deflate Content-Encoding, charging its decompressed size to budget.
+func readPartContent(part *multipart.Part, budget *int64) ([]byte, error) {
+	content, err := readTransferDecoded(part)
 	if err != nil {
 		return nil, err
 	}
+	return decompress(part.Header.Get("Content-Encoding"), content, budget)
+}
+
+// readTransferDecoded reads a MIME part, undoing its
+// Content-Transfer-Encoding.
+func readTransferDecoded(part *multipart.Part) ([]byte, error) {
+	encoding := part.Header.Get("Content-Transfer-Encoding")
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
 
 	switch encoding {
 	case "base64":
-		cleaned := strings.NewReplacer("\r", "", "\n", "").Replace(string(raw))
-		decoded, err := base64.StdEncoding.DecodeString(cleaned)
+		// Decode as the part is read; the decoder skips line breaks. It
+		// reads in small chunks, which the buffer turns into few part reads.
+		r := bufio.NewReaderSize(part, 32*1024)
+		decoded, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, &base64Padder{r: r}))
 		if err != nil {
-			// Try with RawStdEncoding for unpadded base64
-			decoded, err = base64.RawStdEncoding.DecodeString(cleaned)
-			if err != nil {
-				return nil, fmt.Errorf("failed to decode base64 content: %w", err)
-			}
+			return nil, fmt.Errorf("failed to decode base64 content: %w", err)
 		}
 		return decoded, nil
 	default:
 		// For "7bit", "8bit", "binary", "quoted-printable", or empty,
 		// return raw content. Go's multipart reader handles QP internally.
-		return raw, nil
+		return io.ReadAll(part)
+	}
+}
+
+// maxDecompressedSize bounds the total output of a message's compressed
+// parts, so small highly compressed parts cannot expand without limit,
+// however many there are. It matches the default maximum message size.
+const maxDecompressedSize = 25 << 20
+
+// errDecompressedTooLarge is returned once a message's compressed parts
+// expand beyond maxDecompressedSize.
+var errDecompressedTooLarge = fmt.Errorf("compressed content expands beyond %d bytes", maxDecompressedSize)
+
+// decompress undoes a gzip or deflate (zlib) Content-Encoding, as set by
+// some automated senders. Content with no or another encoding is returned
+// unchanged. The output is deducted from budget, the bytes still allowed;
+// output larger than the budget is errDecompressedTooLarge.
+func decompress(encoding string, content []byte, budget *int64) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(bytes.NewReader(content))
+	case "deflate":
+		r, err = zlib.NewReader(bytes.NewReader(content))
+	default:
+		return content, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s content: %w", encoding, err)
+	}
+	defer r.Close()
+
+	decompressed, err := io.ReadAll(io.LimitReader(r, *budget+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s content: %w", encoding, err)
+	}
+	if int64(len(decompressed)) > *budget {
+		return nil, errDecompressedTooLarge
+	}
+	*budget -= int64(len(decompressed))
+	return decompressed, nil
+}
+
+// base64Padder passes base64 text through, adding the trailing "="
+// padding some senders omit so the standard decoder accepts it.
+type base64Padder struct {
+	r io.Reader
+	// n counts the base64 characters read, modulo 4.
+	n   int
+	pad string
+	eof bool
+}
+
+func (p *base64Padder) Read(b []byte) (int, error) {
+	if p.eof {
+		if p.pad == "" {
+			return 0, io.EOF
+		}
+		n := copy(b, p.pad)
+		p.pad = p.pad[n:]
+		return n, nil
+	}
+
+	n, err := p.r.Read(b)
+	chars := n - bytes.Count(b[:n], []byte{'\r'}) - bytes.Count(b[:n], []byte{'\n'})
+	p.n = (p.n + chars) % 4
+	if err == io.EOF {
+		p.eof = true
+		switch p.n {
+		case 2:
+			p.pad = "=="
+		case 3:
+			p.pad = "="
+		}
+		err = nil
 	}
+	return n, err
 }
 
 // extractFilename extracts the filename from a MIME part, checking both
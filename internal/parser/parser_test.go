@@ -1,8 +1,18 @@
 package parser
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/mail"
 	"strings"
 	"testing"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
 )
 
 func TestParsePlainTextEmail(t *testing.T) {
@@ -268,6 +278,31 @@ func TestParseRawHeaders(t *testing.T) {
 	}
 }
 
+func TestParseSender(t *testing.T) {
+	t.Parallel()
+
+	raw := []byte(strings.Join([]string{
+		"From: author@example.com",
+		"Sender: Assistant <assistant@example.com>",
+		"To: recipient@example.com",
+		"Subject: On behalf",
+		"",
+		"Body",
+	}, "\r\n"))
+
+	msg, err := Parse(raw)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if msg.From != "author@example.com" {
+		t.Errorf("From: got %q, want %q", msg.From, "author@example.com")
+	}
+	if msg.Sender != "Assistant <assistant@example.com>" {
+		t.Errorf("Sender: got %q, want %q", msg.Sender, "Assistant <assistant@example.com>")
+	}
+}
+
 func TestParseBase64AttachmentWithCRLF(t *testing.T) {
 	t.Parallel()
 
@@ -309,6 +344,152 @@ func TestParseBase64AttachmentWithCRLF(t *testing.T) {
 	}
 }
 
+func TestParseBase64WithoutPadding(t *testing.T) {
+	t.Parallel()
+
+	for _, content := range []string{"Hello World", "Hello World!", "Hello"} {
+		encoded := base64.RawStdEncoding.EncodeToString([]byte(content))
+		raw := []byte("From: sender@example.com\r\n" +
+			"Content-Type: multipart/mixed; boundary=bound\r\n" +
+			"\r\n" +
+			"--bound\r\n" +
+			"Content-Type: application/octet-stream; name=\"file.bin\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			encoded[:4] + "\r\n" + encoded[4:] + "\r\n" +
+			"--bound--\r\n")
+
+		msg, err := Parse(raw)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", encoded, err)
+		}
+		if len(msg.Attachments) != 1 || string(msg.Attachments[0].Content) != content {
+			t.Errorf("%q: attachments: got %+v, want content %q", encoded, msg.Attachments, content)
+		}
+	}
+}
+
+func TestParseContentEncoding(t *testing.T) {
+	t.Parallel()
+
+	const body = "Nightly report: all jobs succeeded."
+	var gzipped, deflated bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write([]byte(body))
+	gw.Close()
+	zw := zlib.NewWriter(&deflated)
+	zw.Write([]byte(body))
+	zw.Close()
+
+	tests := []struct {
+		name     string
+		encoding string
+		content  []byte
+	}{
+		{"gzip", "gzip", gzipped.Bytes()},
+		{"deflate", "deflate", deflated.Bytes()},
+		{"no encoding", "", []byte(body)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			partHeader := "Content-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n"
+			if tt.encoding != "" {
+				partHeader += "Content-Encoding: " + tt.encoding + "\r\n"
+			}
+			raw := []byte("From: sender@example.com\r\n" +
+				"Content-Type: multipart/mixed; boundary=bound\r\n" +
+				"\r\n" +
+				"--bound\r\n" +
+				partHeader +
+				"\r\n" +
+				base64.StdEncoding.EncodeToString(tt.content) + "\r\n" +
+				"--bound--\r\n")
+
+			msg, err := Parse(raw)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if msg.TextBody != body {
+				t.Errorf("TextBody: got %q, want %q", msg.TextBody, body)
+			}
+		})
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	t.Parallel()
+
+	// Zeros compress about 1000:1, so this is a part of a few tens of KB
+	var bomb bytes.Buffer
+	gw := gzip.NewWriter(&bomb)
+	gw.Write(make([]byte, maxDecompressedSize+1))
+	gw.Close()
+
+	budget := int64(maxDecompressedSize)
+	if _, err := decompress("gzip", bomb.Bytes(), &budget); !errors.Is(err, errDecompressedTooLarge) {
+		t.Fatalf("decompress: got %v for output over the limit, want %v", err, errDecompressedTooLarge)
+	}
+
+	var fits bytes.Buffer
+	gw = gzip.NewWriter(&fits)
+	gw.Write(make([]byte, maxDecompressedSize))
+	gw.Close()
+
+	budget = int64(maxDecompressedSize)
+	got, err := decompress("gzip", fits.Bytes(), &budget)
+	if err != nil {
+		t.Fatalf("decompress: unexpected error at the limit: %v", err)
+	}
+	if len(got) != maxDecompressedSize {
+		t.Errorf("decompressed size: got %d, want %d", len(got), maxDecompressedSize)
+	}
+	if budget != 0 {
+		t.Errorf("remaining budget: got %d, want 0", budget)
+	}
+}
+
+func TestParseDecompressLimitAcrossParts(t *testing.T) {
+	t.Parallel()
+
+	// Each part is well under the limit, but four together expand past it
+	const parts = 4
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write(make([]byte, maxDecompressedSize/parts+1))
+	gw.Close()
+	encoded := base64.StdEncoding.EncodeToString(gzipped.Bytes())
+
+	message := func(n int) []byte {
+		var raw strings.Builder
+		raw.WriteString("From: sender@example.com\r\nContent-Type: multipart/mixed; boundary=bound\r\n\r\n")
+		for i := range n {
+			fmt.Fprintf(&raw, "--bound\r\n"+
+				"Content-Type: application/octet-stream\r\n"+
+				"Content-Disposition: attachment; filename=part%d.bin\r\n"+
+				"Content-Transfer-Encoding: base64\r\n"+
+				"Content-Encoding: gzip\r\n"+
+				"\r\n%s\r\n", i, encoded)
+		}
+		raw.WriteString("--bound--\r\n")
+		return []byte(raw.String())
+	}
+
+	if _, err := Parse(message(parts)); !errors.Is(err, errDecompressedTooLarge) {
+		t.Fatalf("Parse: got %v, want %v", err, errDecompressedTooLarge)
+	}
+
+	msg, err := Parse(message(parts - 1))
+	if err != nil {
+		t.Fatalf("Parse: unexpected error under the limit: %v", err)
+	}
+	if len(msg.Attachments) != parts-1 {
+		t.Errorf("attachments: got %d, want %d", len(msg.Attachments), parts-1)
+	}
+}
+
 func TestParseAttachmentWithoutFilename(t *testing.T) {
 	t.Parallel()
 
@@ -399,3 +580,283 @@ func TestParseNestedMultipart(t *testing.T) {
 		t.Errorf("Attachment Filename: got %q, want %q", msg.Attachments[0].Filename, "data.bin")
 	}
 }
+
+func TestParseImportance(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{name: "importance high", header: "Importance: High", want: "high"},
+		{name: "importance normal", header: "Importance: normal", want: "normal"},
+		{name: "importance low", header: "Importance: low", want: "low"},
+		{name: "x-priority highest", header: "X-Priority: 1 (Highest)", want: "high"},
+		{name: "x-priority high", header: "X-Priority: 2", want: "high"},
+		{name: "x-priority normal", header: "X-Priority: 3 (Normal)", want: "normal"},
+		{name: "x-priority lowest", header: "X-Priority: 5 (Lowest)", want: "low"},
+		{name: "unrecognized", header: "Importance: urgent", want: ""},
+		{name: "absent", header: "X-Mailer: test", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			raw := []byte(strings.Join([]string{
+				"From: sender@example.com",
+				"To: recipient@example.com",
+				tt.header,
+				"Subject: Importance",
+				"",
+				"Body",
+			}, "\r\n"))
+
+			msg, err := Parse(raw)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if msg.Importance != tt.want {
+				t.Errorf("Importance: got %q, want %q", msg.Importance, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAttachmentTypeSniffing(t *testing.T) {
+	t.Parallel()
+
+	pdf := base64.StdEncoding.EncodeToString([]byte("%PDF-1.7\n1 0 obj\n<< /Type /Catalog >>\nendobj\n"))
+	tests := []struct {
+		name        string
+		contentType string
+		content     string
+		want        string
+	}{
+		{"PDF sent as octet-stream", "application/octet-stream", pdf, "application/pdf"},
+		{"specific type kept", "application/pdf", base64.StdEncoding.EncodeToString([]byte("Hello World")), "application/pdf"},
+		{"unrecognized content keeps declared type", "application/octet-stream", base64.StdEncoding.EncodeToString([]byte{0x00, 0x01, 0x02, 0xff}), "application/octet-stream"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			raw := []byte(strings.Join([]string{
+				"From: sender@example.com",
+				"To: recipient@example.com",
+				"Subject: Sniffing",
+				"Content-Type: multipart/mixed; boundary=bound",
+				"",
+				"--bound",
+				"Content-Type: text/plain",
+				"",
+				"body",
+				"--bound",
+				"Content-Type: " + tt.contentType + "; name=\"document\"",
+				"Content-Disposition: attachment; filename=\"document\"",
+				"Content-Transfer-Encoding: base64",
+				"",
+				tt.content,
+				"--bound--",
+			}, "\r\n"))
+
+			msg, err := Parse(raw)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(msg.Attachments) != 1 {
+				t.Fatalf("Attachments: got %d, want 1", len(msg.Attachments))
+			}
+			if got := msg.Attachments[0].ContentType; got != tt.want {
+				t.Errorf("ContentType: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSerializeRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	raw := []byte(strings.Join([]string{
+		"From: Sender <sender@example.com>",
+		"To: alice@example.com, bob@example.com",
+		"Cc: carol@example.com",
+		"Subject: =?UTF-8?Q?Round_trip_=E2=9C=93?=",
+		"Message-Id: <roundtrip@example.com>",
+		"Importance: high",
+		"Content-Type: multipart/mixed; boundary=outer",
+		"",
+		"--outer",
+		"Content-Type: multipart/alternative; boundary=inner",
+		"",
+		"--inner",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		"Hello in plain text",
+		"--inner",
+		"Content-Type: text/html; charset=UTF-8",
+		"",
+		"<p>Hello in HTML</p>",
+		"--inner--",
+		"--outer",
+		"Content-Type: application/pdf; name=\"report.pdf\"",
+		"Content-Disposition: attachment; filename=\"report.pdf\"",
+		"Content-Transfer-Encoding: base64",
+		"",
+		base64.StdEncoding.EncodeToString([]byte("%PDF-1.7 report")),
+		"--outer--",
+	}, "\r\n"))
+
+	first, err := Parse(raw)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	serialized, err := email.Serialize(first)
+	if err != nil {
+		t.Fatalf("Serialize: %v", err)
+	}
+	second, err := Parse(serialized)
+	if err != nil {
+		t.Fatalf("Parse serialized message: %v\n%s", err, serialized)
+	}
+
+	// Serialize quotes display names, so compare the parsed addresses
+	gotFrom, err := mail.ParseAddress(second.From)
+	if err != nil {
+		t.Fatalf("From %q: %v", second.From, err)
+	}
+	if gotFrom.Name != "Sender" || gotFrom.Address != "sender@example.com" {
+		t.Errorf("From: got %q, want %q", second.From, first.From)
+	}
+	if strings.Join(second.To, ",") != strings.Join(first.To, ",") {
+		t.Errorf("To: got %v, want %v", second.To, first.To)
+	}
+	if strings.Join(second.Cc, ",") != strings.Join(first.Cc, ",") {
+		t.Errorf("Cc: got %v, want %v", second.Cc, first.Cc)
+	}
+	if second.Subject != first.Subject {
+		t.Errorf("Subject: got %q, want %q", second.Subject, first.Subject)
+	}
+	if second.MessageID != first.MessageID {
+		t.Errorf("MessageID: got %q, want %q", second.MessageID, first.MessageID)
+	}
+	if second.Importance != email.ImportanceHigh {
+		t.Errorf("Importance: got %q, want %q", second.Importance, email.ImportanceHigh)
+	}
+	if second.TextBody != first.TextBody || second.TextBody == "" {
+		t.Errorf("TextBody: got %q, want %q", second.TextBody, first.TextBody)
+	}
+	if second.HtmlBody != first.HtmlBody || second.HtmlBody == "" {
+		t.Errorf("HtmlBody: got %q, want %q", second.HtmlBody, first.HtmlBody)
+	}
+	if len(second.Attachments) != 1 {
+		t.Fatalf("Attachments: got %d, want 1", len(second.Attachments))
+	}
+	got, want := second.Attachments[0], first.Attachments[0]
+	if got.Filename != want.Filename || got.ContentType != want.ContentType || string(got.Content) != string(want.Content) {
+		t.Errorf("attachment: got %s (%s, %q), want %s (%s, %q)",
+			got.Filename, got.ContentType, got.Content, want.Filename, want.ContentType, want.Content)
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	header := "From: sender@example.com\r\n" +
+		"To: alice@example.com, bob@example.com\r\n" +
+		"Subject: Benchmark\r\n" +
+		"Message-Id: <bench@example.com>\r\n"
+	text := strings.Repeat("The quick brown fox jumps over the lazy dog.\r\n", 40)
+
+	// A 1 MB attachment, base64 encoded in 76-character lines
+	content := make([]byte, 1<<20)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	encoded := base64.StdEncoding.EncodeToString(content)
+	var attachment strings.Builder
+	for len(encoded) > 76 {
+		attachment.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	attachment.WriteString(encoded + "\r\n")
+
+	benchmarks := []struct {
+		name string
+		raw  string
+	}{
+		{"plain text", header +
+			"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			text},
+		{"multipart alternative", header +
+			"Content-Type: multipart/alternative; boundary=alt\r\n" +
+			"\r\n" +
+			"--alt\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			text +
+			"--alt\r\n" +
+			"Content-Type: text/html\r\n" +
+			"\r\n" +
+			"<p>" + text + "</p>\r\n" +
+			"--alt--\r\n"},
+		{"multipart mixed 1MB attachment", header +
+			"Content-Type: multipart/mixed; boundary=mixed\r\n" +
+			"\r\n" +
+			"--mixed\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			text +
+			"--mixed\r\n" +
+			"Content-Type: application/octet-stream; name=\"data.bin\"\r\n" +
+			"Content-Disposition: attachment; filename=\"data.bin\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			attachment.String() +
+			"--mixed--\r\n"},
+	}
+
+	for _, bm := range benchmarks {
+		raw := []byte(bm.raw)
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(raw)))
+			for range b.N {
+				if _, err := Parse(raw); err != nil {
+					b.Fatalf("Parse: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkReadPartContent measures decoding a 1 MB base64 attachment part.
+func BenchmarkReadPartContent(b *testing.B) {
+	content := make([]byte, 1<<20)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	encoded := base64.StdEncoding.EncodeToString(content)
+	var body strings.Builder
+	body.WriteString("--bound\r\nContent-Transfer-Encoding: base64\r\n\r\n")
+	for len(encoded) > 76 {
+		body.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	body.WriteString(encoded + "\r\n--bound--\r\n")
+	raw := body.String()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(raw)))
+	for range b.N {
+		part, err := multipart.NewReader(strings.NewReader(raw), "bound").NextPart()
+		if err != nil {
+			b.Fatalf("NextPart: %v", err)
+		}
+		budget := int64(maxDecompressedSize)
+		if _, err := readPartContent(part, &budget); err != nil {
+			b.Fatalf("readPartContent: %v", err)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package provider
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+)
+
+// RecipientResolver expands a recipient address into the addresses mail
+// should actually be delivered to. Addresses that are not expanded are
+// returned unchanged as a single-element slice.
+type RecipientResolver interface {
+	Resolve(addr string) []string
+}
+
+// AliasMap is a RecipientResolver backed by a static alias table. Alias
+// names are matched case-insensitively.
+type AliasMap map[string][]string
+
+// Resolve returns the members of addr if it is an alias, or addr itself.
+func (m AliasMap) Resolve(addr string) []string {
+	if members, ok := m[strings.ToLower(addr)]; ok {
+		return members
+	}
+	return []string{addr}
+}
+
+// LoadAliasFile reads an alias table from path. Each non-empty line maps an
+// alias to a comma-separated list of recipients, in the style of
+// /etc/aliases:
+//
+//	# comment
+//	team@proxy.local: alice@example.com, bob@example.com
+//
+// Aliases are not expanded recursively.
+func LoadAliasFile(path string) (AliasMap, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open aliases file: %w", err)
+	}
+	defer f.Close()
+
+	aliases := make(AliasMap)
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		alias, list, ok := strings.Cut(line, ":")
+		alias = strings.ToLower(strings.TrimSpace(alias))
+		if !ok || alias == "" {
+			return nil, fmt.Errorf("aliases file %s line %d: expected \"alias: recipient, ...\"", path, lineNum)
+		}
+
+		var members []string
+		for _, m := range strings.Split(list, ",") {
+			if m = strings.TrimSpace(m); m != "" {
+				members = append(members, m)
+			}
+		}
+		if len(members) == 0 {
+			return nil, fmt.Errorf("aliases file %s line %d: alias %s has no recipients", path, lineNum, alias)
+		}
+		aliases[alias] = members
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read aliases file: %w", err)
+	}
+
+	return aliases, nil
+}
+
+// RecipientExpander is a Provider that rewrites the To, Cc and Bcc lists of
+// each message through a RecipientResolver before delivery, so an alias is
+// replaced by its members.
+type RecipientExpander struct {
+	next     Provider
+	resolver RecipientResolver
+}
+
+// NewRecipientExpander wraps next so recipients are expanded by resolver.
+func NewRecipientExpander(next Provider, resolver RecipientResolver) *RecipientExpander {
+	return &RecipientExpander{next: next, resolver: resolver}
+}
+
+// Send expands the recipients of msg and delivers a copy through the
+// wrapped provider. msg itself is not modified.
+func (e *RecipientExpander) Send(ctx context.Context, msg *email.Email) error {
+	expanded := *msg
+	expanded.To = e.expand(msg.To)
+	expanded.Cc = e.expand(msg.Cc)
+	expanded.Bcc = e.expand(msg.Bcc)
+	return e.next.Send(ctx, &expanded)
+}
+
+// Name returns the wrapped provider's name.
+func (e *RecipientExpander) Name() string {
+	return e.next.Name()
+}
+
+// expand resolves each address, dropping duplicates while keeping order.
+func (e *RecipientExpander) expand(addrs []string) []string {
+	if len(addrs) == 0 {
+		return addrs
+	}
+
+	seen := make(map[string]bool)
+	result := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		for _, resolved := range e.resolver.Resolve(addr) {
+			key := strings.ToLower(resolved)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			result = append(result, resolved)
+		}
+	}
+	return result
+}
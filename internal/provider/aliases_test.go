@@ -0,0 +1,116 @@
+package provider
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+)
+
+// writeAliasFile writes content to an aliases file and returns its path.
+func writeAliasFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "aliases")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write aliases file: %v", err)
+	}
+	return path
+}
+
+func TestLoadAliasFile(t *testing.T) {
+	t.Parallel()
+
+	path := writeAliasFile(t, `
+# Team distribution list
+Team@Proxy.local: alice@example.com, bob@example.com,carol@example.com
+
+ops@proxy.local: oncall@example.com
+`)
+
+	aliases, err := LoadAliasFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := AliasMap{
+		"team@proxy.local": {"alice@example.com", "bob@example.com", "carol@example.com"},
+		"ops@proxy.local":  {"oncall@example.com"},
+	}
+	if !reflect.DeepEqual(aliases, want) {
+		t.Errorf("aliases: got %v, want %v", aliases, want)
+	}
+}
+
+func TestLoadAliasFile_Invalid(t *testing.T) {
+	t.Parallel()
+
+	for name, content := range map[string]string{
+		"missing colon": "team@proxy.local alice@example.com\n",
+		"no recipients": "team@proxy.local: , \n",
+		"empty alias":   ": alice@example.com\n",
+	} {
+		if _, err := LoadAliasFile(writeAliasFile(t, content)); err == nil {
+			t.Errorf("%s: expected error, got nil", name)
+		}
+	}
+
+	if _, err := LoadAliasFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected error for nonexistent file, got nil")
+	}
+}
+
+func TestRecipientExpander_ExpandsAlias(t *testing.T) {
+	t.Parallel()
+
+	inner := &fakeProvider{name: "inner"}
+	aliases := AliasMap{
+		"team@proxy.local": {"alice@example.com", "bob@example.com", "carol@example.com"},
+	}
+	e := NewRecipientExpander(inner, aliases)
+
+	msg := &email.Email{
+		To: []string{"TEAM@proxy.local"},
+		Cc: []string{"dave@example.com"},
+	}
+	if err := e.Send(context.Background(), msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	wantTo := []string{"alice@example.com", "bob@example.com", "carol@example.com"}
+	if !reflect.DeepEqual(inner.lastMsg.To, wantTo) {
+		t.Errorf("To: got %v, want %v", inner.lastMsg.To, wantTo)
+	}
+	// Non-alias addresses pass through unchanged
+	if !reflect.DeepEqual(inner.lastMsg.Cc, []string{"dave@example.com"}) {
+		t.Errorf("Cc: got %v, want %v", inner.lastMsg.Cc, []string{"dave@example.com"})
+	}
+	// The caller's message is left untouched
+	if !reflect.DeepEqual(msg.To, []string{"TEAM@proxy.local"}) {
+		t.Errorf("original To modified: got %v", msg.To)
+	}
+	if e.Name() != "inner" {
+		t.Errorf("Name: got %q, want %q", e.Name(), "inner")
+	}
+}
+
+func TestRecipientExpander_DropsDuplicates(t *testing.T) {
+	t.Parallel()
+
+	inner := &fakeProvider{name: "inner"}
+	aliases := AliasMap{"team@proxy.local": {"alice@example.com", "bob@example.com"}}
+	e := NewRecipientExpander(inner, aliases)
+
+	msg := &email.Email{To: []string{"alice@example.com", "team@proxy.local"}}
+	if err := e.Send(context.Background(), msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{"alice@example.com", "bob@example.com"}
+	if !reflect.DeepEqual(inner.lastMsg.To, want) {
+		t.Errorf("To: got %v, want %v", inner.lastMsg.To, want)
+	}
+}
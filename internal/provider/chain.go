@@ -0,0 +1,93 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+)
+
+// Chain is a Provider that delivers through an ordered list of providers,
+// falling back to the next one when a delivery fails transiently.
+type Chain struct {
+	providers []Provider
+}
+
+// NewChain creates a Chain that tries the given providers in order.
+func NewChain(providers ...Provider) *Chain {
+	return &Chain{providers: providers}
+}
+
+// Send tries each provider in order until one succeeds. A permanent failure
+// stops the chain immediately since another provider would reject the
+// message as well. If every provider fails, the last error is returned.
+func (c *Chain) Send(ctx context.Context, msg *email.Email) error {
+	if len(c.providers) == 0 {
+		return fmt.Errorf("provider chain is empty")
+	}
+
+	var lastErr error
+	for i, p := range c.providers {
+		err := p.Send(ctx, msg)
+		if err == nil {
+			return nil
+		}
+
+		lastErr = err
+		if IsPermanent(err) {
+			return err
+		}
+
+		if i < len(c.providers)-1 {
+			slog.Warn("provider failed, falling back to next provider",
+				"provider", p.Name(),
+				"next", c.providers[i+1].Name(),
+				"error", err,
+			)
+		}
+	}
+
+	return lastErr
+}
+
+// BuildRequest builds the request each chained provider would send for
+// msg, keyed by provider name, so a dry run surfaces the build errors of
+// every provider the message could fall back to. Providers that cannot
+// build requests are skipped.
+func (c *Chain) BuildRequest(msg *email.Email) (any, error) {
+	requests := make(map[string]any, len(c.providers))
+	for _, p := range c.providers {
+		builder, ok := p.(RequestBuilder)
+		if !ok {
+			continue
+		}
+		req, err := builder.BuildRequest(msg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p.Name(), err)
+		}
+		requests[p.Name()] = req
+	}
+	return requests, nil
+}
+
+// Name returns the names of the chained providers joined by commas.
+func (c *Chain) Name() string {
+	names := make([]string, 0, len(c.providers))
+	for _, p := range c.providers {
+		names = append(names, p.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+// IsPermanent reports whether err (or any error it wraps) declares itself
+// a permanent failure.
+func IsPermanent(err error) bool {
+	var pe PermanentError
+	if errors.As(err, &pe) {
+		return pe.Permanent()
+	}
+	return false
+}
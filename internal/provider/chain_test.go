@@ -0,0 +1,134 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+)
+
+// fakeProvider records calls and returns a fixed error.
+type fakeProvider struct {
+	name    string
+	err     error
+	calls   int
+	lastMsg *email.Email
+}
+
+func (f *fakeProvider) Send(_ context.Context, msg *email.Email) error {
+	f.calls++
+	f.lastMsg = msg
+	return f.err
+}
+
+func (f *fakeProvider) Name() string {
+	return f.name
+}
+
+// classifiedError is an error that reports whether it is permanent.
+type classifiedError struct {
+	permanent bool
+}
+
+func (e *classifiedError) Error() string {
+	return fmt.Sprintf("classified error (permanent=%t)", e.permanent)
+}
+
+func (e *classifiedError) Permanent() bool {
+	return e.permanent
+}
+
+func TestChain_FirstSuccess(t *testing.T) {
+	t.Parallel()
+
+	primary := &fakeProvider{name: "primary"}
+	secondary := &fakeProvider{name: "secondary"}
+	chain := NewChain(primary, secondary)
+
+	if err := chain.Send(context.Background(), &email.Email{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if primary.calls != 1 {
+		t.Errorf("primary calls: got %d, want 1", primary.calls)
+	}
+	if secondary.calls != 0 {
+		t.Errorf("secondary calls: got %d, want 0", secondary.calls)
+	}
+}
+
+func TestChain_FallbackOnTransient(t *testing.T) {
+	t.Parallel()
+
+	primary := &fakeProvider{name: "primary", err: fmt.Errorf("wrapped: %w", &classifiedError{permanent: false})}
+	secondary := &fakeProvider{name: "secondary"}
+	chain := NewChain(primary, secondary)
+
+	if err := chain.Send(context.Background(), &email.Email{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if primary.calls != 1 {
+		t.Errorf("primary calls: got %d, want 1", primary.calls)
+	}
+	if secondary.calls != 1 {
+		t.Errorf("secondary calls: got %d, want 1", secondary.calls)
+	}
+}
+
+func TestChain_FallbackOnUnclassifiedError(t *testing.T) {
+	t.Parallel()
+
+	primary := &fakeProvider{name: "primary", err: errors.New("connection reset")}
+	secondary := &fakeProvider{name: "secondary"}
+	chain := NewChain(primary, secondary)
+
+	if err := chain.Send(context.Background(), &email.Email{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if secondary.calls != 1 {
+		t.Errorf("secondary calls: got %d, want 1", secondary.calls)
+	}
+}
+
+func TestChain_NoFallbackOnPermanent(t *testing.T) {
+	t.Parallel()
+
+	permErr := &classifiedError{permanent: true}
+	primary := &fakeProvider{name: "primary", err: permErr}
+	secondary := &fakeProvider{name: "secondary"}
+	chain := NewChain(primary, secondary)
+
+	err := chain.Send(context.Background(), &email.Email{})
+	if !errors.Is(err, permErr) {
+		t.Fatalf("error: got %v, want %v", err, permErr)
+	}
+	if secondary.calls != 0 {
+		t.Errorf("secondary calls: got %d, want 0", secondary.calls)
+	}
+}
+
+func TestChain_AllFailReturnsLastError(t *testing.T) {
+	t.Parallel()
+
+	firstErr := errors.New("first failed")
+	lastErr := errors.New("last failed")
+	chain := NewChain(
+		&fakeProvider{name: "primary", err: firstErr},
+		&fakeProvider{name: "secondary", err: lastErr},
+	)
+
+	err := chain.Send(context.Background(), &email.Email{})
+	if !errors.Is(err, lastErr) {
+		t.Fatalf("error: got %v, want %v", err, lastErr)
+	}
+}
+
+func TestChain_Name(t *testing.T) {
+	t.Parallel()
+
+	chain := NewChain(&fakeProvider{name: "ses"}, &fakeProvider{name: "msgraph"})
+	if chain.Name() != "ses,msgraph" {
+		t.Errorf("Name: got %q, want %q", chain.Name(), "ses,msgraph")
+	}
+}
@@ -0,0 +1,119 @@
+package provider
+
+import (
+	"context"
+	"log/slog"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+)
+
+// Deduplicator is a Provider that suppresses repeated deliveries of the same
+// message. A message is identified by the first non-empty header from a
+// configured list (e.g. X-Idempotency-Key, then Message-ID), so clients that
+// retry a send after a lost response do not produce duplicate emails.
+type Deduplicator struct {
+	next    Provider
+	headers []string
+	ttl     time.Duration
+
+	mu sync.Mutex
+	// seen maps a dedup key to the time it was recorded. A zero time marks
+	// a send that is still in flight.
+	seen map[string]time.Time
+}
+
+// NewDeduplicator wraps next so that messages sharing a dedup key within ttl
+// are delivered only once. headers lists the header names consulted, in
+// order, to build the key.
+func NewDeduplicator(next Provider, headers []string, ttl time.Duration) *Deduplicator {
+	canonical := make([]string, 0, len(headers))
+	for _, h := range headers {
+		if h = strings.TrimSpace(h); h != "" {
+			canonical = append(canonical, textproto.CanonicalMIMEHeaderKey(h))
+		}
+	}
+	return &Deduplicator{
+		next:    next,
+		headers: canonical,
+		ttl:     ttl,
+		seen:    make(map[string]time.Time),
+	}
+}
+
+// Send delivers msg through the wrapped provider unless a message with the
+// same dedup key was already delivered (or is being delivered) within the
+// TTL, in which case the send is skipped and reported as successful.
+func (d *Deduplicator) Send(ctx context.Context, msg *email.Email) error {
+	key := d.key(msg)
+	if key == "" {
+		return d.next.Send(ctx, msg)
+	}
+
+	if !d.reserve(key) {
+		slog.Info("duplicate message suppressed",
+			"dedup_key", key,
+			"provider", d.next.Name(),
+		)
+		return nil
+	}
+
+	if err := d.next.Send(ctx, msg); err != nil {
+		// Release the key so a retry of the failed send can go through
+		d.mu.Lock()
+		delete(d.seen, key)
+		d.mu.Unlock()
+		return err
+	}
+
+	d.mu.Lock()
+	d.seen[key] = time.Now()
+	d.mu.Unlock()
+	return nil
+}
+
+// Name returns the wrapped provider's name.
+func (d *Deduplicator) Name() string {
+	return d.next.Name()
+}
+
+// key builds the dedup key from the first configured header present on msg.
+// It returns an empty string if none of the headers are set.
+func (d *Deduplicator) key(msg *email.Email) string {
+	for _, h := range d.headers {
+		var value string
+		if h == "Message-Id" && msg.MessageID != "" {
+			value = msg.MessageID
+		} else if values := msg.RawHeaders[h]; len(values) > 0 {
+			value = values[0]
+		}
+		if value = strings.TrimSpace(value); value != "" {
+			return h + ":" + value
+		}
+	}
+	return ""
+}
+
+// reserve records key as in flight and reports whether the caller should
+// send. It returns false if the key was seen within the TTL. Expired
+// entries are pruned on each call.
+func (d *Deduplicator) reserve(key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for k, at := range d.seen {
+		if !at.IsZero() && now.Sub(at) > d.ttl {
+			delete(d.seen, k)
+		}
+	}
+
+	if _, ok := d.seen[key]; ok {
+		return false
+	}
+	d.seen[key] = time.Time{}
+	return true
+}
@@ -0,0 +1,113 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+)
+
+func TestDeduplicator_SameIdempotencyKeySentOnce(t *testing.T) {
+	t.Parallel()
+
+	inner := &fakeProvider{name: "inner"}
+	d := NewDeduplicator(inner, []string{"X-Idempotency-Key", "Message-ID"}, time.Hour)
+
+	for i, id := range []string{"<a@example.com>", "<b@example.com>"} {
+		msg := &email.Email{
+			MessageID: id,
+			RawHeaders: map[string][]string{
+				"X-Idempotency-Key": {"order-1234"},
+			},
+		}
+		if err := d.Send(context.Background(), msg); err != nil {
+			t.Fatalf("send %d: unexpected error: %v", i, err)
+		}
+	}
+
+	if inner.calls != 1 {
+		t.Errorf("inner calls: got %d, want 1", inner.calls)
+	}
+}
+
+func TestDeduplicator_FallsBackToMessageID(t *testing.T) {
+	t.Parallel()
+
+	inner := &fakeProvider{name: "inner"}
+	d := NewDeduplicator(inner, []string{"X-Idempotency-Key", "Message-ID"}, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		if err := d.Send(context.Background(), &email.Email{MessageID: "<same@example.com>"}); err != nil {
+			t.Fatalf("send %d: unexpected error: %v", i, err)
+		}
+	}
+	if err := d.Send(context.Background(), &email.Email{MessageID: "<other@example.com>"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if inner.calls != 2 {
+		t.Errorf("inner calls: got %d, want 2", inner.calls)
+	}
+}
+
+func TestDeduplicator_NoKeyAlwaysSends(t *testing.T) {
+	t.Parallel()
+
+	inner := &fakeProvider{name: "inner"}
+	d := NewDeduplicator(inner, []string{"X-Idempotency-Key"}, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		if err := d.Send(context.Background(), &email.Email{}); err != nil {
+			t.Fatalf("send %d: unexpected error: %v", i, err)
+		}
+	}
+
+	if inner.calls != 2 {
+		t.Errorf("inner calls: got %d, want 2", inner.calls)
+	}
+}
+
+func TestDeduplicator_FailedSendCanBeRetried(t *testing.T) {
+	t.Parallel()
+
+	inner := &fakeProvider{name: "inner", err: errors.New("temporary failure")}
+	d := NewDeduplicator(inner, []string{"X-Idempotency-Key"}, time.Hour)
+	msg := &email.Email{
+		RawHeaders: map[string][]string{"X-Idempotency-Key": {"order-1234"}},
+	}
+
+	if err := d.Send(context.Background(), msg); err == nil {
+		t.Fatal("expected error from failing provider, got nil")
+	}
+
+	inner.err = nil
+	if err := d.Send(context.Background(), msg); err != nil {
+		t.Fatalf("retry: unexpected error: %v", err)
+	}
+
+	if inner.calls != 2 {
+		t.Errorf("inner calls: got %d, want 2", inner.calls)
+	}
+}
+
+func TestDeduplicator_KeyExpiresAfterTTL(t *testing.T) {
+	t.Parallel()
+
+	inner := &fakeProvider{name: "inner"}
+	d := NewDeduplicator(inner, []string{"Message-ID"}, 10*time.Millisecond)
+	msg := &email.Email{MessageID: "<same@example.com>"}
+
+	if err := d.Send(context.Background(), msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := d.Send(context.Background(), msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if inner.calls != 2 {
+		t.Errorf("inner calls: got %d, want 2", inner.calls)
+	}
+}
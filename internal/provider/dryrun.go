@@ -0,0 +1,57 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+)
+
+// RequestBuilder is implemented by providers that can build the request
+// they would send for a message without sending it.
+type RequestBuilder interface {
+	BuildRequest(msg *email.Email) (any, error)
+}
+
+// DryRun is a Provider that exercises the delivery pipeline without sending.
+// Each message is built into the wrapped provider's request, so build
+// errors still surface, and logged; the network call is skipped.
+type DryRun struct {
+	next Provider
+}
+
+// NewDryRun wraps next so that messages are built and logged but never
+// sent. If next does not implement RequestBuilder, only the message is
+// logged.
+func NewDryRun(next Provider) *DryRun {
+	return &DryRun{next: next}
+}
+
+// Send builds the request for msg and logs it, reporting success without
+// delivering the message.
+func (d *DryRun) Send(_ context.Context, msg *email.Email) error {
+	var request any
+	if builder, ok := d.next.(RequestBuilder); ok {
+		req, err := builder.BuildRequest(msg)
+		if err != nil {
+			return fmt.Errorf("dry run: failed to build %s request: %w", d.next.Name(), err)
+		}
+		request = req
+	}
+
+	slog.Info("dry run: message not sent",
+		"provider", d.next.Name(),
+		"message_id", msg.MessageID,
+		"from", msg.From,
+		"to", msg.To,
+		"subject", msg.Subject,
+		"request", request,
+	)
+	return nil
+}
+
+// Name returns the wrapped provider's name.
+func (d *DryRun) Name() string {
+	return d.next.Name()
+}
@@ -0,0 +1,116 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+)
+
+// buildingProvider is a fakeProvider that also builds requests.
+type buildingProvider struct {
+	fakeProvider
+	buildErr error
+	built    int
+}
+
+func (b *buildingProvider) BuildRequest(msg *email.Email) (any, error) {
+	b.built++
+	if b.buildErr != nil {
+		return nil, b.buildErr
+	}
+	return map[string]string{"subject": msg.Subject}, nil
+}
+
+func TestDryRun_LogsWithoutSending(t *testing.T) {
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	inner := &buildingProvider{fakeProvider: fakeProvider{name: "graph"}}
+	d := NewDryRun(inner)
+
+	msg := &email.Email{MessageID: "<id@test>", To: []string{"alice@example.com"}, Subject: "Hello"}
+	if err := d.Send(context.Background(), msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if inner.calls != 0 {
+		t.Errorf("inner Send calls: got %d, want 0", inner.calls)
+	}
+	if inner.built != 1 {
+		t.Errorf("BuildRequest calls: got %d, want 1", inner.built)
+	}
+	output := buf.String()
+	for _, want := range []string{
+		`"msg":"dry run: message not sent"`,
+		`"provider":"graph"`,
+		`"message_id":"<id@test>"`,
+		`"request":{"subject":"Hello"}`,
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("dry run log missing %s, got: %s", want, output)
+		}
+	}
+	if d.Name() != "graph" {
+		t.Errorf("Name(): got %q, want %q", d.Name(), "graph")
+	}
+}
+
+func TestDryRun_ReturnsBuildError(t *testing.T) {
+	t.Parallel()
+
+	buildErr := errors.New("bad attachment")
+	inner := &buildingProvider{fakeProvider: fakeProvider{name: "ses"}, buildErr: buildErr}
+
+	err := NewDryRun(inner).Send(context.Background(), &email.Email{})
+	if !errors.Is(err, buildErr) {
+		t.Errorf("Send: got %v, want %v", err, buildErr)
+	}
+	if inner.calls != 0 {
+		t.Errorf("inner Send calls: got %d, want 0", inner.calls)
+	}
+}
+
+func TestDryRun_BuildsForEachChainedProvider(t *testing.T) {
+	t.Parallel()
+
+	ses := &buildingProvider{fakeProvider: fakeProvider{name: "ses"}}
+	graph := &buildingProvider{fakeProvider: fakeProvider{name: "graph"}}
+	stdout := &fakeProvider{name: "stdout"}
+	d := NewDryRun(NewChain(ses, graph, stdout))
+
+	if err := d.Send(context.Background(), &email.Email{Subject: "Hello"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ses.built != 1 || graph.built != 1 {
+		t.Errorf("BuildRequest calls: got ses %d, graph %d, want 1 each", ses.built, graph.built)
+	}
+	if ses.calls+graph.calls+stdout.calls != 0 {
+		t.Error("a chained provider was sent the message during a dry run")
+	}
+
+	// A build error from a fallback provider still surfaces
+	buildErr := errors.New("bad attachment")
+	graph.buildErr = buildErr
+	if err := d.Send(context.Background(), &email.Email{}); !errors.Is(err, buildErr) {
+		t.Errorf("Send: got %v, want %v", err, buildErr)
+	}
+}
+
+func TestDryRun_ProviderWithoutBuilder(t *testing.T) {
+	t.Parallel()
+
+	inner := &fakeProvider{name: "stdout"}
+	if err := NewDryRun(inner).Send(context.Background(), &email.Email{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if inner.calls != 0 {
+		t.Errorf("inner Send calls: got %d, want 0", inner.calls)
+	}
+}
@@ -1,11 +1,14 @@
 package graph
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -15,58 +18,240 @@ import (
 // This prevents using a token that is about to expire during a request.
 const tokenExpiryBuffer = 5 * time.Minute
 
+// tokenMaxRetries is how many times a 429 or 5xx from the token endpoint
+// is retried before a refresh fails.
+const tokenMaxRetries = 2
+
+// tokenRetryBaseDelay is the first backoff delay after a retryable token
+// endpoint error; it doubles with each retry.
+const tokenRetryBaseDelay = 500 * time.Millisecond
+
+// maxTokenRetryAfter caps the wait requested by a token endpoint
+// Retry-After header, since sends needing a token wait with it.
+const maxTokenRetryAfter = 10 * time.Second
+
+// tokenRefreshTimeout bounds a token refresh, retries included. A refresh
+// is shared by every caller waiting for a token, so it runs on this
+// timeout rather than on any one caller's context.
+const tokenRefreshTimeout = 30 * time.Second
+
+// refreshLead is how long before the cached token expires the background
+// refresher renews it.
+const refreshLead = time.Minute
+
+// minRefreshInterval is the shortest wait between background refreshes,
+// so a token issued with a very short lifetime, or a failing token
+// endpoint, does not make the refresher spin.
+const minRefreshInterval = 10 * time.Second
+
 // tokenCache manages OAuth2 access tokens with thread-safe caching and
 // automatic refresh before expiration.
 type tokenCache struct {
-	mu           sync.Mutex
-	accessToken  string
-	expiresAt    time.Time
 	tokenURL     string
 	clientID     string
 	clientSecret string
 	scope        string
 	httpClient   *http.Client
+
+	// mu guards the cached token and the refresh in progress. It is never
+	// held while the token endpoint is contacted.
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+
+	// refreshing is the refresh in progress, if any; concurrent callers
+	// wait for its result rather than each fetching a token.
+	refreshing *refreshCall
+
+	// retryBaseDelay, refreshTimeout, refreshLead and minRefreshInterval
+	// tune retries and the background refresher; they are fields so tests
+	// can shorten them.
+	retryBaseDelay     time.Duration
+	refreshTimeout     time.Duration
+	refreshLead        time.Duration
+	minRefreshInterval time.Duration
 }
 
-// newTokenCache creates a new token cache for the given OAuth2 client credentials.
-func newTokenCache(tokenURL, clientID, clientSecret string, httpClient *http.Client) *tokenCache {
+// newTokenCache creates a new token cache for the given OAuth2 client
+// credentials, requesting tokens for scope.
+func newTokenCache(tokenURL, clientID, clientSecret, scope string, httpClient *http.Client) *tokenCache {
 	return &tokenCache{
 		tokenURL:     tokenURL,
 		clientID:     clientID,
 		clientSecret: clientSecret,
-		scope:        "https://graph.microsoft.com/.default",
+		scope:        scope,
 		httpClient:   httpClient,
+
+		retryBaseDelay:     tokenRetryBaseDelay,
+		refreshTimeout:     tokenRefreshTimeout,
+		refreshLead:        refreshLead,
+		minRefreshInterval: minRefreshInterval,
+	}
+}
+
+// runRefresher renews the token shortly before it expires until ctx is
+// cancelled, so Token rarely has to wait on the token endpoint. A token
+// is fetched straight away if none is cached yet.
+func (tc *tokenCache) runRefresher(ctx context.Context) {
+	for {
+		tc.mu.Lock()
+		wait := time.Until(tc.expiresAt) - tc.refreshLead
+		if tc.accessToken == "" {
+			wait = 0
+		}
+		tc.mu.Unlock()
+
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+
+		if _, err := tc.refresh(ctx); err != nil {
+			slog.Warn("background token refresh failed", "error", err)
+		}
+
+		// Wait at least minRefreshInterval before the next attempt
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(tc.minRefreshInterval):
+		}
 	}
 }
 
 // Token returns a valid access token, refreshing it if necessary.
 // This method is safe for concurrent use.
-func (tc *tokenCache) Token() (string, error) {
+func (tc *tokenCache) Token(ctx context.Context) (string, error) {
 	tc.mu.Lock()
-	defer tc.mu.Unlock()
-
 	if tc.accessToken != "" && time.Now().Before(tc.expiresAt) {
-		return tc.accessToken, nil
+		token := tc.accessToken
+		tc.mu.Unlock()
+		return token, nil
 	}
+	tc.mu.Unlock()
+
+	return tc.refresh(ctx)
+}
 
-	return tc.refresh()
+// refreshCall is a refresh in progress. done is closed once token and
+// err are set.
+type refreshCall struct {
+	done  chan struct{}
+	token string
+	err   error
 }
 
 // ForceRefresh discards the current token and acquires a new one.
 // This is used when a 401 response indicates the token is invalid.
-func (tc *tokenCache) ForceRefresh() (string, error) {
+// Callers that arrive while a refresh is in flight share its result, so a
+// burst of 401s costs one token request.
+func (tc *tokenCache) ForceRefresh(ctx context.Context) (string, error) {
 	tc.mu.Lock()
-	defer tc.mu.Unlock()
-
 	tc.accessToken = ""
 	tc.expiresAt = time.Time{}
+	tc.mu.Unlock()
+
+	return tc.refresh(ctx)
+}
+
+// tokenEndpointError is a non-200 response from the token endpoint.
+type tokenEndpointError struct {
+	statusCode int
+	body       string
+	retryAfter string
+}
 
-	return tc.refresh()
+func (e *tokenEndpointError) Error() string {
+	return fmt.Sprintf("token endpoint returned %d: %s", e.statusCode, e.body)
 }
 
-// refresh acquires a new token from the OAuth2 token endpoint.
-// The caller must hold tc.mu.
-func (tc *tokenCache) refresh() (string, error) {
+// retryable reports whether the request may succeed if repeated: the
+// endpoint is throttling (429) or briefly unavailable (5xx). Other 4xx
+// responses, such as invalid_client, fail at once.
+func (e *tokenEndpointError) retryable() bool {
+	return e.statusCode == http.StatusTooManyRequests || e.statusCode >= 500
+}
+
+// refresh acquires a new token and caches it, starting a refresh unless
+// one is already in flight, and waits for its result or for ctx to end.
+// The refresh itself does not end with ctx, so one caller giving up does
+// not fail it for the others.
+func (tc *tokenCache) refresh(ctx context.Context) (string, error) {
+	tc.mu.Lock()
+	call := tc.refreshing
+	if call == nil {
+		call = &refreshCall{done: make(chan struct{})}
+		tc.refreshing = call
+		go tc.runRefresh(context.WithoutCancel(ctx), call)
+	}
+	tc.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.token, call.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// runRefresh fetches a token for call within refreshTimeout, caches it and
+// hands the result to the callers waiting for it.
+func (tc *tokenCache) runRefresh(ctx context.Context, call *refreshCall) {
+	ctx, cancel := context.WithTimeout(ctx, tc.refreshTimeout)
+	defer cancel()
+
+	token, expiresAt, err := tc.fetch(ctx)
+
+	tc.mu.Lock()
+	if err == nil {
+		tc.accessToken, tc.expiresAt = token, expiresAt
+	}
+	tc.refreshing = nil
+	tc.mu.Unlock()
+
+	call.token, call.err = token, err
+	close(call.done)
+}
+
+// fetch requests a token from the OAuth2 token endpoint, retrying
+// throttled and 5xx responses up to tokenMaxRetries times.
+func (tc *tokenCache) fetch(ctx context.Context) (string, time.Time, error) {
+	for attempt := 0; ; attempt++ {
+		token, expiresAt, err := tc.requestToken(ctx)
+		endpointErr, ok := err.(*tokenEndpointError)
+		if !ok || !endpointErr.retryable() || attempt >= tokenMaxRetries {
+			return token, expiresAt, err
+		}
+
+		delay := tc.retryDelay(endpointErr.retryAfter, attempt)
+		slog.Info("token endpoint unavailable, retrying",
+			"status", endpointErr.statusCode,
+			"delay", delay,
+		)
+		if err := sleepWithContext(ctx, delay); err != nil {
+			return "", time.Time{}, fmt.Errorf("token request cancelled during retry wait: %w", err)
+		}
+	}
+}
+
+// retryDelay returns the wait before retrying a token request: the
+// Retry-After seconds if given, capped at maxTokenRetryAfter, otherwise
+// exponential backoff from retryBaseDelay.
+func (tc *tokenCache) retryDelay(retryAfter string, attempt int) time.Duration {
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds > 0 {
+		return min(time.Duration(seconds)*time.Second, maxTokenRetryAfter)
+	}
+	return backoffDelay(tc.retryBaseDelay, attempt)
+}
+
+// requestToken makes a single token request, returning the token and
+// when it should be treated as expired.
+func (tc *tokenCache) requestToken(ctx context.Context) (string, time.Time, error) {
 	data := url.Values{
 		"grant_type":    {"client_credentials"},
 		"client_id":     {tc.clientID},
@@ -74,38 +259,40 @@ func (tc *tokenCache) refresh() (string, error) {
 		"scope":         {tc.scope},
 	}
 
-	req, err := http.NewRequest(http.MethodPost, tc.tokenURL, strings.NewReader(data.Encode()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tc.tokenURL, strings.NewReader(data.Encode()))
 	if err != nil {
-		return "", fmt.Errorf("failed to create token request: %w", err)
+		return "", time.Time{}, fmt.Errorf("failed to create token request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
 	resp, err := tc.httpClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("token request failed: %w", err)
+		return "", time.Time{}, fmt.Errorf("token request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("failed to read token response: %w", err)
+		return "", time.Time{}, fmt.Errorf("failed to read token response: %w", err)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("token endpoint returned %d: %s", resp.StatusCode, string(body))
+		return "", time.Time{}, &tokenEndpointError{
+			statusCode: resp.StatusCode,
+			body:       string(body),
+			retryAfter: resp.Header.Get("Retry-After"),
+		}
 	}
 
 	var tokenResp tokenResponse
 	if err := json.Unmarshal(body, &tokenResp); err != nil {
-		return "", fmt.Errorf("failed to parse token response: %w", err)
+		return "", time.Time{}, fmt.Errorf("failed to parse token response: %w", err)
 	}
 
 	if tokenResp.AccessToken == "" {
-		return "", fmt.Errorf("token response missing access_token")
+		return "", time.Time{}, fmt.Errorf("token response missing access_token")
 	}
 
-	tc.accessToken = tokenResp.AccessToken
-	tc.expiresAt = time.Now().Add(time.Duration(tokenResp.ExpiresIn)*time.Second - tokenExpiryBuffer)
-
-	return tc.accessToken, nil
+	expiresAt := time.Now().Add(time.Duration(tokenResp.ExpiresIn)*time.Second - tokenExpiryBuffer)
+	return tokenResp.AccessToken, expiresAt, nil
 }
@@ -1,7 +1,10 @@
 package graph
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"sync"
@@ -43,9 +46,9 @@ func TestTokenCache_AcquiresToken(t *testing.T) {
 	}))
 	defer server.Close()
 
-	tc := newTokenCache(server.URL, "test-client-id", "test-client-secret", server.Client())
+	tc := newTokenCache(server.URL, "test-client-id", "test-client-secret", defaultScope, server.Client())
 
-	token, err := tc.Token()
+	token, err := tc.Token(context.Background())
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -70,16 +73,16 @@ func TestTokenCache_CachesToken(t *testing.T) {
 	}))
 	defer server.Close()
 
-	tc := newTokenCache(server.URL, "cid", "csecret", server.Client())
+	tc := newTokenCache(server.URL, "cid", "csecret", defaultScope, server.Client())
 
 	// First call should hit the server
-	_, err := tc.Token()
+	_, err := tc.Token(context.Background())
 	if err != nil {
 		t.Fatalf("first call error: %v", err)
 	}
 
 	// Second call should use cache
-	token, err := tc.Token()
+	token, err := tc.Token(context.Background())
 	if err != nil {
 		t.Fatalf("second call error: %v", err)
 	}
@@ -108,16 +111,16 @@ func TestTokenCache_RefreshesExpiredToken(t *testing.T) {
 	}))
 	defer server.Close()
 
-	tc := newTokenCache(server.URL, "cid", "csecret", server.Client())
+	tc := newTokenCache(server.URL, "cid", "csecret", defaultScope, server.Client())
 
 	// First call
-	_, err := tc.Token()
+	_, err := tc.Token(context.Background())
 	if err != nil {
 		t.Fatalf("first call error: %v", err)
 	}
 
 	// Token should be expired (1s - 5min buffer = negative), so next call refreshes
-	_, err = tc.Token()
+	_, err = tc.Token(context.Background())
 	if err != nil {
 		t.Fatalf("second call error: %v", err)
 	}
@@ -143,16 +146,16 @@ func TestTokenCache_ForceRefresh(t *testing.T) {
 	}))
 	defer server.Close()
 
-	tc := newTokenCache(server.URL, "cid", "csecret", server.Client())
+	tc := newTokenCache(server.URL, "cid", "csecret", defaultScope, server.Client())
 
 	// First call
-	_, err := tc.Token()
+	_, err := tc.Token(context.Background())
 	if err != nil {
 		t.Fatalf("first call error: %v", err)
 	}
 
 	// Force refresh should bypass cache
-	token, err := tc.ForceRefresh()
+	token, err := tc.ForceRefresh(context.Background())
 	if err != nil {
 		t.Fatalf("force refresh error: %v", err)
 	}
@@ -185,7 +188,7 @@ func TestTokenCache_ConcurrentAccess(t *testing.T) {
 	}))
 	defer server.Close()
 
-	tc := newTokenCache(server.URL, "cid", "csecret", server.Client())
+	tc := newTokenCache(server.URL, "cid", "csecret", defaultScope, server.Client())
 
 	// Launch multiple goroutines requesting tokens concurrently
 	var wg sync.WaitGroup
@@ -197,7 +200,7 @@ func TestTokenCache_ConcurrentAccess(t *testing.T) {
 		wg.Add(1)
 		go func(idx int) {
 			defer wg.Done()
-			tokens[idx], errors[idx] = tc.Token()
+			tokens[idx], errors[idx] = tc.Token(context.Background())
 		}(i)
 	}
 
@@ -219,18 +222,207 @@ func TestTokenCache_ConcurrentAccess(t *testing.T) {
 func TestTokenCache_ServerError(t *testing.T) {
 	t.Parallel()
 
+	var callCount atomic.Int32
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount.Add(1)
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(`{"error": "internal server error"}`))
 	}))
 	defer server.Close()
 
-	tc := newTokenCache(server.URL, "cid", "csecret", server.Client())
+	tc := newTokenCache(server.URL, "cid", "csecret", defaultScope, server.Client())
+	tc.retryBaseDelay = time.Millisecond
 
-	_, err := tc.Token()
+	_, err := tc.Token(context.Background())
 	if err == nil {
 		t.Error("expected error for server error response, got nil")
 	}
+	if got := callCount.Load(); got != 1+tokenMaxRetries {
+		t.Errorf("token endpoint calls: got %d, want %d", got, 1+tokenMaxRetries)
+	}
+}
+
+func TestTokenCache_RetriesTransientErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+	}{
+		{"service unavailable", http.StatusServiceUnavailable, ""},
+		{"throttled", http.StatusTooManyRequests, "1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			var callCount atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if callCount.Add(1) == 1 {
+					if tt.retryAfter != "" {
+						w.Header().Set("Retry-After", tt.retryAfter)
+					}
+					w.WriteHeader(tt.status)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(tokenResponse{
+					AccessToken: "recovered-token",
+					ExpiresIn:   3600,
+					TokenType:   "Bearer",
+				})
+			}))
+			defer server.Close()
+
+			tc := newTokenCache(server.URL, "cid", "csecret", defaultScope, server.Client())
+			tc.retryBaseDelay = time.Millisecond
+
+			token, err := tc.Token(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if token != "recovered-token" {
+				t.Errorf("token: got %q, want %q", token, "recovered-token")
+			}
+			if got := callCount.Load(); got != 2 {
+				t.Errorf("token endpoint calls: got %d, want 2", got)
+			}
+		})
+	}
+}
+
+func TestTokenCache_ClientErrorNotRetried(t *testing.T) {
+	t.Parallel()
+
+	var callCount atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount.Add(1)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error": "invalid_client"}`))
+	}))
+	defer server.Close()
+
+	tc := newTokenCache(server.URL, "cid", "csecret", defaultScope, server.Client())
+	tc.retryBaseDelay = time.Millisecond
+
+	if _, err := tc.Token(context.Background()); err == nil {
+		t.Fatal("expected error for invalid_client, got nil")
+	}
+	if got := callCount.Load(); got != 1 {
+		t.Errorf("token endpoint calls: got %d, want 1", got)
+	}
+}
+
+func TestTokenCache_RetryWaitHonorsContext(t *testing.T) {
+	t.Parallel()
+
+	// The endpoint asks for a 10s pause, far longer than callers wait
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "10")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	tc := newTokenCache(server.URL, "cid", "csecret", defaultScope, server.Client())
+	tc.refreshTimeout = 500 * time.Millisecond
+
+	// Two callers: one starting the refresh, one joining it
+	start := time.Now()
+	errs := make(chan error, 2)
+	for range 2 {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			_, err := tc.Token(ctx)
+			errs <- err
+		}()
+	}
+	for range 2 {
+		if err := <-errs; !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Token: got error %v, want context.DeadlineExceeded", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Token returned after %s, want soon after the 200ms deadline", elapsed)
+	}
+
+	// The abandoned refresh ends at its own timeout rather than blocking
+	// later refreshes
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		tc.mu.Lock()
+		refreshing := tc.refreshing != nil
+		tc.mu.Unlock()
+		if !refreshing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("refresh still in progress well after its timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTokenCache_LeaderCancelDoesNotFailFollowers(t *testing.T) {
+	t.Parallel()
+
+	var callCount atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount.Add(1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tokenResponse{
+			AccessToken: "shared-token",
+			ExpiresIn:   3600,
+			TokenType:   "Bearer",
+		})
+	}))
+	defer server.Close()
+
+	tc := newTokenCache(server.URL, "id", "secret", defaultScope, server.Client())
+
+	// The leader starts the refresh, then its session ends
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := tc.Token(leaderCtx)
+		leaderErr <- err
+	}()
+	for callCount.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	const followers = 5
+	type result struct {
+		token string
+		err   error
+	}
+	results := make(chan result, followers)
+	for range followers {
+		go func() {
+			token, err := tc.ForceRefresh(context.Background())
+			results <- result{token, err}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	cancelLeader()
+	if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("leader: got error %v, want context.Canceled", err)
+	}
+
+	close(release)
+	for range followers {
+		if r := <-results; r.err != nil || r.token != "shared-token" {
+			t.Errorf("follower: got (%q, %v), want (%q, nil)", r.token, r.err, "shared-token")
+		}
+	}
+	if got := callCount.Load(); got != 1 {
+		t.Errorf("token endpoint called %d times, want 1", got)
+	}
 }
 
 func TestTokenCache_EmptyAccessToken(t *testing.T) {
@@ -245,10 +437,130 @@ func TestTokenCache_EmptyAccessToken(t *testing.T) {
 	}))
 	defer server.Close()
 
-	tc := newTokenCache(server.URL, "cid", "csecret", server.Client())
+	tc := newTokenCache(server.URL, "cid", "csecret", defaultScope, server.Client())
 
-	_, err := tc.Token()
+	_, err := tc.Token(context.Background())
 	if err == nil {
 		t.Error("expected error for empty access token, got nil")
 	}
 }
+
+func TestTokenCache_BackgroundRefresh(t *testing.T) {
+	t.Parallel()
+
+	var callCount atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := callCount.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		// Just over tokenExpiryBuffer: the token is good for about a second
+		json.NewEncoder(w).Encode(tokenResponse{
+			AccessToken: fmt.Sprintf("token-%d", n),
+			ExpiresIn:   int64(tokenExpiryBuffer/time.Second) + 1,
+			TokenType:   "Bearer",
+		})
+	}))
+	defer server.Close()
+
+	tc := newTokenCache(server.URL, "id", "secret", defaultScope, server.Client())
+	tc.refreshLead = 900 * time.Millisecond
+	tc.minRefreshInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tc.runRefresher(ctx)
+
+	// The first fetch happens at once; the second only because the token
+	// is about to expire, with no Token call to trigger it.
+	deadline := time.Now().Add(3 * time.Second)
+	for callCount.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("token endpoint called %d times, want at least 2", callCount.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Let the second fetch store its token
+	for {
+		tc.mu.Lock()
+		refreshing := tc.refreshing != nil
+		tc.mu.Unlock()
+		if !refreshing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	calls := callCount.Load()
+	token, err := tc.Token(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if token == "token-1" {
+		t.Errorf("token: got %q, want a refreshed token", token)
+	}
+	if got := callCount.Load(); got > calls+1 {
+		t.Errorf("Token fetched its own token: endpoint calls went from %d to %d", calls, got)
+	}
+
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	stopped := callCount.Load()
+	time.Sleep(300 * time.Millisecond)
+	if got := callCount.Load(); got != stopped {
+		t.Errorf("refresher kept running after cancel: calls went from %d to %d", stopped, got)
+	}
+}
+
+func TestTokenCache_ConcurrentForceRefresh(t *testing.T) {
+	t.Parallel()
+
+	var callCount atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callCount.Add(1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tokenResponse{
+			AccessToken: "forced-token",
+			ExpiresIn:   3600,
+			TokenType:   "Bearer",
+		})
+	}))
+	defer server.Close()
+
+	tc := newTokenCache(server.URL, "id", "secret", defaultScope, server.Client())
+
+	const goroutines = 20
+	var started, wg sync.WaitGroup
+	started.Add(goroutines)
+	wg.Add(goroutines)
+	errs := make(chan error, goroutines)
+
+	for range goroutines {
+		go func() {
+			defer wg.Done()
+			started.Done()
+			token, err := tc.ForceRefresh(context.Background())
+			if err != nil {
+				errs <- err
+				return
+			}
+			if token != "forced-token" {
+				errs <- fmt.Errorf("token: got %q, want %q", token, "forced-token")
+			}
+		}()
+	}
+
+	// Hold the token response until every goroutine has joined the refresh
+	started.Wait()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if got := callCount.Load(); got != 1 {
+		t.Errorf("token endpoint called %d times, want 1", got)
+	}
+}
@@ -2,16 +2,23 @@ package graph
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+
 	"github.com/shineum/smtp-proxy-lite/internal/email"
+	"github.com/shineum/smtp-proxy-lite/internal/provider"
 )
 
 // GraphProviderConfig holds the configuration for creating a GraphProvider.
@@ -20,58 +27,139 @@ type GraphProviderConfig struct {
 	ClientID     string
 	ClientSecret string
 	Sender       string
+
+	// PreserveFrom shows the message's own From address to recipients,
+	// with Sender as the mailbox sending on its behalf. The Graph
+	// application needs "Send As" or "Send on Behalf" rights for it.
+	PreserveFrom bool
+
+	// SaveToSentItems keeps a copy of each message in the sender's Sent
+	// Items folder.
+	SaveToSentItems bool
+
+	// AllowSenderOverride sends each message from the mailbox in its From
+	// address when that address matches AllowedSenders (exact addresses,
+	// or "*@domain" for any mailbox in a domain). Other messages are sent
+	// from Sender.
+	AllowSenderOverride bool
+	AllowedSenders      []string
+
+	// MaxRetries is the number of retries after a transient failure; nil
+	// uses the default of 3, and zero disables retries. RetryBaseDelay is
+	// the first backoff delay, doubled on each retry; zero uses 1s.
+	MaxRetries     *int
+	RetryBaseDelay time.Duration
+
+	// AuthorityHost, BaseURL and Scope select the cloud: the Azure AD
+	// login host, the Graph API root and the OAuth2 scope requested.
+	// Empty values use the global (commercial) cloud.
+	AuthorityHost string
+	BaseURL       string
+	Scope         string
 }
 
-// maxRetries is the maximum number of retry attempts for transient failures.
-const maxRetries = 3
+// defaultMaxRetries is the default maximum number of retry attempts for
+// transient failures.
+const defaultMaxRetries = 3
+
+// defaultRetryBaseDelay is the default initial delay for exponential backoff.
+const defaultRetryBaseDelay = 1 * time.Second
+
+// Endpoints of the global Azure cloud. Sovereign clouds (US Government,
+// China) have their own.
+const (
+	defaultAuthorityHost = "https://login.microsoftonline.com"
+	defaultGraphBaseURL  = "https://graph.microsoft.com/v1.0"
+	defaultScope         = "https://graph.microsoft.com/.default"
+)
+
+// messageSizeExceededCode is the Graph error code for a message over the
+// mailbox's size limit.
+const messageSizeExceededCode = "ErrorMessageSizeExceeded"
 
-// baseRetryDelay is the initial delay for exponential backoff.
-const baseRetryDelay = 1 * time.Second
+// tooLargeMessage explains a message rejected for its size. sendMail takes
+// the whole message in one request, about 4 MB once base64 encoded.
+const tooLargeMessage = "message exceeds the Graph sendMail size limit (about 4 MB); " +
+	"larger attachments need an upload session"
+
+// invalidHeaderCode is the Graph error code returned when
+// internetMessageHeaders contains a header Graph does not accept.
+const invalidHeaderCode = "InvalidInternetMessageHeader"
 
 // GraphProvider sends emails via the Microsoft Graph API using OAuth2
 // client credentials authentication.
 // @MX:ANCHOR: [AUTO] External system integration point for Microsoft Graph API
 // @MX:REASON: All email delivery flows through this provider when Graph is configured
 type GraphProvider struct {
-	sender     string
-	graphURL   string
-	httpClient *http.Client
-	token      *tokenCache
+	sender          string
+	preserveFrom    bool
+	saveToSentItems bool
+	maxRetries      int
+	retryBaseDelay  time.Duration
+	graphBaseURL    string
+	httpClient      *http.Client
+	token           *tokenCache
+
+	// allowSenderOverride and allowedSenders select the sending mailbox
+	// from each message's From address.
+	allowSenderOverride bool
+	allowedSenders      []string
+
+	// standardHeadersRejected is set once Graph refuses forwarded headers
+	// without an "x-" prefix (such as Thread-Index); later messages are
+	// sent without them.
+	standardHeadersRejected atomic.Bool
 }
 
 // New creates a new GraphProvider with the given configuration.
 func New(cfg GraphProviderConfig) *GraphProvider {
 	tokenURL := fmt.Sprintf(
-		"https://login.microsoftonline.com/%s/oauth2/v2.0/token",
+		"%s/%s/oauth2/v2.0/token",
+		strings.TrimSuffix(cmp.Or(cfg.AuthorityHost, defaultAuthorityHost), "/"),
 		cfg.TenantID,
 	)
+	graphBaseURL := strings.TrimSuffix(cmp.Or(cfg.BaseURL, defaultGraphBaseURL), "/")
 
 	client := &http.Client{Timeout: 30 * time.Second}
 
-	return &GraphProvider{
-		sender:     cfg.Sender,
-		graphURL:   fmt.Sprintf("https://graph.microsoft.com/v1.0/users/%s/sendMail", cfg.Sender),
-		httpClient: client,
-		token:      newTokenCache(tokenURL, cfg.ClientID, cfg.ClientSecret, client),
-	}
+	return newWithOverrides(cfg, graphBaseURL, tokenURL, client)
+}
+
+// StartTokenRefresh starts a goroutine that renews the OAuth2 token
+// shortly before it expires, so sends rarely wait on the token endpoint.
+// The goroutine stops when ctx is cancelled.
+func (p *GraphProvider) StartTokenRefresh(ctx context.Context) {
+	go p.token.runRefresher(ctx)
 }
 
 // newWithOverrides creates a GraphProvider with custom URLs and HTTP client,
-// used for testing.
-func newWithOverrides(cfg GraphProviderConfig, graphURL, tokenURL string, client *http.Client) *GraphProvider {
+// used for testing. graphBaseURL replaces the Graph API root.
+func newWithOverrides(cfg GraphProviderConfig, graphBaseURL, tokenURL string, client *http.Client) *GraphProvider {
 	return &GraphProvider{
-		sender:     cfg.Sender,
-		graphURL:   graphURL,
-		httpClient: client,
-		token:      newTokenCache(tokenURL, cfg.ClientID, cfg.ClientSecret, client),
+		sender:          cfg.Sender,
+		preserveFrom:    cfg.PreserveFrom,
+		saveToSentItems: cfg.SaveToSentItems,
+		maxRetries:      maxRetries(cfg.MaxRetries),
+		retryBaseDelay:  cmp.Or(cfg.RetryBaseDelay, defaultRetryBaseDelay),
+		graphBaseURL:    graphBaseURL,
+		httpClient:      client,
+		token:           newTokenCache(tokenURL, cfg.ClientID, cfg.ClientSecret, cmp.Or(cfg.Scope, defaultScope), client),
+
+		allowSenderOverride: cfg.AllowSenderOverride,
+		allowedSenders:      cfg.AllowedSenders,
 	}
 }
 
 // Send delivers an email message via the Microsoft Graph API.
 // It includes retry logic with exponential backoff for transient failures,
 // Retry-After header respect for HTTP 429, and automatic token refresh for HTTP 401.
+// With PreserveFrom, the message's From address is shown to recipients.
+// With AllowSenderOverride, an allowed From mailbox sends the message itself.
+// Forwarded threading and unsubscribe headers are attempted first; if Graph
+// rejects them, the message is resent without them.
 func (g *GraphProvider) Send(ctx context.Context, msg *email.Email) error {
-	reqBody := buildSendMailRequest(msg)
+	mailbox := g.mailbox(msg)
+	reqBody := g.buildRequest(msg)
 	bodyJSON, err := json.Marshal(reqBody)
 	if err != nil {
 		return fmt.Errorf("failed to marshal request body: %w", err)
@@ -80,15 +168,15 @@ func (g *GraphProvider) Send(ctx context.Context, msg *email.Email) error {
 	var lastErr error
 	tokenRefreshed := false
 
-	for attempt := 0; attempt <= maxRetries; attempt++ {
+	for attempt := 0; attempt <= g.maxRetries; attempt++ {
 		if attempt > 0 {
 			slog.Debug("retrying Graph API request",
 				"attempt", attempt,
-				"max_retries", maxRetries,
+				"max_retries", g.maxRetries,
 			)
 		}
 
-		err := g.doSendRequest(ctx, bodyJSON)
+		err := g.doSendRequest(ctx, mailbox, bodyJSON)
 		if err == nil {
 			return nil
 		}
@@ -101,17 +189,31 @@ func (g *GraphProvider) Send(ctx context.Context, msg *email.Email) error {
 		}
 
 		switch {
+		case graphErr.code == invalidHeaderCode && reqBody.Message.withoutStandardHeaders():
+			// Graph only accepts "x-" headers; resend without the others
+			slog.Warn("Graph API rejected forwarded headers, sending without them",
+				"error", graphErr.message,
+			)
+			g.standardHeadersRejected.Store(true)
+			if bodyJSON, err = json.Marshal(reqBody); err != nil {
+				return fmt.Errorf("failed to marshal request body: %w", err)
+			}
+			continue
 		case graphErr.permanent:
 			return graphErr
 		case graphErr.statusCode == http.StatusUnauthorized && !tokenRefreshed:
 			// Refresh token once and retry immediately
 			slog.Info("refreshing Graph API token after 401")
-			if _, refreshErr := g.token.ForceRefresh(); refreshErr != nil {
+			if _, refreshErr := g.token.ForceRefresh(ctx); refreshErr != nil {
 				return fmt.Errorf("token refresh failed: %w", refreshErr)
 			}
 			tokenRefreshed = true
 			continue
 		case graphErr.statusCode == http.StatusTooManyRequests:
+			if attempt == g.maxRetries {
+				// No retries left, so don't wait for one
+				continue
+			}
 			delay := g.retryAfterDelay(graphErr.retryAfter, attempt)
 			slog.Info("rate limited by Graph API",
 				"retry_after", delay,
@@ -121,7 +223,10 @@ func (g *GraphProvider) Send(ctx context.Context, msg *email.Email) error {
 			}
 			continue
 		case graphErr.transient:
-			delay := backoffDelay(attempt)
+			if attempt == g.maxRetries {
+				continue
+			}
+			delay := backoffDelay(g.retryBaseDelay, attempt)
 			slog.Info("transient Graph API error, retrying",
 				"status", graphErr.statusCode,
 				"delay", delay,
@@ -135,7 +240,57 @@ func (g *GraphProvider) Send(ctx context.Context, msg *email.Email) error {
 		}
 	}
 
-	return fmt.Errorf("Graph API request failed after %d retries: %w", maxRetries, lastErr)
+	return fmt.Errorf("Graph API request failed after %d retries: %w", g.maxRetries, lastErr)
+}
+
+// BuildRequest returns the sendMail request body Send would post for msg,
+// without sending it.
+func (g *GraphProvider) BuildRequest(msg *email.Email) (any, error) {
+	return g.buildRequest(msg), nil
+}
+
+// buildRequest builds the sendMail request body for msg with this
+// provider's settings applied.
+func (g *GraphProvider) buildRequest(msg *email.Email) *sendMailRequest {
+	reqBody := buildSendMailRequest(msg, g.saveToSentItems)
+	if mailbox := g.mailbox(msg); g.preserveFrom && msg.From != "" && !strings.EqualFold(msg.From, mailbox) {
+		reqBody.Message.From = newRecipient(msg.From)
+		reqBody.Message.Sender = newRecipient(mailbox)
+	}
+	if g.standardHeadersRejected.Load() {
+		reqBody.Message.withoutStandardHeaders()
+	}
+	return reqBody
+}
+
+// mailbox returns the mailbox msg is sent from: its From address when
+// sender override is enabled and the address is allowed, otherwise the
+// configured sender.
+func (g *GraphProvider) mailbox(msg *email.Email) string {
+	if g.allowSenderOverride && msg.From != "" && senderAllowed(g.allowedSenders, msg.From) {
+		return msg.From
+	}
+	return g.sender
+}
+
+// senderAllowed reports whether addr matches an entry of allowed: an exact
+// address or "*@domain", compared case-insensitively.
+func senderAllowed(allowed []string, addr string) bool {
+	_, domain, _ := strings.Cut(addr, "@")
+	for _, entry := range allowed {
+		if strings.EqualFold(entry, addr) {
+			return true
+		}
+		if d, ok := strings.CutPrefix(entry, "*@"); ok && domain != "" && strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendMailURL returns the sendMail endpoint for mailbox.
+func (g *GraphProvider) sendMailURL(mailbox string) string {
+	return g.graphBaseURL + "/users/" + url.PathEscape(mailbox) + "/sendMail"
 }
 
 // Name returns the provider name.
@@ -143,14 +298,18 @@ func (g *GraphProvider) Name() string {
 	return "msgraph"
 }
 
-// doSendRequest performs a single HTTP request to the Graph API sendMail endpoint.
-func (g *GraphProvider) doSendRequest(ctx context.Context, bodyJSON []byte) error {
-	token, err := g.token.Token()
+// doSendRequest performs a single HTTP request to the sendMail endpoint of
+// mailbox, traced as a span.
+func (g *GraphProvider) doSendRequest(ctx context.Context, mailbox string, bodyJSON []byte) (err error) {
+	ctx, span := provider.StartSpan(ctx, "graph.sendMail", attribute.String("graph.mailbox", mailbox))
+	defer func() { provider.EndSpan(span, err) }()
+
+	token, err := g.token.Token(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to get access token: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.graphURL, bytes.NewReader(bodyJSON))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.sendMailURL(mailbox), bytes.NewReader(bodyJSON))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
@@ -165,6 +324,7 @@ func (g *GraphProvider) doSendRequest(ctx context.Context, bodyJSON []byte) erro
 		}
 	}
 	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
 
 	// HTTP 202 Accepted is success for sendMail
 	if resp.StatusCode == http.StatusAccepted || resp.StatusCode == http.StatusOK {
@@ -175,26 +335,51 @@ func (g *GraphProvider) doSendRequest(ctx context.Context, bodyJSON []byte) erro
 
 	var graphErrResp graphErrorResponse
 	if jsonErr := json.Unmarshal(body, &graphErrResp); jsonErr == nil && graphErrResp.Error.Message != "" {
-		return classifyError(resp.StatusCode, graphErrResp.Error.Message, resp.Header.Get("Retry-After"))
+		sendErr := classifyError(resp.StatusCode, graphErrResp.Error.Message, resp.Header.Get("Retry-After"))
+		sendErr.code = graphErrResp.Error.Code
+		if sendErr.code == messageSizeExceededCode {
+			sendErr.message = tooLargeMessage
+			sendErr.tooLarge, sendErr.permanent, sendErr.transient = true, true, false
+		}
+		return sendErr
 	}
 
 	return classifyError(resp.StatusCode, string(body), resp.Header.Get("Retry-After"))
 }
 
 // sendError represents an error from the Graph API send operation with
-// classification for retry logic.
+// classification for retry logic. It implements provider.PermanentError.
 type sendError struct {
 	message    string
+	code       string
 	statusCode int
 	permanent  bool
 	transient  bool
 	retryAfter string
+
+	// tooLarge marks a message refused for its size.
+	tooLarge bool
 }
 
 func (e *sendError) Error() string {
 	return fmt.Sprintf("Graph API error (HTTP %d): %s", e.statusCode, e.message)
 }
 
+// Unwrap returns a provider.MessageTooLargeError for a message refused for
+// its size, so the SMTP session can reply 552.
+func (e *sendError) Unwrap() error {
+	if e.tooLarge {
+		return &provider.MessageTooLargeError{Reason: "Message too big for Graph sendMail"}
+	}
+	return nil
+}
+
+// Permanent reports whether the error is a permanent failure that should not
+// be retried or delivered through a fallback provider.
+func (e *sendError) Permanent() bool {
+	return e.permanent
+}
+
 // classifyError categorizes an HTTP error response for retry decisions.
 func classifyError(statusCode int, message, retryAfter string) *sendError {
 	err := &sendError{
@@ -204,6 +389,10 @@ func classifyError(statusCode int, message, retryAfter string) *sendError {
 	}
 
 	switch {
+	case statusCode == http.StatusRequestEntityTooLarge:
+		err.message = tooLargeMessage
+		err.permanent = true
+		err.tooLarge = true
 	case statusCode == http.StatusBadRequest || statusCode == http.StatusForbidden:
 		err.permanent = true
 	case statusCode == http.StatusUnauthorized:
@@ -223,7 +412,7 @@ func classifyError(statusCode int, message, retryAfter string) *sendError {
 // Falls back to exponential backoff if the header is missing or unparseable.
 func (g *GraphProvider) retryAfterDelay(retryAfter string, attempt int) time.Duration {
 	if retryAfter == "" {
-		return backoffDelay(attempt)
+		return backoffDelay(g.retryBaseDelay, attempt)
 	}
 
 	seconds, err := strconv.Atoi(retryAfter)
@@ -231,13 +420,13 @@ func (g *GraphProvider) retryAfterDelay(retryAfter string, attempt int) time.Dur
 		return time.Duration(seconds) * time.Second
 	}
 
-	return backoffDelay(attempt)
+	return backoffDelay(g.retryBaseDelay, attempt)
 }
 
-// backoffDelay returns the exponential backoff delay for the given attempt number.
-// Delays are: 1s, 2s, 4s
-func backoffDelay(attempt int) time.Duration {
-	delay := baseRetryDelay
+// backoffDelay returns the exponential backoff delay for the given attempt
+// number, starting from base. With the default base, delays are: 1s, 2s, 4s
+func backoffDelay(base time.Duration, attempt int) time.Duration {
+	delay := base
 	for i := 0; i < attempt; i++ {
 		delay *= 2
 	}
@@ -253,3 +442,12 @@ func sleepWithContext(ctx context.Context, d time.Duration) error {
 		return nil
 	}
 }
+
+// maxRetries returns the configured retry count, or defaultMaxRetries if
+// none is configured.
+func maxRetries(configured *int) int {
+	if configured == nil {
+		return defaultMaxRetries
+	}
+	return *configured
+}
@@ -3,13 +3,22 @@ package graph
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+
 	"github.com/shineum/smtp-proxy-lite/internal/email"
+	"github.com/shineum/smtp-proxy-lite/internal/provider"
 )
 
 func TestBuildSendMailRequest_BasicEmail(t *testing.T) {
@@ -22,7 +31,7 @@ func TestBuildSendMailRequest_BasicEmail(t *testing.T) {
 		TextBody: "Hello, World!",
 	}
 
-	req := buildSendMailRequest(msg)
+	req := buildSendMailRequest(msg, true)
 
 	if req.Message.Subject != "Test Subject" {
 		t.Errorf("Subject: got %q, want %q", req.Message.Subject, "Test Subject")
@@ -60,7 +69,7 @@ func TestBuildSendMailRequest_HTMLBody(t *testing.T) {
 		HtmlBody: "<p>HTML content</p>",
 	}
 
-	req := buildSendMailRequest(msg)
+	req := buildSendMailRequest(msg, true)
 
 	if req.Message.Body.ContentType != "html" {
 		t.Errorf("Body.ContentType: got %q, want %q", req.Message.Body.ContentType, "html")
@@ -86,7 +95,7 @@ func TestBuildSendMailRequest_WithAttachments(t *testing.T) {
 		},
 	}
 
-	req := buildSendMailRequest(msg)
+	req := buildSendMailRequest(msg, true)
 
 	if len(req.Message.Attachments) != 1 {
 		t.Fatalf("Attachments count: got %d, want 1", len(req.Message.Attachments))
@@ -117,7 +126,7 @@ func TestBuildSendMailRequest_WithCc(t *testing.T) {
 		TextBody: "Hello",
 	}
 
-	req := buildSendMailRequest(msg)
+	req := buildSendMailRequest(msg, true)
 
 	if len(req.Message.CcRecipients) != 2 {
 		t.Fatalf("CcRecipients count: got %d, want 2", len(req.Message.CcRecipients))
@@ -127,6 +136,202 @@ func TestBuildSendMailRequest_WithCc(t *testing.T) {
 	}
 }
 
+func TestBuildSendMailRequest_WithBcc(t *testing.T) {
+	t.Parallel()
+
+	msg := &email.Email{
+		To:       []string{"alice@example.com"},
+		Bcc:      []string{"hidden@example.com"},
+		Subject:  "With BCC",
+		TextBody: "Hello",
+		RawHeaders: map[string][]string{
+			"Bcc": {"hidden@example.com"},
+		},
+	}
+
+	req := buildSendMailRequest(msg, true)
+
+	if len(req.Message.BccRecipients) != 1 {
+		t.Fatalf("BccRecipients count: got %d, want 1", len(req.Message.BccRecipients))
+	}
+	if req.Message.BccRecipients[0].EmailAddress.Address != "hidden@example.com" {
+		t.Errorf("BccRecipients[0]: got %q, want %q", req.Message.BccRecipients[0].EmailAddress.Address, "hidden@example.com")
+	}
+	// The original Bcc header must not be forwarded to the other recipients
+	for _, h := range req.Message.InternetMessageHeaders {
+		if strings.Contains(h.Value, "hidden@example.com") {
+			t.Errorf("internetMessageHeaders exposes the Bcc recipient: %s: %s", h.Name, h.Value)
+		}
+	}
+}
+
+func TestBuildSendMailRequest_Sender(t *testing.T) {
+	t.Parallel()
+
+	msg := &email.Email{
+		From:     "author@example.com",
+		Sender:   "Assistant <assistant@example.com>",
+		To:       []string{"alice@example.com"},
+		TextBody: "Hello",
+	}
+
+	req := buildSendMailRequest(msg, true)
+
+	if req.Message.Sender == nil {
+		t.Fatal("Sender: got nil, want the message's Sender")
+	}
+	if got := req.Message.Sender.EmailAddress; got.Address != "assistant@example.com" || got.Name != "Assistant" {
+		t.Errorf("Sender: got %+v, want Assistant <assistant@example.com>", got)
+	}
+
+	msg.Sender = ""
+	if req := buildSendMailRequest(msg, true); req.Message.Sender != nil {
+		t.Errorf("Sender without a Sender header: got %+v, want nil", req.Message.Sender)
+	}
+}
+
+func TestBuildSendMailRequest_Importance(t *testing.T) {
+	t.Parallel()
+
+	for _, importance := range []string{email.ImportanceHigh, email.ImportanceNormal, email.ImportanceLow} {
+		msg := &email.Email{To: []string{"alice@example.com"}, TextBody: "Hello", Importance: importance}
+
+		data, err := json.Marshal(buildSendMailRequest(msg, true))
+		if err != nil {
+			t.Fatalf("JSON marshal error: %v", err)
+		}
+		var decoded sendMailRequest
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("JSON unmarshal error: %v", err)
+		}
+		if decoded.Message.Importance != importance {
+			t.Errorf("importance: got %q, want %q", decoded.Message.Importance, importance)
+		}
+	}
+
+	data, err := json.Marshal(buildSendMailRequest(&email.Email{To: []string{"alice@example.com"}}, true))
+	if err != nil {
+		t.Fatalf("JSON marshal error: %v", err)
+	}
+	if strings.Contains(string(data), `"importance"`) {
+		t.Errorf("importance should be omitted when unset, got: %s", data)
+	}
+}
+
+func TestBuildSendMailRequest_ThreadHeaders(t *testing.T) {
+	t.Parallel()
+
+	msg := &email.Email{
+		To:       []string{"alice@example.com"},
+		Subject:  "RE: Planning",
+		TextBody: "Hello",
+		RawHeaders: map[string][]string{
+			"Thread-Index": {"AdnQ1234abcd=="},
+			"Thread-Topic": {"Planning"},
+			"Received":     {"from somewhere"},
+		},
+	}
+
+	req := buildSendMailRequest(msg, true)
+
+	want := []internetMessageHeader{
+		{Name: "Thread-Index", Value: "AdnQ1234abcd=="},
+		{Name: "Thread-Topic", Value: "Planning"},
+	}
+	got := req.Message.InternetMessageHeaders
+	if len(got) != len(want) {
+		t.Fatalf("InternetMessageHeaders: got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("InternetMessageHeaders[%d]: got %v, want %v", i, got[i], want[i])
+		}
+	}
+
+	// Messages without threading headers carry none
+	plain := buildSendMailRequest(&email.Email{To: []string{"alice@example.com"}}, true)
+	if plain.Message.InternetMessageHeaders != nil {
+		t.Errorf("InternetMessageHeaders: got %v, want nil", plain.Message.InternetMessageHeaders)
+	}
+}
+
+func TestBuildSendMailRequest_CustomHeaders(t *testing.T) {
+	t.Parallel()
+
+	msg := &email.Email{
+		To:       []string{"alice@example.com"},
+		Subject:  "Custom headers",
+		TextBody: "Hello",
+		RawHeaders: map[string][]string{
+			"X-Mailer":      {"batch-mailer 2.1"},
+			"X-Campaign-Id": {"spring-2024"},
+			"Received":      {"from relay.example.com"},
+			"Content-Type":  {"text/plain"},
+			"Subject":       {"Custom headers"},
+		},
+	}
+
+	data, err := json.Marshal(buildSendMailRequest(msg, true))
+	if err != nil {
+		t.Fatalf("JSON marshal error: %v", err)
+	}
+	var decoded sendMailRequest
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("JSON unmarshal error: %v", err)
+	}
+
+	want := []internetMessageHeader{
+		{Name: "X-Campaign-Id", Value: "spring-2024"},
+		{Name: "X-Mailer", Value: "batch-mailer 2.1"},
+	}
+	got := decoded.Message.InternetMessageHeaders
+	if len(got) != len(want) {
+		t.Fatalf("InternetMessageHeaders: got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("InternetMessageHeaders[%d]: got %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestBuildSendMailRequest_ListUnsubscribeHeaders(t *testing.T) {
+	t.Parallel()
+
+	msg := &email.Email{
+		To:       []string{"alice@example.com"},
+		Subject:  "Newsletter",
+		TextBody: "Hello",
+		RawHeaders: map[string][]string{
+			"List-Unsubscribe":      {"<https://example.com/unsub?id=42>, <mailto:unsub@example.com>"},
+			"List-Unsubscribe-Post": {"List-Unsubscribe=One-Click"},
+		},
+	}
+
+	data, err := json.Marshal(buildSendMailRequest(msg, true))
+	if err != nil {
+		t.Fatalf("JSON marshal error: %v", err)
+	}
+	var decoded sendMailRequest
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("JSON unmarshal error: %v", err)
+	}
+
+	want := []internetMessageHeader{
+		{Name: "List-Unsubscribe", Value: "<https://example.com/unsub?id=42>, <mailto:unsub@example.com>"},
+		{Name: "List-Unsubscribe-Post", Value: "List-Unsubscribe=One-Click"},
+	}
+	got := decoded.Message.InternetMessageHeaders
+	if len(got) != len(want) {
+		t.Fatalf("InternetMessageHeaders: got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("InternetMessageHeaders[%d]: got %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
 func TestBuildSendMailRequest_JSONMarshaling(t *testing.T) {
 	t.Parallel()
 
@@ -136,7 +341,7 @@ func TestBuildSendMailRequest_JSONMarshaling(t *testing.T) {
 		TextBody: "Body",
 	}
 
-	req := buildSendMailRequest(msg)
+	req := buildSendMailRequest(msg, true)
 	data, err := json.Marshal(req)
 	if err != nil {
 		t.Fatalf("JSON marshal error: %v", err)
@@ -152,6 +357,31 @@ func TestBuildSendMailRequest_JSONMarshaling(t *testing.T) {
 	}
 }
 
+func TestBuildSendMailRequest_SaveToSentItems(t *testing.T) {
+	t.Parallel()
+
+	msg := &email.Email{To: []string{"user@example.com"}, TextBody: "Body"}
+
+	for _, save := range []bool{true, false} {
+		data, err := json.Marshal(buildSendMailRequest(msg, save))
+		if err != nil {
+			t.Fatalf("JSON marshal error: %v", err)
+		}
+
+		var decoded map[string]any
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("JSON unmarshal error: %v", err)
+		}
+		got, ok := decoded["saveToSentItems"]
+		if !ok {
+			t.Fatalf("saveToSentItems missing from request JSON: %s", data)
+		}
+		if got != save {
+			t.Errorf("saveToSentItems: got %v, want %v", got, save)
+		}
+	}
+}
+
 func TestGraphProvider_Name(t *testing.T) {
 	t.Parallel()
 
@@ -161,6 +391,56 @@ func TestGraphProvider_Name(t *testing.T) {
 	}
 }
 
+func TestNew_CloudEndpoints(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		cfg          GraphProviderConfig
+		wantTokenURL string
+		wantSendURL  string
+		wantScope    string
+	}{
+		{
+			name:         "global cloud by default",
+			cfg:          GraphProviderConfig{TenantID: "tenant", Sender: "s@example.com"},
+			wantTokenURL: "https://login.microsoftonline.com/tenant/oauth2/v2.0/token",
+			wantSendURL:  "https://graph.microsoft.com/v1.0/users/s@example.com/sendMail",
+			wantScope:    "https://graph.microsoft.com/.default",
+		},
+		{
+			name: "US Government cloud",
+			cfg: GraphProviderConfig{
+				TenantID:      "tenant",
+				Sender:        "s@example.com",
+				AuthorityHost: "https://login.microsoftonline.us/",
+				BaseURL:       "https://graph.microsoft.us/v1.0/",
+				Scope:         "https://graph.microsoft.us/.default",
+			},
+			wantTokenURL: "https://login.microsoftonline.us/tenant/oauth2/v2.0/token",
+			wantSendURL:  "https://graph.microsoft.us/v1.0/users/s@example.com/sendMail",
+			wantScope:    "https://graph.microsoft.us/.default",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			p := New(tt.cfg)
+			if p.token.tokenURL != tt.wantTokenURL {
+				t.Errorf("token URL: got %q, want %q", p.token.tokenURL, tt.wantTokenURL)
+			}
+			if got := p.sendMailURL(tt.cfg.Sender); got != tt.wantSendURL {
+				t.Errorf("sendMail URL: got %q, want %q", got, tt.wantSendURL)
+			}
+			if p.token.scope != tt.wantScope {
+				t.Errorf("scope: got %q, want %q", p.token.scope, tt.wantScope)
+			}
+		})
+	}
+}
+
 func TestGraphProvider_SendSuccess(t *testing.T) {
 	t.Parallel()
 
@@ -220,6 +500,109 @@ func TestGraphProvider_SendSuccess(t *testing.T) {
 	}
 }
 
+func TestGraphProvider_SendSpan(t *testing.T) {
+	// Sets the global tracer provider, so not parallel
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tokenResponse{AccessToken: "test-token", ExpiresIn: 3600})
+	}))
+	defer tokenServer.Close()
+	graphServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer graphServer.Close()
+
+	p := newWithOverrides(
+		GraphProviderConfig{TenantID: "t", ClientID: "c", ClientSecret: "s", Sender: "sender@example.com"},
+		graphServer.URL, tokenServer.URL, graphServer.Client(),
+	)
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "parent")
+	err := p.Send(ctx, &email.Email{To: []string{"user@example.com"}, Subject: "Test", TextBody: "Body"})
+	parent.End()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var send sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == "graph.sendMail" {
+			send = span
+		}
+	}
+	if send == nil {
+		t.Fatal("no graph.sendMail span was recorded")
+	}
+	if send.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Error("graph.sendMail span is not a child of the caller's span")
+	}
+	for _, kv := range send.Attributes() {
+		if kv.Key == "http.response.status_code" && kv.Value.AsInt64() != http.StatusAccepted {
+			t.Errorf("http.response.status_code: got %d, want %d", kv.Value.AsInt64(), http.StatusAccepted)
+		}
+	}
+}
+
+func TestGraphProvider_SendAttachmentOnly(t *testing.T) {
+	t.Parallel()
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tokenResponse{
+			AccessToken: "test-token",
+			ExpiresIn:   3600,
+		})
+	}))
+	defer tokenServer.Close()
+
+	graphServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body sendMailRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("failed to decode request body: %v", err)
+		}
+		if body.Message.Body.ContentType != "text" {
+			t.Errorf("Body.ContentType: got %q, want %q", body.Message.Body.ContentType, "text")
+		}
+		if body.Message.Body.Content != "" {
+			t.Errorf("Body.Content: got %q, want empty", body.Message.Body.Content)
+		}
+		if len(body.Message.Attachments) != 1 {
+			t.Errorf("Attachments count: got %d, want 1", len(body.Message.Attachments))
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer graphServer.Close()
+
+	p := newWithOverrides(
+		GraphProviderConfig{Sender: "sender@example.com"},
+		graphServer.URL,
+		tokenServer.URL,
+		graphServer.Client(),
+	)
+
+	msg := &email.Email{
+		To:      []string{"user@example.com"},
+		Subject: "Attachment Only",
+		Attachments: []email.Attachment{
+			{
+				Filename:    "data.csv",
+				ContentType: "text/csv",
+				Content:     []byte("a,b,c"),
+			},
+		},
+	}
+
+	if err := p.Send(context.Background(), msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
 func TestGraphProvider_PermanentError(t *testing.T) {
 	t.Parallel()
 
@@ -341,6 +724,111 @@ func TestGraphProvider_RetryOn5xx(t *testing.T) {
 	}
 }
 
+func TestGraphProvider_ConfiguredMaxRetries(t *testing.T) {
+	t.Parallel()
+
+	for _, retries := range []int{0, 1} {
+		t.Run(fmt.Sprint(retries), func(t *testing.T) {
+			t.Parallel()
+			testConfiguredMaxRetries(t, retries)
+		})
+	}
+}
+
+// testConfiguredMaxRetries checks that a Graph provider configured with
+// retries makes that many retries after the first attempt fails.
+func testConfiguredMaxRetries(t *testing.T, retries int) {
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tokenResponse{AccessToken: "token", ExpiresIn: 3600})
+	}))
+	defer tokenServer.Close()
+
+	var graphCallCount atomic.Int32
+
+	graphServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		graphCallCount.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(graphErrorResponse{
+			Error: graphError{Code: "ServiceUnavailable", Message: "Try again"},
+		})
+	}))
+	defer graphServer.Close()
+
+	p := newWithOverrides(
+		GraphProviderConfig{
+			Sender: "s@example.com", TenantID: "t", ClientID: "c", ClientSecret: "s",
+			MaxRetries: &retries, RetryBaseDelay: time.Millisecond,
+		},
+		graphServer.URL, tokenServer.URL, graphServer.Client(),
+	)
+
+	err := p.Send(context.Background(), &email.Email{
+		To:       []string{"user@example.com"},
+		Subject:  "Test",
+		TextBody: "Body",
+	})
+
+	if err == nil {
+		t.Fatal("expected error after retries exhausted")
+	}
+	if got, want := graphCallCount.Load(), int32(1+retries); got != want {
+		t.Errorf("graph call count: got %d, want %d (1 attempt + %d retries)", got, want, retries)
+	}
+}
+
+func TestGraphProvider_NoWaitAfterLastAttempt(t *testing.T) {
+	t.Parallel()
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tokenResponse{AccessToken: "token", ExpiresIn: 3600})
+	}))
+	defer tokenServer.Close()
+
+	// Neither a long backoff nor Retry-After delays the error, since
+	// there is no retry to wait for
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		var graphCallCount atomic.Int32
+		graphServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			graphCallCount.Add(1)
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(graphErrorResponse{
+				Error: graphError{Code: "TryAgain", Message: "Try again"},
+			})
+		}))
+
+		retries := 0
+		p := newWithOverrides(
+			GraphProviderConfig{
+				Sender: "s@example.com", TenantID: "t", ClientID: "c", ClientSecret: "s",
+				MaxRetries: &retries, RetryBaseDelay: 10 * time.Second,
+			},
+			graphServer.URL, tokenServer.URL, graphServer.Client(),
+		)
+
+		start := time.Now()
+		err := p.Send(context.Background(), &email.Email{
+			To:       []string{"user@example.com"},
+			Subject:  "Test",
+			TextBody: "Body",
+		})
+		elapsed := time.Since(start)
+		graphServer.Close()
+
+		if err == nil {
+			t.Errorf("HTTP %d: expected error with no retries", status)
+		}
+		if got := graphCallCount.Load(); got != 1 {
+			t.Errorf("HTTP %d: graph call count: got %d, want 1", status, got)
+		}
+		if elapsed > time.Second {
+			t.Errorf("HTTP %d: Send took %s, want no retry wait", status, elapsed)
+		}
+	}
+}
+
 func TestGraphProvider_RetryOn401WithTokenRefresh(t *testing.T) {
 	t.Parallel()
 
@@ -493,6 +981,7 @@ func TestClassifyError(t *testing.T) {
 		{name: "400 Bad Request", statusCode: 400, permanent: true, transient: false},
 		{name: "401 Unauthorized", statusCode: 401, permanent: false, transient: true},
 		{name: "403 Forbidden", statusCode: 403, permanent: true, transient: false},
+		{name: "413 Payload Too Large", statusCode: 413, permanent: true, transient: false},
 		{name: "429 Too Many Requests", statusCode: 429, permanent: false, transient: true},
 		{name: "500 Internal Server Error", statusCode: 500, permanent: false, transient: true},
 		{name: "502 Bad Gateway", statusCode: 502, permanent: false, transient: true},
@@ -509,10 +998,158 @@ func TestClassifyError(t *testing.T) {
 			if err.transient != tt.transient {
 				t.Errorf("transient: got %v, want %v", err.transient, tt.transient)
 			}
+			if err.Permanent() != tt.permanent {
+				t.Errorf("Permanent(): got %v, want %v", err.Permanent(), tt.permanent)
+			}
+		})
+	}
+}
+
+func TestGraphProvider_SenderOverride(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		override   bool
+		from       string
+		wantPath   string
+		wantFrom   string // From in the request body, or "" for none
+		preserveOn bool
+	}{
+		{"disabled", false, "billing@example.com", "/users/relay@example.com/sendMail", "", false},
+		{"allowed address", true, "billing@example.com", "/users/billing@example.com/sendMail", "", false},
+		{"allowed domain", true, "Ops@Tenant.example", "/users/Ops@Tenant.example/sendMail", "", false},
+		{"not allowed", true, "mallory@evil.example", "/users/relay@example.com/sendMail", "", false},
+		{"not allowed with PreserveFrom", true, "mallory@evil.example", "/users/relay@example.com/sendMail", "mallory@evil.example", true},
+		{"allowed with PreserveFrom", true, "billing@example.com", "/users/billing@example.com/sendMail", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(tokenResponse{AccessToken: "test-token", ExpiresIn: 3600})
+			}))
+			defer tokenServer.Close()
+
+			var gotPath, gotFrom string
+			graphServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotPath = r.URL.Path
+				var body sendMailRequest
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					t.Errorf("failed to decode request body: %v", err)
+				}
+				if body.Message.From != nil {
+					gotFrom = body.Message.From.EmailAddress.Address
+				}
+				w.WriteHeader(http.StatusAccepted)
+			}))
+			defer graphServer.Close()
+
+			p := newWithOverrides(
+				GraphProviderConfig{
+					Sender:              "relay@example.com",
+					PreserveFrom:        tt.preserveOn,
+					AllowSenderOverride: tt.override,
+					AllowedSenders:      []string{"billing@example.com", "*@tenant.example"},
+				},
+				graphServer.URL, tokenServer.URL, graphServer.Client(),
+			)
+
+			msg := &email.Email{From: tt.from, To: []string{"user@example.com"}, Subject: "Test", TextBody: "Body"}
+			if err := p.Send(context.Background(), msg); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if gotPath != tt.wantPath {
+				t.Errorf("endpoint: got %q, want %q", gotPath, tt.wantPath)
+			}
+			if gotFrom != tt.wantFrom {
+				t.Errorf("From in body: got %q, want %q", gotFrom, tt.wantFrom)
+			}
 		})
 	}
 }
 
+func TestGraphProvider_PayloadTooLarge(t *testing.T) {
+	t.Parallel()
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tokenResponse{AccessToken: "token", ExpiresIn: 3600})
+	}))
+	defer tokenServer.Close()
+
+	var calls atomic.Int32
+	graphServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	}))
+	defer graphServer.Close()
+
+	p := newWithOverrides(
+		GraphProviderConfig{Sender: "s@example.com", TenantID: "t", ClientID: "c", ClientSecret: "s"},
+		graphServer.URL, tokenServer.URL, graphServer.Client(),
+	)
+
+	err := p.Send(context.Background(), &email.Email{
+		To:       []string{"user@example.com"},
+		Subject:  "Large",
+		TextBody: "Body",
+	})
+	if err == nil {
+		t.Fatal("expected error for 413 response, got nil")
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Graph requests: got %d, want 1 (413 is not retried)", calls.Load())
+	}
+	if !provider.IsPermanent(err) {
+		t.Error("413 should be a permanent failure")
+	}
+	if !strings.Contains(err.Error(), "upload session") {
+		t.Errorf("error should point to upload sessions, got %q", err)
+	}
+
+	var tooLarge *provider.MessageTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("error %q does not wrap provider.MessageTooLargeError", err)
+	}
+	if tooLarge.Reason != "Message too big for Graph sendMail" {
+		t.Errorf("Reason: got %q, want %q", tooLarge.Reason, "Message too big for Graph sendMail")
+	}
+}
+
+func TestSendError_PermanentErrorInterface(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		statusCode int
+		want       bool
+	}{
+		{400, true},
+		{403, true},
+		{429, false},
+		{500, false},
+	}
+
+	for _, tt := range tests {
+		// Wrapped as the provider chain and session would see it
+		err := fmt.Errorf("graph: %w", classifyError(tt.statusCode, "test message", ""))
+
+		var pe provider.PermanentError
+		if !errors.As(err, &pe) {
+			t.Fatalf("HTTP %d: error does not implement provider.PermanentError", tt.statusCode)
+		}
+		if pe.Permanent() != tt.want {
+			t.Errorf("HTTP %d: Permanent() = %v, want %v", tt.statusCode, pe.Permanent(), tt.want)
+		}
+		if provider.IsPermanent(err) != tt.want {
+			t.Errorf("HTTP %d: provider.IsPermanent = %v, want %v", tt.statusCode, !tt.want, tt.want)
+		}
+	}
+}
+
 func TestBackoffDelay(t *testing.T) {
 	t.Parallel()
 
@@ -526,7 +1163,7 @@ func TestBackoffDelay(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		got := backoffDelay(tt.attempt)
+		got := backoffDelay(defaultRetryBaseDelay, tt.attempt)
 		if got != tt.want {
 			t.Errorf("backoffDelay(%d): got %v, want %v", tt.attempt, got, tt.want)
 		}
@@ -546,3 +1183,148 @@ func TestSendError_Error(t *testing.T) {
 		t.Errorf("Error(): got %q, want %q", err.Error(), expected)
 	}
 }
+
+func TestGraphProvider_ThreadHeadersRejected(t *testing.T) {
+	t.Parallel()
+
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tokenResponse{AccessToken: "token", ExpiresIn: 3600})
+	}))
+	defer tokenServer.Close()
+
+	var requests []sendMailRequest
+	graphServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body sendMailRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("failed to decode request body: %v", err)
+		}
+		requests = append(requests, body)
+
+		// Graph only accepts headers starting with "x-"
+		for _, h := range body.Message.InternetMessageHeaders {
+			if !isCustomHeader(h.Name) {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(graphErrorResponse{
+					Error: graphError{
+						Code:    invalidHeaderCode,
+						Message: "The internet message header name '" + h.Name + "' should start with 'x-' or 'X-'.",
+					},
+				})
+				return
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer graphServer.Close()
+
+	p := newWithOverrides(
+		GraphProviderConfig{Sender: "s@example.com", TenantID: "t", ClientID: "c", ClientSecret: "s"},
+		graphServer.URL, tokenServer.URL, graphServer.Client(),
+	)
+
+	msg := &email.Email{
+		To:       []string{"user@example.com"},
+		Subject:  "RE: Planning",
+		TextBody: "Body",
+		RawHeaders: map[string][]string{
+			"Thread-Index": {"AdnQ1234abcd=="},
+			"Thread-Topic": {"Planning"},
+		},
+	}
+
+	if err := p.Send(context.Background(), msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("requests: got %d, want 2 (attempt with headers, then without)", len(requests))
+	}
+	if len(requests[0].Message.InternetMessageHeaders) != 2 {
+		t.Errorf("first request headers: got %v, want Thread-Index and Thread-Topic", requests[0].Message.InternetMessageHeaders)
+	}
+	if len(requests[1].Message.InternetMessageHeaders) != 0 {
+		t.Errorf("retry headers: got %v, want none", requests[1].Message.InternetMessageHeaders)
+	}
+
+	// Later messages skip the rejected headers up front
+	if err := p.Send(context.Background(), msg); err != nil {
+		t.Fatalf("unexpected error on second send: %v", err)
+	}
+	if len(requests) != 3 {
+		t.Errorf("requests after second send: got %d, want 3", len(requests))
+	}
+}
+
+func TestGraphProvider_FromAddress(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		preserveFrom bool
+		wantFrom     *emailAddress
+		wantSender   *emailAddress
+	}{
+		{name: "configured sender", preserveFrom: false},
+		{
+			name:         "preserve from",
+			preserveFrom: true,
+			wantFrom:     &emailAddress{Name: "Alice", Address: "alice@example.com"},
+			wantSender:   &emailAddress{Address: "sender@example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(tokenResponse{AccessToken: "test-token", ExpiresIn: 3600})
+			}))
+			defer tokenServer.Close()
+
+			var body sendMailRequest
+			graphServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					t.Errorf("failed to decode request body: %v", err)
+				}
+				w.WriteHeader(http.StatusAccepted)
+			}))
+			defer graphServer.Close()
+
+			p := newWithOverrides(
+				GraphProviderConfig{Sender: "sender@example.com", PreserveFrom: tt.preserveFrom},
+				graphServer.URL,
+				tokenServer.URL,
+				graphServer.Client(),
+			)
+
+			msg := &email.Email{
+				From:     "Alice <alice@example.com>",
+				To:       []string{"user@example.com"},
+				Subject:  "Test",
+				TextBody: "Body",
+			}
+			if err := p.Send(context.Background(), msg); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			checkAddress(t, "from", body.Message.From, tt.wantFrom)
+			checkAddress(t, "sender", body.Message.Sender, tt.wantSender)
+		})
+	}
+}
+
+// checkAddress compares a request recipient against the expected address,
+// where nil means the field must be absent.
+func checkAddress(t *testing.T, field string, got *recipient, want *emailAddress) {
+	t.Helper()
+
+	switch {
+	case want == nil && got != nil:
+		t.Errorf("%s: got %+v, want none", field, got.EmailAddress)
+	case want != nil && got == nil:
+		t.Errorf("%s: missing, want %+v", field, *want)
+	case want != nil && got.EmailAddress != *want:
+		t.Errorf("%s: got %+v, want %+v", field, got.EmailAddress, *want)
+	}
+}
@@ -3,22 +3,43 @@ package graph
 
 import (
 	"encoding/base64"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
 
 	"github.com/shineum/smtp-proxy-lite/internal/email"
 )
 
 // sendMailRequest is the top-level request body for the Graph API sendMail endpoint.
 type sendMailRequest struct {
-	Message sendMailMessage `json:"message"`
+	Message         sendMailMessage `json:"message"`
+	SaveToSentItems bool            `json:"saveToSentItems"`
 }
 
 // sendMailMessage represents the message portion of a sendMail request.
 type sendMailMessage struct {
-	Subject      string            `json:"subject"`
-	Body         messageBody       `json:"body"`
-	ToRecipients []recipient       `json:"toRecipients"`
-	CcRecipients []recipient       `json:"ccRecipients,omitempty"`
-	Attachments  []graphAttachment `json:"attachments,omitempty"`
+	Subject       string            `json:"subject"`
+	Body          messageBody       `json:"body"`
+	Importance    string            `json:"importance,omitempty"`
+	ToRecipients  []recipient       `json:"toRecipients"`
+	CcRecipients  []recipient       `json:"ccRecipients,omitempty"`
+	BccRecipients []recipient       `json:"bccRecipients,omitempty"`
+	Attachments   []graphAttachment `json:"attachments,omitempty"`
+
+	// From is only set when the message's own From address is preserved,
+	// and Sender is then the mailbox sending on its behalf. Otherwise
+	// Sender carries the message's own Sender header, if any.
+	From   *recipient `json:"from,omitempty"`
+	Sender *recipient `json:"sender,omitempty"`
+
+	InternetMessageHeaders []internetMessageHeader `json:"internetMessageHeaders,omitempty"`
+}
+
+// internetMessageHeader is a raw header forwarded with the message.
+type internetMessageHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
 }
 
 // messageBody represents the body of an email message.
@@ -34,6 +55,7 @@ type recipient struct {
 
 // emailAddress represents an email address in a Graph API request.
 type emailAddress struct {
+	Name    string `json:"name,omitempty"`
 	Address string `json:"address"`
 }
 
@@ -63,8 +85,20 @@ type graphError struct {
 	Message string `json:"message"`
 }
 
+// forwardedHeaders lists the original message headers copied into
+// internetMessageHeaders. Thread-Index and Thread-Topic carry Outlook
+// conversation threading; List-Unsubscribe and List-Unsubscribe-Post carry
+// unsubscribe links, including RFC 8058 one-click unsubscribe.
+var forwardedHeaders = []string{
+	"Thread-Index",
+	"Thread-Topic",
+	"List-Unsubscribe",
+	"List-Unsubscribe-Post",
+}
+
 // buildSendMailRequest converts an email.Email into a Graph API sendMail request body.
-func buildSendMailRequest(msg *email.Email) *sendMailRequest {
+// saveToSentItems controls whether Graph keeps a copy in the sender's Sent Items.
+func buildSendMailRequest(msg *email.Email, saveToSentItems bool) *sendMailRequest {
 	// Determine body content type and content
 	body := messageBody{
 		ContentType: "text",
@@ -90,6 +124,13 @@ func buildSendMailRequest(msg *email.Email) *sendMailRequest {
 		})
 	}
 
+	bccRecipients := make([]recipient, 0, len(msg.Bcc))
+	for _, addr := range msg.Bcc {
+		bccRecipients = append(bccRecipients, recipient{
+			EmailAddress: emailAddress{Address: addr},
+		})
+	}
+
 	// Build attachments
 	attachments := make([]graphAttachment, 0, len(msg.Attachments))
 	for _, att := range msg.Attachments {
@@ -101,13 +142,76 @@ func buildSendMailRequest(msg *email.Email) *sendMailRequest {
 		})
 	}
 
+	// Forward allowlisted headers from the original message, then any
+	// custom "x-" headers in name order
+	var headers []internetMessageHeader
+	for _, name := range forwardedHeaders {
+		for _, value := range msg.RawHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+			headers = append(headers, internetMessageHeader{Name: name, Value: value})
+		}
+	}
+	var custom []string
+	for name := range msg.RawHeaders {
+		if isCustomHeader(name) {
+			custom = append(custom, name)
+		}
+	}
+	sort.Strings(custom)
+	for _, name := range custom {
+		for _, value := range msg.RawHeaders[name] {
+			headers = append(headers, internetMessageHeader{Name: name, Value: value})
+		}
+	}
+
+	var sender *recipient
+	if msg.Sender != "" {
+		sender = newRecipient(msg.Sender)
+	}
+
 	return &sendMailRequest{
 		Message: sendMailMessage{
-			Subject:      msg.Subject,
-			Body:         body,
-			ToRecipients: toRecipients,
-			CcRecipients: ccRecipients,
-			Attachments:  attachments,
+			Subject:       msg.Subject,
+			Body:          body,
+			Importance:    msg.Importance,
+			ToRecipients:  toRecipients,
+			CcRecipients:  ccRecipients,
+			BccRecipients: bccRecipients,
+			Attachments:   attachments,
+			Sender:        sender,
+
+			InternetMessageHeaders: headers,
 		},
+		SaveToSentItems: saveToSentItems,
+	}
+}
+
+// newRecipient builds a recipient from an address that may carry a display
+// name (e.g. "Alice <alice@example.com>"). Unparseable addresses are used
+// verbatim.
+func newRecipient(raw string) *recipient {
+	addr, err := mail.ParseAddress(raw)
+	if err != nil {
+		return &recipient{EmailAddress: emailAddress{Address: raw}}
+	}
+	return &recipient{EmailAddress: emailAddress{Name: addr.Name, Address: addr.Address}}
+}
+
+// isCustomHeader reports whether name is an "x-" header. Graph only
+// documents such headers as allowed in internetMessageHeaders.
+func isCustomHeader(name string) bool {
+	return strings.HasPrefix(strings.ToLower(name), "x-")
+}
+
+// withoutStandardHeaders drops forwarded headers that are not "x-" headers,
+// returning true if any were removed.
+func (m *sendMailMessage) withoutStandardHeaders() bool {
+	kept := m.InternetMessageHeaders[:0]
+	for _, h := range m.InternetMessageHeaders {
+		if isCustomHeader(h.Name) {
+			kept = append(kept, h)
+		}
 	}
+	removed := len(kept) != len(m.InternetMessageHeaders)
+	m.InternetMessageHeaders = kept
+	return removed
 }
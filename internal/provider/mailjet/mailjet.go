@@ -0,0 +1,268 @@
+package mailjet
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+	"github.com/shineum/smtp-proxy-lite/internal/provider"
+)
+
+// defaultBaseURL is the Mailjet API root.
+const defaultBaseURL = "https://api.mailjet.com"
+
+// defaultMaxRetries is the default maximum number of retry attempts for
+// transient failures.
+const defaultMaxRetries = 3
+
+// defaultRetryBaseDelay is the default initial delay for exponential backoff.
+const defaultRetryBaseDelay = 1 * time.Second
+
+// MailjetProviderConfig holds the configuration for creating a MailjetProvider.
+type MailjetProviderConfig struct {
+	APIKey    string
+	SecretKey string
+	Sender    string
+
+	// PreserveFrom sends with the message's own From address rather than
+	// Sender. The address must be a validated Mailjet sender.
+	PreserveFrom bool
+
+	// MaxRetries is the number of retries after a transient failure; nil
+	// uses the default of 3, and zero disables retries. RetryBaseDelay is
+	// the first backoff delay, doubled on each retry; zero uses 1s.
+	MaxRetries     *int
+	RetryBaseDelay time.Duration
+}
+
+// MailjetProvider sends emails via the Mailjet Send API v3.1, authenticating
+// with an API key and secret key.
+type MailjetProvider struct {
+	apiKey         string
+	secretKey      string
+	sender         string
+	preserveFrom   bool
+	maxRetries     int
+	retryBaseDelay time.Duration
+	sendURL        string
+	httpClient     *http.Client
+}
+
+// New creates a new MailjetProvider with the given configuration.
+func New(cfg MailjetProviderConfig) *MailjetProvider {
+	return newWithOverrides(cfg, defaultBaseURL, &http.Client{Timeout: 30 * time.Second})
+}
+
+// newWithOverrides creates a MailjetProvider with a custom API root and HTTP
+// client, used for testing.
+func newWithOverrides(cfg MailjetProviderConfig, baseURL string, client *http.Client) *MailjetProvider {
+	return &MailjetProvider{
+		apiKey:         cfg.APIKey,
+		secretKey:      cfg.SecretKey,
+		sender:         cfg.Sender,
+		preserveFrom:   cfg.PreserveFrom,
+		maxRetries:     maxRetries(cfg.MaxRetries),
+		retryBaseDelay: cmp.Or(cfg.RetryBaseDelay, defaultRetryBaseDelay),
+		sendURL:        strings.TrimSuffix(baseURL, "/") + "/v3.1/send",
+		httpClient:     client,
+	}
+}
+
+// Send delivers an email message via the Mailjet Send API.
+// HTTP 429 and 5xx responses are retried with exponential backoff,
+// respecting the Retry-After header.
+func (m *MailjetProvider) Send(ctx context.Context, msg *email.Email) error {
+	bodyJSON, err := json.Marshal(buildSendRequest(m.fromAddress(msg), msg))
+	if err != nil {
+		return fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= m.maxRetries; attempt++ {
+		if attempt > 0 {
+			slog.Debug("retrying Mailjet API request",
+				"attempt", attempt,
+				"max_retries", m.maxRetries,
+			)
+		}
+
+		err := m.doSendRequest(ctx, bodyJSON)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+
+		sendErr, ok := err.(*sendError)
+		if !ok || !sendErr.transient {
+			return err
+		}
+		if attempt == m.maxRetries {
+			// No retries left, so don't wait for one
+			break
+		}
+
+		delay := m.retryDelay(sendErr.retryAfter, attempt)
+		slog.Info("transient Mailjet API error, retrying",
+			"status", sendErr.statusCode,
+			"delay", delay,
+		)
+		if err := sleepWithContext(ctx, delay); err != nil {
+			return fmt.Errorf("context cancelled during retry wait: %w", err)
+		}
+	}
+
+	return fmt.Errorf("Mailjet API request failed after %d retries: %w", m.maxRetries, lastErr)
+}
+
+// BuildRequest returns the request body Send would post for msg, without
+// sending it.
+func (m *MailjetProvider) BuildRequest(msg *email.Email) (any, error) {
+	return buildSendRequest(m.fromAddress(msg), msg), nil
+}
+
+// fromAddress returns the From address to send msg with: the message's own
+// From when PreserveFrom is set and it has one, otherwise the configured
+// sender.
+func (m *MailjetProvider) fromAddress(msg *email.Email) string {
+	if m.preserveFrom && msg.From != "" {
+		return msg.From
+	}
+	return m.sender
+}
+
+// Name returns the provider name.
+func (m *MailjetProvider) Name() string {
+	return "mailjet"
+}
+
+// doSendRequest performs a single HTTP request to the send endpoint.
+func (m *MailjetProvider) doSendRequest(ctx context.Context, bodyJSON []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.sendURL, bytes.NewReader(bodyJSON))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(m.apiKey, m.secretKey)
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return &sendError{
+			message:   fmt.Sprintf("HTTP request failed: %v", err),
+			transient: true,
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated {
+		return nil
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	message := string(body)
+	var sendResp sendResponse
+	if json.Unmarshal(body, &sendResp) == nil && sendResp.errorMessage() != "" {
+		message = sendResp.errorMessage()
+	}
+	return classifyError(resp.StatusCode, message, resp.Header.Get("Retry-After"))
+}
+
+// sendError represents an error from the Mailjet API send operation with
+// classification for retry logic. It implements provider.PermanentError.
+type sendError struct {
+	message    string
+	statusCode int
+	permanent  bool
+	transient  bool
+	retryAfter string
+}
+
+func (e *sendError) Error() string {
+	return fmt.Sprintf("Mailjet API error (HTTP %d): %s", e.statusCode, e.message)
+}
+
+// Unwrap returns a provider.MessageTooLargeError for a message refused for
+// its size, so the SMTP session can reply 552.
+func (e *sendError) Unwrap() error {
+	if e.statusCode == http.StatusRequestEntityTooLarge {
+		return &provider.MessageTooLargeError{Reason: "Message too big for Mailjet"}
+	}
+	return nil
+}
+
+// Permanent reports whether the error is a permanent failure that should not
+// be retried or delivered through a fallback provider.
+func (e *sendError) Permanent() bool {
+	return e.permanent
+}
+
+// classifyError categorizes an HTTP error response for retry decisions.
+// Authentication failures are neither retried nor permanent: the message
+// itself is fine, so another provider may still deliver it.
+func classifyError(statusCode int, message, retryAfter string) *sendError {
+	err := &sendError{
+		message:    message,
+		statusCode: statusCode,
+		retryAfter: retryAfter,
+	}
+
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		// Bad credentials: not retried, but not the message's fault
+	case statusCode == http.StatusTooManyRequests:
+		err.transient = true
+	case statusCode >= 500:
+		err.transient = true
+	default:
+		err.permanent = true
+	}
+
+	return err
+}
+
+// retryDelay returns the delay before the next attempt: the Retry-After
+// header value if it holds a number of seconds, otherwise exponential
+// backoff.
+func (m *MailjetProvider) retryDelay(retryAfter string, attempt int) time.Duration {
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return backoffDelay(m.retryBaseDelay, attempt)
+}
+
+// backoffDelay returns the exponential backoff delay for the given attempt
+// number, starting from base. With the default base, delays are: 1s, 2s, 4s
+func backoffDelay(base time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 0; i < attempt; i++ {
+		delay *= 2
+	}
+	return delay
+}
+
+// sleepWithContext waits for the specified duration or until the context is cancelled.
+func sleepWithContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// maxRetries returns the configured retry count, or defaultMaxRetries if
+// none is configured.
+func maxRetries(configured *int) int {
+	if configured == nil {
+		return defaultMaxRetries
+	}
+	return *configured
+}
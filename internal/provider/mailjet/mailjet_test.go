@@ -0,0 +1,240 @@
+package mailjet
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+	"github.com/shineum/smtp-proxy-lite/internal/provider"
+)
+
+func TestBuildSendRequest(t *testing.T) {
+	t.Parallel()
+
+	msg := &email.Email{
+		To:       []string{"Alice <alice@example.com>", "bob@example.com"},
+		Cc:       []string{"carol@example.com"},
+		Bcc:      []string{"hidden@example.com"},
+		Subject:  "Report",
+		TextBody: "Hello",
+		HtmlBody: "<p>Hello</p>",
+		Attachments: []email.Attachment{
+			{Filename: "report.pdf", ContentType: "application/pdf", Content: []byte("%PDF")},
+			{Filename: "data.bin", Content: []byte{0, 1}},
+		},
+	}
+
+	data, err := json.Marshal(buildSendRequest("Sender <sender@example.com>", msg))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	want := `{"Messages":[{` +
+		`"From":{"Email":"sender@example.com","Name":"Sender"},` +
+		`"To":[{"Email":"alice@example.com","Name":"Alice"},{"Email":"bob@example.com"}],` +
+		`"Cc":[{"Email":"carol@example.com"}],` +
+		`"Bcc":[{"Email":"hidden@example.com"}],` +
+		`"Subject":"Report",` +
+		`"TextPart":"Hello",` +
+		`"HTMLPart":"\u003cp\u003eHello\u003c/p\u003e",` +
+		`"Attachments":[` +
+		`{"ContentType":"application/pdf","Filename":"report.pdf","Base64Content":"JVBERg=="},` +
+		`{"ContentType":"application/octet-stream","Filename":"data.bin","Base64Content":"AAE="}]}]}`
+	if string(data) != want {
+		t.Errorf("request body:\n got %s\nwant %s", data, want)
+	}
+}
+
+func TestBuildSendRequest_OmitsEmptyFields(t *testing.T) {
+	t.Parallel()
+
+	data, err := json.Marshal(buildSendRequest("sender@example.com", &email.Email{
+		To:       []string{"alice@example.com"},
+		TextBody: "Hello",
+	}))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	for _, key := range []string{`"Cc"`, `"Bcc"`, `"HTMLPart"`, `"Attachments"`} {
+		if strings.Contains(string(data), key) {
+			t.Errorf("request body contains %s: %s", key, data)
+		}
+	}
+}
+
+func TestMailjetProvider_SendSuccess(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3.1/send" {
+			t.Errorf("path: got %q, want %q", r.URL.Path, "/v3.1/send")
+		}
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "api-key" || pass != "secret-key" {
+			t.Errorf("basic auth: got %q/%q (%v), want api-key/secret-key", user, pass, ok)
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Content-Type header: got %q, want %q", r.Header.Get("Content-Type"), "application/json")
+		}
+
+		var body sendRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("failed to decode request body: %v", err)
+		}
+		if len(body.Messages) != 1 || body.Messages[0].Subject != "Test" || body.Messages[0].From.Email != "sender@example.com" {
+			t.Errorf("request body: got %+v", body)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"Messages":[{"Status":"success"}]}`))
+	}))
+	defer server.Close()
+
+	p := newWithOverrides(MailjetProviderConfig{
+		APIKey:    "api-key",
+		SecretKey: "secret-key",
+		Sender:    "sender@example.com",
+	}, server.URL, server.Client())
+
+	msg := &email.Email{
+		From:     "author@example.com",
+		To:       []string{"user@example.com"},
+		Subject:  "Test",
+		TextBody: "Body",
+	}
+	if err := p.Send(context.Background(), msg); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+}
+
+func TestMailjetProvider_RetriesTransientErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) < 3 {
+				w.WriteHeader(status)
+				return
+			}
+			w.Write([]byte(`{"Messages":[{"Status":"success"}]}`))
+		}))
+
+		p := newWithOverrides(MailjetProviderConfig{
+			Sender:         "sender@example.com",
+			RetryBaseDelay: time.Millisecond,
+		}, server.URL, server.Client())
+
+		err := p.Send(context.Background(), &email.Email{To: []string{"user@example.com"}, TextBody: "Body"})
+		server.Close()
+		if err != nil {
+			t.Errorf("HTTP %d: Send: %v", status, err)
+		}
+		if got := calls.Load(); got != 3 {
+			t.Errorf("HTTP %d: calls: got %d, want 3", status, got)
+		}
+	}
+}
+
+func TestMailjetProvider_ZeroMaxRetriesSendsOnce(t *testing.T) {
+	t.Parallel()
+
+	// Neither a long backoff nor Retry-After delays the error, since
+	// there is no retry to wait for
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(status)
+		}))
+
+		retries := 0
+		p := newWithOverrides(MailjetProviderConfig{
+			Sender:         "sender@example.com",
+			MaxRetries:     &retries,
+			RetryBaseDelay: 10 * time.Second,
+		}, server.URL, server.Client())
+
+		start := time.Now()
+		err := p.Send(context.Background(), &email.Email{To: []string{"user@example.com"}, TextBody: "Body"})
+		elapsed := time.Since(start)
+		server.Close()
+		if err == nil {
+			t.Errorf("HTTP %d: Send: got nil error, want failure", status)
+		}
+		if got := calls.Load(); got != 1 {
+			t.Errorf("HTTP %d: calls: got %d, want 1", status, got)
+		}
+		if elapsed > time.Second {
+			t.Errorf("HTTP %d: Send took %s, want no retry wait", status, elapsed)
+		}
+	}
+}
+func TestMailjetProvider_ClientErrorNotRetried(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"Messages":[{"Status":"error","Errors":[{"ErrorMessage":"Type mismatch. Expected type \"email\"."}]}]}`))
+	}))
+	defer server.Close()
+
+	p := newWithOverrides(MailjetProviderConfig{
+		Sender:         "sender@example.com",
+		RetryBaseDelay: time.Millisecond,
+	}, server.URL, server.Client())
+
+	err := p.Send(context.Background(), &email.Email{To: []string{"not-an-address"}, TextBody: "Body"})
+	if err == nil {
+		t.Fatal("Send: got nil error, want a rejection")
+	}
+	if !provider.IsPermanent(err) {
+		t.Errorf("error %v is not permanent", err)
+	}
+	if !strings.Contains(err.Error(), "Type mismatch") {
+		t.Errorf("error %q does not carry the Mailjet message", err)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("calls: got %d, want 1", got)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		status        int
+		wantTransient bool
+		wantPermanent bool
+	}{
+		{http.StatusBadRequest, false, true},
+		{http.StatusUnauthorized, false, false},
+		{http.StatusForbidden, false, false},
+		{http.StatusTooManyRequests, true, false},
+		{http.StatusInternalServerError, true, false},
+		{http.StatusRequestEntityTooLarge, false, true},
+	}
+
+	for _, tt := range tests {
+		err := classifyError(tt.status, "error", "")
+		if err.transient != tt.wantTransient || err.permanent != tt.wantPermanent {
+			t.Errorf("HTTP %d: got transient=%v permanent=%v, want transient=%v permanent=%v",
+				tt.status, err.transient, err.permanent, tt.wantTransient, tt.wantPermanent)
+		}
+	}
+
+	var tooLarge *provider.MessageTooLargeError
+	if !errors.As(classifyError(http.StatusRequestEntityTooLarge, "too big", ""), &tooLarge) {
+		t.Error("HTTP 413 is not a MessageTooLargeError")
+	}
+}
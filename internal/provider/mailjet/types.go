@@ -0,0 +1,117 @@
+// Package mailjet implements a Provider that sends emails via the Mailjet Send API v3.1.
+package mailjet
+
+import (
+	"encoding/base64"
+	"net/mail"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+)
+
+// sendRequest is the request body for the Send API v3.1.
+type sendRequest struct {
+	Messages []message `json:"Messages"`
+}
+
+// message is a single message of a send request.
+type message struct {
+	From        address      `json:"From"`
+	To          []address    `json:"To"`
+	Cc          []address    `json:"Cc,omitempty"`
+	Bcc         []address    `json:"Bcc,omitempty"`
+	Subject     string       `json:"Subject"`
+	TextPart    string       `json:"TextPart,omitempty"`
+	HTMLPart    string       `json:"HTMLPart,omitempty"`
+	Attachments []attachment `json:"Attachments,omitempty"`
+}
+
+// address is a sender or recipient, with an optional display name.
+type address struct {
+	Email string `json:"Email"`
+	Name  string `json:"Name,omitempty"`
+}
+
+// attachment is a file attached to a message.
+type attachment struct {
+	ContentType   string `json:"ContentType"`
+	Filename      string `json:"Filename"`
+	Base64Content string `json:"Base64Content"`
+}
+
+// sendResponse is the response body of the Send API. Request-level errors
+// (such as bad credentials) set ErrorMessage; per-message errors are listed
+// under Messages.
+type sendResponse struct {
+	ErrorMessage string `json:"ErrorMessage"`
+	Messages     []struct {
+		Status string `json:"Status"`
+		Errors []struct {
+			ErrorMessage string `json:"ErrorMessage"`
+		} `json:"Errors"`
+	} `json:"Messages"`
+}
+
+// errorMessage returns the first error message in the response, or empty.
+func (r *sendResponse) errorMessage() string {
+	if r.ErrorMessage != "" {
+		return r.ErrorMessage
+	}
+	for _, m := range r.Messages {
+		for _, e := range m.Errors {
+			if e.ErrorMessage != "" {
+				return e.ErrorMessage
+			}
+		}
+	}
+	return ""
+}
+
+// buildSendRequest converts an email.Email into a Send API request body,
+// sent from the given address.
+func buildSendRequest(from string, msg *email.Email) *sendRequest {
+	attachments := make([]attachment, 0, len(msg.Attachments))
+	for _, att := range msg.Attachments {
+		contentType := att.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		attachments = append(attachments, attachment{
+			ContentType:   contentType,
+			Filename:      att.Filename,
+			Base64Content: base64.StdEncoding.EncodeToString(att.Content),
+		})
+	}
+
+	return &sendRequest{
+		Messages: []message{{
+			From:        newAddress(from),
+			To:          newAddresses(msg.To),
+			Cc:          newAddresses(msg.Cc),
+			Bcc:         newAddresses(msg.Bcc),
+			Subject:     msg.Subject,
+			TextPart:    msg.TextBody,
+			HTMLPart:    msg.HtmlBody,
+			Attachments: attachments,
+		}},
+	}
+}
+
+// newAddress builds an address from one that may carry a display name
+// (e.g. "Alice <alice@example.com>"). Unparseable addresses are used
+// verbatim.
+func newAddress(raw string) address {
+	addr, err := mail.ParseAddress(raw)
+	if err != nil {
+		return address{Email: raw}
+	}
+	return address{Email: addr.Address, Name: addr.Name}
+}
+
+// newAddresses builds an address for each entry of addrs.
+func newAddresses(addrs []string) []address {
+	list := make([]address, 0, len(addrs))
+	for _, raw := range addrs {
+		list = append(list, newAddress(raw))
+	}
+	return list
+}
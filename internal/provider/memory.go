@@ -0,0 +1,44 @@
+package provider
+
+import (
+	"context"
+	"sync"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+)
+
+// Memory is a Provider that records sent messages in memory instead of
+// delivering them. It is safe for concurrent use and is intended for tests
+// and for programs embedding the proxy that need to inspect what was sent.
+type Memory struct {
+	mu   sync.Mutex
+	sent []*email.Email
+}
+
+// NewMemory creates an empty Memory provider.
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+// Send records msg. It always succeeds.
+func (m *Memory) Send(_ context.Context, msg *email.Email) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// Sent returns the messages recorded so far, in the order they were sent.
+// The returned slice is a copy; the messages themselves are shared.
+func (m *Memory) Sent() []*email.Email {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sent := make([]*email.Email, len(m.sent))
+	copy(sent, m.sent)
+	return sent
+}
+
+// Name returns the provider name.
+func (m *Memory) Name() string {
+	return "memory"
+}
@@ -0,0 +1,68 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+)
+
+func TestMemory_SentPreservesOrder(t *testing.T) {
+	t.Parallel()
+
+	m := NewMemory()
+	if got := m.Sent(); len(got) != 0 {
+		t.Fatalf("Sent(): got %d messages, want 0", len(got))
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := m.Send(context.Background(), &email.Email{Subject: fmt.Sprintf("msg-%d", i)}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	sent := m.Sent()
+	if len(sent) != 3 {
+		t.Fatalf("Sent(): got %d messages, want 3", len(sent))
+	}
+	for i, msg := range sent {
+		if want := fmt.Sprintf("msg-%d", i); msg.Subject != want {
+			t.Errorf("Sent()[%d].Subject: got %q, want %q", i, msg.Subject, want)
+		}
+	}
+
+	// The returned slice is a snapshot
+	sent[0] = nil
+	if m.Sent()[0] == nil {
+		t.Error("modifying the result of Sent() changed the recorded messages")
+	}
+}
+
+func TestMemory_ConcurrentSend(t *testing.T) {
+	t.Parallel()
+
+	m := NewMemory()
+
+	const senders, perSender = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perSender; j++ {
+				m.Send(context.Background(), &email.Email{})
+				m.Sent()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := len(m.Sent()); got != senders*perSender {
+		t.Errorf("Sent(): got %d messages, want %d", got, senders*perSender)
+	}
+	if m.Name() != "memory" {
+		t.Errorf("Name(): got %q, want %q", m.Name(), "memory")
+	}
+}
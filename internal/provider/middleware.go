@@ -0,0 +1,96 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+)
+
+// Middleware wraps a Provider to add behavior around Send, such as content
+// policy checks.
+type Middleware func(next Provider) Provider
+
+// Wrap applies middlewares to p. The first middleware is the outermost, so
+// it sees each message first.
+func Wrap(p Provider, middlewares ...Middleware) Provider {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		p = middlewares[i](p)
+	}
+	return p
+}
+
+// PolicyError is returned when a message violates a content policy. It is
+// permanent, and Reason is suitable for an SMTP reply.
+type PolicyError struct {
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return e.Reason
+}
+
+// Permanent reports true: the message violates the policy on every attempt.
+func (e *PolicyError) Permanent() bool {
+	return true
+}
+
+// policyFilter is a Provider that rejects messages failing check and
+// passes the rest to next.
+type policyFilter struct {
+	next  Provider
+	check func(msg *email.Email) error
+}
+
+// Send delivers msg through the wrapped provider if it passes the check.
+func (f *policyFilter) Send(ctx context.Context, msg *email.Email) error {
+	if err := f.check(msg); err != nil {
+		return err
+	}
+	return f.next.Send(ctx, msg)
+}
+
+// Name returns the wrapped provider's name.
+func (f *policyFilter) Name() string {
+	return f.next.Name()
+}
+
+// DenyAttachmentExtensions returns a Middleware that rejects messages with
+// an attachment whose file extension is in exts (e.g. "exe" or ".exe"),
+// matched case-insensitively.
+func DenyAttachmentExtensions(exts []string) Middleware {
+	denied := make(map[string]bool, len(exts))
+	for _, ext := range exts {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ext != "" {
+			denied[ext] = true
+		}
+	}
+
+	return func(next Provider) Provider {
+		return &policyFilter{next: next, check: func(msg *email.Email) error {
+			for _, att := range msg.Attachments {
+				ext := strings.ToLower(strings.TrimPrefix(path.Ext(att.Filename), "."))
+				if denied[ext] {
+					return &PolicyError{Reason: fmt.Sprintf("Attachment type .%s is not allowed", ext)}
+				}
+			}
+			return nil
+		}}
+	}
+}
+
+// MaxAttachments returns a Middleware that rejects messages with more than
+// max attachments.
+func MaxAttachments(max int) Middleware {
+	return func(next Provider) Provider {
+		return &policyFilter{next: next, check: func(msg *email.Email) error {
+			if n := len(msg.Attachments); n > max {
+				return &PolicyError{Reason: fmt.Sprintf("Too many attachments (%d, limit %d)", n, max)}
+			}
+			return nil
+		}}
+	}
+}
@@ -0,0 +1,131 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+)
+
+func TestWrap_Order(t *testing.T) {
+	var order []string
+	tag := func(name string) Middleware {
+		return func(next Provider) Provider {
+			return &policyFilter{next: next, check: func(*email.Email) error {
+				order = append(order, name)
+				return nil
+			}}
+		}
+	}
+
+	next := &fakeProvider{name: "next"}
+	p := Wrap(next, tag("first"), tag("second"))
+	if err := p.Send(context.Background(), &email.Email{}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if len(order) != 2 || order[0] != "first" || order[1] != "second" {
+		t.Errorf("middleware order: got %v, want [first second]", order)
+	}
+	if next.calls != 1 {
+		t.Errorf("next calls: got %d, want 1", next.calls)
+	}
+	if p.Name() != "next" {
+		t.Errorf("Name: got %q, want %q", p.Name(), "next")
+	}
+}
+
+// rawFakeProvider is a fakeProvider that also implements StreamingProvider.
+type rawFakeProvider struct {
+	fakeProvider
+}
+
+func (f *rawFakeProvider) SendRaw(context.Context, Envelope, io.Reader) error {
+	return nil
+}
+
+func TestDecorators_DoNotStream(t *testing.T) {
+	next := &rawFakeProvider{fakeProvider{name: "raw"}}
+	if _, ok := Provider(next).(StreamingProvider); !ok {
+		t.Fatal("test provider does not implement StreamingProvider")
+	}
+
+	tests := []struct {
+		name string
+		prov Provider
+	}{
+		{"middleware", Wrap(next, DenyAttachmentExtensions(nil))},
+		{"chain", NewChain(next)},
+		{"deduplicator", NewDeduplicator(next, []string{"Message-ID"}, time.Hour)},
+		{"recipient expander", NewRecipientExpander(next, AliasMap{})},
+		{"dry run", NewDryRun(next)},
+	}
+	for _, tt := range tests {
+		if _, ok := tt.prov.(StreamingProvider); ok {
+			t.Errorf("%s implements StreamingProvider, which would bypass it", tt.name)
+		}
+	}
+}
+
+func TestDenyAttachmentExtensions(t *testing.T) {
+	tests := []struct {
+		name        string
+		attachments []email.Attachment
+		wantReject  bool
+	}{
+		{"executable", []email.Attachment{{Filename: "report.pdf"}, {Filename: "setup.EXE"}}, true},
+		{"allowed types", []email.Attachment{{Filename: "report.pdf"}, {Filename: "notes.txt"}}, false},
+		{"no attachments", nil, false},
+		{"extension only in name", []email.Attachment{{Filename: "exe.txt"}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &fakeProvider{name: "next"}
+			p := Wrap(next, DenyAttachmentExtensions([]string{".exe", "bat"}))
+
+			err := p.Send(context.Background(), &email.Email{Attachments: tt.attachments})
+			if !tt.wantReject {
+				if err != nil {
+					t.Fatalf("Send: %v", err)
+				}
+				if next.calls != 1 {
+					t.Errorf("next calls: got %d, want 1", next.calls)
+				}
+				return
+			}
+
+			var policyErr *PolicyError
+			if !errors.As(err, &policyErr) {
+				t.Fatalf("Send: got %v, want a *PolicyError", err)
+			}
+			if !IsPermanent(err) {
+				t.Error("policy rejection is not permanent")
+			}
+			if next.calls != 0 {
+				t.Errorf("rejected message reached the provider %d times", next.calls)
+			}
+		})
+	}
+}
+
+func TestMaxAttachments(t *testing.T) {
+	next := &fakeProvider{name: "next"}
+	p := Wrap(next, MaxAttachments(2))
+
+	two := &email.Email{Attachments: make([]email.Attachment, 2)}
+	if err := p.Send(context.Background(), two); err != nil {
+		t.Errorf("Send with 2 attachments: %v", err)
+	}
+
+	three := &email.Email{Attachments: make([]email.Attachment, 3)}
+	var policyErr *PolicyError
+	if err := p.Send(context.Background(), three); !errors.As(err, &policyErr) {
+		t.Errorf("Send with 3 attachments: got %v, want a *PolicyError", err)
+	}
+	if next.calls != 1 {
+		t.Errorf("next calls: got %d, want 1", next.calls)
+	}
+}
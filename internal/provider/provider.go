@@ -3,6 +3,7 @@ package provider
 
 import (
 	"context"
+	"io"
 
 	"github.com/shineum/smtp-proxy-lite/internal/email"
 )
@@ -18,3 +19,60 @@ type Provider interface {
 	// Name returns the human-readable name of this provider.
 	Name() string
 }
+
+// Envelope is the SMTP envelope of a message, which may differ from its
+// From, To and Cc headers.
+type Envelope struct {
+	// From is the MAIL FROM address, empty for the null reverse-path
+	// (MAIL FROM:<>) used by bounces.
+	From string
+
+	// Recipients are the RCPT TO addresses, in the order given. They
+	// include Bcc recipients, which do not appear in the message headers.
+	Recipients []string
+}
+
+// StreamingProvider is implemented by providers that can deliver a message
+// as raw RFC 5322 bytes, such as an SMTP relay or a maildir writer. For a
+// large message the session prefers SendRaw, piping DATA through to the
+// provider as it arrives instead of holding the whole message in memory
+// and parsing it; smaller messages still go through Send. Middleware, the
+// Chain, Deduplicator, RecipientExpander and DryRun all work on the parsed
+// message and deliberately do not forward SendRaw, so a provider wrapped
+// in any of them is used through Send only: streaming never bypasses
+// content policy, deduplication, alias expansion or a dry run.
+type StreamingProvider interface {
+	Provider
+
+	// SendRaw delivers the message read from r to the envelope recipients.
+	// r yields the message with CRLF line endings and dot-stuffing removed,
+	// and returns io.EOF at its end. Any other error from r, such as the
+	// client disconnecting, means the message is incomplete and must not
+	// be delivered.
+	SendRaw(ctx context.Context, env Envelope, r io.Reader) error
+}
+
+// PermanentError is implemented by provider errors that classify a failed
+// delivery. A permanent failure will not succeed on retry or through
+// another provider; anything else is treated as transient.
+type PermanentError interface {
+	error
+
+	// Permanent reports whether the failure is permanent.
+	Permanent() bool
+}
+
+// MessageTooLargeError is returned by providers that refuse a message for
+// its size. It is permanent, and Reason is suitable for an SMTP reply.
+type MessageTooLargeError struct {
+	Reason string
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return e.Reason
+}
+
+// Permanent reports true: the same message is too large on every attempt.
+func (e *MessageTooLargeError) Permanent() bool {
+	return true
+}
@@ -3,12 +3,12 @@ package ses
 
 import (
 	"bytes"
+	"cmp"
 	"context"
-	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
-	"mime"
-	"mime/multipart"
 	"net/textproto"
 	"strings"
 	"time"
@@ -20,13 +20,18 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/sesv2/types"
 
 	"github.com/shineum/smtp-proxy-lite/internal/email"
+	"github.com/shineum/smtp-proxy-lite/internal/provider"
 )
 
-// maxRetries is the maximum number of retry attempts for transient failures.
-const maxRetries = 3
+// defaultMaxRetries is the default maximum number of retry attempts for
+// transient failures.
+const defaultMaxRetries = 3
 
-// baseRetryDelay is the initial delay for exponential backoff.
-const baseRetryDelay = 1 * time.Second
+// defaultRetryBaseDelay is the default initial delay for exponential backoff.
+const defaultRetryBaseDelay = 1 * time.Second
+
+// maxRawMessageSize is the largest message SES accepts, in bytes.
+const maxRawMessageSize = 40 << 20
 
 // SESProviderConfig holds the configuration for creating a SESProvider.
 type SESProviderConfig struct {
@@ -34,14 +39,37 @@ type SESProviderConfig struct {
 	AccessKeyID     string
 	SecretAccessKey string
 	Sender          string
+
+	// PreserveFrom sends with the message's own From address instead of
+	// Sender. Its domain must be a verified SES identity.
+	PreserveFrom bool
+
+	// ConfigurationSet names the SES configuration set used for event
+	// publishing and IP pool selection. Empty sends without one.
+	ConfigurationSet string
+
+	// Tags are "name=value" message tags added to every message, for
+	// example to break down CloudWatch metrics.
+	Tags []string
+
+	// MaxRetries is the number of retries after a transient failure; nil
+	// uses the default of 3, and zero disables retries. RetryBaseDelay is
+	// the first backoff delay, doubled on each retry; zero uses 1s.
+	MaxRetries     *int
+	RetryBaseDelay time.Duration
 }
 
 // SESProvider sends emails via the AWS SES v2 API.
 // @MX:ANCHOR: [AUTO] External system integration point for AWS SES
 // @MX:REASON: All email delivery flows through this provider when SES is configured
 type SESProvider struct {
-	sender string
-	client SendEmailAPI
+	sender           string
+	preserveFrom     bool
+	configurationSet string
+	tags             []types.MessageTag
+	maxRetries       int
+	retryBaseDelay   time.Duration
+	client           SendEmailAPI
 }
 
 // SendEmailAPI is the interface for the SES v2 SendEmail operation.
@@ -52,6 +80,11 @@ type SendEmailAPI interface {
 
 // New creates a new SESProvider with the given configuration.
 func New(ctx context.Context, cfg SESProviderConfig) (*SESProvider, error) {
+	tags, err := parseTags(cfg.Tags)
+	if err != nil {
+		return nil, err
+	}
+
 	var opts []func(*awsconfig.LoadOptions) error
 
 	opts = append(opts, awsconfig.WithRegion(cfg.Region))
@@ -70,59 +103,107 @@ func New(ctx context.Context, cfg SESProviderConfig) (*SESProvider, error) {
 	client := sesv2.NewFromConfig(awsCfg)
 
 	return &SESProvider{
-		sender: cfg.Sender,
-		client: client,
+		sender:           cfg.Sender,
+		preserveFrom:     cfg.PreserveFrom,
+		configurationSet: cfg.ConfigurationSet,
+		tags:             tags,
+		maxRetries:       maxRetries(cfg.MaxRetries),
+		retryBaseDelay:   cmp.Or(cfg.RetryBaseDelay, defaultRetryBaseDelay),
+		client:           client,
 	}, nil
 }
 
 // NewWithClient creates a SESProvider with a custom client, used for testing.
 func NewWithClient(sender string, client SendEmailAPI) *SESProvider {
 	return &SESProvider{
-		sender: sender,
-		client: client,
+		sender:         sender,
+		maxRetries:     defaultMaxRetries,
+		retryBaseDelay: defaultRetryBaseDelay,
+		client:         client,
 	}
 }
 
-// Send delivers an email message via AWS SES v2.
-// For emails with attachments, it builds a raw MIME message.
-// For simple emails, it uses the SES simple email format.
+// Send delivers an email message via AWS SES v2. Transient failures, such as
+// throttling, are retried with exponential backoff unless the backoff would
+// outlast the context deadline; permanent failures are returned immediately.
 func (s *SESProvider) Send(ctx context.Context, msg *email.Email) error {
-	var input *sesv2.SendEmailInput
+	input, err := s.buildInput(msg)
+	if err != nil {
+		return err
+	}
+	return s.send(ctx, input)
+}
 
-	if len(msg.Attachments) > 0 {
-		raw, err := buildRawMessage(s.sender, msg)
-		if err != nil {
-			return fmt.Errorf("failed to build raw message: %w", err)
-		}
-		input = &sesv2.SendEmailInput{
-			Content: &types.EmailContent{
-				Raw: &types.RawMessage{
-					Data: raw,
-				},
-			},
-		}
-	} else {
-		input = buildSimpleInput(s.sender, msg)
+// SendRaw delivers a message received as raw bytes to the envelope
+// recipients as an SES raw message, without parsing and rebuilding it.
+// SES takes the message in a single request, so it is read into memory,
+// but only once. The From header is replaced by the configured sender
+// unless PreserveFrom is set, and headers that must not travel further
+// are dropped (see strippedRawHeaders).
+func (s *SESProvider) SendRaw(ctx context.Context, env provider.Envelope, r io.Reader) error {
+	raw, err := io.ReadAll(io.LimitReader(r, maxRawMessageSize+1))
+	if err != nil {
+		return fmt.Errorf("failed to read message: %w", err)
+	}
+	if len(raw) > maxRawMessageSize {
+		return &provider.MessageTooLargeError{Reason: fmt.Sprintf("Message exceeds the SES limit of %d bytes", maxRawMessageSize)}
+	}
+
+	input := &sesv2.SendEmailInput{
+		Destination: &types.Destination{ToAddresses: env.Recipients},
+		Content: &types.EmailContent{
+			Raw: &types.RawMessage{Data: s.rewriteRawHeaders(raw)},
+		},
 	}
+	if s.configurationSet != "" {
+		input.ConfigurationSetName = aws.String(s.configurationSet)
+	}
+	input.EmailTags = s.tags
+	return s.send(ctx, input)
+}
 
+// sendEmail makes a single SendEmail API request, traced as a span.
+func (s *SESProvider) sendEmail(ctx context.Context, input *sesv2.SendEmailInput) (*sesv2.SendEmailOutput, error) {
+	ctx, span := provider.StartSpan(ctx, "ses.SendEmail")
+	out, err := s.client.SendEmail(ctx, input)
+	provider.EndSpan(span, err)
+	return out, err
+}
+
+// send submits input, retrying transient failures.
+func (s *SESProvider) send(ctx context.Context, input *sesv2.SendEmailInput) error {
 	var lastErr error
-	for attempt := 0; attempt <= maxRetries; attempt++ {
+	for attempt := 0; attempt <= s.maxRetries; attempt++ {
 		if attempt > 0 {
 			slog.Debug("retrying SES API request",
 				"attempt", attempt,
-				"max_retries", maxRetries,
+				"max_retries", s.maxRetries,
 			)
-			delay := backoffDelay(attempt)
+			delay := backoffDelay(s.retryBaseDelay, attempt)
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+				// The retry could not start before the caller gives up
+				return &sendError{
+					err: fmt.Errorf("SES API request failed, no time left to retry before the deadline: %w", lastErr),
+				}
+			}
 			if err := sleepWithContext(ctx, delay); err != nil {
 				return fmt.Errorf("context cancelled during retry wait: %w", err)
 			}
 		}
 
-		_, err := s.client.SendEmail(ctx, input)
+		_, err := s.sendEmail(ctx, input)
 		if err == nil {
 			return nil
 		}
 
+		if isPermanentError(err) {
+			// Retrying cannot succeed; fail immediately
+			return &sendError{
+				err:       fmt.Errorf("SES API request failed: %w", err),
+				permanent: true,
+			}
+		}
+
 		lastErr = err
 		slog.Warn("SES API error",
 			"attempt", attempt,
@@ -130,7 +211,59 @@ func (s *SESProvider) Send(ctx context.Context, msg *email.Email) error {
 		)
 	}
 
-	return fmt.Errorf("SES API request failed after %d retries: %w", maxRetries, lastErr)
+	return &sendError{
+		err: fmt.Errorf("SES API request failed after %d retries: %w", s.maxRetries, lastErr),
+	}
+}
+
+// BuildRequest returns the SendEmail input Send would submit for msg,
+// without sending it.
+func (s *SESProvider) BuildRequest(msg *email.Email) (any, error) {
+	return s.buildInput(msg)
+}
+
+// buildInput builds the SendEmail input for msg. For emails with
+// attachments, an importance, a Sender or custom headers, it builds a raw
+// MIME message so that they are carried. For simple emails, it uses the SES
+// simple email format. Both are sent with the configured configuration set,
+// if any, and message tags.
+func (s *SESProvider) buildInput(msg *email.Email) (*sesv2.SendEmailInput, error) {
+	var input *sesv2.SendEmailInput
+	from := s.fromAddress(msg)
+
+	if len(msg.Attachments) > 0 || msg.Importance != "" || msg.Sender != "" || len(passthroughHeaders(msg)) > 0 {
+		raw, err := buildRawMessage(from, msg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build raw message: %w", err)
+		}
+		// Raw messages omit Bcc from the headers, so recipients are
+		// listed explicitly for SES to deliver to all of them.
+		input = &sesv2.SendEmailInput{
+			Destination: buildDestination(msg),
+			Content: &types.EmailContent{
+				Raw: &types.RawMessage{
+					Data: raw,
+				},
+			},
+		}
+	} else {
+		input = buildSimpleInput(from, msg)
+	}
+	if s.configurationSet != "" {
+		input.ConfigurationSetName = aws.String(s.configurationSet)
+	}
+	input.EmailTags = s.tags
+	return input, nil
+}
+
+// fromAddress returns the From address to send msg with: the message's own
+// From when PreserveFrom is set and it has one, otherwise the configured
+// sender.
+func (s *SESProvider) fromAddress(msg *email.Email) string {
+	if s.preserveFrom && msg.From != "" {
+		return msg.From
+	}
+	return s.sender
 }
 
 // Name returns the provider name.
@@ -138,6 +271,47 @@ func (s *SESProvider) Name() string {
 	return "ses"
 }
 
+// sendError wraps a failed SES send with its permanent/transient
+// classification. It implements provider.PermanentError.
+type sendError struct {
+	err       error
+	permanent bool
+}
+
+func (e *sendError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sendError) Unwrap() error {
+	return e.err
+}
+
+// Permanent reports whether the error is a permanent failure that should not
+// be retried or delivered through a fallback provider.
+func (e *sendError) Permanent() bool {
+	return e.permanent
+}
+
+// isPermanentError reports whether an SES API error indicates the message
+// will never be accepted as-is (rejected content, unverified identities,
+// suspended account, or an invalid request).
+func isPermanentError(err error) bool {
+	var (
+		rejected   *types.MessageRejected
+		unverified *types.MailFromDomainNotVerifiedException
+		suspended  *types.AccountSuspendedException
+		paused     *types.SendingPausedException
+		badRequest *types.BadRequestException
+		notFound   *types.NotFoundException
+	)
+	return errors.As(err, &rejected) ||
+		errors.As(err, &unverified) ||
+		errors.As(err, &suspended) ||
+		errors.As(err, &paused) ||
+		errors.As(err, &badRequest) ||
+		errors.As(err, &notFound)
+}
+
 // buildSimpleInput creates a SES SendEmailInput for emails without attachments.
 func buildSimpleInput(sender string, msg *email.Email) *sesv2.SendEmailInput {
 	body := &types.Body{}
@@ -155,15 +329,9 @@ func buildSimpleInput(sender string, msg *email.Email) *sesv2.SendEmailInput {
 		}
 	}
 
-	dest := &types.Destination{
-		ToAddresses:  msg.To,
-		CcAddresses:  msg.Cc,
-		BccAddresses: msg.Bcc,
-	}
-
 	return &sesv2.SendEmailInput{
 		FromEmailAddress: aws.String(sender),
-		Destination:      dest,
+		Destination:      buildDestination(msg),
 		Content: &types.EmailContent{
 			Simple: &types.Message{
 				Subject: &types.Content{
@@ -176,83 +344,118 @@ func buildSimpleInput(sender string, msg *email.Email) *sesv2.SendEmailInput {
 	}
 }
 
-// buildRawMessage constructs a raw MIME message for emails with attachments.
-func buildRawMessage(sender string, msg *email.Email) ([]byte, error) {
-	var buf bytes.Buffer
-
-	// Write headers
-	fmt.Fprintf(&buf, "From: %s\r\n", sender)
-	if len(msg.To) > 0 {
-		fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(msg.To, ", "))
-	}
-	if len(msg.Cc) > 0 {
-		fmt.Fprintf(&buf, "Cc: %s\r\n", strings.Join(msg.Cc, ", "))
-	}
-	fmt.Fprintf(&buf, "Subject: %s\r\n", msg.Subject)
-	if msg.MessageID != "" {
-		fmt.Fprintf(&buf, "Message-ID: %s\r\n", msg.MessageID)
+// buildDestination lists the To, Cc and Bcc recipients of msg.
+func buildDestination(msg *email.Email) *types.Destination {
+	return &types.Destination{
+		ToAddresses:  msg.To,
+		CcAddresses:  msg.Cc,
+		BccAddresses: msg.Bcc,
 	}
-	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+}
 
-	writer := multipart.NewWriter(&buf)
-	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", writer.Boundary())
+// parseTags parses "name=value" pairs into SES message tags.
+func parseTags(pairs []string) ([]types.MessageTag, error) {
+	var tags []types.MessageTag
+	for _, pair := range pairs {
+		name, value, ok := strings.Cut(pair, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid SES tag %q: expected name=value", pair)
+		}
+		tags = append(tags, types.MessageTag{
+			Name:  aws.String(name),
+			Value: aws.String(value),
+		})
+	}
+	return tags, nil
+}
 
-	// Write body part
-	bodyHeader := make(textproto.MIMEHeader)
-	if msg.HtmlBody != "" {
-		bodyHeader.Set("Content-Type", "text/html; charset=UTF-8")
-		part, err := writer.CreatePart(bodyHeader)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create body part: %w", err)
+// passthroughHeaders returns the headers of msg that are copied into the
+// raw message unchanged: custom X-* headers, such as X-Campaign-ID, and
+// List-* headers, such as List-Unsubscribe. Everything else is either
+// written by email.Serialize or describes the inbound transport (Received,
+// DKIM-Signature, ARC-*, Authentication-Results), and must neither travel
+// further nor force a message onto the raw path.
+func passthroughHeaders(msg *email.Email) map[string][]string {
+	headers := make(map[string][]string)
+	for name, values := range msg.RawHeaders {
+		key := textproto.CanonicalMIMEHeaderKey(name)
+		if key == "X-Priority" {
+			// Written from msg.Importance
+			continue
 		}
-		part.Write([]byte(msg.HtmlBody))
-	} else if msg.TextBody != "" {
-		bodyHeader.Set("Content-Type", "text/plain; charset=UTF-8")
-		part, err := writer.CreatePart(bodyHeader)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create body part: %w", err)
+		if strings.HasPrefix(key, "X-") || strings.HasPrefix(key, "List-") {
+			headers[key] = values
 		}
-		part.Write([]byte(msg.TextBody))
 	}
+	return headers
+}
 
-	// Write attachments
-	for _, att := range msg.Attachments {
-		attHeader := make(textproto.MIMEHeader)
-		attHeader.Set("Content-Type", att.ContentType)
-		attHeader.Set("Content-Transfer-Encoding", "base64")
-		attHeader.Set("Content-Disposition",
-			fmt.Sprintf("attachment; filename=%s", mime.QEncoding.Encode("UTF-8", att.Filename)))
-
-		part, err := writer.CreatePart(attHeader)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create attachment part: %w", err)
-		}
+// strippedRawHeaders lists headers removed from messages sent with SendRaw:
+// Bcc would reveal hidden recipients, and the rest record authentication
+// results that no longer hold once SES re-sends the message.
+var strippedRawHeaders = map[string]bool{
+	"Bcc":                        true,
+	"Return-Path":                true,
+	"Dkim-Signature":             true,
+	"Authentication-Results":     true,
+	"Arc-Seal":                   true,
+	"Arc-Message-Signature":      true,
+	"Arc-Authentication-Results": true,
+}
 
-		encoded := encodeBase64WithLineBreaks(att.Content)
-		part.Write([]byte(encoded))
+// rewriteRawHeaders returns raw with its header section prepared for SES:
+// stripped headers are removed and, unless PreserveFrom is set, the From
+// header is replaced by the configured sender. The body is not touched.
+func (s *SESProvider) rewriteRawHeaders(raw []byte) []byte {
+	header, body, found := bytes.Cut(raw, []byte("\r\n\r\n"))
+	if !found {
+		header, body = raw, nil
 	}
 
-	writer.Close()
-	return buf.Bytes(), nil
-}
+	var out bytes.Buffer
+	out.Grow(len(raw) + len(s.sender))
+	if !s.preserveFrom {
+		fmt.Fprintf(&out, "From: %s\r\n", s.sender)
+	}
 
-// encodeBase64WithLineBreaks encodes bytes to base64 with 76-character line breaks per RFC 2045.
-func encodeBase64WithLineBreaks(data []byte) string {
-	encoded := base64.StdEncoding.EncodeToString(data)
-	var lines []string
-	for i := 0; i < len(encoded); i += 76 {
-		end := i + 76
-		if end > len(encoded) {
-			end = len(encoded)
+	// A line starting with whitespace continues the previous header
+	skip := false
+	for _, line := range bytes.SplitAfter(header, []byte("\r\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name, _, _ := bytes.Cut(line, []byte(":"))
+			key := textproto.CanonicalMIMEHeaderKey(string(bytes.TrimSpace(name)))
+			skip = strippedRawHeaders[key] || (key == "From" && !s.preserveFrom)
 		}
-		lines = append(lines, encoded[i:end])
+		if !skip {
+			out.Write(line)
+		}
+	}
+	if !bytes.HasSuffix(out.Bytes(), []byte("\r\n")) {
+		out.WriteString("\r\n")
+	}
+	if found {
+		out.WriteString("\r\n")
+		out.Write(body)
 	}
-	return strings.Join(lines, "\r\n")
+	return out.Bytes()
 }
 
-// backoffDelay returns the exponential backoff delay for the given attempt number.
-func backoffDelay(attempt int) time.Duration {
-	delay := baseRetryDelay
+// buildRawMessage constructs a raw MIME message, sent from the configured
+// sender address, that includes the message's pass-through headers.
+func buildRawMessage(sender string, msg *email.Email) ([]byte, error) {
+	raw := *msg
+	raw.From = sender
+	return email.SerializeWithHeaders(&raw, passthroughHeaders(msg))
+}
+
+// backoffDelay returns the exponential backoff delay for the given attempt
+// number, starting from base.
+func backoffDelay(base time.Duration, attempt int) time.Duration {
+	delay := base
 	for i := 0; i < attempt; i++ {
 		delay *= 2
 	}
@@ -268,3 +471,12 @@ func sleepWithContext(ctx context.Context, d time.Duration) error {
 		return nil
 	}
 }
+
+// maxRetries returns the configured retry count, or defaultMaxRetries if
+// none is configured.
+func maxRetries(configured *int) int {
+	if configured == nil {
+		return defaultMaxRetries
+	}
+	return *configured
+}
@@ -5,12 +5,14 @@ import (
 	"errors"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	sesv2 "github.com/aws/aws-sdk-go-v2/service/sesv2"
 	"github.com/aws/aws-sdk-go-v2/service/sesv2/types"
 
 	"github.com/shineum/smtp-proxy-lite/internal/email"
+	"github.com/shineum/smtp-proxy-lite/internal/provider"
 )
 
 // mockSESClient implements SendEmailAPI for testing.
@@ -191,6 +193,218 @@ func TestSend_WithAttachments(t *testing.T) {
 	}
 }
 
+func TestSend_RawMessageIncludesBccDestination(t *testing.T) {
+	t.Parallel()
+
+	mock := &mockSESClient{}
+	p := NewWithClient("sender@example.com", mock)
+
+	msg := &email.Email{
+		To:       []string{"to@example.com"},
+		Bcc:      []string{"hidden@example.com"},
+		Subject:  "With Attachment",
+		TextBody: "See attachment",
+		Attachments: []email.Attachment{
+			{Filename: "test.txt", ContentType: "text/plain", Content: []byte("file content")},
+		},
+		RawHeaders: map[string][]string{
+			"Bcc": {"hidden@example.com"},
+		},
+	}
+
+	if err := p.Send(context.Background(), msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	dest := mock.lastInput.Destination
+	if dest == nil {
+		t.Fatal("expected Destination for raw message, got nil")
+	}
+	if len(dest.BccAddresses) != 1 || dest.BccAddresses[0] != "hidden@example.com" {
+		t.Errorf("BccAddresses: got %v, want [hidden@example.com]", dest.BccAddresses)
+	}
+	raw := string(mock.lastInput.Content.Raw.Data)
+	if strings.Contains(raw, "hidden@example.com") || strings.Contains(raw, "\r\nBcc:") {
+		t.Error("raw message exposes the Bcc recipient in its headers")
+	}
+}
+
+func TestSend_ImportanceUsesRawMessage(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		importance string
+		priority   string
+	}{
+		{email.ImportanceHigh, "X-Priority: 1 (Highest)"},
+		{email.ImportanceNormal, "X-Priority: 3 (Normal)"},
+		{email.ImportanceLow, "X-Priority: 5 (Lowest)"},
+	}
+
+	for _, tt := range tests {
+		mock := &mockSESClient{}
+		p := NewWithClient("sender@example.com", mock)
+
+		msg := &email.Email{
+			To:         []string{"to@example.com"},
+			Subject:    "Priority",
+			TextBody:   "Hello",
+			Importance: tt.importance,
+		}
+		if err := p.Send(context.Background(), msg); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if mock.lastInput.Content.Raw == nil {
+			t.Fatalf("expected raw content for importance %q", tt.importance)
+		}
+		raw := string(mock.lastInput.Content.Raw.Data)
+		if !strings.Contains(raw, "Importance: "+tt.importance+"\r\n") {
+			t.Errorf("raw message missing Importance: %s header", tt.importance)
+		}
+		if !strings.Contains(raw, tt.priority+"\r\n") {
+			t.Errorf("raw message missing %q header", tt.priority)
+		}
+	}
+}
+
+func TestSend_SenderUsesRawMessage(t *testing.T) {
+	t.Parallel()
+
+	mock := &mockSESClient{}
+	p := NewWithClient("sender@example.com", mock)
+
+	msg := &email.Email{
+		From:     "author@example.com",
+		Sender:   "assistant@example.com",
+		To:       []string{"to@example.com"},
+		Subject:  "On behalf",
+		TextBody: "Hello",
+		RawHeaders: map[string][]string{
+			"Sender": {"assistant@example.com"},
+		},
+	}
+	if err := p.Send(context.Background(), msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if mock.lastInput.Content.Raw == nil {
+		t.Fatal("expected raw content for a message with a Sender")
+	}
+	raw := string(mock.lastInput.Content.Raw.Data)
+	if n := strings.Count(raw, "\r\nSender: "); n != 1 {
+		t.Errorf("raw message has %d Sender headers, want 1", n)
+	}
+	if !strings.Contains(raw, "\r\nSender: assistant@example.com\r\n") {
+		t.Error("raw message missing Sender: assistant@example.com header")
+	}
+}
+
+func TestSend_PassesThroughCustomHeaders(t *testing.T) {
+	t.Parallel()
+
+	mock := &mockSESClient{}
+	p := NewWithClient("sender@example.com", mock)
+
+	msg := &email.Email{
+		To:       []string{"to@example.com"},
+		Subject:  "Newsletter",
+		TextBody: "Hello",
+		RawHeaders: map[string][]string{
+			"X-Campaign-Id":         {"spring-2024"},
+			"List-Unsubscribe":      {"<https://example.com/unsub?id=42>"},
+			"List-Unsubscribe-Post": {"List-Unsubscribe=One-Click"},
+			"Received":              {"from relay.example.com"},
+			"Content-Type":          {"text/plain; charset=us-ascii"},
+			"Subject":               {"Newsletter"},
+		},
+	}
+
+	if err := p.Send(context.Background(), msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mock.lastInput.Content.Raw == nil {
+		t.Fatal("expected raw content for a message with custom headers")
+	}
+
+	raw := string(mock.lastInput.Content.Raw.Data)
+	for _, want := range []string{
+		"X-Campaign-Id: spring-2024\r\n",
+		"List-Unsubscribe: <https://example.com/unsub?id=42>\r\n",
+		"List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n",
+	} {
+		if !strings.Contains(raw, want) {
+			t.Errorf("raw message missing header %q", want)
+		}
+	}
+	for _, unwanted := range []string{"Received:", "charset=us-ascii"} {
+		if strings.Contains(raw, unwanted) {
+			t.Errorf("raw message should not contain %q", unwanted)
+		}
+	}
+	if n := strings.Count(raw, "Subject:"); n != 1 {
+		t.Errorf("Subject header count: got %d, want 1", n)
+	}
+}
+
+func TestSend_TransportHeadersKeepSimplePath(t *testing.T) {
+	t.Parallel()
+
+	for _, header := range []string{"Received", "ARC-Seal", "Authentication-Results", "DKIM-Signature", "X-Priority"} {
+		mock := &mockSESClient{}
+		p := NewWithClient("sender@example.com", mock)
+
+		msg := &email.Email{
+			To:         []string{"to@example.com"},
+			Subject:    "Relayed",
+			TextBody:   "Hello",
+			RawHeaders: map[string][]string{header: {"from relay.example.com"}},
+		}
+		if err := p.Send(context.Background(), msg); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if mock.lastInput.Content.Simple == nil {
+			t.Errorf("a message with only a %s header was not sent as a simple message", header)
+		}
+	}
+}
+
+func TestSend_AttachmentOnly(t *testing.T) {
+	t.Parallel()
+
+	mock := &mockSESClient{}
+	p := NewWithClient("sender@example.com", mock)
+
+	msg := &email.Email{
+		To:      []string{"to@example.com"},
+		Subject: "Attachment Only",
+		Attachments: []email.Attachment{
+			{
+				Filename:    "data.csv",
+				ContentType: "text/csv",
+				Content:     []byte("a,b,c"),
+			},
+		},
+	}
+
+	if err := p.Send(context.Background(), msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	input := mock.lastInput
+	if input.Content.Raw == nil {
+		t.Fatal("expected raw email content for attachment-only message, got nil")
+	}
+
+	rawStr := string(input.Content.Raw.Data)
+	if !strings.Contains(rawStr, "Content-Type: text/plain; charset=UTF-8") {
+		t.Error("raw message missing empty text body part")
+	}
+	if !strings.Contains(rawStr, "data.csv") {
+		t.Error("raw message missing attachment filename")
+	}
+}
+
 func TestSend_RetryOnError(t *testing.T) {
 	t.Parallel()
 
@@ -252,6 +466,97 @@ func TestSend_AllRetriesExhausted(t *testing.T) {
 	}
 }
 
+func TestSend_PermanentErrorNotRetried(t *testing.T) {
+	t.Parallel()
+
+	mock := &mockSESClient{
+		sendFn: func(ctx context.Context, params *sesv2.SendEmailInput, optFns ...func(*sesv2.Options)) (*sesv2.SendEmailOutput, error) {
+			return nil, &types.MessageRejected{Message: aws.String("Email address is not verified")}
+		},
+	}
+	p := NewWithClient("sender@example.com", mock)
+
+	msg := &email.Email{To: []string{"to@example.com"}, Subject: "Rejected", TextBody: "Hello"}
+
+	err := p.Send(context.Background(), msg)
+	if err == nil {
+		t.Fatal("expected error for rejected message")
+	}
+	if mock.callCount != 1 {
+		t.Errorf("call count: got %d, want 1", mock.callCount)
+	}
+	var sendErr *sendError
+	if !errors.As(err, &sendErr) || !sendErr.Permanent() {
+		t.Errorf("expected a permanent sendError, got %v", err)
+	}
+}
+
+func TestSend_ThrottlingRetried(t *testing.T) {
+	t.Parallel()
+
+	mock := &mockSESClient{}
+	mock.sendFn = func(ctx context.Context, params *sesv2.SendEmailInput, optFns ...func(*sesv2.Options)) (*sesv2.SendEmailOutput, error) {
+		if mock.callCount == 1 {
+			return nil, &types.TooManyRequestsException{Message: aws.String("Maximum sending rate exceeded")}
+		}
+		return &sesv2.SendEmailOutput{MessageId: aws.String("ok")}, nil
+	}
+	p := NewWithClient("sender@example.com", mock)
+
+	msg := &email.Email{To: []string{"to@example.com"}, Subject: "Throttled", TextBody: "Hello"}
+
+	if err := p.Send(context.Background(), msg); err != nil {
+		t.Fatalf("expected success after retry, got: %v", err)
+	}
+	if mock.callCount != 2 {
+		t.Errorf("call count: got %d, want 2", mock.callCount)
+	}
+}
+
+func TestSend_ConfiguredMaxRetries(t *testing.T) {
+	t.Parallel()
+
+	mock := &mockSESClient{
+		sendFn: func(ctx context.Context, params *sesv2.SendEmailInput, optFns ...func(*sesv2.Options)) (*sesv2.SendEmailOutput, error) {
+			return nil, errors.New("persistent error")
+		},
+	}
+	p := NewWithClient("sender@example.com", mock)
+	p.maxRetries = 1
+	p.retryBaseDelay = time.Millisecond
+
+	msg := &email.Email{To: []string{"to@example.com"}, Subject: "Fail Test", TextBody: "Hello"}
+
+	if err := p.Send(context.Background(), msg); err == nil {
+		t.Fatal("expected error after all retries exhausted")
+	}
+	// 1 initial + 1 retry = 2 total
+	if mock.callCount != 2 {
+		t.Errorf("call count: got %d, want 2", mock.callCount)
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	t.Parallel()
+
+	zero, two := 0, 2
+	tests := []struct {
+		name       string
+		configured *int
+		want       int
+	}{
+		{"unset", nil, defaultMaxRetries},
+		{"zero disables retries", &zero, 0},
+		{"configured", &two, 2},
+	}
+
+	for _, tt := range tests {
+		if got := maxRetries(tt.configured); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
 func TestSend_ContextCancelled(t *testing.T) {
 	t.Parallel()
 
@@ -278,6 +583,73 @@ func TestSend_ContextCancelled(t *testing.T) {
 	}
 }
 
+func TestSend_DeadlineShorterThanBackoff(t *testing.T) {
+	t.Parallel()
+
+	mock := &mockSESClient{
+		sendFn: func(ctx context.Context, params *sesv2.SendEmailInput, optFns ...func(*sesv2.Options)) (*sesv2.SendEmailOutput, error) {
+			return nil, errors.New("transient error")
+		},
+	}
+	p := NewWithClient("sender@example.com", mock)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	msg := &email.Email{To: []string{"to@example.com"}, Subject: "Deadline", TextBody: "Hello"}
+
+	start := time.Now()
+	err := p.Send(ctx, msg)
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatal("expected error when the deadline leaves no time to retry")
+	}
+	if elapsed > 500*time.Millisecond {
+		t.Errorf("Send took %v, want it to return before the 500ms deadline", elapsed)
+	}
+	if mock.callCount != 1 {
+		t.Errorf("call count: got %d, want 1", mock.callCount)
+	}
+}
+
+func TestIsPermanentError(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"message rejected", &types.MessageRejected{Message: aws.String("rejected")}, true},
+		{"domain not verified", &types.MailFromDomainNotVerifiedException{}, true},
+		{"account suspended", &types.AccountSuspendedException{}, true},
+		{"bad request", &types.BadRequestException{}, true},
+		{"throttled", &types.TooManyRequestsException{}, false},
+		{"generic", errors.New("connection reset"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			if got := isPermanentError(tt.err); got != tt.want {
+				t.Errorf("isPermanentError: got %v, want %v", got, tt.want)
+			}
+			sendErr := &sendError{err: tt.err, permanent: isPermanentError(tt.err)}
+			if sendErr.Permanent() != tt.want {
+				t.Errorf("Permanent: got %v, want %v", sendErr.Permanent(), tt.want)
+			}
+			if !errors.Is(sendErr, tt.err) {
+				t.Error("sendError should unwrap to the underlying error")
+			}
+			var pe provider.PermanentError
+			if !errors.As(sendErr, &pe) || pe.Permanent() != tt.want {
+				t.Errorf("sendError should implement provider.PermanentError reporting %v", tt.want)
+			}
+		})
+	}
+}
+
 func TestBuildSimpleInput(t *testing.T) {
 	t.Parallel()
 
@@ -376,24 +748,43 @@ func TestBuildRawMessage_HtmlBody(t *testing.T) {
 	}
 }
 
-func TestEncodeBase64WithLineBreaks(t *testing.T) {
+func TestBuildRawMessage_TextAndHtmlBodies(t *testing.T) {
 	t.Parallel()
 
-	// Create data that produces a long base64 string
-	data := make([]byte, 100)
-	for i := range data {
-		data[i] = byte(i)
+	msg := &email.Email{
+		To:       []string{"to@example.com"},
+		Subject:  "Both Bodies",
+		TextBody: "Hello in text",
+		HtmlBody: "<h1>Hello in HTML</h1>",
+		Attachments: []email.Attachment{
+			{Filename: "report.csv", ContentType: "text/csv", Content: []byte("a,b")},
+		},
 	}
 
-	encoded := encodeBase64WithLineBreaks(data)
-	lines := strings.Split(encoded, "\r\n")
-	for i, line := range lines {
-		if i < len(lines)-1 && len(line) != 76 {
-			t.Errorf("line %d length: got %d, want 76", i, len(line))
-		}
-		if len(line) > 76 {
-			t.Errorf("line %d exceeds 76 chars: got %d", i, len(line))
+	raw, err := buildRawMessage("sender@example.com", msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rawStr := string(raw)
+
+	// Both bodies sit in a multipart/alternative part, with the attachment
+	// beside it at the multipart/mixed level.
+	parts := []string{
+		"Content-Type: multipart/mixed",
+		"Content-Type: multipart/alternative",
+		"Content-Type: text/plain; charset=UTF-8",
+		"Hello in text",
+		"Content-Type: text/html; charset=UTF-8",
+		"<h1>Hello in HTML</h1>",
+		"Content-Disposition: attachment; filename=report.csv",
+	}
+	pos := 0
+	for _, part := range parts {
+		i := strings.Index(rawStr[pos:], part)
+		if i < 0 {
+			t.Fatalf("raw message missing %q after offset %d:\n%s", part, pos, rawStr)
 		}
+		pos += i + len(part)
 	}
 }
 
@@ -410,7 +801,7 @@ func TestBackoffDelay(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		if got := backoffDelay(tt.attempt); got != tt.want {
+		if got := backoffDelay(defaultRetryBaseDelay, tt.attempt); got != tt.want {
 			t.Errorf("backoffDelay(%d): got %v, want %v", tt.attempt, got, tt.want)
 		}
 	}
@@ -425,3 +816,208 @@ func TestProviderInterface(t *testing.T) {
 		Name() string
 	} = (*SESProvider)(nil)
 }
+
+func TestSend_ConfigurationSet(t *testing.T) {
+	t.Parallel()
+
+	simple := &email.Email{To: []string{"to@example.com"}, Subject: "Simple", TextBody: "Hello"}
+	withAttachment := &email.Email{
+		To:       []string{"to@example.com"},
+		Subject:  "Raw",
+		TextBody: "Hello",
+		Attachments: []email.Attachment{
+			{Filename: "test.txt", ContentType: "text/plain", Content: []byte("file content")},
+		},
+	}
+
+	for _, msg := range []*email.Email{simple, withAttachment} {
+		mock := &mockSESClient{}
+		p := NewWithClient("sender@example.com", mock)
+		p.configurationSet = "transactional"
+
+		if err := p.Send(context.Background(), msg); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := aws.ToString(mock.lastInput.ConfigurationSetName); got != "transactional" {
+			t.Errorf("%s: ConfigurationSetName: got %q, want %q", msg.Subject, got, "transactional")
+		}
+
+		mock = &mockSESClient{}
+		p = NewWithClient("sender@example.com", mock)
+		if err := p.Send(context.Background(), msg); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if mock.lastInput.ConfigurationSetName != nil {
+			t.Errorf("%s: ConfigurationSetName: got %q, want nil", msg.Subject, *mock.lastInput.ConfigurationSetName)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	t.Parallel()
+
+	tags, err := parseTags([]string{"env=prod", " team = billing "})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]string{"env": "prod", "team": "billing"}
+	if len(tags) != len(want) {
+		t.Fatalf("tags: got %d, want %d", len(tags), len(want))
+	}
+	for _, tag := range tags {
+		if got := aws.ToString(tag.Value); got != want[aws.ToString(tag.Name)] {
+			t.Errorf("tag %q: got %q, want %q", aws.ToString(tag.Name), got, want[aws.ToString(tag.Name)])
+		}
+	}
+
+	for _, bad := range []string{"env", "=prod"} {
+		if _, err := parseTags([]string{bad}); err == nil {
+			t.Errorf("parseTags(%q): expected error", bad)
+		}
+	}
+}
+
+func TestSend_EmailTags(t *testing.T) {
+	t.Parallel()
+
+	tags, err := parseTags([]string{"env=prod", "team=billing"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	simple := &email.Email{To: []string{"to@example.com"}, Subject: "Simple", TextBody: "Hello"}
+	withAttachment := &email.Email{
+		To:       []string{"to@example.com"},
+		Subject:  "Raw",
+		TextBody: "Hello",
+		Attachments: []email.Attachment{
+			{Filename: "test.txt", ContentType: "text/plain", Content: []byte("file content")},
+		},
+	}
+
+	for _, msg := range []*email.Email{simple, withAttachment} {
+		mock := &mockSESClient{}
+		p := NewWithClient("sender@example.com", mock)
+		p.tags = tags
+
+		if err := p.Send(context.Background(), msg); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got := mock.lastInput.EmailTags
+		if len(got) != 2 || aws.ToString(got[0].Name) != "env" || aws.ToString(got[1].Value) != "billing" {
+			t.Errorf("%s: EmailTags: got %v, want env=prod, team=billing", msg.Subject, got)
+		}
+	}
+}
+
+func TestSend_FromAddress(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name         string
+		preserveFrom bool
+		msgFrom      string
+		want         string
+	}{
+		{name: "configured sender", preserveFrom: false, msgFrom: "alice@example.com", want: "sender@example.com"},
+		{name: "preserve from", preserveFrom: true, msgFrom: "alice@example.com", want: "alice@example.com"},
+		{name: "preserve from without header", preserveFrom: true, msgFrom: "", want: "sender@example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			mock := &mockSESClient{}
+			p := NewWithClient("sender@example.com", mock)
+			p.preserveFrom = tt.preserveFrom
+
+			msg := &email.Email{
+				From:     tt.msgFrom,
+				To:       []string{"to@example.com"},
+				Subject:  "Test",
+				TextBody: "Hello",
+			}
+			if err := p.Send(context.Background(), msg); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := *mock.lastInput.FromEmailAddress; got != tt.want {
+				t.Errorf("FromEmailAddress: got %q, want %q", got, tt.want)
+			}
+
+			msg.Attachments = []email.Attachment{{Filename: "a.txt", ContentType: "text/plain", Content: []byte("a")}}
+			if err := p.Send(context.Background(), msg); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if raw := string(mock.lastInput.Content.Raw.Data); !strings.Contains(raw, "From: "+tt.want+"\r\n") {
+				t.Errorf("raw message From: want %q in\n%s", tt.want, raw)
+			}
+		})
+	}
+}
+
+func TestSendRaw(t *testing.T) {
+	t.Parallel()
+
+	raw := "Received: from client ([127.0.0.1])\r\n\tby mail.test.com\r\n" +
+		"From: Author <author@example.com>\r\n" +
+		"To: user@example.org\r\n" +
+		"Bcc: hidden@example.org\r\n" +
+		"DKIM-Signature: v=1; a=rsa-sha256;\r\n\td=example.com; b=abc\r\n" +
+		"Subject: Report\r\n" +
+		"\r\n" +
+		"From: not a header\r\n" +
+		"Body\r\n"
+	env := provider.Envelope{From: "author@example.com", Recipients: []string{"user@example.org", "hidden@example.org"}}
+
+	tests := []struct {
+		name         string
+		preserveFrom bool
+		wantFrom     string
+	}{
+		{"sender", false, "From: sender@example.com\r\n"},
+		{"preserve from", true, "From: Author <author@example.com>\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			mock := &mockSESClient{}
+			p := NewWithClient("sender@example.com", mock)
+			p.preserveFrom = tt.preserveFrom
+
+			if err := p.SendRaw(context.Background(), env, strings.NewReader(raw)); err != nil {
+				t.Fatalf("SendRaw: %v", err)
+			}
+
+			input := mock.lastInput
+			if input.Content.Raw == nil {
+				t.Fatal("expected a raw message")
+			}
+			if got := input.Destination.ToAddresses; len(got) != 2 || got[1] != "hidden@example.org" {
+				t.Errorf("destination: got %v, want the envelope recipients", got)
+			}
+
+			got := string(input.Content.Raw.Data)
+			header, body, _ := strings.Cut(got, "\r\n\r\n")
+			header += "\r\n"
+			if strings.Count(header, "From: ") != 1 || !strings.Contains(header, tt.wantFrom) {
+				t.Errorf("header section should have the single From %q:\n%s", tt.wantFrom, header)
+			}
+			for _, gone := range []string{"Bcc:", "DKIM-Signature:", "d=example.com"} {
+				if strings.Contains(header, gone) {
+					t.Errorf("header section still contains %q:\n%s", gone, header)
+				}
+			}
+			for _, kept := range []string{"Received: from client ([127.0.0.1])\r\n\tby mail.test.com\r\n", "To: user@example.org\r\n", "Subject: Report\r\n"} {
+				if !strings.Contains(header, kept) {
+					t.Errorf("header section is missing %q:\n%s", kept, header)
+				}
+			}
+			if body != "From: not a header\r\nBody\r\n" {
+				t.Errorf("body: got %q, want it unchanged", body)
+			}
+		})
+	}
+}
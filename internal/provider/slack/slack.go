@@ -0,0 +1,211 @@
+// Package slack implements a Provider that posts emails to a Slack incoming webhook.
+package slack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+)
+
+// Slack block size limits, in characters.
+const (
+	maxHeaderLength  = 150
+	maxSectionLength = 3000
+)
+
+// SlackProviderConfig holds the configuration for creating a SlackProvider.
+type SlackProviderConfig struct {
+	WebhookURL string
+}
+
+// SlackProvider posts each email as a message to a Slack incoming webhook.
+// It suits low-volume notifications: attachments are listed by name and
+// size rather than uploaded.
+type SlackProvider struct {
+	webhookURL string
+	httpClient *http.Client
+}
+
+// New creates a new SlackProvider with the given configuration.
+func New(cfg SlackProviderConfig) *SlackProvider {
+	return newWithClient(cfg, &http.Client{Timeout: 30 * time.Second})
+}
+
+// newWithClient creates a SlackProvider with a custom HTTP client, used for
+// testing.
+func newWithClient(cfg SlackProviderConfig, client *http.Client) *SlackProvider {
+	return &SlackProvider{
+		webhookURL: cfg.WebhookURL,
+		httpClient: client,
+	}
+}
+
+// payload is the request body of an incoming webhook. Text is the fallback
+// shown in notifications; Blocks is the rendered message.
+type payload struct {
+	Text   string  `json:"text"`
+	Blocks []block `json:"blocks"`
+}
+
+// block is a Block Kit layout block: a header or section with Text, or a
+// context block with Elements.
+type block struct {
+	Type     string       `json:"type"`
+	Text     *textObject  `json:"text,omitempty"`
+	Elements []textObject `json:"elements,omitempty"`
+}
+
+// textObject is a plain_text or mrkdwn text object.
+type textObject struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// Send posts the email to the webhook. Slack answers 429 when rate limited
+// and 5xx on outages; those failures are transient. Other rejections, such
+// as a malformed payload, are permanent.
+func (s *SlackProvider) Send(ctx context.Context, msg *email.Email) error {
+	bodyJSON, err := json.Marshal(buildPayload(msg))
+	if err != nil {
+		return fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.webhookURL, bytes.NewReader(bodyJSON))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Slack webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	return &webhookError{
+		statusCode: resp.StatusCode,
+		message:    strings.TrimSpace(string(body)),
+		permanent:  resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusRequestEntityTooLarge,
+	}
+}
+
+// BuildRequest returns the payload Send would post for msg, without
+// sending it.
+func (s *SlackProvider) BuildRequest(msg *email.Email) (any, error) {
+	return buildPayload(msg), nil
+}
+
+// Name returns the provider name.
+func (s *SlackProvider) Name() string {
+	return "slack"
+}
+
+// webhookError is an error response from the webhook. It implements
+// provider.PermanentError.
+type webhookError struct {
+	statusCode int
+	message    string
+	permanent  bool
+}
+
+func (e *webhookError) Error() string {
+	return fmt.Sprintf("Slack webhook error (HTTP %d): %s", e.statusCode, e.message)
+}
+
+// Permanent reports whether the webhook rejected the message itself, so
+// retrying it cannot succeed.
+func (e *webhookError) Permanent() bool {
+	return e.permanent
+}
+
+// buildPayload formats msg as a Slack message: the subject as a header, the
+// text body (or the HTML body if there is none) as a section, and the
+// addresses and attachments as context lines.
+func buildPayload(msg *email.Email) *payload {
+	subject := msg.Subject
+	if subject == "" {
+		subject = "(no subject)"
+	}
+
+	body := msg.TextBody
+	if body == "" {
+		body = msg.HtmlBody
+	}
+
+	details := []textObject{
+		{Type: "mrkdwn", Text: escape("From: " + msg.From)},
+		{Type: "mrkdwn", Text: escape("To: " + strings.Join(msg.To, ", "))},
+	}
+	if len(msg.Cc) > 0 {
+		details = append(details, textObject{Type: "mrkdwn", Text: escape("Cc: " + strings.Join(msg.Cc, ", "))})
+	}
+
+	blocks := []block{
+		{Type: "header", Text: &textObject{Type: "plain_text", Text: truncate(subject, maxHeaderLength)}},
+		{Type: "context", Elements: details},
+	}
+	if body != "" {
+		blocks = append(blocks, block{
+			Type: "section",
+			Text: &textObject{Type: "mrkdwn", Text: truncate(escape(body), maxSectionLength)},
+		})
+	}
+	if len(msg.Attachments) > 0 {
+		attachments := make([]string, 0, len(msg.Attachments))
+		for _, att := range msg.Attachments {
+			attachments = append(attachments, fmt.Sprintf("%s (%s)", att.Filename, formatSize(len(att.Content))))
+		}
+		blocks = append(blocks, block{
+			Type:     "context",
+			Elements: []textObject{{Type: "mrkdwn", Text: escape("Attachments: " + strings.Join(attachments, ", "))}},
+		})
+	}
+
+	return &payload{Text: subject, Blocks: blocks}
+}
+
+// escape escapes the characters Slack treats as control sequences in
+// message text.
+func escape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// truncate shortens s to at most max characters, marking the cut with an
+// ellipsis.
+func truncate(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:max-1]) + "…"
+}
+
+// formatSize formats a byte count into a human-readable string.
+func formatSize(bytes int) string {
+	const (
+		kb = 1024
+		mb = kb * 1024
+	)
+
+	switch {
+	case bytes >= mb:
+		return fmt.Sprintf("%.1f MB", float64(bytes)/float64(mb))
+	case bytes >= kb:
+		return fmt.Sprintf("%.1f KB", float64(bytes)/float64(kb))
+	default:
+		return fmt.Sprintf("%d B", bytes)
+	}
+}
@@ -0,0 +1,122 @@
+package slack
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+	"github.com/shineum/smtp-proxy-lite/internal/provider"
+)
+
+func TestSlackProvider_SendSuccess(t *testing.T) {
+	t.Parallel()
+
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("method: got %s, want POST", r.Method)
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Content-Type header: got %q, want %q", r.Header.Get("Content-Type"), "application/json")
+		}
+		body, _ = io.ReadAll(r.Body)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	p := newWithClient(SlackProviderConfig{WebhookURL: server.URL + "/services/T000/B000/XXXX"}, server.Client())
+
+	msg := &email.Email{
+		From:     "cron@example.com",
+		To:       []string{"ops@example.com", "dev@example.com"},
+		Subject:  "Nightly backup finished",
+		TextBody: "All 12 databases were backed up.",
+		Attachments: []email.Attachment{
+			{Filename: "backup.log", Content: make([]byte, 2048)},
+		},
+	}
+	if err := p.Send(context.Background(), msg); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	var got payload
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("failed to decode request body: %v", err)
+	}
+	if got.Text != "Nightly backup finished" {
+		t.Errorf("text: got %q, want the subject", got.Text)
+	}
+	if got.Blocks[0].Type != "header" || got.Blocks[0].Text.Text != "Nightly backup finished" {
+		t.Errorf("first block: got %+v, want a header with the subject", got.Blocks[0])
+	}
+	for _, want := range []string{
+		"All 12 databases were backed up.",
+		"To: ops@example.com, dev@example.com",
+		"backup.log (2.0 KB)",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("payload missing %q: %s", want, body)
+		}
+	}
+}
+
+func TestSlackProvider_SendErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		status        int
+		wantPermanent bool
+	}{
+		{"invalid payload", http.StatusBadRequest, true},
+		{"revoked webhook", http.StatusNotFound, false},
+		{"rate limited", http.StatusTooManyRequests, false},
+		{"outage", http.StatusServiceUnavailable, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte("invalid_payload"))
+			}))
+			defer server.Close()
+
+			p := newWithClient(SlackProviderConfig{WebhookURL: server.URL}, server.Client())
+			err := p.Send(context.Background(), &email.Email{Subject: "Alert"})
+			if err == nil {
+				t.Fatal("Send: got nil error")
+			}
+			if got := provider.IsPermanent(err); got != tt.wantPermanent {
+				t.Errorf("IsPermanent: got %v, want %v (%v)", got, tt.wantPermanent, err)
+			}
+		})
+	}
+}
+
+func TestBuildPayload(t *testing.T) {
+	t.Parallel()
+
+	got := buildPayload(&email.Email{
+		HtmlBody: "<p>a & b</p>",
+	})
+	if got.Text != "(no subject)" {
+		t.Errorf("text: got %q, want %q", got.Text, "(no subject)")
+	}
+	section := got.Blocks[len(got.Blocks)-1]
+	if section.Type != "section" || section.Text.Text != "&lt;p&gt;a &amp; b&lt;/p&gt;" {
+		t.Errorf("body section: got %+v, want the escaped HTML body", section)
+	}
+
+	long := buildPayload(&email.Email{Subject: strings.Repeat("x", 200)})
+	if n := len([]rune(long.Blocks[0].Text.Text)); n != maxHeaderLength {
+		t.Errorf("header length: got %d, want %d", n, maxHeaderLength)
+	}
+}
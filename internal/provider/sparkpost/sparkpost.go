@@ -0,0 +1,271 @@
+package sparkpost
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+	"github.com/shineum/smtp-proxy-lite/internal/provider"
+)
+
+// defaultBaseURL is the SparkPost API root. EU accounts use
+// https://api.eu.sparkpost.com/api/v1 instead.
+const defaultBaseURL = "https://api.sparkpost.com/api/v1"
+
+// defaultMaxRetries is the default maximum number of retry attempts for
+// transient failures.
+const defaultMaxRetries = 3
+
+// defaultRetryBaseDelay is the default initial delay for exponential backoff.
+const defaultRetryBaseDelay = 1 * time.Second
+
+// SparkPostProviderConfig holds the configuration for creating a
+// SparkPostProvider.
+type SparkPostProviderConfig struct {
+	APIKey string
+	Sender string
+
+	// BaseURL is the API root; empty uses the US endpoint.
+	BaseURL string
+
+	// PreserveFrom sends with the message's own From address rather than
+	// Sender. Its domain must be a verified SparkPost sending domain.
+	PreserveFrom bool
+
+	// MaxRetries is the number of retries after a transient failure; nil
+	// uses the default of 3, and zero disables retries. RetryBaseDelay is
+	// the first backoff delay, doubled on each retry; zero uses 1s.
+	MaxRetries     *int
+	RetryBaseDelay time.Duration
+}
+
+// SparkPostProvider sends emails via the SparkPost Transmissions API,
+// authenticating with an API key.
+type SparkPostProvider struct {
+	apiKey         string
+	sender         string
+	preserveFrom   bool
+	maxRetries     int
+	retryBaseDelay time.Duration
+	transmitURL    string
+	httpClient     *http.Client
+}
+
+// New creates a new SparkPostProvider with the given configuration.
+func New(cfg SparkPostProviderConfig) *SparkPostProvider {
+	return newWithOverrides(cfg, &http.Client{Timeout: 30 * time.Second})
+}
+
+// newWithOverrides creates a SparkPostProvider with a custom HTTP client,
+// used for testing.
+func newWithOverrides(cfg SparkPostProviderConfig, client *http.Client) *SparkPostProvider {
+	baseURL := strings.TrimSuffix(cmp.Or(cfg.BaseURL, defaultBaseURL), "/")
+	return &SparkPostProvider{
+		apiKey:         cfg.APIKey,
+		sender:         cfg.Sender,
+		preserveFrom:   cfg.PreserveFrom,
+		maxRetries:     maxRetries(cfg.MaxRetries),
+		retryBaseDelay: cmp.Or(cfg.RetryBaseDelay, defaultRetryBaseDelay),
+		transmitURL:    baseURL + "/transmissions",
+		httpClient:     client,
+	}
+}
+
+// Send delivers an email message via the SparkPost Transmissions API.
+// HTTP 429 and 5xx responses are retried with exponential backoff,
+// respecting the Retry-After header.
+func (s *SparkPostProvider) Send(ctx context.Context, msg *email.Email) error {
+	bodyJSON, err := json.Marshal(buildTransmission(s.fromAddress(msg), msg))
+	if err != nil {
+		return fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= s.maxRetries; attempt++ {
+		if attempt > 0 {
+			slog.Debug("retrying SparkPost API request",
+				"attempt", attempt,
+				"max_retries", s.maxRetries,
+			)
+		}
+
+		err := s.doSendRequest(ctx, bodyJSON)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+
+		sendErr, ok := err.(*sendError)
+		if !ok || !sendErr.transient {
+			return err
+		}
+		if attempt == s.maxRetries {
+			// No retries left, so don't wait for one
+			break
+		}
+
+		delay := s.retryDelay(sendErr.retryAfter, attempt)
+		slog.Info("transient SparkPost API error, retrying",
+			"status", sendErr.statusCode,
+			"delay", delay,
+		)
+		if err := sleepWithContext(ctx, delay); err != nil {
+			return fmt.Errorf("context cancelled during retry wait: %w", err)
+		}
+	}
+
+	return fmt.Errorf("SparkPost API request failed after %d retries: %w", s.maxRetries, lastErr)
+}
+
+// BuildRequest returns the request body Send would post for msg, without
+// sending it.
+func (s *SparkPostProvider) BuildRequest(msg *email.Email) (any, error) {
+	return buildTransmission(s.fromAddress(msg), msg), nil
+}
+
+// fromAddress returns the From address to send msg with: the message's own
+// From when PreserveFrom is set and it has one, otherwise the configured
+// sender.
+func (s *SparkPostProvider) fromAddress(msg *email.Email) string {
+	if s.preserveFrom && msg.From != "" {
+		return msg.From
+	}
+	return s.sender
+}
+
+// Name returns the provider name.
+func (s *SparkPostProvider) Name() string {
+	return "sparkpost"
+}
+
+// doSendRequest performs a single HTTP request to the transmissions endpoint.
+func (s *SparkPostProvider) doSendRequest(ctx context.Context, bodyJSON []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.transmitURL, bytes.NewReader(bodyJSON))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", s.apiKey)
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return &sendError{
+			message:   fmt.Sprintf("HTTP request failed: %v", err),
+			transient: true,
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	message := string(body)
+	var errResp errorResponse
+	if json.Unmarshal(body, &errResp) == nil && errResp.errorMessage() != "" {
+		message = errResp.errorMessage()
+	}
+	return classifyError(resp.StatusCode, message, resp.Header.Get("Retry-After"))
+}
+
+// sendError represents an error from the SparkPost API send operation with
+// classification for retry logic. It implements provider.PermanentError.
+type sendError struct {
+	message    string
+	statusCode int
+	permanent  bool
+	transient  bool
+	retryAfter string
+}
+
+func (e *sendError) Error() string {
+	return fmt.Sprintf("SparkPost API error (HTTP %d): %s", e.statusCode, e.message)
+}
+
+// Unwrap returns a provider.MessageTooLargeError for a message refused for
+// its size, so the SMTP session can reply 552.
+func (e *sendError) Unwrap() error {
+	if e.statusCode == http.StatusRequestEntityTooLarge {
+		return &provider.MessageTooLargeError{Reason: "Message too big for SparkPost"}
+	}
+	return nil
+}
+
+// Permanent reports whether the error is a permanent failure that should not
+// be retried or delivered through a fallback provider.
+func (e *sendError) Permanent() bool {
+	return e.permanent
+}
+
+// classifyError categorizes an HTTP error response for retry decisions.
+// Authentication failures are neither retried nor permanent: the message
+// itself is fine, so another provider may still deliver it.
+func classifyError(statusCode int, message, retryAfter string) *sendError {
+	err := &sendError{
+		message:    message,
+		statusCode: statusCode,
+		retryAfter: retryAfter,
+	}
+
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		// Bad or under-privileged API key: not retried, but not the message's fault
+	case statusCode == http.StatusTooManyRequests:
+		err.transient = true
+	case statusCode >= 500:
+		err.transient = true
+	default:
+		err.permanent = true
+	}
+
+	return err
+}
+
+// retryDelay returns the delay before the next attempt: the Retry-After
+// header value if it holds a number of seconds, otherwise exponential
+// backoff.
+func (s *SparkPostProvider) retryDelay(retryAfter string, attempt int) time.Duration {
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return backoffDelay(s.retryBaseDelay, attempt)
+}
+
+// backoffDelay returns the exponential backoff delay for the given attempt
+// number, starting from base. With the default base, delays are: 1s, 2s, 4s
+func backoffDelay(base time.Duration, attempt int) time.Duration {
+	delay := base
+	for i := 0; i < attempt; i++ {
+		delay *= 2
+	}
+	return delay
+}
+
+// sleepWithContext waits for the specified duration or until the context is cancelled.
+func sleepWithContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// maxRetries returns the configured retry count, or defaultMaxRetries if
+// none is configured.
+func maxRetries(configured *int) int {
+	if configured == nil {
+		return defaultMaxRetries
+	}
+	return *configured
+}
@@ -0,0 +1,264 @@
+package sparkpost
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+	"github.com/shineum/smtp-proxy-lite/internal/provider"
+)
+
+func TestBuildTransmission(t *testing.T) {
+	t.Parallel()
+
+	msg := &email.Email{
+		To:       []string{"Alice <alice@example.com>"},
+		Cc:       []string{"carol@example.com"},
+		Bcc:      []string{"hidden@example.com"},
+		Subject:  "Report",
+		TextBody: "Hello",
+		HtmlBody: "<p>Hello</p>",
+		Attachments: []email.Attachment{
+			{Filename: "report.pdf", ContentType: "application/pdf", Content: []byte("%PDF")},
+			{Filename: "data.bin", Content: []byte{0, 1}},
+		},
+	}
+
+	data, err := json.Marshal(buildTransmission("Sender <sender@example.com>", msg))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	want := `{"recipients":[` +
+		`{"address":{"email":"alice@example.com","name":"Alice"}},` +
+		`{"address":{"email":"carol@example.com","header_to":"Alice \u003calice@example.com\u003e"}},` +
+		`{"address":{"email":"hidden@example.com","header_to":"Alice \u003calice@example.com\u003e"}}],` +
+		`"content":{` +
+		`"from":{"email":"sender@example.com","name":"Sender"},` +
+		`"subject":"Report",` +
+		`"text":"Hello",` +
+		`"html":"\u003cp\u003eHello\u003c/p\u003e",` +
+		`"headers":{"CC":"carol@example.com"},` +
+		`"attachments":[` +
+		`{"name":"report.pdf","type":"application/pdf","data":"JVBERg=="},` +
+		`{"name":"data.bin","type":"application/octet-stream","data":"AAE="}]}}`
+	if string(data) != want {
+		t.Errorf("request body:\n got %s\nwant %s", data, want)
+	}
+}
+
+func TestBuildTransmission_OmitsEmptyFields(t *testing.T) {
+	t.Parallel()
+
+	data, err := json.Marshal(buildTransmission("sender@example.com", &email.Email{
+		To:       []string{"alice@example.com"},
+		TextBody: "Hello",
+	}))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	for _, key := range []string{`"header_to"`, `"html"`, `"headers"`, `"attachments"`} {
+		if strings.Contains(string(data), key) {
+			t.Errorf("request body contains %s: %s", key, data)
+		}
+	}
+}
+
+func TestSparkPostProvider_SendSuccess(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/transmissions" {
+			t.Errorf("path: got %q, want %q", r.URL.Path, "/api/v1/transmissions")
+		}
+		if r.Header.Get("Authorization") != "api-key" {
+			t.Errorf("Authorization header: got %q, want %q", r.Header.Get("Authorization"), "api-key")
+		}
+
+		var body transmission
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("failed to decode request body: %v", err)
+		}
+		if body.Content.Subject != "Test" || body.Content.From.Email != "sender@example.com" || len(body.Recipients) != 1 {
+			t.Errorf("request body: got %+v", body)
+		}
+
+		w.Write([]byte(`{"results":{"total_accepted_recipients":1,"total_rejected_recipients":0,"id":"1"}}`))
+	}))
+	defer server.Close()
+
+	p := newWithOverrides(SparkPostProviderConfig{
+		APIKey:  "api-key",
+		Sender:  "sender@example.com",
+		BaseURL: server.URL + "/api/v1/",
+	}, server.Client())
+
+	msg := &email.Email{
+		From:     "author@example.com",
+		To:       []string{"user@example.com"},
+		Subject:  "Test",
+		TextBody: "Body",
+	}
+	if err := p.Send(context.Background(), msg); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+}
+
+func TestSparkPostProvider_RetriesTransientErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusBadGateway} {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) < 3 {
+				w.WriteHeader(status)
+				return
+			}
+			w.Write([]byte(`{"results":{"id":"1"}}`))
+		}))
+
+		p := newWithOverrides(SparkPostProviderConfig{
+			Sender:         "sender@example.com",
+			BaseURL:        server.URL,
+			RetryBaseDelay: time.Millisecond,
+		}, server.Client())
+
+		err := p.Send(context.Background(), &email.Email{To: []string{"user@example.com"}, TextBody: "Body"})
+		server.Close()
+		if err != nil {
+			t.Errorf("HTTP %d: Send: %v", status, err)
+		}
+		if got := calls.Load(); got != 3 {
+			t.Errorf("HTTP %d: calls: got %d, want 3", status, got)
+		}
+	}
+}
+
+func TestSparkPostProvider_RetriesExhausted(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	retries := 2
+	p := newWithOverrides(SparkPostProviderConfig{
+		Sender:         "sender@example.com",
+		BaseURL:        server.URL,
+		MaxRetries:     &retries,
+		RetryBaseDelay: time.Millisecond,
+	}, server.Client())
+
+	err := p.Send(context.Background(), &email.Email{To: []string{"user@example.com"}, TextBody: "Body"})
+	if err == nil {
+		t.Fatal("Send: got nil error, want failure after retries")
+	}
+	if provider.IsPermanent(err) {
+		t.Errorf("error %v is permanent, want transient", err)
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("calls: got %d, want 3", got)
+	}
+}
+
+func TestSparkPostProvider_ZeroMaxRetriesSendsOnce(t *testing.T) {
+	t.Parallel()
+
+	// Neither a long backoff nor Retry-After delays the error, since
+	// there is no retry to wait for
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(status)
+		}))
+
+		retries := 0
+		p := newWithOverrides(SparkPostProviderConfig{
+			Sender:         "sender@example.com",
+			BaseURL:        server.URL,
+			MaxRetries:     &retries,
+			RetryBaseDelay: 10 * time.Second,
+		}, server.Client())
+
+		start := time.Now()
+		err := p.Send(context.Background(), &email.Email{To: []string{"user@example.com"}, TextBody: "Body"})
+		elapsed := time.Since(start)
+		server.Close()
+		if err == nil {
+			t.Errorf("HTTP %d: Send: got nil error, want failure", status)
+		}
+		if got := calls.Load(); got != 1 {
+			t.Errorf("HTTP %d: calls: got %d, want 1", status, got)
+		}
+		if elapsed > time.Second {
+			t.Errorf("HTTP %d: Send took %s, want no retry wait", status, elapsed)
+		}
+	}
+}
+func TestSparkPostProvider_ClientErrorNotRetried(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"errors":[{"message":"Invalid domain","description":"Unconfigured Sending Domain","code":"7001"}]}`))
+	}))
+	defer server.Close()
+
+	p := newWithOverrides(SparkPostProviderConfig{
+		Sender:         "sender@example.com",
+		BaseURL:        server.URL,
+		RetryBaseDelay: time.Millisecond,
+	}, server.Client())
+
+	err := p.Send(context.Background(), &email.Email{To: []string{"user@example.com"}, TextBody: "Body"})
+	if err == nil {
+		t.Fatal("Send: got nil error, want a rejection")
+	}
+	if !provider.IsPermanent(err) {
+		t.Errorf("error %v is not permanent", err)
+	}
+	if !strings.Contains(err.Error(), "Unconfigured Sending Domain") {
+		t.Errorf("error %q does not carry the SparkPost message", err)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("calls: got %d, want 1", got)
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		status        int
+		wantTransient bool
+		wantPermanent bool
+	}{
+		{http.StatusBadRequest, false, true},
+		{http.StatusUnauthorized, false, false},
+		{http.StatusForbidden, false, false},
+		{http.StatusTooManyRequests, true, false},
+		{http.StatusInternalServerError, true, false},
+		{http.StatusServiceUnavailable, true, false},
+	}
+
+	for _, tt := range tests {
+		err := classifyError(tt.status, "error", "")
+		if err.transient != tt.wantTransient || err.permanent != tt.wantPermanent {
+			t.Errorf("HTTP %d: got transient=%v permanent=%v, want transient=%v permanent=%v",
+				tt.status, err.transient, err.permanent, tt.wantTransient, tt.wantPermanent)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Package sparkpost implements a Provider that sends emails via the SparkPost Transmissions API.
+package sparkpost
+
+import (
+	"encoding/base64"
+	"net/mail"
+	"strings"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+)
+
+// transmission is the request body for the Transmissions API.
+type transmission struct {
+	Recipients []recipient `json:"recipients"`
+	Content    content     `json:"content"`
+}
+
+// recipient is a single delivery address.
+type recipient struct {
+	Address recipientAddress `json:"address"`
+}
+
+// recipientAddress is the address of a recipient. HeaderTo is the To
+// header shown to Cc and Bcc recipients; it is empty for primary recipients.
+type recipientAddress struct {
+	Email    string `json:"email"`
+	Name     string `json:"name,omitempty"`
+	HeaderTo string `json:"header_to,omitempty"`
+}
+
+// content is the inline message content of a transmission.
+type content struct {
+	From        sender            `json:"from"`
+	Subject     string            `json:"subject"`
+	Text        string            `json:"text,omitempty"`
+	HTML        string            `json:"html,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Attachments []attachment      `json:"attachments,omitempty"`
+}
+
+// sender is the From address, with an optional display name.
+type sender struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+// attachment is a file attached to a message.
+type attachment struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Data string `json:"data"`
+}
+
+// errorResponse is the body of a failed Transmissions API request.
+type errorResponse struct {
+	Errors []struct {
+		Message     string `json:"message"`
+		Description string `json:"description"`
+	} `json:"errors"`
+}
+
+// errorMessage returns the first error in the response, or empty.
+func (r *errorResponse) errorMessage() string {
+	if len(r.Errors) == 0 {
+		return ""
+	}
+	if r.Errors[0].Description != "" {
+		return r.Errors[0].Message + ": " + r.Errors[0].Description
+	}
+	return r.Errors[0].Message
+}
+
+// buildTransmission converts an email.Email into a Transmissions API request
+// body, sent from the given address.
+//
+// SparkPost has no Cc or Bcc fields: every address is a recipient, and Cc
+// and Bcc recipients carry the primary To addresses in header_to so they see
+// the same To header. Cc addresses are listed in a CC header; Bcc addresses
+// appear in no header.
+func buildTransmission(from string, msg *email.Email) *transmission {
+	headerTo := strings.Join(msg.To, ", ")
+
+	recipients := make([]recipient, 0, len(msg.To)+len(msg.Cc)+len(msg.Bcc))
+	for _, raw := range msg.To {
+		recipients = append(recipients, newRecipient(raw, ""))
+	}
+	for _, raw := range msg.Cc {
+		recipients = append(recipients, newRecipient(raw, headerTo))
+	}
+	for _, raw := range msg.Bcc {
+		recipients = append(recipients, newRecipient(raw, headerTo))
+	}
+
+	var headers map[string]string
+	if len(msg.Cc) > 0 {
+		headers = map[string]string{"CC": strings.Join(msg.Cc, ", ")}
+	}
+
+	attachments := make([]attachment, 0, len(msg.Attachments))
+	for _, att := range msg.Attachments {
+		contentType := att.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		attachments = append(attachments, attachment{
+			Name: att.Filename,
+			Type: contentType,
+			Data: base64.StdEncoding.EncodeToString(att.Content),
+		})
+	}
+
+	fromAddr := newRecipient(from, "").Address
+	return &transmission{
+		Recipients: recipients,
+		Content: content{
+			From:        sender{Email: fromAddr.Email, Name: fromAddr.Name},
+			Subject:     msg.Subject,
+			Text:        msg.TextBody,
+			HTML:        msg.HtmlBody,
+			Headers:     headers,
+			Attachments: attachments,
+		},
+	}
+}
+
+// newRecipient builds a recipient from an address that may carry a display
+// name (e.g. "Alice <alice@example.com>"). Unparseable addresses are used
+// verbatim.
+func newRecipient(raw, headerTo string) recipient {
+	addr, err := mail.ParseAddress(raw)
+	if err != nil {
+		return recipient{Address: recipientAddress{Email: raw, HeaderTo: headerTo}}
+	}
+	return recipient{Address: recipientAddress{Email: addr.Address, Name: addr.Name, HeaderTo: headerTo}}
+}
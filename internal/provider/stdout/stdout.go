@@ -42,6 +42,13 @@ func (p *Provider) Send(_ context.Context, msg *email.Email) error {
 	}
 
 	b.WriteString(fmt.Sprintf("Subject: %s\n", msg.Subject))
+
+	for _, name := range []string{"List-Unsubscribe", "List-Unsubscribe-Post"} {
+		for _, value := range msg.RawHeaders[name] {
+			b.WriteString(fmt.Sprintf("%s: %s\n", name, value))
+		}
+	}
+
 	b.WriteString("Body:\n")
 
 	body := msg.TextBody
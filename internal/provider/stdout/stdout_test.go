@@ -198,6 +198,37 @@ func TestSend_MultipleRecipients(t *testing.T) {
 	}
 }
 
+func TestSend_ListUnsubscribeHeaders(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	p := NewWithWriter(&buf)
+
+	msg := &email.Email{
+		From:     "sender@example.com",
+		To:       []string{"recipient@example.com"},
+		Subject:  "Newsletter",
+		TextBody: "Hello",
+		RawHeaders: map[string][]string{
+			"List-Unsubscribe":      {"<https://example.com/unsub?id=42>"},
+			"List-Unsubscribe-Post": {"List-Unsubscribe=One-Click"},
+		},
+	}
+
+	err := p.Send(context.Background(), msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	output := buf.String()
+	if !strings.Contains(output, "List-Unsubscribe: <https://example.com/unsub?id=42>\n") {
+		t.Error("output missing List-Unsubscribe header")
+	}
+	if !strings.Contains(output, "List-Unsubscribe-Post: List-Unsubscribe=One-Click\n") {
+		t.Error("output missing List-Unsubscribe-Post header")
+	}
+}
+
 func TestName(t *testing.T) {
 	t.Parallel()
 
@@ -0,0 +1,33 @@
+package provider
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName names the tracer of the spans recorded by providers.
+const tracerName = "github.com/shineum/smtp-proxy-lite/internal/provider"
+
+// StartSpan starts a span for an API request made by a provider, as a
+// child of the span in ctx. It uses the global tracer, a no-op unless
+// tracing is set up.
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+// EndSpan ends a span started by StartSpan, recording err, if any, as its
+// outcome.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
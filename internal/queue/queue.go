@@ -0,0 +1,433 @@
+// Package queue provides a file-backed spool of messages awaiting
+// delivery, retried in the background until the provider accepts them.
+package queue
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+	"github.com/shineum/smtp-proxy-lite/internal/provider"
+)
+
+// defaultMaxAttempts is the default number of delivery attempts before a
+// message is dead-lettered.
+const defaultMaxAttempts = 10
+
+// defaultRetryDelay is the default wait after the first failed attempt; it
+// doubles with each further failure.
+const defaultRetryDelay = time.Minute
+
+// maxRetryDelay caps the wait between attempts.
+const maxRetryDelay = time.Hour
+
+// defaultWorkers is the default number of delivery workers.
+const defaultWorkers = 2
+
+// pollInterval is the longest an idle worker waits before looking for
+// due messages again.
+const pollInterval = time.Second
+
+// entrySuffix marks spooled message files.
+const entrySuffix = ".json"
+
+// Config holds the configuration for a Spool.
+type Config struct {
+	// Dir is the spool directory. It is created if missing.
+	Dir string
+
+	// DeadLetterDir receives messages that failed permanently or ran out
+	// of attempts. Empty uses Dir/dead.
+	DeadLetterDir string
+
+	// Provider delivers spooled messages.
+	Provider provider.Provider
+
+	// MaxAttempts is the number of delivery attempts before a message is
+	// dead-lettered. Zero uses the default (10).
+	MaxAttempts int
+
+	// RetryDelay is the wait after the first failed attempt; it doubles
+	// with each further failure, up to an hour. Zero uses the default (1m).
+	RetryDelay time.Duration
+
+	// Workers is the number of messages delivered concurrently. Zero uses
+	// the default (2).
+	Workers int
+}
+
+// entry is a spooled message and its delivery state, stored as JSON.
+type entry struct {
+	ID          string      `json:"id"`
+	EnqueuedAt  time.Time   `json:"enqueued_at"`
+	Attempts    int         `json:"attempts"`
+	NextAttempt time.Time   `json:"next_attempt"`
+	LastError   string      `json:"last_error,omitempty"`
+	Message     email.Email `json:"message"`
+}
+
+// Spool is a durable delivery queue. Each message is a JSON file in the
+// spool directory, so messages survive a restart; Run delivers them through
+// the provider, retrying transient failures with exponential backoff and
+// moving messages that fail permanently, or too often, to the dead-letter
+// directory. A spool directory must not be shared between processes.
+type Spool struct {
+	dir         string
+	deadDir     string
+	provider    provider.Provider
+	maxAttempts int
+	retryDelay  time.Duration
+	workers     int
+
+	// wake tells an idle worker that a message was enqueued.
+	wake chan struct{}
+
+	mu sync.Mutex
+	// pending maps the ID of each spooled message to the time of its next
+	// attempt; claimed holds the IDs a worker is delivering.
+	pending map[string]time.Time
+	claimed map[string]bool
+}
+
+// New creates a Spool, creating its directories and loading any messages
+// already spooled in them.
+func New(cfg Config) (*Spool, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("queue directory is required")
+	}
+	q := &Spool{
+		dir:         cfg.Dir,
+		deadDir:     cmp.Or(cfg.DeadLetterDir, filepath.Join(cfg.Dir, "dead")),
+		provider:    cfg.Provider,
+		maxAttempts: cmp.Or(cfg.MaxAttempts, defaultMaxAttempts),
+		retryDelay:  cmp.Or(cfg.RetryDelay, defaultRetryDelay),
+		workers:     cmp.Or(cfg.Workers, defaultWorkers),
+		wake:        make(chan struct{}, 1),
+		pending:     make(map[string]time.Time),
+		claimed:     make(map[string]bool),
+	}
+
+	for _, dir := range []string{q.dir, q.deadDir} {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create queue directory: %w", err)
+		}
+	}
+
+	files, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue directory: %w", err)
+	}
+	for _, f := range files {
+		id, ok := strings.CutSuffix(f.Name(), entrySuffix)
+		if !ok || f.IsDir() {
+			continue
+		}
+		e, err := q.load(id)
+		if err != nil {
+			// Scheduled at once so a worker dead-letters it
+			slog.Warn("unreadable queued message", "queue_id", id, "error", err)
+			q.pending[id] = time.Time{}
+			continue
+		}
+		q.pending[id] = e.NextAttempt
+	}
+	if len(q.pending) > 0 {
+		slog.Info("loaded queued messages", "dir", q.dir, "count", len(q.pending))
+	}
+	return q, nil
+}
+
+// Enqueue spools msg for delivery as soon as a worker is free.
+func (q *Spool) Enqueue(msg *email.Email) error {
+	now := time.Now()
+	return q.add(&entry{EnqueuedAt: now, NextAttempt: now, Message: *msg})
+}
+
+// Retry spools msg, whose delivery has just failed with sendErr, for
+// another attempt after the retry delay. The failure counts as the first
+// attempt.
+func (q *Spool) Retry(msg *email.Email, sendErr error) error {
+	now := time.Now()
+	return q.add(&entry{
+		EnqueuedAt:  now,
+		Attempts:    1,
+		NextAttempt: now.Add(q.backoff(1)),
+		LastError:   sendErr.Error(),
+		Message:     *msg,
+	})
+}
+
+// add assigns e an ID, writes it to the spool and schedules it.
+func (q *Spool) add(e *entry) error {
+	id, err := newEntryID(e.EnqueuedAt)
+	if err != nil {
+		return err
+	}
+	e.ID = id
+	if err := writeEntry(q.dir, e); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	q.pending[id] = e.NextAttempt
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Len returns the number of messages in the spool, excluding dead letters.
+func (q *Spool) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// Run delivers spooled messages until ctx is cancelled, then waits for
+// deliveries in progress to return. A delivery cut short by cancellation
+// is not counted as an attempt.
+func (q *Spool) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for range q.workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// work delivers due messages one at a time until ctx is cancelled.
+func (q *Spool) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		id, wait := q.claim(time.Now())
+		if id != "" {
+			q.deliver(ctx, id)
+			q.mu.Lock()
+			delete(q.claimed, id)
+			q.mu.Unlock()
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// claim picks the oldest due message no other worker is delivering. If
+// none is due, it returns an empty ID and the time until the next one is.
+func (q *Spool) claim(now time.Time) (string, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var due []string
+	wait := pollInterval
+	for id, next := range q.pending {
+		if q.claimed[id] {
+			continue
+		}
+		if next.After(now) {
+			wait = min(wait, next.Sub(now))
+		} else {
+			due = append(due, id)
+		}
+	}
+	if len(due) == 0 {
+		return "", wait
+	}
+	// IDs start with the enqueue time, so the smallest is the oldest
+	id := slices.Min(due)
+	q.claimed[id] = true
+	return id, 0
+}
+
+// deliver makes one delivery attempt for the spooled message id and
+// records the outcome.
+func (q *Spool) deliver(ctx context.Context, id string) {
+	e, err := q.load(id)
+	if err != nil {
+		slog.Error("failed to load queued message, dead-lettering it",
+			"queue_id", id,
+			"error", err,
+		)
+		q.deadLetterFile(id)
+		return
+	}
+
+	err = q.provider.Send(ctx, &e.Message)
+	if err == nil {
+		if err := os.Remove(q.path(id)); err != nil {
+			slog.Error("failed to remove delivered message from queue", "queue_id", id, "error", err)
+		}
+		q.forget(id)
+		slog.Info("queued message delivered",
+			"queue_id", id,
+			"provider", q.provider.Name(),
+			"message_id", e.Message.MessageID,
+			"attempts", e.Attempts+1,
+		)
+		return
+	}
+	if ctx.Err() != nil {
+		// Shutting down; leave the message for the next run
+		return
+	}
+
+	e.Attempts++
+	e.LastError = err.Error()
+	permanent := provider.IsPermanent(err)
+	if permanent || e.Attempts >= q.maxAttempts {
+		slog.Warn("queued message dead-lettered",
+			"queue_id", id,
+			"provider", q.provider.Name(),
+			"message_id", e.Message.MessageID,
+			"attempts", e.Attempts,
+			"permanent", permanent,
+			"error", err,
+		)
+		q.deadLetter(e)
+		return
+	}
+
+	e.NextAttempt = time.Now().Add(q.backoff(e.Attempts))
+	slog.Info("queued message delivery failed, will retry",
+		"queue_id", id,
+		"provider", q.provider.Name(),
+		"message_id", e.Message.MessageID,
+		"attempts", e.Attempts,
+		"next_attempt", e.NextAttempt,
+		"error", err,
+	)
+	if err := writeEntry(q.dir, e); err != nil {
+		slog.Error("failed to update queued message", "queue_id", id, "error", err)
+	}
+	q.mu.Lock()
+	q.pending[id] = e.NextAttempt
+	q.mu.Unlock()
+}
+
+// backoff returns the wait after the given number of failed attempts.
+func (q *Spool) backoff(attempts int) time.Duration {
+	delay := q.retryDelay
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
+
+// deadLetter writes e to the dead-letter directory and removes it from
+// the spool.
+func (q *Spool) deadLetter(e *entry) {
+	if err := writeEntry(q.deadDir, e); err != nil {
+		slog.Error("failed to dead-letter queued message", "queue_id", e.ID, "error", err)
+		return
+	}
+	if err := os.Remove(q.path(e.ID)); err != nil {
+		slog.Error("failed to remove dead-lettered message from queue", "queue_id", e.ID, "error", err)
+	}
+	q.forget(e.ID)
+}
+
+// deadLetterFile moves an unreadable spool file to the dead-letter
+// directory as it is.
+func (q *Spool) deadLetterFile(id string) {
+	data, err := os.ReadFile(q.path(id))
+	if err == nil {
+		err = writeFile(filepath.Join(q.deadDir, id+entrySuffix), data)
+	}
+	if err == nil || errors.Is(err, os.ErrNotExist) {
+		os.Remove(q.path(id))
+	}
+	if err != nil {
+		slog.Error("failed to dead-letter queued message", "queue_id", id, "error", err)
+	}
+	q.forget(id)
+}
+
+// forget drops id from the schedule.
+func (q *Spool) forget(id string) {
+	q.mu.Lock()
+	delete(q.pending, id)
+	q.mu.Unlock()
+}
+
+// path returns the spool file for id.
+func (q *Spool) path(id string) string {
+	return filepath.Join(q.dir, id+entrySuffix)
+}
+
+// load reads the spooled message id.
+func (q *Spool) load(id string) (*entry, error) {
+	data, err := os.ReadFile(q.path(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queued message: %w", err)
+	}
+	var e entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("failed to parse queued message %s: %w", id, err)
+	}
+	return &e, nil
+}
+
+// writeEntry stores e as dir/<id>.json.
+func writeEntry(dir string, e *entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode queued message: %w", err)
+	}
+	return writeFile(filepath.Join(dir, e.ID+entrySuffix), data)
+}
+
+// writeFile writes data to path through a temporary file and a rename, so
+// a crash never leaves a partly written message behind.
+func writeFile(path string, data []byte) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write queued message: %w", err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write queued message: %w", err)
+	}
+	return nil
+}
+
+// newEntryID returns a unique ID that sorts by enqueue time.
+func newEntryID(now time.Time) (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate queue ID: %w", err)
+	}
+	return fmt.Sprintf("%d-%s", now.UnixNano(), hex.EncodeToString(b)), nil
+}
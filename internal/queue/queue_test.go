@@ -0,0 +1,283 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+	"github.com/shineum/smtp-proxy-lite/internal/provider"
+)
+
+// flakyProvider fails the first failures sends with err, then succeeds.
+type flakyProvider struct {
+	mu       sync.Mutex
+	failures int
+	err      error
+	calls    int
+	sent     []*email.Email
+}
+
+func (f *flakyProvider) Send(_ context.Context, msg *email.Email) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.calls <= f.failures {
+		return f.err
+	}
+	f.sent = append(f.sent, msg)
+	return nil
+}
+
+func (f *flakyProvider) Name() string {
+	return "flaky"
+}
+
+func (f *flakyProvider) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+// permanentError is an error the provider will never accept.
+type permanentError struct{}
+
+func (permanentError) Error() string   { return "mailbox does not exist" }
+func (permanentError) Permanent() bool { return true }
+
+func testMessage() *email.Email {
+	return &email.Email{
+		From:        "sender@example.com",
+		To:          []string{"rcpt@example.com"},
+		Subject:     "Queued",
+		TextBody:    "Hello",
+		MessageID:   "<queued@example.com>",
+		Attachments: []email.Attachment{{Filename: "a.bin", Content: []byte{0, 1, 2}}},
+	}
+}
+
+// runSpool runs q until the test ends.
+func runSpool(t *testing.T, q *Spool) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		q.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// waitFor polls cond until it holds or a few seconds pass.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// spooledFiles returns the message files in dir.
+func spooledFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*"+entrySuffix))
+	if err != nil {
+		t.Fatalf("glob %s: %v", dir, err)
+	}
+	return files
+}
+
+func TestSpool_EnqueueDelivers(t *testing.T) {
+	dir := t.TempDir()
+	mem := provider.NewMemory()
+	q, err := New(Config{Dir: dir, Provider: mem})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if err := q.Enqueue(testMessage()); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	if q.Len() != 1 {
+		t.Errorf("Len: got %d, want 1", q.Len())
+	}
+	if files := spooledFiles(t, dir); len(files) != 1 {
+		t.Fatalf("spool files: got %d, want 1", len(files))
+	}
+
+	runSpool(t, q)
+	waitFor(t, "delivery", func() bool { return len(mem.Sent()) == 1 })
+	waitFor(t, "spool to empty", func() bool { return q.Len() == 0 })
+
+	got := mem.Sent()[0]
+	want := testMessage()
+	if got.Subject != want.Subject || got.MessageID != want.MessageID || string(got.Attachments[0].Content) != string(want.Attachments[0].Content) {
+		t.Errorf("delivered message: got %+v, want %+v", got, want)
+	}
+	if files := spooledFiles(t, dir); len(files) != 0 {
+		t.Errorf("spool files after delivery: %v", files)
+	}
+}
+
+func TestSpool_LoadsSpooledMessages(t *testing.T) {
+	dir := t.TempDir()
+	first, err := New(Config{Dir: dir, Provider: provider.NewMemory()})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := first.Enqueue(testMessage()); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	// A new spool on the same directory, as after a restart
+	mem := provider.NewMemory()
+	q, err := New(Config{Dir: dir, Provider: mem})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if q.Len() != 1 {
+		t.Fatalf("Len after reload: got %d, want 1", q.Len())
+	}
+
+	runSpool(t, q)
+	waitFor(t, "delivery", func() bool { return len(mem.Sent()) == 1 })
+}
+
+func TestSpool_RetriesTransientFailures(t *testing.T) {
+	dir := t.TempDir()
+	flaky := &flakyProvider{failures: 2, err: errors.New("service unavailable")}
+	q, err := New(Config{Dir: dir, Provider: flaky, RetryDelay: time.Millisecond})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if err := q.Enqueue(testMessage()); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	runSpool(t, q)
+	waitFor(t, "spool to empty", func() bool { return q.Len() == 0 })
+
+	if got := flaky.callCount(); got != 3 {
+		t.Errorf("provider calls: got %d, want 3", got)
+	}
+	if files := spooledFiles(t, filepath.Join(dir, "dead")); len(files) != 0 {
+		t.Errorf("dead letters: %v", files)
+	}
+}
+
+func TestSpool_Retry(t *testing.T) {
+	q, err := New(Config{Dir: t.TempDir(), Provider: provider.NewMemory(), RetryDelay: time.Hour})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if err := q.Retry(testMessage(), errors.New("throttled")); err != nil {
+		t.Fatalf("Retry: %v", err)
+	}
+	if id, _ := q.claim(time.Now()); id != "" {
+		t.Error("message claimed before its retry delay")
+	}
+	id, _ := q.claim(time.Now().Add(2 * time.Hour))
+	if id == "" {
+		t.Fatal("message not claimed after its retry delay")
+	}
+
+	e, err := q.load(id)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if e.Attempts != 1 || e.LastError != "throttled" {
+		t.Errorf("entry: got attempts %d, last error %q; want 1, %q", e.Attempts, e.LastError, "throttled")
+	}
+}
+
+func TestSpool_DeadLetter(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		wantCalls int
+	}{
+		{"attempts exhausted", errors.New("service unavailable"), 3},
+		{"permanent failure", permanentError{}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			deadDir := filepath.Join(t.TempDir(), "dead-letters")
+			flaky := &flakyProvider{failures: 100, err: tt.err}
+			q, err := New(Config{
+				Dir:           dir,
+				DeadLetterDir: deadDir,
+				Provider:      flaky,
+				MaxAttempts:   3,
+				RetryDelay:    time.Millisecond,
+			})
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+
+			if err := q.Enqueue(testMessage()); err != nil {
+				t.Fatalf("Enqueue: %v", err)
+			}
+			runSpool(t, q)
+			waitFor(t, "spool to empty", func() bool { return q.Len() == 0 })
+
+			if got := flaky.callCount(); got != tt.wantCalls {
+				t.Errorf("provider calls: got %d, want %d", got, tt.wantCalls)
+			}
+			if files := spooledFiles(t, dir); len(files) != 0 {
+				t.Errorf("spool files after dead-lettering: %v", files)
+			}
+			dead := spooledFiles(t, deadDir)
+			if len(dead) != 1 {
+				t.Fatalf("dead letters: got %d, want 1", len(dead))
+			}
+
+			data, err := os.ReadFile(dead[0])
+			if err != nil {
+				t.Fatalf("read dead letter: %v", err)
+			}
+			var e entry
+			if err := json.Unmarshal(data, &e); err != nil {
+				t.Fatalf("parse dead letter: %v", err)
+			}
+			if e.Attempts != tt.wantCalls || e.LastError != tt.err.Error() {
+				t.Errorf("dead letter: got attempts %d, last error %q; want %d, %q",
+					e.Attempts, e.LastError, tt.wantCalls, tt.err.Error())
+			}
+			if e.Message.MessageID != testMessage().MessageID {
+				t.Errorf("dead letter message ID: got %q", e.Message.MessageID)
+			}
+		})
+	}
+}
+
+func TestSpool_UnreadableEntryDeadLettered(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "1-broken"+entrySuffix), []byte("{not json"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := New(Config{Dir: dir, Provider: provider.NewMemory()})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	runSpool(t, q)
+	waitFor(t, "spool to empty", func() bool { return q.Len() == 0 })
+
+	if dead := spooledFiles(t, filepath.Join(dir, "dead")); len(dead) != 1 {
+		t.Errorf("dead letters: got %d, want 1", len(dead))
+	}
+}
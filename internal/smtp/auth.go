@@ -2,45 +2,82 @@
 package smtp
 
 import (
+	"bufio"
 	"encoding/base64"
 	"fmt"
+	"os"
+	"slices"
 	"strings"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
+// User is an account loaded from a users file.
+type User struct {
+	// Name is the AUTH username.
+	Name string
+
+	// PasswordHash is the bcrypt hash of the user's password.
+	PasswordHash []byte
+
+	// AllowedDomains restricts the MAIL FROM domains the user may send
+	// from. Empty allows any domain.
+	AllowedDomains []string
+}
+
 // Authenticator handles SMTP AUTH verification against configured credentials.
 type Authenticator struct {
 	username string
 	password string
+
+	// users holds accounts from a users file, keyed by name.
+	users map[string]User
 }
 
-// NewAuthenticator creates an Authenticator with the given credentials.
-// If both username and password are empty, authentication is disabled.
-func NewAuthenticator(username, password string) *Authenticator {
-	return &Authenticator{
+// NewAuthenticator creates an Authenticator with the given credentials and
+// optional file-based users. If username, password and users are all
+// empty, authentication is disabled.
+func NewAuthenticator(username, password string, users ...User) *Authenticator {
+	a := &Authenticator{
 		username: username,
 		password: password,
 	}
+	if len(users) > 0 {
+		a.users = make(map[string]User, len(users))
+		for _, u := range users {
+			a.users[u.Name] = u
+		}
+	}
+	return a
 }
 
 // Enabled returns true if authentication credentials are configured.
 func (a *Authenticator) Enabled() bool {
-	return a.username != "" && a.password != ""
+	return (a.username != "" && a.password != "") || len(a.users) > 0
 }
 
 // VerifyPlain decodes and verifies an AUTH PLAIN response.
 // AUTH PLAIN format: base64(\0username\0password)
 // Returns nil on success or an error describing the failure.
 func (a *Authenticator) VerifyPlain(encoded string) error {
+	_, err := a.AuthenticatePlain(encoded)
+	return err
+}
+
+// AuthenticatePlain is like VerifyPlain but also returns the authenticated
+// username. When the credentials decode but do not match, the attempted
+// username is returned along with the error so the failure can be logged.
+func (a *Authenticator) AuthenticatePlain(encoded string) (string, error) {
 	decoded, err := base64.StdEncoding.DecodeString(encoded)
 	if err != nil {
-		return fmt.Errorf("invalid base64 encoding")
+		return "", fmt.Errorf("invalid base64 encoding")
 	}
 
 	// AUTH PLAIN format: \0username\0password
 	// or: authzid\0authcid\0password
 	parts := strings.SplitN(string(decoded), "\x00", 3)
 	if len(parts) != 3 {
-		return fmt.Errorf("invalid AUTH PLAIN format")
+		return "", fmt.Errorf("invalid AUTH PLAIN format")
 	}
 
 	// parts[0] is authorization identity (ignored)
@@ -49,29 +86,114 @@ func (a *Authenticator) VerifyPlain(encoded string) error {
 	user := parts[1]
 	pass := parts[2]
 
-	if user != a.username || pass != a.password {
-		return fmt.Errorf("authentication failed")
+	if !a.check(user, pass) {
+		return user, fmt.Errorf("authentication failed")
 	}
 
-	return nil
+	return user, nil
 }
 
 // VerifyLogin verifies AUTH LOGIN credentials after the challenge-response flow.
 // Both username and password should be base64-encoded.
 func (a *Authenticator) VerifyLogin(encodedUser, encodedPass string) error {
+	_, err := a.AuthenticateLogin(encodedUser, encodedPass)
+	return err
+}
+
+// AuthenticateLogin is like VerifyLogin but also returns the authenticated
+// username, or the attempted one along with the error when the credentials
+// do not match.
+func (a *Authenticator) AuthenticateLogin(encodedUser, encodedPass string) (string, error) {
 	user, err := base64.StdEncoding.DecodeString(encodedUser)
 	if err != nil {
-		return fmt.Errorf("invalid base64 username")
+		return "", fmt.Errorf("invalid base64 username")
 	}
 
 	pass, err := base64.StdEncoding.DecodeString(encodedPass)
 	if err != nil {
-		return fmt.Errorf("invalid base64 password")
+		return "", fmt.Errorf("invalid base64 password")
+	}
+
+	if !a.check(string(user), string(pass)) {
+		return string(user), fmt.Errorf("authentication failed")
+	}
+
+	return string(user), nil
+}
+
+// AllowedSender reports whether the authenticated user may use from as the
+// envelope sender. Users without domain restrictions, including the
+// statically configured AUTH user, may send from any address.
+func (a *Authenticator) AllowedSender(user, from string) bool {
+	u, ok := a.users[user]
+	if !ok || len(u.AllowedDomains) == 0 {
+		return true
+	}
+
+	at := strings.LastIndex(from, "@")
+	if at < 0 {
+		return false
+	}
+	return slices.Contains(u.AllowedDomains, strings.ToLower(from[at+1:]))
+}
+
+// check reports whether user and pass match the static credentials or a
+// file-based user.
+func (a *Authenticator) check(user, pass string) bool {
+	if a.username != "" && a.password != "" && user == a.username && pass == a.password {
+		return true
+	}
+	if u, ok := a.users[user]; ok {
+		return bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(pass)) == nil
+	}
+	return false
+}
+
+// LoadUsersFile reads SMTP AUTH accounts from path. Each non-empty line has
+// a username, a bcrypt password hash (as produced by "htpasswd -nB") and an
+// optional comma-separated list of domains the user may send from:
+//
+//	# comment
+//	alice:$2y$10$...:example.com,example.org
+//	bob:$2y$10$...
+func LoadUsersFile(path string) ([]User, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open users file: %w", err)
 	}
+	defer f.Close()
 
-	if string(user) != a.username || string(pass) != a.password {
-		return fmt.Errorf("authentication failed")
+	var users []User
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" {
+			return nil, fmt.Errorf("users file %s line %d: expected \"user:bcrypt-hash[:domain,...]\"", path, lineNum)
+		}
+		if _, err := bcrypt.Cost([]byte(fields[1])); err != nil {
+			return nil, fmt.Errorf("users file %s line %d: invalid bcrypt hash for %s", path, lineNum, fields[0])
+		}
+
+		u := User{Name: fields[0], PasswordHash: []byte(fields[1])}
+		if len(fields) == 3 {
+			for _, d := range strings.Split(fields[2], ",") {
+				if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+					u.AllowedDomains = append(u.AllowedDomains, d)
+				}
+			}
+		}
+		users = append(users, u)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read users file: %w", err)
 	}
 
-	return nil
+	return users, nil
 }
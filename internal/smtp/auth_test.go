@@ -2,7 +2,12 @@ package smtp
 
 import (
 	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestAuthenticator_Enabled(t *testing.T) {
@@ -164,3 +169,89 @@ func TestAuthenticator_VerifyLogin_InvalidBase64Pass(t *testing.T) {
 		t.Error("expected error for invalid base64 password, got nil")
 	}
 }
+
+func TestLoadUsersFile(t *testing.T) {
+	t.Parallel()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "users")
+	content := "# accounts\n" +
+		"alice:" + string(hash) + ":Alpha.example, alpha.test\n" +
+		"\n" +
+		"bob:" + string(hash) + "\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	users, err := LoadUsersFile(path)
+	if err != nil {
+		t.Fatalf("LoadUsersFile: %v", err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("got %d users, want 2", len(users))
+	}
+
+	auth := NewAuthenticator("", "", users...)
+	if !auth.Enabled() {
+		t.Error("Enabled(): got false with file users, want true")
+	}
+	if err := auth.VerifyLogin(base64.StdEncoding.EncodeToString([]byte("bob")),
+		base64.StdEncoding.EncodeToString([]byte("secret"))); err != nil {
+		t.Errorf("VerifyLogin(bob): unexpected error: %v", err)
+	}
+	if err := auth.VerifyLogin(base64.StdEncoding.EncodeToString([]byte("bob")),
+		base64.StdEncoding.EncodeToString([]byte("wrong"))); err == nil {
+		t.Error("VerifyLogin(bob) with wrong password: expected error, got nil")
+	}
+
+	tests := []struct {
+		user string
+		from string
+		want bool
+	}{
+		{user: "alice", from: "alice@alpha.example", want: true},
+		{user: "alice", from: "alice@ALPHA.TEST", want: true},
+		{user: "alice", from: "alice@beta.example", want: false},
+		{user: "alice", from: "alice", want: false},
+		{user: "bob", from: "bob@anywhere.example", want: true},
+		{user: "static", from: "static@anywhere.example", want: true},
+	}
+	for _, tt := range tests {
+		if got := auth.AllowedSender(tt.user, tt.from); got != tt.want {
+			t.Errorf("AllowedSender(%q, %q): got %v, want %v", tt.user, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestLoadUsersFile_Invalid(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{name: "missing hash", content: "alice\n", wantErr: "line 1"},
+		{name: "plaintext password", content: "alice:secret\n", wantErr: "invalid bcrypt hash"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "users")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+
+			_, err := LoadUsersFile(path)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package smtp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultAuthBanWindow is the default period over which failed AUTH
+// attempts from an IP are counted towards a ban.
+const defaultAuthBanWindow = 10 * time.Minute
+
+// defaultAuthBanDuration is the default time a banned IP is refused.
+const defaultAuthBanDuration = 15 * time.Minute
+
+// authBans counts failed AUTH attempts per client IP and bans an IP once
+// threshold failures fall within window, fail2ban style. A banned IP's new
+// connections are refused until the ban expires. It is safe for concurrent
+// use.
+type authBans struct {
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+
+	// now returns the current time; tests replace it.
+	now func() time.Time
+
+	mu        sync.Mutex
+	clients   map[string]*authBanEntry
+	lastSweep time.Time
+}
+
+// authBanEntry is the failure history of one IP.
+type authBanEntry struct {
+	failures    []time.Time
+	bannedUntil time.Time
+}
+
+// newAuthBans creates a tracker banning an IP for duration after threshold
+// failures within window.
+func newAuthBans(threshold int, window, duration time.Duration) *authBans {
+	return &authBans{
+		threshold: threshold,
+		window:    window,
+		duration:  duration,
+		now:       time.Now,
+		clients:   make(map[string]*authBanEntry),
+	}
+}
+
+// recordFailure records a failed AUTH attempt from ip and reports whether
+// it started a ban.
+func (b *authBans) recordFailure(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.sweep(now)
+
+	entry := b.clients[ip]
+	if entry == nil {
+		entry = &authBanEntry{}
+		b.clients[ip] = entry
+	}
+	if now.Before(entry.bannedUntil) {
+		return false
+	}
+
+	entry.failures = append(recentFailures(entry.failures, now.Add(-b.window)), now)
+	if len(entry.failures) < b.threshold {
+		return false
+	}
+	entry.failures = nil
+	entry.bannedUntil = now.Add(b.duration)
+	return true
+}
+
+// banned reports whether ip is currently banned.
+func (b *authBans) banned(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry := b.clients[ip]
+	return entry != nil && b.now().Before(entry.bannedUntil)
+}
+
+// sweep drops IPs with neither an active ban nor a failure inside the
+// window, at most once per window, so the table does not grow with every
+// client that ever mistyped a password. b.mu must be held.
+func (b *authBans) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < b.window {
+		return
+	}
+	b.lastSweep = now
+
+	cutoff := now.Add(-b.window)
+	for ip, entry := range b.clients {
+		entry.failures = recentFailures(entry.failures, cutoff)
+		if len(entry.failures) == 0 && !now.Before(entry.bannedUntil) {
+			delete(b.clients, ip)
+		}
+	}
+}
+
+// recentFailures returns the failures after cutoff. failures is in
+// chronological order.
+func recentFailures(failures []time.Time, cutoff time.Time) []time.Time {
+	for i, t := range failures {
+		if t.After(cutoff) {
+			return failures[i:]
+		}
+	}
+	return nil
+}
+
+// remoteIP returns the IP address of conn's remote end, without the port.
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
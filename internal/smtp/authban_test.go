@@ -0,0 +1,56 @@
+package smtp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuthBans(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	bans := newAuthBans(3, time.Minute, 10*time.Minute)
+	bans.now = func() time.Time { return now }
+
+	// Failures spread wider than the window never reach the threshold
+	for range 3 {
+		if bans.recordFailure("192.0.2.1") {
+			t.Fatal("ban started by failures outside the window")
+		}
+		now = now.Add(40 * time.Second)
+	}
+	if bans.banned("192.0.2.1") {
+		t.Fatal("IP banned by failures outside the window")
+	}
+
+	// Three failures within the window start a ban for that IP only
+	bans.recordFailure("192.0.2.1")
+	if !bans.recordFailure("192.0.2.1") {
+		t.Fatal("third failure within the window did not start a ban")
+	}
+	if !bans.banned("192.0.2.1") {
+		t.Error("IP not banned after reaching the threshold")
+	}
+	if bans.banned("192.0.2.2") {
+		t.Error("another IP is banned")
+	}
+
+	now = now.Add(9 * time.Minute)
+	if !bans.banned("192.0.2.1") {
+		t.Error("ban expired early")
+	}
+	now = now.Add(time.Minute)
+	if bans.banned("192.0.2.1") {
+		t.Error("IP still banned after the ban duration")
+	}
+
+	// The ban clears the failure count, and idle entries are swept
+	if bans.recordFailure("192.0.2.1") {
+		t.Error("first failure after a ban started a new ban")
+	}
+	now = now.Add(2 * time.Minute)
+	bans.recordFailure("192.0.2.2")
+	if _, ok := bans.clients["192.0.2.1"]; ok {
+		t.Error("idle IP was not swept from the table")
+	}
+}
@@ -0,0 +1,123 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+	"github.com/shineum/smtp-proxy-lite/internal/provider"
+)
+
+// defaultDeliveryWorkers is the default number of asynchronous delivery
+// workers.
+const defaultDeliveryWorkers = 4
+
+// defaultDeliveryQueueSize is the default number of accepted messages that
+// may wait for an asynchronous delivery worker.
+const defaultDeliveryQueueSize = 100
+
+// errDeliveryQueueFull is returned when an accepted message cannot be
+// handed to the delivery workers because too many are already waiting.
+var errDeliveryQueueFull = errors.New("delivery queue is full")
+
+// enqueueDelivery hands msg to the background delivery workers, or to the
+// retry queue if one is configured.
+func (s *Server) enqueueDelivery(msg *email.Email) error {
+	if s.config.Queue != nil {
+		return s.config.Queue.Enqueue(msg)
+	}
+	select {
+	case s.deliveries <- msg:
+		return nil
+	default:
+		return errDeliveryQueueFull
+	}
+}
+
+// startDeliveryWorkers starts the asynchronous delivery workers, which
+// send on ctx. The returned function tells them to deliver what is still
+// waiting and stop, and waits up to shutdownTimeout for them to finish.
+func (s *Server) startDeliveryWorkers(ctx context.Context) (drain func()) {
+	workers := s.config.DeliveryWorkers
+	if workers <= 0 {
+		workers = defaultDeliveryWorkers
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.deliveryWorker(ctx, stop)
+		}()
+	}
+
+	return func() {
+		close(stop)
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+			slog.Info("all accepted messages delivered")
+		case <-time.After(shutdownTimeout):
+			slog.Warn("shutdown timeout reached, abandoning undelivered messages",
+				"pending", len(s.deliveries),
+			)
+		}
+	}
+}
+
+// deliveryWorker sends accepted messages until stop is closed, then
+// sends any still waiting and returns.
+func (s *Server) deliveryWorker(ctx context.Context, stop <-chan struct{}) {
+	for {
+		select {
+		case msg := <-s.deliveries:
+			s.deliver(ctx, msg)
+		case <-stop:
+			for {
+				select {
+				case msg := <-s.deliveries:
+					s.deliver(ctx, msg)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliver sends a message accepted in asynchronous mode. The client has
+// already been told it was accepted, so a failure, after the provider's
+// own retries, can only be logged.
+func (s *Server) deliver(ctx context.Context, msg *email.Email) {
+	start := time.Now()
+	err := s.config.Provider.Send(ctx, msg)
+	latency := time.Since(start)
+	if err != nil {
+		slog.Error("asynchronous delivery failed",
+			"provider", s.config.Provider.Name(),
+			"message_id", msg.MessageID,
+			"from", msg.From,
+			"latency_ms", latency.Milliseconds(),
+			"permanent", provider.IsPermanent(err),
+			"error", err,
+		)
+		return
+	}
+	slog.Info("message delivered",
+		"provider", s.config.Provider.Name(),
+		"message_id", msg.MessageID,
+		"from", msg.From,
+		"latency_ms", latency.Milliseconds(),
+		"async", true,
+	)
+}
@@ -0,0 +1,110 @@
+package smtp
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// mailDSN holds the delivery status notification parameters (RFC 3461)
+// given on MAIL FROM.
+type mailDSN struct {
+	// Ret is "FULL" or "HDRS", or empty if not requested.
+	Ret string
+
+	// EnvID is the xtext-decoded envelope identifier.
+	EnvID string
+}
+
+// rcptDSN holds the delivery status notification parameters (RFC 3461)
+// given on RCPT TO.
+type rcptDSN struct {
+	// Notify is "NEVER", or any of "SUCCESS", "FAILURE" and "DELAY".
+	Notify []string
+
+	// ORcpt is the original recipient as "addr-type;address", with the
+	// address xtext-decoded.
+	ORcpt string
+}
+
+// requested reports whether any MAIL FROM DSN parameter was given.
+func (d mailDSN) requested() bool {
+	return d.Ret != "" || d.EnvID != ""
+}
+
+// parseMailDSN extracts the RET and ENVID parameters.
+func parseMailDSN(params map[string]string) (mailDSN, error) {
+	var dsn mailDSN
+
+	if ret, ok := params["RET"]; ok {
+		ret = strings.ToUpper(ret)
+		if ret != "FULL" && ret != "HDRS" {
+			return mailDSN{}, fmt.Errorf("RET must be FULL or HDRS")
+		}
+		dsn.Ret = ret
+	}
+
+	if envID, ok := params["ENVID"]; ok {
+		decoded, err := decodeXtext(envID)
+		if err != nil {
+			return mailDSN{}, fmt.Errorf("ENVID: %w", err)
+		}
+		dsn.EnvID = decoded
+	}
+
+	return dsn, nil
+}
+
+// parseRcptDSN extracts the NOTIFY and ORCPT parameters.
+func parseRcptDSN(params map[string]string) (rcptDSN, error) {
+	var dsn rcptDSN
+
+	if notify, ok := params["NOTIFY"]; ok {
+		for _, v := range strings.Split(strings.ToUpper(notify), ",") {
+			if !slices.Contains([]string{"NEVER", "SUCCESS", "FAILURE", "DELAY"}, v) || slices.Contains(dsn.Notify, v) {
+				return rcptDSN{}, fmt.Errorf("invalid NOTIFY value %q", notify)
+			}
+			dsn.Notify = append(dsn.Notify, v)
+		}
+		if len(dsn.Notify) > 1 && slices.Contains(dsn.Notify, "NEVER") {
+			return rcptDSN{}, fmt.Errorf("NOTIFY=NEVER cannot be combined with other values")
+		}
+	}
+
+	if orcpt, ok := params["ORCPT"]; ok {
+		addrType, addr, found := strings.Cut(orcpt, ";")
+		if !found || addrType == "" || addr == "" {
+			return rcptDSN{}, fmt.Errorf("ORCPT must be addr-type;address")
+		}
+		decoded, err := decodeXtext(addr)
+		if err != nil {
+			return rcptDSN{}, fmt.Errorf("ORCPT: %w", err)
+		}
+		dsn.ORcpt = addrType + ";" + decoded
+	}
+
+	return dsn, nil
+}
+
+// decodeXtext decodes an xtext value (RFC 3461 section 4), in which "+XX"
+// encodes the byte with hex value XX.
+func decodeXtext(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '+' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("truncated xtext escape")
+		}
+		n, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid xtext escape %q", s[i:i+3])
+		}
+		b.WriteByte(byte(n))
+		i += 2
+	}
+	return b.String(), nil
+}
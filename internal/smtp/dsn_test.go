@@ -0,0 +1,142 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseMailDSN(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		params  map[string]string
+		want    mailDSN
+		wantErr bool
+	}{
+		{name: "none", params: map[string]string{}},
+		{name: "ret full", params: map[string]string{"RET": "full"}, want: mailDSN{Ret: "FULL"}},
+		{
+			name:   "ret hdrs with envid",
+			params: map[string]string{"RET": "HDRS", "ENVID": "QQ314159+2Bx"},
+			want:   mailDSN{Ret: "HDRS", EnvID: "QQ314159+x"},
+		},
+		{name: "invalid ret", params: map[string]string{"RET": "BODY"}, wantErr: true},
+		{name: "bad xtext", params: map[string]string{"ENVID": "abc+Z1"}, wantErr: true},
+		{name: "truncated xtext", params: map[string]string{"ENVID": "abc+2"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := parseMailDSN(tt.params)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error: got %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRcptDSN(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		params     map[string]string
+		wantNotify []string
+		wantORcpt  string
+		wantErr    bool
+	}{
+		{name: "none", params: map[string]string{}},
+		{name: "never", params: map[string]string{"NOTIFY": "NEVER"}, wantNotify: []string{"NEVER"}},
+		{
+			name:       "success and failure",
+			params:     map[string]string{"NOTIFY": "success,FAILURE"},
+			wantNotify: []string{"SUCCESS", "FAILURE"},
+		},
+		{
+			name:      "orcpt",
+			params:    map[string]string{"ORCPT": "rfc822;user+2Btag@example.com"},
+			wantORcpt: "rfc822;user+tag@example.com",
+		},
+		{name: "never combined", params: map[string]string{"NOTIFY": "NEVER,DELAY"}, wantErr: true},
+		{name: "unknown notify", params: map[string]string{"NOTIFY": "ALWAYS"}, wantErr: true},
+		{name: "orcpt without type", params: map[string]string{"ORCPT": "user@example.com"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := parseRcptDSN(tt.params)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error: got %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got.Notify, tt.wantNotify) {
+				t.Errorf("Notify: got %v, want %v", got.Notify, tt.wantNotify)
+			}
+			if got.ORcpt != tt.wantORcpt {
+				t.Errorf("ORcpt: got %q, want %q", got.ORcpt, tt.wantORcpt)
+			}
+		})
+	}
+}
+
+func TestSession_DSNParameters(t *testing.T) {
+	t.Parallel()
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	auth := NewAuthenticator("", "")
+	sess := NewSession(server, auth, &mockProvider{}, "mail.test.com", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go sess.Handle(ctx)
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "EHLO client.test.com")
+	if lines := readEHLO(t, reader); !slices.Contains(lines, "250-DSN") {
+		t.Errorf("EHLO does not advertise DSN: %q", lines)
+	}
+
+	steps := []struct {
+		cmd  string
+		want string
+	}{
+		{"MAIL FROM:<a@example.com> RET=BOGUS", "501 5.5.4 Invalid DSN parameter: RET must be FULL or HDRS"},
+		{"MAIL FROM:<a@example.com> RET=HDRS ENVID=batch+2D42", "250 OK"},
+		{"RCPT TO:<b@example.com> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;b@example.com", "250 OK"},
+		{"RCPT TO:<c@example.com>", "250 OK"},
+		{"RCPT TO:<d@example.com> NOTIFY=NEVER,SUCCESS", "501 5.5.4 Invalid DSN parameter: NOTIFY=NEVER cannot be combined with other values"},
+		{"NOOP", "250 OK"},
+	}
+	for _, step := range steps {
+		sendCmd(t, client, step.cmd)
+		if resp := readLine(t, reader); resp != step.want {
+			t.Errorf("%s: got %q, want %q", step.cmd, resp, step.want)
+		}
+	}
+
+	if want := (mailDSN{Ret: "HDRS", EnvID: "batch-42"}); sess.dsn != want {
+		t.Errorf("transaction DSN: got %+v, want %+v", sess.dsn, want)
+	}
+	if len(sess.rcptDSN) != 2 {
+		t.Fatalf("recipient DSN entries: got %d, want 2", len(sess.rcptDSN))
+	}
+	if got := sess.rcptDSN[0]; !slices.Equal(got.Notify, []string{"SUCCESS", "FAILURE"}) || got.ORcpt != "rfc822;b@example.com" {
+		t.Errorf("first recipient DSN: got %+v", got)
+	}
+	if got := sess.rcptDSN[1]; len(got.Notify) != 0 || got.ORcpt != "" {
+		t.Errorf("second recipient DSN: got %+v, want empty", got)
+	}
+}
@@ -0,0 +1,104 @@
+package smtp
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultGreylistDelay is the default time a sender must wait before a
+// retry of a greylisted delivery is accepted.
+const defaultGreylistDelay = 5 * time.Minute
+
+// defaultGreylistTTL is the default time a triplet is remembered after it
+// was last seen.
+const defaultGreylistTTL = 24 * time.Hour
+
+// Greylister decides whether a delivery attempt, identified by the client
+// IP, envelope sender and recipient, is accepted or temporarily refused.
+// Legitimate mail servers retry a refused delivery, while most spam
+// senders do not. Implementations must be safe for concurrent use.
+type Greylister interface {
+	// Allow records the attempt and reports whether it may proceed.
+	Allow(ip, from, rcpt string) bool
+}
+
+// MemoryGreylist is a Greylister that keeps its triplets in memory, so they
+// are forgotten on restart.
+type MemoryGreylist struct {
+	delay time.Duration
+	ttl   time.Duration
+
+	// now returns the current time; tests replace it.
+	now func() time.Time
+
+	mu        sync.Mutex
+	triplets  map[string]*greylistEntry
+	lastSweep time.Time
+}
+
+// greylistEntry is the history of one triplet.
+type greylistEntry struct {
+	firstSeen time.Time
+	lastSeen  time.Time
+	passed    bool
+}
+
+// NewMemoryGreylist creates an in-memory Greylister that accepts a triplet
+// once it is retried at least delay after it was first seen. Triplets are
+// forgotten ttl after they were last seen. Zero values use the defaults of
+// 5m and 24h.
+func NewMemoryGreylist(delay, ttl time.Duration) *MemoryGreylist {
+	if delay <= 0 {
+		delay = defaultGreylistDelay
+	}
+	if ttl <= 0 {
+		ttl = defaultGreylistTTL
+	}
+	return &MemoryGreylist{
+		delay:    delay,
+		ttl:      ttl,
+		now:      time.Now,
+		triplets: make(map[string]*greylistEntry),
+	}
+}
+
+// Allow records the attempt and reports whether it may proceed: a new
+// triplet, or one retried too soon, is refused.
+func (g *MemoryGreylist) Allow(ip, from, rcpt string) bool {
+	key := ip + "\x00" + strings.ToLower(from) + "\x00" + strings.ToLower(rcpt)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	g.sweep(now)
+
+	entry := g.triplets[key]
+	if entry == nil || now.Sub(entry.lastSeen) >= g.ttl {
+		g.triplets[key] = &greylistEntry{firstSeen: now, lastSeen: now}
+		return false
+	}
+
+	entry.lastSeen = now
+	if !entry.passed && now.Sub(entry.firstSeen) < g.delay {
+		return false
+	}
+	entry.passed = true
+	return true
+}
+
+// sweep drops triplets not seen within the TTL, at most once per delay.
+// g.mu must be held.
+func (g *MemoryGreylist) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < g.delay {
+		return
+	}
+	g.lastSweep = now
+
+	for key, entry := range g.triplets {
+		if now.Sub(entry.lastSeen) >= g.ttl {
+			delete(g.triplets, key)
+		}
+	}
+}
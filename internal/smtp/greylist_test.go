@@ -0,0 +1,49 @@
+package smtp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryGreylist(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	g := NewMemoryGreylist(5*time.Minute, time.Hour)
+	g.now = func() time.Time { return now }
+
+	if g.Allow("192.0.2.1", "sender@example.com", "user@example.org") {
+		t.Fatal("first attempt allowed")
+	}
+	now = now.Add(time.Minute)
+	if g.Allow("192.0.2.1", "sender@example.com", "user@example.org") {
+		t.Fatal("retry before the delay allowed")
+	}
+	now = now.Add(4 * time.Minute)
+	if !g.Allow("192.0.2.1", "Sender@Example.com", "user@example.org") {
+		t.Fatal("retry after the delay refused")
+	}
+	if !g.Allow("192.0.2.1", "sender@example.com", "user@example.org") {
+		t.Error("passed triplet refused")
+	}
+
+	// Each part of the triplet counts
+	if g.Allow("192.0.2.2", "sender@example.com", "user@example.org") {
+		t.Error("new client IP allowed")
+	}
+	if g.Allow("192.0.2.1", "other@example.com", "user@example.org") {
+		t.Error("new sender allowed")
+	}
+	if g.Allow("192.0.2.1", "sender@example.com", "other@example.org") {
+		t.Error("new recipient allowed")
+	}
+
+	// A triplet not seen within the TTL is greylisted again
+	now = now.Add(time.Hour)
+	if g.Allow("192.0.2.1", "sender@example.com", "user@example.org") {
+		t.Error("expired triplet allowed")
+	}
+	if len(g.triplets) != 1 {
+		t.Errorf("triplets after sweep: got %d, want 1", len(g.triplets))
+	}
+}
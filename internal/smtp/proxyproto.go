@@ -0,0 +1,174 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout bounds the wait for the PROXY protocol header at the
+// start of a connection.
+const proxyHeaderTimeout = 5 * time.Second
+
+// maxProxyV1Length is the longest PROXY protocol v1 header, including CRLF.
+const maxProxyV1Length = 107
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is a connection whose client address was taken from a PROXY
+// protocol header sent by a load balancer.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+// Read reads from the data buffered after the header, then the connection.
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address given in the PROXY header.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// acceptProxyHeader reads the PROXY protocol header (v1 or v2) that must
+// start conn and returns a connection reporting the client address from
+// it. A header that carries no address (v1 UNKNOWN, v2 LOCAL) keeps the
+// connection's own address.
+func acceptProxyHeader(conn net.Conn) (net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	addr, err := readProxyHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	if addr == nil {
+		addr = conn.RemoteAddr()
+	}
+	return &proxyConn{Conn: conn, reader: reader, remote: addr}, nil
+}
+
+// readProxyHeader reads a PROXY protocol header from r and returns the
+// source address it gives, or nil if it gives none.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	if sig, err := r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	return readProxyV1(r)
+}
+
+// readProxyV1 parses a text header such as
+// "PROXY TCP4 203.0.113.7 192.0.2.1 51234 25\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	if prefix, err := r.Peek(len("PROXY ")); err != nil || string(prefix) != "PROXY " {
+		return nil, fmt.Errorf("missing PROXY protocol header")
+	}
+
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading PROXY header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= maxProxyV1Length {
+			return nil, fmt.Errorf("PROXY header longer than %d bytes", maxProxyV1Length)
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("PROXY header not terminated by CRLF")
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("malformed PROXY header %q", strings.TrimSpace(string(line)))
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid PROXY source address %q", fields[2])
+	}
+	switch fields[1] {
+	case "TCP4":
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("PROXY TCP4 header with IPv6 address %q", fields[2])
+		}
+	case "TCP6":
+		if ip.To4() != nil {
+			return nil, fmt.Errorf("PROXY TCP6 header with IPv4 address %q", fields[2])
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol %q", fields[1])
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY source port %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses a binary header: the signature, version and command,
+// address family, payload length, then the addresses and any TLVs.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("reading PROXY v2 header: %w", err)
+	}
+	verCmd, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("reading PROXY v2 addresses: %w", err)
+	}
+
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", verCmd>>4)
+	}
+	switch verCmd & 0x0f {
+	case 0x0: // LOCAL: a health check from the proxy itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command %#x", verCmd&0x0f)
+	}
+
+	var ipLen int
+	switch family >> 4 {
+	case 0x1: // AF_INET
+		ipLen = net.IPv4len
+	case 0x2: // AF_INET6
+		ipLen = net.IPv6len
+	default: // AF_UNSPEC, AF_UNIX: no usable client address
+		return nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, fmt.Errorf("PROXY v2 address block too short: %d bytes", len(payload))
+	}
+	return &net.TCPAddr{
+		IP:   net.IP(slices.Clone(payload[:ipLen])),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}, nil
+}
@@ -0,0 +1,157 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2Header builds a PROXY protocol v2 header for a TCP connection
+// from src to dst, followed by tlv.
+func proxyV2Header(cmd byte, src, dst *net.TCPAddr, tlv []byte) []byte {
+	family := byte(0x11) // AF_INET, STREAM
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP == nil {
+		family = 0x21 // AF_INET6, STREAM
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+
+	var payload []byte
+	payload = append(payload, srcIP...)
+	payload = append(payload, dstIP...)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(src.Port))
+	payload = binary.BigEndian.AppendUint16(payload, uint16(dst.Port))
+	payload = append(payload, tlv...)
+
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|cmd, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	t.Parallel()
+
+	src4 := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}
+	dst4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 25}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 40000}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 25}
+
+	tests := []struct {
+		name    string
+		header  string
+		want    string // source address, or "" for none
+		wantErr bool
+	}{
+		{"v1 TCP4", "PROXY TCP4 203.0.113.7 192.0.2.1 51234 25\r\n", "203.0.113.7:51234", false},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::7 2001:db8::1 40000 25\r\n", "[2001:db8::7]:40000", false},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "", false},
+		{"v2 TCP4 with TLV", string(proxyV2Header(0x1, src4, dst4, []byte{0x04, 0x00, 0x01, 0x00})), "203.0.113.7:51234", false},
+		{"v2 TCP6", string(proxyV2Header(0x1, src6, dst6, nil)), "[2001:db8::7]:40000", false},
+		{"v2 LOCAL", string(proxyV2Header(0x0, src4, dst4, nil)), "", false},
+		{"no header", "EHLO client.test.com\r\n", "", true},
+		{"bad source address", "PROXY TCP4 203.0.113.300 192.0.2.1 51234 25\r\n", "", true},
+		{"bad source port", "PROXY TCP4 203.0.113.7 192.0.2.1 70000 25\r\n", "", true},
+		{"family mismatch", "PROXY TCP4 2001:db8::7 2001:db8::1 40000 25\r\n", "", true},
+		{"missing fields", "PROXY TCP4 203.0.113.7\r\n", "", true},
+		{"bare LF", "PROXY TCP4 203.0.113.7 192.0.2.1 51234 25\n", "", true},
+		{"too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", true},
+		{"v2 bad version", string(append(append([]byte{}, proxyV2Signature...), 0x11, 0x11, 0x00, 0x00)), "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			r := bufio.NewReader(strings.NewReader(tt.header + "EHLO client.test.com\r\n"))
+			addr, err := readProxyHeader(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got address %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("source address: got %q, want %q", got, tt.want)
+			}
+
+			// The data after the header is left for the session
+			rest, _ := io.ReadAll(r)
+			if string(rest) != "EHLO client.test.com\r\n" {
+				t.Errorf("data after header: got %q", rest)
+			}
+		})
+	}
+}
+
+func TestAcceptProxyHeader(t *testing.T) {
+	t.Parallel()
+
+	client, server := connPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	if _, err := client.Write([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 51234 25\r\nQUIT\r\n")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	conn, err := acceptProxyHeader(server)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := conn.RemoteAddr().String(); got != "203.0.113.7:51234" {
+		t.Errorf("RemoteAddr: got %q, want %q", got, "203.0.113.7:51234")
+	}
+	if line := readLine(t, bufio.NewReader(conn)); line != "QUIT" {
+		t.Errorf("first line after header: got %q, want %q", line, "QUIT")
+	}
+}
+
+func TestServer_ProxyProtocolRejectsMalformedHeader(t *testing.T) {
+	t.Parallel()
+
+	srv := New(ServerConfig{
+		ListenAddr:    "127.0.0.1:0",
+		Hostname:      "mail.test.com",
+		Provider:      &mockProvider{},
+		ProxyProtocol: true,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startServer(t, ctx, srv)
+
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	// A client talking SMTP directly is closed without a greeting
+	sendCmd(t, conn, "EHLO client.test.com")
+	if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("failed to set deadline: %v", err)
+	}
+	data, err := io.ReadAll(conn)
+	if len(data) != 0 {
+		t.Errorf("connection without PROXY header: got %q, want no data", data)
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("connection without PROXY header was not closed")
+	}
+}
@@ -0,0 +1,16 @@
+package smtp
+
+import (
+	"runtime"
+	"strings"
+)
+
+// soReusePort is the SO_REUSEPORT socket option, which the frozen syscall
+// package does not define for Linux. MIPS numbers its socket options
+// differently from the other architectures.
+var soReusePort = func() int {
+	if strings.HasPrefix(runtime.GOARCH, "mips") {
+		return 0x200
+	}
+	return 0xf
+}()
@@ -0,0 +1,46 @@
+package smtp
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/shineum/smtp-proxy-lite/internal/provider"
+)
+
+func TestServer_ReusePort(t *testing.T) {
+	first := provider.NewMemory()
+	firstSrv := New(ServerConfig{ListenAddr: "127.0.0.1:0", Provider: first, ReusePort: true})
+	firstCtx, stopFirst := context.WithCancel(context.Background())
+	defer stopFirst()
+	firstErr := startServer(t, firstCtx, firstSrv)
+
+	// A second instance binds the same port
+	second := provider.NewMemory()
+	secondSrv := New(ServerConfig{ListenAddr: firstSrv.Addr(), Provider: second, ReusePort: true})
+	secondCtx, stopSecond := context.WithCancel(context.Background())
+	defer stopSecond()
+	secondErr := startServer(t, secondCtx, secondSrv)
+
+	addr := firstSrv.Addr()
+	if resp := sendMessage(t, addr, "One"); !strings.HasPrefix(resp, "250 ") {
+		t.Fatalf("first message: got %q, want prefix '250 '", resp)
+	}
+
+	// Stop whichever instance took the message; the other must take the next
+	served, stop, errCh, other := first, stopFirst, firstErr, second
+	if len(second.Sent()) == 1 {
+		served, stop, errCh, other = second, stopSecond, secondErr, first
+	}
+	stop()
+	if err := <-errCh; err != nil {
+		t.Fatalf("ListenAndServe: %v", err)
+	}
+
+	if resp := sendMessage(t, addr, "Two"); !strings.HasPrefix(resp, "250 ") {
+		t.Fatalf("second message: got %q, want prefix '250 '", resp)
+	}
+	if len(served.Sent()) != 1 || len(other.Sent()) != 1 {
+		t.Errorf("messages per instance: got %d and %d, want 1 each", len(served.Sent()), len(other.Sent()))
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package smtp
+
+import "syscall"
+
+// reusePortSupported reports whether listeners can be created with
+// SO_REUSEPORT on this platform.
+const reusePortSupported = false
+
+// reusePortControl is never used where SO_REUSEPORT is not available.
+func reusePortControl(_, _ string, _ syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package smtp
+
+import "syscall"
+
+// reusePortSupported reports whether listeners can be created with
+// SO_REUSEPORT on this platform.
+const reusePortSupported = true
+
+// reusePortControl sets SO_REUSEPORT on a listening socket so several
+// processes can bind the same address, with the kernel spreading incoming
+// connections across them.
+func reusePortControl(_, _ string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -1,14 +1,21 @@
 package smtp
 
 import (
+	"cmp"
 	"context"
 	"crypto/tls"
+	"fmt"
 	"log/slog"
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/shineum/smtp-proxy-lite/internal/email"
 	"github.com/shineum/smtp-proxy-lite/internal/provider"
+	"github.com/shineum/smtp-proxy-lite/internal/queue"
+	smtptls "github.com/shineum/smtp-proxy-lite/internal/tls"
 )
 
 // shutdownTimeout is the maximum time to wait for in-flight connections
@@ -17,12 +24,23 @@ const shutdownTimeout = 30 * time.Second
 
 // ServerConfig holds the configuration for an SMTP server.
 type ServerConfig struct {
-	// ListenAddr is the address to listen on (e.g., ":2525").
+	// ListenAddr is the address to listen on (e.g., ":2525"), or a
+	// comma-separated list of addresses (e.g., ":2525,[::1]:2525") each
+	// served by its own listener.
 	ListenAddr string
 
+	// TLSListen is an optional address for an implicit TLS (SMTPS) listener
+	// (e.g., ":465"). Connections on it are TLS from the first byte, so
+	// STARTTLS is not offered. Requires TLSConfig.
+	TLSListen string
+
 	// Hostname is the server hostname used in EHLO responses.
 	Hostname string
 
+	// Banner replaces the "ESMTP smtp-proxy-lite" text after the hostname
+	// in the 220 greeting. Empty keeps the default.
+	Banner string
+
 	// Provider is the email delivery backend.
 	Provider provider.Provider
 
@@ -30,21 +48,149 @@ type ServerConfig struct {
 	// If nil, STARTTLS is not advertised.
 	TLSConfig *tls.Config
 
+	// ClientCAFile is an optional PEM bundle of CA certificates used to
+	// verify client certificates (mutual TLS). A verified client
+	// certificate satisfies AUTH. Requires TLSConfig.
+	ClientCAFile string
+
+	// ClientAuth is the client certificate policy applied when ClientCAFile
+	// is set. Zero (tls.NoClientCert) uses tls.RequireAndVerifyClientCert.
+	ClientAuth tls.ClientAuthType
+
 	// AuthUsername and AuthPassword configure SMTP AUTH.
 	// If both are empty, authentication is not required.
 	AuthUsername string
 	AuthPassword string
+
+	// Users are additional AUTH accounts, typically from a users file.
+	// A user with AllowedDomains may only send from those domains.
+	Users []User
+
+	// RequireTLSForAuth refuses AUTH on unencrypted connections and only
+	// advertises it after STARTTLS (or on the implicit TLS listener).
+	RequireTLSForAuth bool
+
+	// MaxAuthAttempts is the number of failed AUTH attempts after which a
+	// session is disconnected. Zero uses the default (3).
+	MaxAuthAttempts int
+
+	// AuthBanThreshold bans a client IP once it fails AUTH this many times
+	// within AuthBanWindow: its new connections are refused with 421 for
+	// AuthBanDuration. Zero disables banning. Zero window and duration use
+	// the defaults (10m and 15m).
+	AuthBanThreshold int
+	AuthBanWindow    time.Duration
+	AuthBanDuration  time.Duration
+
+	// MaxReceivedHeaders is the number of Received headers a message may
+	// arrive with, not counting the one the proxy adds; more are rejected
+	// as a routing loop. Zero uses the default (30).
+	MaxReceivedHeaders int
+
+	// MaxRecipients is the number of RCPT TO addresses accepted per
+	// message. Zero uses the default (100).
+	MaxRecipients int
+
+	// MaxTransactions is the number of messages a connection may send,
+	// after which it is answered 421 and closed. Zero means unlimited.
+	MaxTransactions int
+
+	// ReusePort creates the listeners with SO_REUSEPORT, so several
+	// instances can bind the same address and the kernel balances
+	// connections across them. It is ignored, with a warning, on platforms
+	// without SO_REUSEPORT.
+	ReusePort bool
+
+	// ProxyProtocol requires each connection to start with a PROXY
+	// protocol (v1 or v2) header, as sent by HAProxy or an AWS NLB, and
+	// uses the client address from it. Only enable it behind such a proxy.
+	ProxyProtocol bool
+
+	// MaxLineLength is the longest command line accepted, including CRLF.
+	// Zero uses the RFC 5321 limit (512). AUTH lines are allowed 12288.
+	MaxLineLength int
+
+	// CommandTimeout is the time allowed to read each command line. Zero
+	// uses the default (60s).
+	CommandTimeout time.Duration
+
+	// MaxSessionDuration caps the total lifetime of a session, so a client
+	// cannot hold a connection open by trickling commands. Zero uses the
+	// default (30m).
+	MaxSessionDuration time.Duration
+
+	// AllowedRecipientDomains, if set, restricts RCPT TO to these domains;
+	// "*" allows any domain. DeniedRecipientDomains are always refused.
+	// Both match case-insensitively.
+	AllowedRecipientDomains []string
+	DeniedRecipientDomains  []string
+
+	// AllowedSenders, if set, restricts MAIL FROM to these addresses or
+	// "*@domain" patterns. It applies in addition to per-user domains.
+	AllowedSenders []string
+
+	// Greylist, if set, answers 451 to the recipients of unauthenticated
+	// clients until the delivery is retried (see NewMemoryGreylist).
+	Greylist Greylister
+
+	// Queue, if set, accepts messages whose delivery fails transiently and
+	// retries them in the background; the client gets 250 instead of 451.
+	Queue *queue.Spool
+
+	// AsyncDelivery accepts each message as soon as it is received and
+	// delivers it in the background, so clients never wait on the
+	// provider; delivery failures are logged rather than reported. With
+	// Queue set, messages are spooled to it. Otherwise they wait in memory
+	// for DeliveryWorkers (zero uses 4), up to DeliveryQueueSize (zero uses
+	// 100) at a time, and are lost if the process dies.
+	AsyncDelivery     bool
+	DeliveryWorkers   int
+	DeliveryQueueSize int
+}
+
+// Limits are the per-session limits that can be changed while the server
+// runs (see Server.SetLimits). Zero values use the defaults, as the
+// ServerConfig fields of the same names do.
+type Limits struct {
+	MaxAuthAttempts    int
+	MaxReceivedHeaders int
+	MaxRecipients      int
+	MaxTransactions    int
 }
 
 // Server is an SMTP server that accepts connections and delegates
 // email delivery to a configured Provider.
 type Server struct {
-	config   ServerConfig
-	auth     *Authenticator
-	listener net.Listener
+	config ServerConfig
+
+	// mu guards the listeners, which ListenAndServe sets once they are
+	// bound and the address methods read from other goroutines.
+	mu          sync.Mutex
+	listeners   []net.Listener
+	tlsListener net.Listener
+
+	// ready is closed once the listeners are bound.
+	ready chan struct{}
+
+	// auth holds the current Authenticator. It is swapped by
+	// SetCredentials; each session keeps the one it started with.
+	auth atomic.Pointer[Authenticator]
+
+	// limits holds the current per-session limits. It is swapped by
+	// SetLimits; each session keeps the ones it started with.
+	limits atomic.Pointer[Limits]
 
 	// wg tracks in-flight session goroutines for graceful shutdown.
 	wg sync.WaitGroup
+
+	// authBans tracks AUTH failures per client IP. It is nil unless
+	// AuthBanThreshold is set.
+	authBans *authBans
+
+	// deliveries carries messages accepted in asynchronous mode to the
+	// delivery workers. It is nil unless AsyncDelivery is set without a
+	// Queue.
+	deliveries chan *email.Email
 }
 
 // New creates a new SMTP Server with the given configuration.
@@ -53,46 +199,198 @@ func New(cfg ServerConfig) *Server {
 		cfg.Hostname = "localhost"
 	}
 
-	return &Server{
-		config: cfg,
-		auth:   NewAuthenticator(cfg.AuthUsername, cfg.AuthPassword),
+	s := &Server{config: cfg, ready: make(chan struct{})}
+	if cfg.AsyncDelivery && cfg.Queue == nil {
+		size := cfg.DeliveryQueueSize
+		if size <= 0 {
+			size = defaultDeliveryQueueSize
+		}
+		s.deliveries = make(chan *email.Email, size)
+	}
+	if cfg.AuthBanThreshold > 0 {
+		s.authBans = newAuthBans(
+			cfg.AuthBanThreshold,
+			cmp.Or(cfg.AuthBanWindow, defaultAuthBanWindow),
+			cmp.Or(cfg.AuthBanDuration, defaultAuthBanDuration),
+		)
 	}
+	s.auth.Store(NewAuthenticator(cfg.AuthUsername, cfg.AuthPassword, cfg.Users...))
+	s.limits.Store(&Limits{
+		MaxAuthAttempts:    cfg.MaxAuthAttempts,
+		MaxReceivedHeaders: cfg.MaxReceivedHeaders,
+		MaxRecipients:      cfg.MaxRecipients,
+		MaxTransactions:    cfg.MaxTransactions,
+	})
+	return s
+}
+
+// SetCredentials replaces the SMTP AUTH credentials. Sessions accepted
+// afterwards use the new credentials; sessions already in progress keep
+// the ones they started with. Users from ServerConfig.Users are kept.
+// Empty credentials disable authentication unless such users exist.
+func (s *Server) SetCredentials(username, password string) {
+	s.auth.Store(NewAuthenticator(username, password, s.config.Users...))
+}
+
+// SetLimits replaces the per-session limits. Like SetCredentials, it
+// applies to sessions accepted afterwards.
+func (s *Server) SetLimits(limits Limits) {
+	s.limits.Store(&limits)
 }
 
 // ListenAndServe starts the SMTP server and blocks until the context is cancelled.
-// On context cancellation, it stops accepting new connections and waits up to
-// 30 seconds for in-flight sessions to complete.
+// If TLSListen is configured, an implicit TLS listener is served alongside the
+// plaintext one. On context cancellation, it stops accepting new connections
+// and waits up to 30 seconds for in-flight sessions to complete.
 // @MX:WARN: [AUTO] Goroutine spawned per connection without explicit limit
 // @MX:REASON: Each accepted TCP connection starts a goroutine for session handling
 func (s *Server) ListenAndServe(ctx context.Context) error {
-	ln, err := net.Listen("tcp", s.config.ListenAddr)
-	if err != nil {
-		return err
+	if s.config.ClientCAFile != "" {
+		if err := s.configureClientAuth(); err != nil {
+			return err
+		}
+	}
+
+	var lns []net.Listener
+	closeAll := func() {
+		for _, ln := range lns {
+			ln.Close()
+		}
+	}
+	for _, addr := range listenAddrs(s.config.ListenAddr) {
+		ln, err := s.listen(ctx, addr)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		lns = append(lns, ln)
 	}
-	s.listener = ln
+
+	var tlsLn net.Listener
+	if s.config.TLSListen != "" {
+		if s.config.TLSConfig == nil {
+			closeAll()
+			return fmt.Errorf("implicit TLS listener requires a TLS configuration")
+		}
+		var err error
+		tlsLn, err = s.listen(ctx, s.config.TLSListen)
+		if err != nil {
+			closeAll()
+			return err
+		}
+	}
+	s.mu.Lock()
+	s.listeners = lns
+	s.tlsListener = tlsLn
+	s.mu.Unlock()
+	close(s.ready)
 
 	slog.Info("SMTP server listening",
-		"addr", ln.Addr().String(),
+		"addr", strings.Join(s.Addrs(), ","),
+		"smtps_addr", s.TLSAddr(),
 		"provider", s.config.Provider.Name(),
-		"auth_enabled", s.auth.Enabled(),
+		"auth_enabled", s.auth.Load().Enabled(),
 		"tls_enabled", s.config.TLSConfig != nil,
+		"client_cert_auth", s.config.ClientCAFile != "",
 	)
 
+	// Sessions run on a context that outlives ctx, so a transaction already
+	// in DATA can finish delivering during the shutdown window. It is only
+	// cancelled once that window has passed.
+	sessionCtx, cancelSessions := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelSessions()
+
+	// Accepted messages are still delivered during the shutdown window
+	var drainDeliveries func()
+	if s.deliveries != nil {
+		drainDeliveries = s.startDeliveryWorkers(sessionCtx)
+	}
+
 	// Monitor context for shutdown
 	go func() {
 		<-ctx.Done()
 		slog.Info("shutting down SMTP server")
-		ln.Close()
+		closeAll()
+		if tlsLn != nil {
+			tlsLn.Close()
+		}
 	}()
 
+	var loops sync.WaitGroup
+	for _, ln := range lns {
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			s.acceptLoop(ctx, sessionCtx, ln, false)
+		}()
+	}
+	if tlsLn != nil {
+		loops.Add(1)
+		go func() {
+			defer loops.Done()
+			s.acceptLoop(ctx, sessionCtx, tlsLn, true)
+		}()
+	}
+	loops.Wait()
+
+	s.waitForSessions()
+	if drainDeliveries != nil {
+		drainDeliveries()
+	}
+	return nil
+}
+
+// listen creates a TCP listener on addr, with SO_REUSEPORT if ReusePort is
+// set and the platform supports it.
+func (s *Server) listen(ctx context.Context, addr string) (net.Listener, error) {
+	var lc net.ListenConfig
+	if s.config.ReusePort {
+		if reusePortSupported {
+			lc.Control = reusePortControl
+		} else {
+			slog.Warn("SO_REUSEPORT is not supported on this platform, listening without it",
+				"addr", addr,
+			)
+		}
+	}
+	return lc.Listen(ctx, "tcp", addr)
+}
+
+// configureClientAuth loads the client CA bundle and enables client
+// certificate verification on a copy of the server TLS configuration.
+func (s *Server) configureClientAuth() error {
+	if s.config.TLSConfig == nil {
+		return fmt.Errorf("client certificate authentication requires a TLS configuration")
+	}
+
+	pool, err := smtptls.LoadClientCAs(s.config.ClientCAFile)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig := s.config.TLSConfig.Clone()
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = s.config.ClientAuth
+	if tlsConfig.ClientAuth == tls.NoClientCert {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	s.config.TLSConfig = tlsConfig
+	return nil
+}
+
+// acceptLoop accepts connections on ln and starts a session for each until
+// ctx is cancelled. Sessions run on sessionCtx and are told of the shutdown
+// through ctx, ending after their current command. With ProxyProtocol the
+// PROXY header is read first; connections on an implicit TLS listener are
+// then wrapped in TLS before the session starts.
+func (s *Server) acceptLoop(ctx, sessionCtx context.Context, ln net.Listener, implicitTLS bool) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
 			select {
 			case <-ctx.Done():
 				// Expected error from listener close during shutdown
-				s.waitForSessions()
-				return nil
+				return
 			default:
 				slog.Error("accept error", "error", err)
 				continue
@@ -102,18 +400,104 @@ func (s *Server) ListenAndServe(ctx context.Context) error {
 		s.wg.Add(1)
 		go func() {
 			defer s.wg.Done()
-			session := NewSession(
-				conn,
-				s.auth,
-				s.config.Provider,
-				s.config.Hostname,
-				s.config.TLSConfig,
-			)
-			session.Handle(ctx)
+
+			if s.config.ProxyProtocol {
+				pc, err := acceptProxyHeader(conn)
+				if err != nil {
+					slog.Warn("rejected connection with invalid PROXY protocol header",
+						"remote_addr", conn.RemoteAddr().String(),
+						"error", err,
+					)
+					conn.Close()
+					return
+				}
+				conn = pc
+			}
+			if implicitTLS {
+				conn = tls.Server(conn, s.config.TLSConfig)
+			}
+			if s.authBans != nil && s.authBans.banned(remoteIP(conn)) {
+				s.refuseBanned(conn)
+				return
+			}
+
+			session := s.newSession(conn, implicitTLS)
+			session.shutdown = ctx.Done()
+			session.Handle(sessionCtx)
 		}()
 	}
 }
 
+// refuseBanned answers a connection from a banned IP with 421 and closes
+// it.
+func (s *Server) refuseBanned(conn net.Conn) {
+	defer conn.Close()
+
+	slog.Info("refused connection from banned IP", "remote_addr", conn.RemoteAddr().String())
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return
+	}
+	fmt.Fprintf(conn, "421 4.7.0 %s Too many authentication failures, try again later\r\n", s.config.Hostname)
+}
+
+// newSession creates a Session for an accepted connection and applies the
+// server-level session settings. implicitTLS marks connections that are
+// already TLS-wrapped so STARTTLS is not offered.
+func (s *Server) newSession(conn net.Conn, implicitTLS bool) *Session {
+	session := NewSession(
+		conn,
+		s.auth.Load(),
+		s.config.Provider,
+		s.config.Hostname,
+		s.config.TLSConfig,
+	)
+	session.tlsActive = implicitTLS
+	if s.config.Banner != "" {
+		session.banner = s.config.Banner
+	}
+	session.requireTLSForAuth = s.config.RequireTLSForAuth
+	if s.authBans != nil {
+		session.onAuthFailure = func() {
+			ip := remoteIP(conn)
+			if s.authBans.recordFailure(ip) {
+				slog.Warn("banning client IP after repeated authentication failures",
+					"ip", ip,
+					"duration", s.authBans.duration,
+				)
+			}
+		}
+	}
+	limits := s.limits.Load()
+	if limits.MaxAuthAttempts > 0 {
+		session.maxAuthAttempts = limits.MaxAuthAttempts
+	}
+	if limits.MaxReceivedHeaders > 0 {
+		session.maxReceivedHeaders = limits.MaxReceivedHeaders
+	}
+	if limits.MaxRecipients > 0 {
+		session.maxRecipients = limits.MaxRecipients
+	}
+	session.maxTransactions = limits.MaxTransactions
+	if s.config.MaxLineLength > 0 {
+		session.maxLineLength = s.config.MaxLineLength
+	}
+	if s.config.CommandTimeout > 0 {
+		session.commandTimeout = s.config.CommandTimeout
+	}
+	if s.config.MaxSessionDuration > 0 {
+		session.maxSessionDuration = s.config.MaxSessionDuration
+	}
+	session.allowedRcptDomains = s.config.AllowedRecipientDomains
+	session.deniedRcptDomains = s.config.DeniedRecipientDomains
+	session.allowedSenders = s.config.AllowedSenders
+	session.greylist = s.config.Greylist
+	session.queue = s.config.Queue
+	if s.config.AsyncDelivery {
+		session.deliverAsync = s.enqueueDelivery
+	}
+	return session
+}
+
 // waitForSessions waits for all in-flight sessions to complete,
 // with a maximum timeout to prevent indefinite blocking.
 func (s *Server) waitForSessions() {
@@ -131,10 +515,54 @@ func (s *Server) waitForSessions() {
 	}
 }
 
-// Addr returns the listener address, or empty string if not listening.
+// Addr returns the first listener address, or empty string if not listening.
 func (s *Server) Addr() string {
-	if s.listener != nil {
-		return s.listener.Addr().String()
+	if addrs := s.Addrs(); len(addrs) > 0 {
+		return addrs[0]
+	}
+	return ""
+}
+
+// Addrs returns the addresses of all plaintext listeners, or nil if not
+// listening.
+func (s *Server) Addrs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var addrs []string
+	for _, ln := range s.listeners {
+		addrs = append(addrs, ln.Addr().String())
+	}
+	return addrs
+}
+
+// listenAddrs splits a comma-separated list of listen addresses, such as
+// ":2525,[::1]:2525". An empty list yields the single address "", which
+// listens on a random port.
+func listenAddrs(list string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(list, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return []string{""}
+	}
+	return addrs
+}
+
+// Ready returns a channel that is closed once ListenAndServe has bound its
+// listeners, after which Addr, Addrs and TLSAddr report them.
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// TLSAddr returns the implicit TLS listener address, or empty string if not listening.
+func (s *Server) TLSAddr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tlsListener != nil {
+		return s.tlsListener.Addr().String()
 	}
 	return ""
 }
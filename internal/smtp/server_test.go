@@ -0,0 +1,560 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+	"github.com/shineum/smtp-proxy-lite/internal/provider"
+	smtptls "github.com/shineum/smtp-proxy-lite/internal/tls"
+)
+
+// startServer runs the server in the background and waits until it is
+// listening. The returned channel receives ListenAndServe's result.
+func startServer(t *testing.T, ctx context.Context, srv *Server) <-chan error {
+	t.Helper()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe(ctx)
+	}()
+
+	select {
+	case <-srv.Ready():
+	case err := <-errCh:
+		t.Fatalf("server failed to start: %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("server did not start listening")
+	}
+	return errCh
+}
+
+func TestServer_ImplicitTLS(t *testing.T) {
+	t.Parallel()
+
+	cert, err := smtptls.GenerateSelfSignedCert()
+	if err != nil {
+		t.Fatalf("failed to generate certificate: %v", err)
+	}
+
+	srv := New(ServerConfig{
+		ListenAddr: "127.0.0.1:0",
+		TLSListen:  "127.0.0.1:0",
+		Hostname:   "mail.test.com",
+		Provider:   &mockProvider{},
+		TLSConfig:  &tls.Config{Certificates: []tls.Certificate{*cert}},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := startServer(t, ctx, srv)
+
+	conn, err := tls.Dial("tcp", srv.TLSAddr(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("failed to dial implicit TLS listener: %v", err)
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	greeting := readLine(t, reader)
+	if !strings.HasPrefix(greeting, "220 ") {
+		t.Errorf("greeting: got %q, want prefix '220 '", greeting)
+	}
+
+	sendCmd(t, conn, "EHLO client.test.com")
+	var ehloLines []string
+	for {
+		line := readLine(t, reader)
+		ehloLines = append(ehloLines, line)
+		if !strings.HasPrefix(line, "250-") {
+			break
+		}
+	}
+
+	last := ehloLines[len(ehloLines)-1]
+	if !strings.HasPrefix(last, "250 ") {
+		t.Errorf("final EHLO line: got %q, want prefix '250 '", last)
+	}
+	for _, line := range ehloLines {
+		if strings.Contains(line, "STARTTLS") {
+			t.Error("EHLO on implicit TLS listener should not advertise STARTTLS")
+		}
+	}
+
+	sendCmd(t, conn, "QUIT")
+	readLine(t, reader) // 221 Bye
+
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Errorf("ListenAndServe: unexpected error: %v", err)
+	}
+}
+
+func TestServer_ImplicitTLSRequiresTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	srv := New(ServerConfig{
+		ListenAddr: "127.0.0.1:0",
+		TLSListen:  "127.0.0.1:0",
+		Provider:   &mockProvider{},
+	})
+
+	if err := srv.ListenAndServe(context.Background()); err == nil {
+		t.Error("expected error when TLSListen is set without TLSConfig, got nil")
+	}
+}
+
+func TestServer_SetCredentialsAppliesToNewSessions(t *testing.T) {
+	t.Parallel()
+
+	srv := New(ServerConfig{
+		ListenAddr:   "127.0.0.1:0",
+		Hostname:     "mail.test.com",
+		Provider:     &mockProvider{},
+		AuthUsername: "user",
+		AuthPassword: "old",
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startServer(t, ctx, srv)
+
+	// dial opens a session and greets the server.
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", srv.Addr())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		reader := bufio.NewReader(conn)
+		readLine(t, reader) // Skip greeting
+		sendCmd(t, conn, "EHLO client.test.com")
+		readEHLO(t, reader)
+		return conn, reader
+	}
+
+	// base64("\x00user\x00old") and base64("\x00user\x00new")
+	const oldCreds = "AHVzZXIAb2xk"
+	const newCreds = "AHVzZXIAbmV3"
+
+	existing, existingReader := dial()
+
+	srv.SetCredentials("user", "new")
+
+	// The session opened before the swap keeps the old credentials
+	sendCmd(t, existing, "AUTH PLAIN "+oldCreds)
+	if resp := readLine(t, existingReader); !strings.HasPrefix(resp, "235 ") {
+		t.Errorf("old credentials on existing session: got %q, want prefix '235 '", resp)
+	}
+
+	conn, reader := dial()
+	sendCmd(t, conn, "AUTH PLAIN "+oldCreds)
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "535 ") {
+		t.Errorf("old credentials on new session: got %q, want prefix '535 '", resp)
+	}
+	sendCmd(t, conn, "AUTH PLAIN "+newCreds)
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "235 ") {
+		t.Errorf("new credentials on new session: got %q, want prefix '235 '", resp)
+	}
+}
+
+func TestServer_SetLimitsAppliesToNewSessions(t *testing.T) {
+	t.Parallel()
+
+	srv := New(ServerConfig{
+		ListenAddr:    "127.0.0.1:0",
+		Hostname:      "mail.test.com",
+		Provider:      &mockProvider{},
+		MaxRecipients: 1,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startServer(t, ctx, srv)
+
+	// dial opens a session and starts a transaction.
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", srv.Addr())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		reader := bufio.NewReader(conn)
+		readLine(t, reader) // Skip greeting
+		sendCmd(t, conn, "EHLO client.test.com")
+		readEHLO(t, reader)
+		sendCmd(t, conn, "MAIL FROM:<sender@example.com>")
+		readLine(t, reader)
+		return conn, reader
+	}
+
+	// secondRecipient sends two recipients and returns the reply to the
+	// second.
+	secondRecipient := func(conn net.Conn, reader *bufio.Reader) string {
+		sendCmd(t, conn, "RCPT TO:<first@example.com>")
+		readLine(t, reader)
+		sendCmd(t, conn, "RCPT TO:<second@example.com>")
+		return readLine(t, reader)
+	}
+
+	existing, existingReader := dial()
+
+	srv.SetLimits(Limits{MaxRecipients: 2})
+
+	// The session opened before the swap keeps the old limit
+	if resp := secondRecipient(existing, existingReader); !strings.HasPrefix(resp, "452 ") {
+		t.Errorf("second recipient on existing session: got %q, want prefix '452 '", resp)
+	}
+
+	conn, reader := dial()
+	if resp := secondRecipient(conn, reader); !strings.HasPrefix(resp, "250 ") {
+		t.Errorf("second recipient on new session: got %q, want prefix '250 '", resp)
+	}
+}
+
+// ctxProvider reports the context error seen by each Send.
+type ctxProvider struct {
+	sent chan error
+}
+
+func (p *ctxProvider) Send(ctx context.Context, _ *email.Email) error {
+	p.sent <- ctx.Err()
+	return ctx.Err()
+}
+
+func (p *ctxProvider) Name() string {
+	return "ctx"
+}
+
+func TestServer_ShutdownLetsDATAFinish(t *testing.T) {
+	t.Parallel()
+
+	prov := &ctxProvider{sent: make(chan error, 1)}
+	srv := New(ServerConfig{
+		ListenAddr: "127.0.0.1:0",
+		Hostname:   "mail.test.com",
+		Provider:   prov,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := startServer(t, ctx, srv)
+
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	readLine(t, reader) // Skip greeting
+	sendCmd(t, conn, "EHLO client.test.com")
+	readEHLO(t, reader)
+	sendCmd(t, conn, "MAIL FROM:<sender@example.com>")
+	readLine(t, reader)
+	sendCmd(t, conn, "RCPT TO:<recipient@example.com>")
+	readLine(t, reader)
+	sendCmd(t, conn, "DATA")
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "354 ") {
+		t.Fatalf("DATA: got %q, want prefix '354 '", resp)
+	}
+	sendCmd(t, conn, "Subject: Shutdown\r\n\r\nFirst half")
+
+	// Shut down mid-transfer, then finish the message
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	sendCmd(t, conn, "Second half\r\n.")
+
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "250 ") {
+		t.Errorf("end of DATA after shutdown: got %q, want prefix '250 '", resp)
+	}
+	select {
+	case err := <-prov.sent:
+		if err != nil {
+			t.Errorf("provider context cancelled during shutdown: %v", err)
+		}
+	default:
+		t.Error("message was not delivered")
+	}
+
+	// The session ends before the next command
+	sendCmd(t, conn, "NOOP")
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "421 ") {
+		t.Errorf("command after shutdown: got %q, want prefix '421 '", resp)
+	}
+
+	if err := <-errCh; err != nil {
+		t.Errorf("ListenAndServe: %v", err)
+	}
+}
+
+// blockingProvider signals each Send on started and holds it until
+// release is closed.
+type blockingProvider struct {
+	started chan *email.Email
+	release chan struct{}
+}
+
+func (p *blockingProvider) Send(_ context.Context, msg *email.Email) error {
+	p.started <- msg
+	<-p.release
+	return nil
+}
+
+func (p *blockingProvider) Name() string {
+	return "blocking"
+}
+
+// sendMessage runs a mail transaction on a new connection and returns the
+// reply to the end of DATA.
+func sendMessage(t *testing.T, addr, subject string) string {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	readLine(t, reader) // Skip greeting
+	sendCmd(t, conn, "EHLO client.test.com")
+	readEHLO(t, reader)
+	sendCmd(t, conn, "MAIL FROM:<sender@example.com>")
+	readLine(t, reader)
+	sendCmd(t, conn, "RCPT TO:<recipient@example.com>")
+	readLine(t, reader)
+	sendCmd(t, conn, "DATA")
+	readLine(t, reader)
+	sendCmd(t, conn, "Subject: "+subject+"\r\n\r\nHello\r\n.")
+	resp := readLine(t, reader)
+	sendCmd(t, conn, "QUIT")
+	return resp
+}
+
+func TestServer_MultipleListenAddrs(t *testing.T) {
+	t.Parallel()
+
+	mem := provider.NewMemory()
+	srv := New(ServerConfig{
+		ListenAddr: "127.0.0.1:0, 127.0.0.1:0",
+		Hostname:   "mail.test.com",
+		Provider:   mem,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := startServer(t, ctx, srv)
+
+	addrs := srv.Addrs()
+	if len(addrs) != 2 || addrs[0] == addrs[1] {
+		t.Fatalf("Addrs: got %v, want two distinct addresses", addrs)
+	}
+	for _, addr := range addrs {
+		if resp := sendMessage(t, addr, addr); !strings.HasPrefix(resp, "250 ") {
+			t.Errorf("message via %s: got %q, want prefix '250 '", addr, resp)
+		}
+	}
+	if got := len(mem.Sent()); got != 2 {
+		t.Errorf("delivered messages: got %d, want 2", got)
+	}
+
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Errorf("ListenAndServe: %v", err)
+	}
+	for _, addr := range addrs {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			t.Errorf("listener %s still accepting after shutdown", addr)
+		}
+	}
+}
+
+func TestListenAddrs(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		list string
+		want []string
+	}{
+		{":2525", []string{":2525"}},
+		{":2525, [::1]:2525", []string{":2525", "[::1]:2525"}},
+		{"", []string{""}},
+	}
+	for _, tt := range tests {
+		if got := listenAddrs(tt.list); !slices.Equal(got, tt.want) {
+			t.Errorf("listenAddrs(%q): got %q, want %q", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestServer_Banner(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		banner string
+		want   string
+	}{
+		{"default", "", "220 mail.test.com ESMTP smtp-proxy-lite"},
+		{"custom", "ESMTP ready", "220 mail.test.com ESMTP ready"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			srv := New(ServerConfig{
+				Hostname: "mail.test.com",
+				Banner:   tt.banner,
+				Provider: &mockProvider{},
+			})
+
+			client, server := connPair(t)
+			defer client.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			go srv.newSession(server, false).Handle(ctx)
+
+			if greeting := readLine(t, bufio.NewReader(client)); greeting != tt.want {
+				t.Errorf("greeting: got %q, want %q", greeting, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_AsyncDelivery(t *testing.T) {
+	t.Parallel()
+
+	prov := &blockingProvider{started: make(chan *email.Email, 1), release: make(chan struct{})}
+	srv := New(ServerConfig{
+		ListenAddr:    "127.0.0.1:0",
+		Hostname:      "mail.test.com",
+		Provider:      prov,
+		AsyncDelivery: true,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := startServer(t, ctx, srv)
+
+	// Accepted while the provider is still blocked
+	if resp := sendMessage(t, srv.Addr(), "Async"); !strings.HasPrefix(resp, "250 ") {
+		t.Errorf("end of DATA: got %q, want prefix '250 '", resp)
+	}
+
+	select {
+	case msg := <-prov.started:
+		if msg.Subject != "Async" {
+			t.Errorf("delivered subject: got %q, want %q", msg.Subject, "Async")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("worker did not deliver the accepted message")
+	}
+
+	// Shutdown waits for the delivery in progress
+	cancel()
+	select {
+	case err := <-errCh:
+		t.Fatalf("ListenAndServe returned during delivery: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(prov.release)
+	if err := <-errCh; err != nil {
+		t.Errorf("ListenAndServe: %v", err)
+	}
+}
+
+func TestServer_AsyncDeliveryQueueFull(t *testing.T) {
+	t.Parallel()
+
+	prov := &blockingProvider{started: make(chan *email.Email, 1), release: make(chan struct{})}
+	defer close(prov.release)
+	srv := New(ServerConfig{
+		ListenAddr:        "127.0.0.1:0",
+		Hostname:          "mail.test.com",
+		Provider:          prov,
+		AsyncDelivery:     true,
+		DeliveryWorkers:   1,
+		DeliveryQueueSize: 1,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startServer(t, ctx, srv)
+
+	// The first message occupies the worker, the second the queue
+	if resp := sendMessage(t, srv.Addr(), "First"); !strings.HasPrefix(resp, "250 ") {
+		t.Fatalf("first message: got %q, want prefix '250 '", resp)
+	}
+	<-prov.started
+	if resp := sendMessage(t, srv.Addr(), "Second"); !strings.HasPrefix(resp, "250 ") {
+		t.Fatalf("second message: got %q, want prefix '250 '", resp)
+	}
+
+	if resp := sendMessage(t, srv.Addr(), "Third"); !strings.HasPrefix(resp, "451 ") {
+		t.Errorf("message over the queue size: got %q, want prefix '451 '", resp)
+	}
+}
+
+func TestServer_AuthFailureBan(t *testing.T) {
+	t.Parallel()
+
+	srv := New(ServerConfig{
+		ListenAddr:       "127.0.0.1:0",
+		Hostname:         "mail.test.com",
+		Provider:         &mockProvider{},
+		AuthUsername:     "user",
+		AuthPassword:     "secret",
+		AuthBanThreshold: 2,
+		AuthBanDuration:  300 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startServer(t, ctx, srv)
+
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	readLine(t, reader) // Skip greeting
+	sendCmd(t, conn, "EHLO client.test.com")
+	readEHLO(t, reader)
+
+	// base64("\x00user\x00wrong")
+	for range 2 {
+		sendCmd(t, conn, "AUTH PLAIN AHVzZXIAd3Jvbmc=")
+		if resp := readLine(t, reader); !strings.HasPrefix(resp, "535 ") {
+			t.Fatalf("AUTH with wrong password: got %q, want prefix '535 '", resp)
+		}
+	}
+
+	// greeting dials the server and returns its first reply line.
+	greeting := func() string {
+		conn, err := net.Dial("tcp", srv.Addr())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		defer conn.Close()
+		return readLine(t, bufio.NewReader(conn))
+	}
+
+	if got := greeting(); !strings.HasPrefix(got, "421 4.7.0 ") {
+		t.Errorf("connection from banned IP: got %q, want prefix '421 4.7.0 '", got)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	if got := greeting(); !strings.HasPrefix(got, "220 ") {
+		t.Errorf("connection after the ban expired: got %q, want prefix '220 '", got)
+	}
+}
@@ -2,17 +2,34 @@ package smtp
 
 import (
 	"bufio"
+	"bytes"
+	"cmp"
 	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"net/mail"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
 	"github.com/shineum/smtp-proxy-lite/internal/parser"
 	"github.com/shineum/smtp-proxy-lite/internal/provider"
+	"github.com/shineum/smtp-proxy-lite/internal/queue"
 )
 
 // Session states for the SMTP state machine.
@@ -26,15 +43,54 @@ const (
 	stateDone
 )
 
-// idleTimeout is the maximum time a session can remain idle before being closed.
-const idleTimeout = 60 * time.Second
+// defaultCommandTimeout is the default time allowed to read each command
+// line before the session is closed as idle.
+const defaultCommandTimeout = 60 * time.Second
+
+// defaultMaxSessionDuration is the default total lifetime of a session,
+// however active the client is.
+const defaultMaxSessionDuration = 30 * time.Minute
 
 // maxMessageSize is the default maximum message size (10 MB).
 const maxMessageSize = 10 * 1024 * 1024
 
+// defaultMaxLineLength is the default longest command line accepted,
+// including CRLF (RFC 5321 section 4.5.3.1.4).
+const defaultMaxLineLength = 512
+
+// maxAuthLineLength is the longest AUTH command or exchange line accepted,
+// including CRLF (RFC 4954 section 4 requires at least 12288 octets).
+const maxAuthLineLength = 12288
+
+// errLineTooLong is returned by readBoundedLine for a line over its limit.
+var errLineTooLong = errors.New("line too long")
+
+// tracerName names the tracer of the spans recorded by sessions.
+const tracerName = "github.com/shineum/smtp-proxy-lite/internal/smtp"
+
+// defaultMaxAuthAttempts is the default number of failed AUTH attempts
+// allowed per session before disconnecting.
+const defaultMaxAuthAttempts = 3
+
+// defaultBanner is the text that follows the hostname in the 220 greeting.
+const defaultBanner = "ESMTP smtp-proxy-lite"
+
+// defaultMaxReceivedHeaders is the default number of Received headers a
+// message may arrive with; more means it is looping (matches Postfix's
+// hopcount_limit).
+const defaultMaxReceivedHeaders = 30
+
+// defaultMaxRecipients is the default number of RCPT TO addresses accepted
+// per message.
+const defaultMaxRecipients = 100
+
 // Session represents a single SMTP client connection and manages the
 // SMTP protocol state machine.
 type Session struct {
+	// id identifies the session in logs; logger carries it as session_id.
+	id     string
+	logger *slog.Logger
+
 	conn     net.Conn
 	reader   *bufio.Reader
 	writer   *bufio.Writer
@@ -42,20 +98,117 @@ type Session struct {
 	auth     *Authenticator
 	provider provider.Provider
 	hostname string
+	banner   string
 
 	// TLS support
 	tlsConfig *tls.Config
 	tlsActive bool
 
+	// certAuthenticated is set once the client presents a verified TLS
+	// client certificate, which satisfies AUTH for the rest of the session.
+	certAuthenticated bool
+
+	// authUser is the username the client authenticated as with AUTH.
+	authUser string
+
+	// requireTLSForAuth refuses AUTH until the connection is encrypted.
+	requireTLSForAuth bool
+
+	// maxAuthAttempts is the number of failed AUTH attempts after which the
+	// session is closed.
+	maxAuthAttempts int
+	authFailures    int
+
+	// onAuthFailure, if set, is called after each failed AUTH attempt so
+	// the server can track failures across connections.
+	onAuthFailure func()
+
+	// maxReceivedHeaders is the Received header count, not counting our
+	// own, above which a message is rejected as a routing loop.
+	maxReceivedHeaders int
+
+	// maxRecipients is the number of RCPT TO addresses accepted per
+	// message.
+	maxRecipients int
+
+	// maxTransactions is the number of messages accepted per session,
+	// after which the connection is closed. Zero means unlimited.
+	maxTransactions int
+	transactions    int
+
+	// maxLineLength is the longest command line accepted, including CRLF.
+	// AUTH lines may be up to maxAuthLineLength regardless.
+	maxLineLength int
+
+	// commandTimeout bounds the wait for each command line.
+	// maxSessionDuration caps the whole session from the greeting; zero
+	// means unlimited. sessionDeadline is set from it when Handle starts.
+	commandTimeout     time.Duration
+	maxSessionDuration time.Duration
+	sessionDeadline    time.Time
+
+	// streamThreshold is the message size above which DATA is streamed to
+	// a provider.StreamingProvider rather than parsed and sent.
+	streamThreshold int
+
+	// allowedRcptDomains, if non-empty, lists the only recipient domains
+	// accepted ("*" allows all). deniedRcptDomains are always refused.
+	allowedRcptDomains []string
+	deniedRcptDomains  []string
+
+	// greylist, if set, temporarily refuses recipients of unauthenticated
+	// clients until the delivery is retried.
+	greylist Greylister
+
+	// allowedSenders, if non-empty, lists the MAIL FROM addresses accepted:
+	// exact addresses, or "*@domain" for any address in a domain.
+	allowedSenders []string
+
+	// queue, if set, takes messages whose delivery failed transiently so
+	// they are retried in the background instead of bounced with a 451.
+	queue *queue.Spool
+
+	// deliverAsync, if set, takes each accepted message for background
+	// delivery; the client is answered without waiting on the provider.
+	deliverAsync func(*email.Email) error
+
+	// tracer records a span for each message received with DATA. It is
+	// the global tracer, a no-op unless tracing is set up.
+	tracer trace.Tracer
+
+	// lastReply is the last reply line written, recorded as the outcome
+	// of the DATA span.
+	lastReply string
+
+	// heloName is the hostname the client gave in EHLO/HELO.
+	heloName string
+
+	// closeReason records why the session ended, for the connection
+	// closed log record. Empty means the client disconnected.
+	closeReason string
+
+	// shutdown is closed when the server stops accepting connections. The
+	// session then ends before reading its next command, while a command
+	// in progress, such as DATA, still completes.
+	shutdown <-chan struct{}
+
 	// Current transaction
-	mailFrom   string
-	rcptTo     []string
-	dataBuffer strings.Builder
+	mailFrom string
+	rcptTo   []string
+
+	// dsn and rcptDSN hold the DSN parameters of the transaction;
+	// rcptDSN is parallel to rcptTo.
+	dsn     mailDSN
+	rcptDSN []rcptDSN
 }
 
 // NewSession creates a new SMTP session for the given connection.
 func NewSession(conn net.Conn, auth *Authenticator, prov provider.Provider, hostname string, tlsConfig *tls.Config) *Session {
+	id := newSessionID()
 	return &Session{
+		id:     id,
+		logger: slog.Default().With("session_id", id),
+
 		conn:      conn,
 		reader:    bufio.NewReader(conn),
 		writer:    bufio.NewWriter(conn),
@@ -63,44 +216,105 @@ func NewSession(conn net.Conn, auth *Authenticator, prov provider.Provider, host
 		auth:      auth,
 		provider:  prov,
 		hostname:  hostname,
+		banner:    defaultBanner,
 		tlsConfig: tlsConfig,
+
+		maxAuthAttempts:    defaultMaxAuthAttempts,
+		maxReceivedHeaders: defaultMaxReceivedHeaders,
+		maxRecipients:      defaultMaxRecipients,
+		maxLineLength:      defaultMaxLineLength,
+		commandTimeout:     defaultCommandTimeout,
+		streamThreshold:    defaultStreamThreshold,
+		maxSessionDuration: defaultMaxSessionDuration,
+
+		tracer: otel.Tracer(tracerName),
 	}
 }
 
+// HeloName returns the hostname the client gave in EHLO or HELO, or an
+// empty string before the client has greeted.
+func (s *Session) HeloName() string {
+	return s.heloName
+}
+
 // Handle runs the SMTP session, processing commands until the client
 // disconnects or an error occurs.
 func (s *Session) Handle(ctx context.Context) {
-	defer s.conn.Close()
+	start := time.Now()
+	remoteAddr := s.conn.RemoteAddr().String()
+	defer func() {
+		s.conn.Close()
+		s.logger.Info("connection closed",
+			"remote_addr", remoteAddr,
+			"duration", time.Since(start),
+			"reason", cmp.Or(s.closeReason, "client disconnected"),
+		)
+	}()
+
+	if s.maxSessionDuration > 0 {
+		s.sessionDeadline = start.Add(s.maxSessionDuration)
+	}
+
+	s.logger.Info("connection accepted", "remote_addr", remoteAddr)
+
+	// Commands sent before the greeting (early talkers) stay buffered in
+	// the connection and are processed in order once the greeting is out.
+	s.writeLine("220 %s %s", s.hostname, s.banner)
 
-	s.writeLine("220 %s ESMTP smtp-proxy-lite", s.hostname)
+	// On the implicit TLS listener the handshake completes with the greeting
+	if tlsConn, ok := s.conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		if state.HandshakeComplete {
+			s.logTLS(state)
+		}
+		s.checkClientCert(state)
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
+			s.closeReason = "server shutdown"
+			s.writeLine("421 Service shutting down")
+			return
+		case <-s.shutdown:
+			s.closeReason = "server shutdown"
 			s.writeLine("421 Service shutting down")
 			return
 		default:
 		}
 
-		if err := s.conn.SetDeadline(time.Now().Add(idleTimeout)); err != nil {
-			slog.Error("failed to set connection deadline", "error", err)
+		if err := s.conn.SetDeadline(s.readDeadline()); err != nil {
+			s.logger.Error("failed to set connection deadline", "error", err)
+			s.closeReason = "connection error"
 			return
 		}
 
-		line, err := s.reader.ReadString('\n')
-		if err != nil {
-			if err != io.EOF {
-				slog.Debug("connection read error", "error", err)
+		line, err := s.readBoundedLine(max(s.maxLineLength, maxAuthLineLength))
+		if err != nil && !errors.Is(err, errLineTooLong) {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				s.closeOnTimeout()
+			} else if err != io.EOF {
+				s.logger.Debug("connection read error", "error", err)
+				s.closeReason = "read error"
 			}
 			return
 		}
 
-		line = strings.TrimRight(line, "\r\n")
 		if line == "" {
 			continue
 		}
 
 		cmd, arg := parseCommand(line)
+		if cmd == "AUTH" {
+			if errors.Is(err, errLineTooLong) {
+				s.writeLine("500 5.5.6 Authentication Exchange line is too long")
+				continue
+			}
+		} else if errors.Is(err, errLineTooLong) || len(line)+len("\r\n") > s.maxLineLength {
+			s.writeLine("500 5.5.2 Line too long")
+			continue
+		}
+
 		done := s.handleCommand(ctx, cmd, arg)
 		if done {
 			return
@@ -108,6 +322,33 @@ func (s *Session) Handle(ctx context.Context) {
 	}
 }
 
+// readDeadline returns the deadline for reading the next command: the
+// command timeout from now, or the session deadline if that comes first.
+func (s *Session) readDeadline() time.Time {
+	deadline := time.Now().Add(s.commandTimeout)
+	if !s.sessionDeadline.IsZero() && s.sessionDeadline.Before(deadline) {
+		return s.sessionDeadline
+	}
+	return deadline
+}
+
+// closeOnTimeout tells the client why the session is ending after a read
+// deadline expired. The write gets a short deadline of its own since the
+// connection deadline has already passed.
+func (s *Session) closeOnTimeout() {
+	reason := "command timeout"
+	if !s.sessionDeadline.IsZero() && !time.Now().Before(s.sessionDeadline) {
+		reason = "session time limit exceeded"
+	}
+	s.logger.Info("closing session", "reason", reason, "remote_addr", s.conn.RemoteAddr().String())
+	s.closeReason = reason
+
+	if err := s.conn.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
+		return
+	}
+	s.writeLine("421 4.4.2 %s closing connection: %s", s.hostname, reason)
+}
+
 // handleCommand processes a single SMTP command and returns true if the session should end.
 func (s *Session) handleCommand(ctx context.Context, cmd, arg string) bool {
 	switch cmd {
@@ -116,19 +357,28 @@ func (s *Session) handleCommand(ctx context.Context, cmd, arg string) bool {
 	case "STARTTLS":
 		s.handleSTARTTLS()
 	case "AUTH":
-		s.handleAUTH(arg)
+		return s.handleAUTH(arg)
 	case "MAIL":
 		s.handleMAIL(arg)
 	case "RCPT":
 		s.handleRCPT(arg)
 	case "DATA":
 		s.handleDATA(ctx)
+		return s.transactionLimitReached()
 	case "RSET":
 		s.handleRSET()
 	case "NOOP":
 		s.writeLine("250 OK")
+	case "VRFY":
+		// RFC 5321 section 3.5.3: don't disclose whether the user exists
+		s.writeLine("252 2.5.2 Cannot VRFY user, but will accept message and attempt delivery")
+	case "EXPN":
+		s.writeLine("502 5.5.1 EXPN not supported")
+	case "HELP":
+		s.handleHELP()
 	case "QUIT":
 		s.writeLine("221 Bye")
+		s.closeReason = "quit"
 		return true
 	default:
 		s.writeLine("500 Unrecognized command")
@@ -136,6 +386,21 @@ func (s *Session) handleCommand(ctx context.Context, cmd, arg string) bool {
 	return false
 }
 
+// handleHELP lists the commands available in the current session state.
+// STARTTLS and AUTH are only listed when EHLO would advertise them.
+func (s *Session) handleHELP() {
+	commands := []string{"EHLO", "HELO"}
+	if s.tlsConfig != nil && !s.tlsActive {
+		commands = append(commands, "STARTTLS")
+	}
+	if s.authAvailable() {
+		commands = append(commands, "AUTH")
+	}
+	commands = append(commands, "MAIL", "RCPT", "DATA", "RSET", "NOOP", "VRFY", "HELP", "QUIT")
+
+	s.writeMultiline(214, []string{"Supported commands:", strings.Join(commands, " ")})
+}
+
 // handleEHLO processes EHLO/HELO commands.
 func (s *Session) handleEHLO(cmd, arg string) {
 	if arg == "" {
@@ -143,24 +408,36 @@ func (s *Session) handleEHLO(cmd, arg string) {
 		return
 	}
 
+	s.heloName = arg
+	s.state = stateGreeted
+	if s.certAuthenticated {
+		s.state = stateAuthOK
+	}
+
 	if cmd == "HELO" {
-		s.state = stateGreeted
 		s.writeLine("250 %s Hello %s", s.hostname, arg)
 		return
 	}
 
-	// EHLO response with capabilities
-	s.state = stateGreeted
-	s.writeLine("250-%s Hello %s", s.hostname, arg)
+	s.writeMultiline(250, s.ehloLines(arg))
+}
 
+// ehloLines returns the EHLO reply lines: the greeting followed by the
+// capabilities enabled for the current session.
+func (s *Session) ehloLines(clientName string) []string {
+	lines := []string{fmt.Sprintf("%s Hello %s", s.hostname, clientName)}
 	if s.tlsConfig != nil && !s.tlsActive {
-		s.writeLine("250-STARTTLS")
+		lines = append(lines, "STARTTLS")
 	}
-	if s.auth.Enabled() {
-		s.writeLine("250-AUTH PLAIN LOGIN")
+	if s.authAvailable() {
+		lines = append(lines, "AUTH PLAIN LOGIN")
 	}
-	s.writeLine("250-SIZE %d", maxMessageSize)
-	s.writeLine("250 OK")
+	return append(lines,
+		fmt.Sprintf("SIZE %d", maxMessageSize),
+		"8BITMIME",
+		"DSN",
+		"SMTPUTF8",
+	)
 }
 
 // handleSTARTTLS upgrades the connection to TLS.
@@ -178,26 +455,61 @@ func (s *Session) handleSTARTTLS() {
 
 	tlsConn := tls.Server(s.conn, s.tlsConfig)
 	if err := tlsConn.Handshake(); err != nil {
-		slog.Error("TLS handshake failed", "error", err)
+		s.logger.Error("TLS handshake failed", "error", err)
 		return
 	}
 
+	state := tlsConn.ConnectionState()
+	s.logTLS(state)
+
 	s.conn = tlsConn
 	s.reader = bufio.NewReader(tlsConn)
 	s.writer = bufio.NewWriter(tlsConn)
 	s.tlsActive = true
 	s.state = stateConnected
+	s.checkClientCert(state)
+}
+
+// logTLS records the parameters negotiated by a completed TLS handshake.
+func (s *Session) logTLS(state tls.ConnectionState) {
+	s.logger.Info("TLS handshake completed",
+		"remote_addr", s.conn.RemoteAddr().String(),
+		"tls_version", tls.VersionName(state.Version),
+		"cipher_suite", tls.CipherSuiteName(state.CipherSuite),
+		"alpn", state.NegotiatedProtocol,
+	)
+}
+
+// checkClientCert marks the session authenticated if the TLS handshake
+// verified a client certificate against the configured client CAs.
+func (s *Session) checkClientCert(state tls.ConnectionState) {
+	if len(state.VerifiedChains) == 0 {
+		return
+	}
+
+	// handleEHLO promotes the session once the client greets again
+	s.certAuthenticated = true
+	s.logger.Info("client authenticated by TLS certificate",
+		"remote_addr", s.conn.RemoteAddr().String(),
+		"subject", state.PeerCertificates[0].Subject.String(),
+	)
 }
 
 // handleAUTH processes AUTH commands (PLAIN and LOGIN mechanisms).
-func (s *Session) handleAUTH(arg string) {
+// It returns true if the session should end because too many
+// authentication attempts failed.
+func (s *Session) handleAUTH(arg string) bool {
 	if s.state < stateGreeted {
 		s.writeLine("503 Send EHLO/HELO first")
-		return
+		return false
 	}
 	if !s.auth.Enabled() {
 		s.writeLine("503 AUTH not available")
-		return
+		return false
+	}
+	if s.requireTLSForAuth && !s.tlsActive {
+		s.writeLine("538 Encryption required for requested authentication mechanism")
+		return false
 	}
 
 	parts := strings.SplitN(arg, " ", 2)
@@ -205,16 +517,24 @@ func (s *Session) handleAUTH(arg string) {
 
 	switch mechanism {
 	case "PLAIN":
-		s.handleAuthPlain(parts)
+		return s.handleAuthPlain(parts)
 	case "LOGIN":
-		s.handleAuthLogin()
+		return s.handleAuthLogin()
 	default:
 		s.writeLine("504 Unrecognized authentication type")
+		return false
 	}
 }
 
-// handleAuthPlain processes AUTH PLAIN authentication.
-func (s *Session) handleAuthPlain(parts []string) {
+// authAvailable reports whether AUTH may be advertised on the connection in
+// its current state.
+func (s *Session) authAvailable() bool {
+	return s.auth.Enabled() && (!s.requireTLSForAuth || s.tlsActive)
+}
+
+// handleAuthPlain processes AUTH PLAIN authentication. It returns true if
+// the session should end.
+func (s *Session) handleAuthPlain(parts []string) bool {
 	var encoded string
 
 	if len(parts) > 1 && parts[1] != "" {
@@ -223,77 +543,177 @@ func (s *Session) handleAuthPlain(parts []string) {
 	} else {
 		// Challenge-response: send 334 and wait for credentials
 		s.writeLine("334")
-		line, err := s.reader.ReadString('\n')
+		line, err := s.readAuthLine("AUTH PLAIN response")
 		if err != nil {
-			slog.Error("failed to read AUTH PLAIN response", "error", err)
-			return
+			return s.authReadFailed(err)
 		}
-		encoded = strings.TrimRight(line, "\r\n")
+		encoded = line
 	}
 
 	if encoded == "*" {
 		s.writeLine("501 Authentication cancelled")
-		return
+		return false
 	}
 
-	if err := s.auth.VerifyPlain(encoded); err != nil {
-		s.writeLine("535 Authentication failed")
-		return
+	user, err := s.auth.AuthenticatePlain(encoded)
+	if err != nil {
+		return s.authFailed("PLAIN", user)
 	}
 
-	s.state = stateAuthOK
-	s.writeLine("235 Authentication successful")
+	s.authSucceeded("PLAIN", user)
+	return false
+}
+
+// readBoundedLine reads a line from the client and returns it without the
+// line terminator. Once the line, including CRLF, exceeds limit the rest
+// of it is discarded unbuffered, and the first limit bytes are returned
+// with errLineTooLong so the caller can still see which command it was.
+func (s *Session) readBoundedLine(limit int) (string, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := s.reader.ReadSlice('\n')
+		if !tooLong {
+			line = append(line, chunk...)
+			if len(bytes.TrimRight(line, "\r\n"))+len("\r\n") > limit {
+				tooLong, line = true, line[:min(len(line), limit)]
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+
+	text := strings.TrimRight(string(line), "\r\n")
+	if tooLong {
+		return text, errLineTooLong
+	}
+	return text, nil
+}
+
+// readAuthLine reads the client's reply to an AUTH challenge under a fresh
+// read deadline, since it happens outside the command loop. A line longer
+// than maxAuthLineLength returns errLineTooLong; on a timeout the client
+// is sent 421.
+func (s *Session) readAuthLine(what string) (string, error) {
+	if err := s.conn.SetDeadline(s.readDeadline()); err != nil {
+		s.logger.Error("failed to set connection deadline", "error", err)
+		return "", err
+	}
+
+	line, err := s.readBoundedLine(maxAuthLineLength)
+	if err != nil && !errors.Is(err, errLineTooLong) {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			s.closeOnTimeout()
+		} else {
+			s.logger.Error("failed to read "+what, "error", err)
+			s.closeReason = "read error"
+		}
+	}
+	return line, err
+}
+
+// authReadFailed handles an error from readAuthLine and returns true if the
+// session should end. An over-long line only aborts the AUTH exchange.
+func (s *Session) authReadFailed(err error) bool {
+	if errors.Is(err, errLineTooLong) {
+		s.writeLine("500 5.5.6 Authentication Exchange line is too long")
+		return false
+	}
+	return true
 }
 
 // handleAuthLogin processes AUTH LOGIN authentication via challenge-response.
-func (s *Session) handleAuthLogin() {
+// It returns true if the session should end.
+func (s *Session) handleAuthLogin() bool {
 	// Challenge for username (base64 encoded "Username:")
 	s.writeLine("334 VXNlcm5hbWU6")
-	userLine, err := s.reader.ReadString('\n')
+	encodedUser, err := s.readAuthLine("AUTH LOGIN username")
 	if err != nil {
-		slog.Error("failed to read AUTH LOGIN username", "error", err)
-		return
+		return s.authReadFailed(err)
 	}
-	encodedUser := strings.TrimRight(userLine, "\r\n")
 
 	if encodedUser == "*" {
 		s.writeLine("501 Authentication cancelled")
-		return
+		return false
 	}
 
 	// Challenge for password (base64 encoded "Password:")
 	s.writeLine("334 UGFzc3dvcmQ6")
-	passLine, err := s.reader.ReadString('\n')
+	encodedPass, err := s.readAuthLine("AUTH LOGIN password")
 	if err != nil {
-		slog.Error("failed to read AUTH LOGIN password", "error", err)
-		return
+		return s.authReadFailed(err)
 	}
-	encodedPass := strings.TrimRight(passLine, "\r\n")
 
 	if encodedPass == "*" {
 		s.writeLine("501 Authentication cancelled")
-		return
+		return false
 	}
 
-	if err := s.auth.VerifyLogin(encodedUser, encodedPass); err != nil {
-		s.writeLine("535 Authentication failed")
-		return
+	user, err := s.auth.AuthenticateLogin(encodedUser, encodedPass)
+	if err != nil {
+		return s.authFailed("LOGIN", user)
 	}
 
+	s.authSucceeded("LOGIN", user)
+	return false
+}
+
+// authSucceeded marks the session authenticated as user and replies to the
+// client.
+func (s *Session) authSucceeded(mechanism, user string) {
+	s.logger.Info("authentication succeeded",
+		"remote_addr", s.conn.RemoteAddr().String(),
+		"mechanism", mechanism,
+		"username", user,
+	)
+	s.authUser = user
 	s.state = stateAuthOK
 	s.writeLine("235 Authentication successful")
 }
 
+// authFailed records a failed authentication attempt by user (empty if the
+// credentials could not be decoded) and replies to the client. Once
+// maxAuthAttempts failures accumulate, it reports that the session should
+// be closed. The password is never logged.
+func (s *Session) authFailed(mechanism, user string) bool {
+	s.authFailures++
+	if s.onAuthFailure != nil {
+		s.onAuthFailure()
+	}
+	s.logger.Warn("authentication failed",
+		"remote_addr", s.conn.RemoteAddr().String(),
+		"mechanism", mechanism,
+		"username", user,
+		"failures", s.authFailures,
+	)
+	if s.authFailures >= s.maxAuthAttempts {
+		s.logger.Warn("too many authentication failures, closing connection",
+			"remote_addr", s.conn.RemoteAddr().String(),
+			"failures", s.authFailures,
+		)
+		s.closeReason = "too many authentication failures"
+		s.writeLine("535 5.7.8 Too many authentication failures")
+		return true
+	}
+	s.writeLine("535 Authentication failed")
+	return false
+}
+
 // handleMAIL processes the MAIL FROM command.
 func (s *Session) handleMAIL(arg string) {
-	if s.auth.Enabled() && s.state < stateAuthOK {
-		s.writeLine("530 Authentication required")
-		return
-	}
 	if s.state < stateGreeted {
 		s.writeLine("503 Send EHLO/HELO first")
 		return
 	}
+	if s.auth.Enabled() && s.state < stateAuthOK {
+		s.writeLine("530 Authentication required")
+		return
+	}
 
 	upper := strings.ToUpper(arg)
 	if !strings.HasPrefix(upper, "FROM:") {
@@ -301,15 +721,51 @@ func (s *Session) handleMAIL(arg string) {
 		return
 	}
 
-	addr := extractAddress(arg[5:])
-	if addr == "" {
+	// An empty reverse-path (MAIL FROM:<>) is valid and used for bounces
+	param := strings.TrimSpace(arg[5:])
+	addr := extractAddress(param)
+	if addr == "" && !strings.HasPrefix(param, "<>") {
 		s.writeLine("501 Syntax: MAIL FROM:<address>")
 		return
 	}
+	if addr != "" && !isValidAddress(addr) {
+		s.writeLine("501 5.1.7 Bad sender address syntax")
+		return
+	}
+
+	// BODY (RFC 6152) needs no handling as messages are forwarded 8-bit clean
+	params := esmtpParams(param)
+	if body, ok := params["BODY"]; ok && body != "7BIT" && body != "8BITMIME" {
+		s.writeLine("501 5.5.4 Unsupported BODY parameter")
+		return
+	}
+	dsn, err := parseMailDSN(params)
+	if err != nil {
+		s.writeLine("501 5.5.4 Invalid DSN parameter: %s", err)
+		return
+	}
+
+	if s.authUser != "" && !s.auth.AllowedSender(s.authUser, addr) {
+		s.logger.Warn("sender domain not allowed for user",
+			"user", s.authUser,
+			"from", addr,
+		)
+		s.writeLine("550 5.7.1 From not authorized for this user")
+		return
+	}
+	if len(s.allowedSenders) > 0 && !senderAllowed(s.allowedSenders, addr) {
+		s.logger.Warn("sender address not allowed",
+			"remote_addr", s.conn.RemoteAddr().String(),
+			"from", addr,
+		)
+		s.writeLine("550 5.7.1 Sender address rejected")
+		return
+	}
 
 	s.mailFrom = addr
+	s.dsn = dsn
 	s.rcptTo = nil
-	s.dataBuffer.Reset()
+	s.rcptDSN = nil
 	s.state = stateMailFrom
 	s.writeLine("250 OK")
 }
@@ -332,12 +788,97 @@ func (s *Session) handleRCPT(arg string) {
 		s.writeLine("501 Syntax: RCPT TO:<address>")
 		return
 	}
+	// A bare "postmaster" has no domain but must be accepted (RFC 5321)
+	if !isValidAddress(addr) && !isPostmaster(addr, s.hostname) {
+		s.writeLine("501 5.1.3 Bad recipient address syntax")
+		return
+	}
+	dsn, err := parseRcptDSN(esmtpParams(arg[3:]))
+	if err != nil {
+		s.writeLine("501 5.5.4 Invalid DSN parameter: %s", err)
+		return
+	}
+
+	if len(s.rcptTo) >= s.maxRecipients {
+		s.writeLine("452 4.5.3 Too many recipients")
+		return
+	}
+
+	// RFC 5321 section 4.5.1 requires postmaster to always be accepted,
+	// so it bypasses recipient policy checks.
+	if !isPostmaster(addr, s.hostname) {
+		if reply := s.checkRecipient(addr); reply != "" {
+			s.writeLine("%s", reply)
+			return
+		}
+	}
 
 	s.rcptTo = append(s.rcptTo, addr)
+	s.rcptDSN = append(s.rcptDSN, dsn)
 	s.state = stateRcptTo
 	s.writeLine("250 OK")
 }
 
+// checkRecipient applies recipient policy to a RCPT TO address. It returns
+// the SMTP reply to send when the recipient is rejected, or an empty string
+// when it is accepted.
+func (s *Session) checkRecipient(addr string) string {
+	_, domain, _ := strings.Cut(addr, "@")
+
+	denied := domainListed(s.deniedRcptDomains, domain)
+	allowed := len(s.allowedRcptDomains) == 0 ||
+		slices.Contains(s.allowedRcptDomains, "*") ||
+		domainListed(s.allowedRcptDomains, domain)
+	if denied || !allowed {
+		s.logger.Warn("recipient domain not allowed",
+			"remote_addr", s.conn.RemoteAddr().String(),
+			"rcpt_to", addr,
+		)
+		return "550 5.7.1 Relaying denied"
+	}
+
+	// Authenticated clients are our own submitters, not inbound relays
+	authenticated := s.authUser != "" || s.certAuthenticated
+	if s.greylist != nil && !authenticated && !s.greylist.Allow(remoteIP(s.conn), s.mailFrom, addr) {
+		s.logger.Info("recipient greylisted",
+			"remote_addr", s.conn.RemoteAddr().String(),
+			"from", s.mailFrom,
+			"rcpt_to", addr,
+		)
+		return "451 4.7.1 Greylisted, try again later"
+	}
+	return ""
+}
+
+// senderAllowed reports whether addr matches one of patterns: an exact
+// address, or "*@domain" for any address in domain. Matching ignores case.
+func senderAllowed(patterns []string, addr string) bool {
+	_, domain, _ := strings.Cut(addr, "@")
+	for _, p := range patterns {
+		if local, pdomain, ok := strings.Cut(p, "@"); ok && local == "*" {
+			if strings.EqualFold(pdomain, domain) {
+				return true
+			}
+			continue
+		}
+		if strings.EqualFold(p, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// domainListed reports whether domain matches an entry of list,
+// ignoring case.
+func domainListed(list []string, domain string) bool {
+	for _, d := range list {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
 // handleDATA processes the DATA command.
 // @MX:WARN: [AUTO] DATA handler reads until dot-stuffed terminator; large messages may consume memory
 // @MX:REASON: Unbounded read from network until \r\n.\r\n terminator
@@ -349,38 +890,71 @@ func (s *Session) handleDATA(ctx context.Context) {
 
 	s.writeLine("354 Start mail input; end with <CRLF>.<CRLF>")
 
-	var dataBuilder strings.Builder
+	// The span covers receiving, parsing and sending the message; the
+	// provider's API requests are its children
+	ctx, span := s.tracer.Start(ctx, "smtp.data", trace.WithAttributes(
+		attribute.String("smtp.provider", s.provider.Name()),
+		attribute.Int("smtp.recipients", len(s.rcptTo)),
+	))
+	defer s.endDataSpan(span)
+
+	// A message outgrowing the stream threshold is handed to a streaming
+	// provider as it arrives. Messages are only queued or spooled for
+	// retry once parsed, so streaming is off when either is configured.
+	// Without recipients the buffered path below rejects the message.
+	sp, canStream := s.provider.(provider.StreamingProvider)
+	canStream = canStream && s.deliverAsync == nil && s.queue == nil && len(s.rcptTo) > 0
+
+	buf := getDataBuffer()
+	defer putDataBuffer(buf)
+
+	buf.WriteString(s.receivedHeader(time.Now()))
+	headers := newHeaderScan()
 	for {
-		line, err := s.reader.ReadString('\n')
+		line, end, err := s.readDataLine()
 		if err != nil {
-			slog.Error("error reading DATA", "error", err)
+			s.logger.Error("error reading DATA", "error", err)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "error reading DATA")
 			return
 		}
-
-		// Check for end of data marker
-		trimmed := strings.TrimRight(line, "\r\n")
-		if trimmed == "." {
+		if end {
 			break
 		}
+		headers.scan(line)
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
 
-		// Dot-stuffing: lines starting with ".." have the leading dot removed
-		if strings.HasPrefix(trimmed, "..") {
-			line = line[1:]
+		if canStream && buf.Len() > s.streamThreshold {
+			s.streamDATA(ctx, sp, buf.Bytes(), headers)
+			return
 		}
-
-		dataBuilder.WriteString(line)
 	}
+	size := buf.Len()
+	span.SetAttributes(attribute.Int("smtp.size_bytes", size))
 
-	rawData := dataBuilder.String()
-
-	// Parse the message
-	msg, err := parser.Parse([]byte(rawData))
+	// Parse the message. The parser copies what it keeps, so the buffer
+	// can go back to the pool once handleDATA returns.
+	msg, err := parser.Parse(buf.Bytes())
 	if err != nil {
-		slog.Error("failed to parse message", "error", err)
+		s.logger.Error("failed to parse message", "error", err)
+		span.RecordError(err)
 		s.writeLine("550 Failed to process message")
 		s.resetTransaction()
 		return
 	}
+	span.SetAttributes(attribute.String("smtp.message_id", msg.MessageID))
+
+	// Reject messages that have already passed through too many hops
+	if hops := headers.hops; hops > s.maxReceivedHeaders {
+		s.logger.Warn("routing loop detected",
+			"received_headers", hops,
+			"max_received_headers", s.maxReceivedHeaders,
+		)
+		s.writeLine("554 5.4.6 Routing loop detected")
+		s.resetTransaction()
+		return
+	}
 
 	// Set envelope information if not present in parsed message
 	if msg.From == "" {
@@ -389,23 +963,278 @@ func (s *Session) handleDATA(ctx context.Context) {
 	if len(msg.To) == 0 {
 		msg.To = s.rcptTo
 	}
+	addEnvelopeBcc(msg, s.rcptTo)
+
+	// DATA requires a recipient, so this only happens if the transaction
+	// state is inconsistent; never hand the provider a message to nobody
+	if !hasRecipients(msg) {
+		s.logger.Warn("rejecting message without recipients",
+			"remote_addr", s.conn.RemoteAddr().String(),
+			"mail_from", s.mailFrom,
+		)
+		s.writeLine("554 5.5.0 No valid recipients")
+		s.resetTransaction()
+		return
+	}
+
+	// A message with no content is most likely a client bug
+	if isEmptyMessage(msg) {
+		s.logger.Warn("rejecting empty message",
+			"remote_addr", s.conn.RemoteAddr().String(),
+			"mail_from", s.mailFrom,
+		)
+		s.writeLine("550 5.6.0 Empty message")
+		s.resetTransaction()
+		return
+	}
+
+	if s.deliverAsync != nil {
+		if err := s.deliverAsync(msg); err != nil {
+			s.logger.Error("failed to accept message for delivery",
+				"message_id", msg.MessageID,
+				"error", err,
+			)
+			s.writeLine("451 4.3.1 Delivery queue unavailable, please try again later")
+			s.resetTransaction()
+			return
+		}
+		s.logger.Info("message accepted for delivery",
+			"message_id", msg.MessageID,
+			"remote_addr", s.conn.RemoteAddr().String(),
+			"helo", s.heloName,
+			"mail_from", s.mailFrom,
+			"from", msg.From,
+			"recipients", len(s.rcptTo),
+			"size_bytes", size,
+		)
+		s.transactions++
+		s.writeLine("250 OK message queued")
+		s.resetTransaction()
+		return
+	}
 
 	// Send via provider
-	if err := s.provider.Send(ctx, msg); err != nil {
-		slog.Error("provider send failed",
+	start := time.Now()
+	err = s.provider.Send(ctx, msg)
+	latency := time.Since(start)
+	if err != nil {
+		span.RecordError(err)
+		permanent := provider.IsPermanent(err)
+		s.logger.Error("provider send failed",
 			"provider", s.provider.Name(),
+			"message_id", msg.MessageID,
+			"latency_ms", latency.Milliseconds(),
+			"permanent", permanent,
 			"error", err,
 		)
-		// Map provider errors to SMTP response codes
-		s.writeLine("451 Temporary failure, please try again later")
+		if !permanent && s.queue != nil {
+			qerr := s.queue.Retry(msg, err)
+			if qerr == nil {
+				s.logger.Info("message queued for retry",
+					"provider", s.provider.Name(),
+					"message_id", msg.MessageID,
+					"mail_from", s.mailFrom,
+					"recipients", len(s.rcptTo),
+				)
+				s.transactions++
+				s.writeLine("250 OK message queued for retry")
+				s.resetTransaction()
+				return
+			}
+			// Without the queue the client must retry, as before
+			s.logger.Error("failed to queue message for retry", "error", qerr)
+		}
+		s.writeSendFailure(err)
 		s.resetTransaction()
 		return
 	}
 
+	s.logDSNRequest()
+	s.logger.Info("message delivered",
+		"provider", s.provider.Name(),
+		"message_id", msg.MessageID,
+		"remote_addr", s.conn.RemoteAddr().String(),
+		"helo", s.heloName,
+		"mail_from", s.mailFrom,
+		"from", msg.From,
+		"recipients", len(s.rcptTo),
+		"size_bytes", size,
+		"latency_ms", latency.Milliseconds(),
+	)
+	s.transactions++
 	s.writeLine("250 OK message queued")
 	s.resetTransaction()
 }
 
+// endDataSpan ends the span of a DATA command, recording the reply the
+// client was given as its outcome.
+func (s *Session) endDataSpan(span trace.Span) {
+	// A 354 reply means the message never arrived in full, which the
+	// caller has recorded already
+	code, _, _ := strings.Cut(s.lastReply, " ")
+	if n, err := strconv.Atoi(code); err == nil && n != 354 {
+		span.SetAttributes(attribute.Int("smtp.reply_code", n))
+		if n >= 400 {
+			span.SetStatus(codes.Error, s.lastReply)
+		}
+	}
+	span.End()
+}
+
+// readDataLine reads one line of DATA and returns it without its line
+// ending and with dot-stuffing removed. end reports the terminating ".".
+func (s *Session) readDataLine() (line string, end bool, err error) {
+	line, err = s.reader.ReadString('\n')
+	if err != nil {
+		return "", false, err
+	}
+
+	// Check for end of data marker. Some clients end lines with a bare
+	// LF, so accept either ending here; callers store CRLF.
+	line = strings.TrimRight(line, "\r\n")
+	if line == "." {
+		return "", true, nil
+	}
+
+	// Dot-stuffing: the client doubles a leading dot, so strip exactly
+	// one from every line that starts with one (RFC 5321 section 4.5.2)
+	return strings.TrimPrefix(line, "."), false, nil
+}
+
+// writeSendFailure replies to a failed provider send. A permanent failure
+// is bounced so the client does not retry a message the provider will
+// never accept.
+func (s *Session) writeSendFailure(err error) {
+	var tooLarge *provider.MessageTooLargeError
+	var policy *provider.PolicyError
+	if errors.As(err, &tooLarge) {
+		s.writeLine("552 5.3.4 %s", tooLarge.Reason)
+	} else if errors.As(err, &policy) {
+		s.writeLine("550 5.7.1 %s", policy.Reason)
+	} else if provider.IsPermanent(err) {
+		s.writeLine("550 5.0.0 Message rejected by provider")
+	} else {
+		s.writeLine("451 4.3.0 Temporary failure, please try again later")
+	}
+}
+
+// logDSNRequest records DSN parameters of the transaction, which providers
+// do not support, for auditing.
+func (s *Session) logDSNRequest() {
+	if s.dsn.requested() || slices.ContainsFunc(s.rcptDSN, func(d rcptDSN) bool { return len(d.Notify) > 0 }) {
+		s.logger.Debug("DSN requested but not forwarded by provider",
+			"provider", s.provider.Name(),
+			"ret", s.dsn.Ret,
+			"envid", s.dsn.EnvID,
+			"rcpt_dsn", s.rcptDSN,
+		)
+	}
+}
+
+// transactionLimitReached reports whether the session has accepted
+// maxTransactions messages, in which case the client is told and the
+// session should be closed.
+func (s *Session) transactionLimitReached() bool {
+	if s.maxTransactions == 0 || s.transactions < s.maxTransactions {
+		return false
+	}
+	s.logger.Warn("too many messages this session, closing connection",
+		"remote_addr", s.conn.RemoteAddr().String(),
+		"messages", s.transactions,
+	)
+	s.closeReason = "too many messages"
+	s.writeLine("421 4.7.0 Too many messages this session")
+	return true
+}
+
+// maxPooledDataBuffer is the largest DATA buffer returned to the pool; the
+// occasional large message should not pin its memory for the life of the
+// process.
+const maxPooledDataBuffer = 1 << 20
+
+// dataBufferPool holds the buffers DATA is accumulated in, shared by all
+// sessions to spare an allocation per message.
+var dataBufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+// getDataBuffer returns an empty buffer from the pool.
+func getDataBuffer() *bytes.Buffer {
+	buf := dataBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// putDataBuffer returns buf to the pool unless it has grown too large.
+// Nothing may refer to its contents afterwards.
+func putDataBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledDataBuffer {
+		return
+	}
+	dataBufferPool.Put(buf)
+}
+
+// receivedHeader returns the Received header recording this hop, to be
+// prepended to the message (RFC 5321 section 4.4).
+func (s *Session) receivedHeader(now time.Time) string {
+	// RFC 5321 section 4.1.3 tags IPv6 address literals
+	literal := remoteIP(s.conn)
+	if strings.Contains(literal, ":") {
+		literal = "IPv6:" + literal
+	}
+
+	return fmt.Sprintf("Received: from %s ([%s])\r\n\tby %s with ESMTP id %s;\r\n\t%s\r\n",
+		s.heloName, literal, s.hostname, newQueueID(), now.Format(time.RFC1123Z))
+}
+
+// newQueueID returns a random identifier for a received message.
+func newQueueID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return strings.ToUpper(hex.EncodeToString(b))
+}
+
+// newSessionID returns a short random identifier for a session.
+func newSessionID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// addEnvelopeBcc adds envelope recipients that appear in none of the To,
+// Cc or Bcc headers to msg.Bcc. Clients usually list Bcc recipients only in
+// RCPT TO, and providers deliver to the header recipients.
+func addEnvelopeBcc(msg *email.Email, rcptTo []string) {
+	listed := make(map[string]bool)
+	for _, list := range [][]string{msg.To, msg.Cc, msg.Bcc} {
+		for _, addr := range list {
+			listed[strings.ToLower(addr)] = true
+		}
+	}
+
+	for _, rcpt := range rcptTo {
+		key := strings.ToLower(rcpt)
+		if listed[key] {
+			continue
+		}
+		listed[key] = true
+		msg.Bcc = append(msg.Bcc, rcpt)
+	}
+}
+
+// hasRecipients reports whether a parsed message has at least one
+// recipient, in its headers or added from the envelope.
+func hasRecipients(msg *email.Email) bool {
+	return len(msg.To) > 0 || len(msg.Cc) > 0 || len(msg.Bcc) > 0
+}
+
+// isEmptyMessage reports whether a parsed message has neither a body nor
+// attachments.
+func isEmptyMessage(msg *email.Email) bool {
+	hasBody := strings.TrimSpace(msg.TextBody) != "" || strings.TrimSpace(msg.HtmlBody) != ""
+	return !hasBody && len(msg.Attachments) == 0
+}
+
 // handleRSET resets the current transaction state.
 func (s *Session) handleRSET() {
 	s.resetTransaction()
@@ -417,7 +1246,8 @@ func (s *Session) handleRSET() {
 func (s *Session) resetTransaction() {
 	s.mailFrom = ""
 	s.rcptTo = nil
-	s.dataBuffer.Reset()
+	s.dsn = mailDSN{}
+	s.rcptDSN = nil
 
 	// Reset state to post-auth or post-greet
 	if s.auth.Enabled() && s.state >= stateAuthOK {
@@ -427,16 +1257,48 @@ func (s *Session) resetTransaction() {
 	}
 }
 
-// writeLine writes a formatted line to the client, followed by \r\n.
+// writeMultiline writes a multi-line reply (RFC 5321 section 4.2.1): every
+// line but the last is joined to the code with "-", the last with a space.
+// The lines are flushed together, so a long reply such as EHLO's costs one
+// write to the connection rather than one per line.
+func (s *Session) writeMultiline(code int, lines []string) {
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		if !s.bufferLine("%d%s%s", code, sep, line) {
+			return
+		}
+	}
+	s.flush()
+}
+
+// writeLine writes a formatted line to the client, followed by \r\n, and
+// flushes it.
 func (s *Session) writeLine(format string, args ...interface{}) {
+	if s.bufferLine(format, args...) {
+		s.flush()
+	}
+}
+
+// bufferLine adds a formatted line, followed by \r\n, to the output
+// buffer without sending it, so several replies can go out in one flush.
+// It reports whether the line was buffered.
+func (s *Session) bufferLine(format string, args ...interface{}) bool {
 	line := fmt.Sprintf(format, args...)
-	_, err := s.writer.WriteString(line + "\r\n")
-	if err != nil {
-		slog.Error("failed to write to client", "error", err)
-		return
+	s.lastReply = line
+	if _, err := s.writer.WriteString(line + "\r\n"); err != nil {
+		s.logger.Error("failed to write to client", "error", err)
+		return false
 	}
+	return true
+}
+
+// flush sends the buffered output to the client.
+func (s *Session) flush() {
 	if err := s.writer.Flush(); err != nil {
-		slog.Error("failed to flush to client", "error", err)
+		s.logger.Error("failed to flush to client", "error", err)
 	}
 }
 
@@ -451,8 +1313,56 @@ func parseCommand(line string) (string, string) {
 	return cmd, arg
 }
 
+// isPostmaster reports whether addr is the bare "postmaster" mailbox or
+// postmaster at this server's hostname. The local part is case-insensitive
+// per RFC 5321.
+func isPostmaster(addr, hostname string) bool {
+	local, domain, hasDomain := strings.Cut(addr, "@")
+	if !strings.EqualFold(local, "postmaster") {
+		return false
+	}
+	return !hasDomain || strings.EqualFold(domain, hostname)
+}
+
+// esmtpParams returns the ESMTP parameters following the address in a MAIL
+// or RCPT argument (e.g. "<a@b> BODY=8BITMIME SMTPUTF8"), keyed by upper-case
+// name. Parameters without a value map to an empty string. The BODY value
+// is case-insensitive and is upper-cased too.
+func esmtpParams(s string) map[string]string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "<") {
+		end := strings.Index(s, ">")
+		if end < 0 {
+			return nil
+		}
+		s = s[end+1:]
+	} else {
+		_, s, _ = strings.Cut(s, " ")
+	}
+
+	params := make(map[string]string)
+	for _, field := range strings.Fields(s) {
+		key, value, _ := strings.Cut(field, "=")
+		key = strings.ToUpper(key)
+		if key == "BODY" {
+			value = strings.ToUpper(value)
+		}
+		params[key] = value
+	}
+	return params
+}
+
+// isValidAddress reports whether addr is a syntactically valid bare email
+// address (local@domain, without a display name).
+func isValidAddress(addr string) bool {
+	parsed, err := mail.ParseAddress(addr)
+	return err == nil && parsed.Name == "" && strings.Contains(addr, "@")
+}
+
 // extractAddress extracts an email address from an SMTP parameter,
-// handling both angle-bracket and bare formats.
+// handling both angle-bracket and bare formats. ESMTP parameters after the
+// address (e.g. SMTPUTF8 or SIZE=n) are ignored. UTF-8 addresses
+// (RFC 6531) are returned unchanged.
 func extractAddress(s string) string {
 	s = strings.TrimSpace(s)
 
@@ -466,5 +1376,6 @@ func extractAddress(s string) string {
 	}
 
 	// Bare address format
-	return s
+	addr, _, _ := strings.Cut(s, " ")
+	return addr
 }
@@ -2,13 +2,39 @@ package smtp
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
 	"net"
+	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/crypto/bcrypt"
+
 	"github.com/shineum/smtp-proxy-lite/internal/email"
+	"github.com/shineum/smtp-proxy-lite/internal/provider"
+	"github.com/shineum/smtp-proxy-lite/internal/queue"
+	smtptls "github.com/shineum/smtp-proxy-lite/internal/tls"
 )
 
 // mockProvider implements provider.Provider for testing.
@@ -27,7 +53,7 @@ func (m *mockProvider) Name() string {
 }
 
 // connPair creates a connected pair of net.Conn for testing SMTP sessions.
-func connPair(t *testing.T) (client net.Conn, server net.Conn) {
+func connPair(t testing.TB) (client net.Conn, server net.Conn) {
 	t.Helper()
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -53,8 +79,38 @@ func connPair(t *testing.T) (client net.Conn, server net.Conn) {
 	return client, server
 }
 
+// logBuffer collects log output. A session may still be logging, for
+// example as its connection closes, while the test reads the buffer.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs redirects the default slog logger to a buffer at debug level
+// for the duration of the test. Tests using it must not call t.Parallel.
+func captureLogs(t *testing.T) *logBuffer {
+	t.Helper()
+	buf := &logBuffer{}
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return buf
+}
+
 // readLine reads a line from a buffered reader with a timeout.
-func readLine(t *testing.T, reader *bufio.Reader) string {
+func readLine(t testing.TB, reader *bufio.Reader) string {
 	t.Helper()
 	line, err := reader.ReadString('\n')
 	if err != nil {
@@ -63,8 +119,21 @@ func readLine(t *testing.T, reader *bufio.Reader) string {
 	return strings.TrimRight(line, "\r\n")
 }
 
+// readEHLO reads a complete multi-line EHLO response and returns its lines.
+func readEHLO(t testing.TB, reader *bufio.Reader) []string {
+	t.Helper()
+	var lines []string
+	for {
+		line := readLine(t, reader)
+		lines = append(lines, line)
+		if !strings.HasPrefix(line, "250-") {
+			return lines
+		}
+	}
+}
+
 // sendCmd sends a command to the SMTP session.
-func sendCmd(t *testing.T, conn net.Conn, cmd string) {
+func sendCmd(t testing.TB, conn net.Conn, cmd string) {
 	t.Helper()
 	_, err := conn.Write([]byte(cmd + "\r\n"))
 	if err != nil {
@@ -148,6 +217,114 @@ func TestSession_EHLO(t *testing.T) {
 	}
 }
 
+func TestSession_EHLO_FramingWithoutTLSOrAuth(t *testing.T) {
+	t.Parallel()
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	// No TLS config and no credentials: neither STARTTLS nor AUTH is offered
+	sess := NewSession(server, NewAuthenticator("", ""), &mockProvider{}, "mail.test.com", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go sess.Handle(ctx)
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "EHLO client.test.com")
+	lines := readEHLO(t, reader)
+
+	want := []string{
+		"250-mail.test.com Hello client.test.com",
+		"250-SIZE 10485760",
+		"250-8BITMIME",
+		"250-DSN",
+		"250 SMTPUTF8",
+	}
+	if !slices.Equal(lines, want) {
+		t.Errorf("EHLO reply:\n got %q\nwant %q", lines, want)
+	}
+}
+
+// BenchmarkEHLOReply measures sending an EHLO reply and the client reading
+// all of it, flushing after every line versus once for the whole reply.
+func BenchmarkEHLOReply(b *testing.B) {
+	client, server := connPair(b)
+	defer client.Close()
+	defer server.Close()
+
+	tlsConfig := &tls.Config{}
+	sess := NewSession(server, NewAuthenticator("user", "pass"), &mockProvider{}, "mail.test.com", tlsConfig)
+	lines := sess.ehloLines("client.test.com")
+
+	// The client reads replies until the final line and reports each one
+	read := make(chan struct{})
+	go func() {
+		reader := bufio.NewReader(client)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if len(line) > 3 && line[3] == ' ' {
+				read <- struct{}{}
+			}
+		}
+	}()
+
+	b.Run("per-line flush", func(b *testing.B) {
+		for range b.N {
+			for i, line := range lines {
+				sep := "-"
+				if i == len(lines)-1 {
+					sep = " "
+				}
+				sess.writeLine("250%s%s", sep, line)
+			}
+			<-read
+		}
+	})
+
+	b.Run("batched flush", func(b *testing.B) {
+		for range b.N {
+			sess.writeMultiline(250, lines)
+			<-read
+		}
+	})
+}
+
+func TestSession_HeloNameCaptured(t *testing.T) {
+	t.Parallel()
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	auth := NewAuthenticator("", "")
+	sess := NewSession(server, auth, &mockProvider{}, "mail.test.com", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go sess.Handle(ctx)
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "EHLO client.test.com")
+	readEHLO(t, reader)
+
+	// A later command round-trip ensures EHLO has been fully processed
+	sendCmd(t, client, "NOOP")
+	readLine(t, reader)
+
+	if got := sess.HeloName(); got != "client.test.com" {
+		t.Errorf("HeloName(): got %q, want %q", got, "client.test.com")
+	}
+}
+
 func TestSession_HELO(t *testing.T) {
 	t.Parallel()
 
@@ -430,6 +607,104 @@ func TestSession_UnknownCommand(t *testing.T) {
 	}
 }
 
+func TestSession_VRFYAndEXPN(t *testing.T) {
+	t.Parallel()
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	prov := &mockProvider{}
+	auth := NewAuthenticator("", "")
+	sess := NewSession(server, auth, prov, "mail.test.com", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go sess.Handle(ctx)
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "VRFY postmaster")
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "252 ") {
+		t.Errorf("VRFY response: got %q, want prefix '252 '", resp)
+	}
+
+	sendCmd(t, client, "EXPN staff")
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "502 ") {
+		t.Errorf("EXPN response: got %q, want prefix '502 '", resp)
+	}
+}
+
+func TestSession_HELP(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		tlsConfig *tls.Config
+		auth      *Authenticator
+		want      []string
+		notWant   []string
+	}{
+		{
+			name:    "plain",
+			auth:    NewAuthenticator("", ""),
+			want:    []string{"EHLO", "MAIL", "RCPT", "DATA", "RSET", "NOOP", "QUIT"},
+			notWant: []string{"STARTTLS", "AUTH"},
+		},
+		{
+			name:      "tls and auth",
+			tlsConfig: &tls.Config{},
+			auth:      NewAuthenticator("user", "pass"),
+			want:      []string{"STARTTLS", "AUTH", "MAIL"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			client, server := connPair(t)
+			defer client.Close()
+
+			sess := NewSession(server, tt.auth, &mockProvider{}, "mail.test.com", tt.tlsConfig)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			go sess.Handle(ctx)
+
+			reader := bufio.NewReader(client)
+			readLine(t, reader) // Skip greeting
+
+			sendCmd(t, client, "HELP")
+			var lines []string
+			for {
+				line := readLine(t, reader)
+				if !strings.HasPrefix(line, "214") {
+					t.Fatalf("HELP response: got %q, want prefix '214'", line)
+				}
+				lines = append(lines, line)
+				if strings.HasPrefix(line, "214 ") {
+					break
+				}
+			}
+
+			help := strings.Fields(strings.Join(lines, " "))
+			for _, cmd := range tt.want {
+				if !slices.Contains(help, cmd) {
+					t.Errorf("HELP missing %s: %q", cmd, lines)
+				}
+			}
+			for _, cmd := range tt.notWant {
+				if slices.Contains(help, cmd) {
+					t.Errorf("HELP lists unavailable %s: %q", cmd, lines)
+				}
+			}
+		})
+	}
+}
+
 func TestSession_EHLO_MissingHostname(t *testing.T) {
 	t.Parallel()
 
@@ -496,6 +771,9 @@ func TestExtractAddress(t *testing.T) {
 		{"<user@example.com>", "user@example.com"},
 		{"  <user@example.com>  ", "user@example.com"},
 		{"user@example.com", "user@example.com"},
+		{"<user@example.com> SMTPUTF8", "user@example.com"},
+		{"user@example.com SIZE=100", "user@example.com"},
+		{"<müller@münchen.example>", "müller@münchen.example"},
 		{"<>", ""},
 		{"", ""},
 	}
@@ -511,6 +789,229 @@ func TestExtractAddress(t *testing.T) {
 	}
 }
 
+func TestIsValidAddress(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"user@example.com", true},
+		{"first.last+tag@sub.example.com", true},
+		{"not an email", false},
+		{"user@", false},
+		{"@example.com", false},
+		{"user", false},
+		{"Name <user@example.com>", false},
+	}
+
+	for _, tt := range tests {
+		if got := isValidAddress(tt.addr); got != tt.want {
+			t.Errorf("isValidAddress(%q): got %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestSession_AddressSyntax(t *testing.T) {
+	t.Parallel()
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	prov := &mockProvider{}
+	auth := NewAuthenticator("", "")
+	sess := NewSession(server, auth, prov, "mail.test.com", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go sess.Handle(ctx)
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "EHLO client.test.com")
+	readEHLO(t, reader)
+
+	steps := []struct {
+		cmd  string
+		want string
+	}{
+		{"MAIL FROM:<not an email>", "501 5.1.7 Bad sender address syntax"},
+		{"MAIL FROM:<>", "250 OK"},
+		{"MAIL FROM:<sender@example.com>", "250 OK"},
+		{"RCPT TO:<bad@>", "501 5.1.3 Bad recipient address syntax"},
+		{"RCPT TO:<recipient@example.com>", "250 OK"},
+		{"RCPT TO:<postmaster>", "250 OK"},
+	}
+	for _, step := range steps {
+		sendCmd(t, client, step.cmd)
+		if resp := readLine(t, reader); resp != step.want {
+			t.Errorf("%s: got %q, want %q", step.cmd, resp, step.want)
+		}
+	}
+}
+
+func TestSession_RecipientDomainPolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		allowed []string
+		denied  []string
+		rcpts   map[string]string
+	}{
+		{
+			name: "default allows all",
+			rcpts: map[string]string{
+				"user@example.com": "250 OK",
+				"user@other.org":   "250 OK",
+			},
+		},
+		{
+			name:    "allow only",
+			allowed: []string{"Example.com"},
+			rcpts: map[string]string{
+				"user@EXAMPLE.COM": "250 OK",
+				"user@other.org":   "550 5.7.1 Relaying denied",
+			},
+		},
+		{
+			name:    "wildcard allows all",
+			allowed: []string{"*"},
+			rcpts: map[string]string{
+				"user@other.org": "250 OK",
+			},
+		},
+		{
+			name:   "deny only",
+			denied: []string{"blocked.example"},
+			rcpts: map[string]string{
+				"user@Blocked.Example": "550 5.7.1 Relaying denied",
+				"user@example.com":     "250 OK",
+			},
+		},
+		{
+			name:    "deny overrides allow",
+			allowed: []string{"*"},
+			denied:  []string{"blocked.example"},
+			rcpts: map[string]string{
+				"user@blocked.example": "550 5.7.1 Relaying denied",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			client, server := connPair(t)
+			defer client.Close()
+
+			auth := NewAuthenticator("", "")
+			sess := NewSession(server, auth, &mockProvider{}, "mail.test.com", nil)
+			sess.allowedRcptDomains = tt.allowed
+			sess.deniedRcptDomains = tt.denied
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			go sess.Handle(ctx)
+
+			reader := bufio.NewReader(client)
+			readLine(t, reader) // Skip greeting
+
+			sendCmd(t, client, "EHLO client.test.com")
+			readEHLO(t, reader)
+			sendCmd(t, client, "MAIL FROM:<sender@example.com>")
+			readLine(t, reader)
+
+			for rcpt, want := range tt.rcpts {
+				sendCmd(t, client, "RCPT TO:<"+rcpt+">")
+				if resp := readLine(t, reader); resp != want {
+					t.Errorf("RCPT TO:<%s>: got %q, want %q", rcpt, resp, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSession_Greylisting(t *testing.T) {
+	t.Parallel()
+
+	greylist := NewMemoryGreylist(100*time.Millisecond, time.Hour)
+
+	// attempt opens a session and returns the reply to RCPT TO.
+	attempt := func() string {
+		client, server := connPair(t)
+		defer client.Close()
+
+		sess := NewSession(server, NewAuthenticator("", ""), &mockProvider{}, "mail.test.com", nil)
+		sess.greylist = greylist
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		go sess.Handle(ctx)
+
+		reader := bufio.NewReader(client)
+		readLine(t, reader) // Skip greeting
+
+		sendCmd(t, client, "EHLO client.test.com")
+		readEHLO(t, reader)
+		sendCmd(t, client, "MAIL FROM:<sender@example.com>")
+		readLine(t, reader)
+		sendCmd(t, client, "RCPT TO:<user@example.org>")
+		return readLine(t, reader)
+	}
+
+	if got := attempt(); got != "451 4.7.1 Greylisted, try again later" {
+		t.Errorf("first attempt: got %q, want %q", got, "451 4.7.1 Greylisted, try again later")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if got := attempt(); got != "250 OK" {
+		t.Errorf("retry after the delay: got %q, want %q", got, "250 OK")
+	}
+}
+
+func TestSession_AllowedSenders(t *testing.T) {
+	t.Parallel()
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	auth := NewAuthenticator("", "")
+	sess := NewSession(server, auth, &mockProvider{}, "mail.test.com", nil)
+	sess.allowedSenders = []string{"app@example.com", "*@Notify.Example"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go sess.Handle(ctx)
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "EHLO client.test.com")
+	readEHLO(t, reader)
+
+	tests := []struct {
+		from string
+		want string
+	}{
+		{"App@Example.com", "250 OK"},
+		{"alerts@notify.example", "250 OK"},
+		{"other@example.com", "550 5.7.1 Sender address rejected"},
+		{"app@sub.notify.example", "550 5.7.1 Sender address rejected"},
+	}
+	for _, tt := range tests {
+		sendCmd(t, client, "MAIL FROM:<"+tt.from+">")
+		if resp := readLine(t, reader); resp != tt.want {
+			t.Errorf("MAIL FROM:<%s>: got %q, want %q", tt.from, resp, tt.want)
+		}
+	}
+}
+
 func TestSession_AuthBeforeMailFrom(t *testing.T) {
 	t.Parallel()
 
@@ -536,3 +1037,1839 @@ func TestSession_AuthBeforeMailFrom(t *testing.T) {
 		t.Errorf("AUTH before EHLO: got %q, want prefix '503 '", resp)
 	}
 }
+
+func TestSession_CommandTimeout(t *testing.T) {
+	t.Parallel()
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	sess := NewSession(server, NewAuthenticator("", ""), &mockProvider{}, "mail.test.com", nil)
+	sess.commandTimeout = 100 * time.Millisecond
+
+	go sess.Handle(context.Background())
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	// Send nothing; the session closes once the command timeout passes
+	resp := readLine(t, reader)
+	if !strings.HasPrefix(resp, "421 ") || !strings.Contains(resp, "command timeout") {
+		t.Errorf("idle client: got %q, want 421 command timeout", resp)
+	}
+}
+
+func TestSession_AuthContinuationTimeout(t *testing.T) {
+	t.Parallel()
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	sess := NewSession(server, NewAuthenticator("user", "pass"), &mockProvider{}, "mail.test.com", nil)
+	sess.commandTimeout = 100 * time.Millisecond
+
+	done := make(chan struct{})
+	go func() {
+		sess.Handle(context.Background())
+		close(done)
+	}()
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "EHLO client.test.com")
+	readEHLO(t, reader)
+
+	// Start AUTH LOGIN, then never send the username
+	sendCmd(t, client, "AUTH LOGIN")
+	if resp := readLine(t, reader); resp != "334 VXNlcm5hbWU6" {
+		t.Fatalf("AUTH LOGIN: got %q, want username challenge", resp)
+	}
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "421 ") {
+		t.Errorf("stalled AUTH: got %q, want prefix '421 '", resp)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("session still running after AUTH continuation timed out")
+	}
+}
+
+func TestSession_AuthLineTooLong(t *testing.T) {
+	t.Parallel()
+
+	long := strings.Repeat("A", maxAuthLineLength+1)
+
+	tests := []struct {
+		name  string
+		steps []string // commands sent after EHLO; each but the last expects a 334
+	}{
+		{"inline PLAIN argument", []string{"AUTH PLAIN " + long}},
+		{"PLAIN continuation", []string{"AUTH PLAIN", long}},
+		{"LOGIN username", []string{"AUTH LOGIN", long}},
+		{"LOGIN password", []string{"AUTH LOGIN", "dXNlcg==", long}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			client, server := connPair(t)
+			defer client.Close()
+
+			sess := NewSession(server, NewAuthenticator("user", "pass"), &mockProvider{}, "mail.test.com", nil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			go sess.Handle(ctx)
+
+			reader := bufio.NewReader(client)
+			readLine(t, reader) // Skip greeting
+
+			sendCmd(t, client, "EHLO client.test.com")
+			readEHLO(t, reader)
+
+			for i, step := range tt.steps {
+				sendCmd(t, client, step)
+				resp := readLine(t, reader)
+				if i < len(tt.steps)-1 {
+					if !strings.HasPrefix(resp, "334") {
+						t.Fatalf("step %d: got %q, want a 334 challenge", i+1, resp)
+					}
+					continue
+				}
+				if want := "500 5.5.6 Authentication Exchange line is too long"; resp != want {
+					t.Errorf("over-long line: got %q, want %q", resp, want)
+				}
+			}
+
+			// The session continues after the AUTH exchange is refused
+			sendCmd(t, client, "NOOP")
+			if resp := readLine(t, reader); resp != "250 OK" {
+				t.Errorf("NOOP after refused AUTH: got %q, want %q", resp, "250 OK")
+			}
+		})
+	}
+}
+
+func TestSession_LineTooLong(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		maxLineLength int
+		line          string
+		want          string
+	}{
+		{"600 bytes", 0, "NOOP " + strings.Repeat("x", 593), "500 5.5.2 Line too long"},
+		{"larger than read buffer", 0, "NOOP " + strings.Repeat("x", 20000), "500 5.5.2 Line too long"},
+		{"exactly 512 bytes", 0, "NOOP " + strings.Repeat("x", 505), "250 OK"},
+		{"raised limit", 1024, "NOOP " + strings.Repeat("x", 593), "250 OK"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			client, server := connPair(t)
+			defer client.Close()
+
+			sess := NewSession(server, NewAuthenticator("", ""), &mockProvider{}, "mail.test.com", nil)
+			if tt.maxLineLength > 0 {
+				sess.maxLineLength = tt.maxLineLength
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			go sess.Handle(ctx)
+
+			reader := bufio.NewReader(client)
+			readLine(t, reader) // Skip greeting
+
+			sendCmd(t, client, tt.line)
+			if resp := readLine(t, reader); resp != tt.want {
+				t.Errorf("%d-byte line: got %q, want %q", len(tt.line)+2, resp, tt.want)
+			}
+
+			// The rest of the long line is not taken as a new command
+			sendCmd(t, client, "NOOP")
+			if resp := readLine(t, reader); resp != "250 OK" {
+				t.Errorf("NOOP after long line: got %q, want %q", resp, "250 OK")
+			}
+		})
+	}
+}
+
+func TestSession_MaxSessionDuration(t *testing.T) {
+	t.Parallel()
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	sess := NewSession(server, NewAuthenticator("", ""), &mockProvider{}, "mail.test.com", nil)
+	sess.commandTimeout = 300 * time.Millisecond
+	sess.maxSessionDuration = 700 * time.Millisecond
+
+	start := time.Now()
+	go sess.Handle(context.Background())
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	// A slow client that always answers within the command timeout must
+	// still be cut off at the session limit.
+	for {
+		time.Sleep(100 * time.Millisecond)
+		if time.Since(start) > 3*time.Second {
+			t.Fatal("session outlived its maximum duration")
+		}
+		if _, err := client.Write([]byte("NOOP\r\n")); err != nil {
+			t.Fatalf("connection closed without a 421 reply: %v", err)
+		}
+		resp := readLine(t, reader)
+		if resp == "250 OK" {
+			continue
+		}
+		if !strings.HasPrefix(resp, "421 ") || !strings.Contains(resp, "session time limit exceeded") {
+			t.Fatalf("got %q, want 421 session time limit exceeded", resp)
+		}
+		break
+	}
+
+	if elapsed := time.Since(start); elapsed < 700*time.Millisecond {
+		t.Errorf("session closed after %s, before its 700ms limit", elapsed)
+	}
+}
+
+func TestSession_RoutingLoopDetected(t *testing.T) {
+	t.Parallel()
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	prov := &mockProvider{}
+	auth := NewAuthenticator("", "")
+	sess := NewSession(server, auth, prov, "mail.test.com", nil)
+	sess.maxReceivedHeaders = 5
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go sess.Handle(ctx)
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "EHLO client.test.com")
+	for {
+		line := readLine(t, reader)
+		if !strings.HasPrefix(line, "250-") {
+			break
+		}
+	}
+
+	sendCmd(t, client, "MAIL FROM:<sender@example.com>")
+	readLine(t, reader) // 250 OK
+	sendCmd(t, client, "RCPT TO:<recipient@example.com>")
+	readLine(t, reader) // 250 OK
+	sendCmd(t, client, "DATA")
+	readLine(t, reader) // 354
+
+	var lines []string
+	for i := 0; i < 6; i++ {
+		lines = append(lines, "Received: from hop.example.com by relay.example.com; Mon, 2 Jan 2006 15:04:05 -0700")
+	}
+	lines = append(lines,
+		"From: sender@example.com",
+		"To: recipient@example.com",
+		"Subject: Looping",
+		"",
+		"Round and round.",
+		".",
+	)
+	if _, err := client.Write([]byte(strings.Join(lines, "\r\n") + "\r\n")); err != nil {
+		t.Fatalf("failed to write DATA: %v", err)
+	}
+
+	resp := readLine(t, reader)
+	if !strings.HasPrefix(resp, "554 5.4.6") {
+		t.Errorf("DATA completion response: got %q, want prefix '554 5.4.6'", resp)
+	}
+	if prov.lastMsg != nil {
+		t.Error("provider should not receive a looping message")
+	}
+}
+
+func TestSession_RoutingLoopBoundary(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		hops int
+		want string
+	}{
+		{"at the limit", defaultMaxReceivedHeaders, "250 "},
+		{"over the limit", defaultMaxReceivedHeaders + 1, "554 5.4.6"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			client, server := connPair(t)
+			defer client.Close()
+
+			sess := NewSession(server, NewAuthenticator("", ""), &mockProvider{}, "mail.test.com", nil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			go sess.Handle(ctx)
+
+			reader := bufio.NewReader(client)
+			readLine(t, reader) // Skip greeting
+
+			sendCmd(t, client, "EHLO client.test.com")
+			readEHLO(t, reader)
+			sendCmd(t, client, "MAIL FROM:<sender@example.com>")
+			readLine(t, reader)
+			sendCmd(t, client, "RCPT TO:<recipient@example.com>")
+			readLine(t, reader)
+			sendCmd(t, client, "DATA")
+			readLine(t, reader)
+
+			message := strings.Repeat("Received: from hop.example.com\r\n", tt.hops) + "Subject: Test\r\n\r\nHello\r\n."
+			sendCmd(t, client, message)
+			if resp := readLine(t, reader); !strings.HasPrefix(resp, tt.want) {
+				t.Errorf("%d Received headers: got %q, want prefix %q", tt.hops, resp, tt.want)
+			}
+		})
+	}
+}
+
+func TestSession_PostmasterAlwaysAccepted(t *testing.T) {
+	t.Parallel()
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	prov := &mockProvider{}
+	auth := NewAuthenticator("", "")
+	sess := NewSession(server, auth, prov, "mail.test.com", nil)
+
+	// A recipient policy that admits neither form of postmaster
+	sess.allowedRcptDomains = []string{"example.com"}
+	sess.deniedRcptDomains = []string{"mail.test.com"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go sess.Handle(ctx)
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "EHLO client.test.com")
+	for {
+		line := readLine(t, reader)
+		if !strings.HasPrefix(line, "250-") {
+			break
+		}
+	}
+
+	sendCmd(t, client, "MAIL FROM:<sender@example.com>")
+	readLine(t, reader) // 250 OK
+
+	for _, rcpt := range []string{"<postmaster>", "<Postmaster@mail.test.com>"} {
+		sendCmd(t, client, "RCPT TO:"+rcpt)
+		resp := readLine(t, reader)
+		if !strings.HasPrefix(resp, "250 ") {
+			t.Errorf("RCPT TO:%s response: got %q, want prefix '250 '", rcpt, resp)
+		}
+	}
+
+	// Other recipients are still subject to the policy
+	sendCmd(t, client, "RCPT TO:<user@mail.test.com>")
+	if resp := readLine(t, reader); resp != "550 5.7.1 Relaying denied" {
+		t.Errorf("RCPT TO:<user@mail.test.com>: got %q, want %q", resp, "550 5.7.1 Relaying denied")
+	}
+}
+
+func TestIsPostmaster(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"postmaster", true},
+		{"POSTMASTER", true},
+		{"postmaster@mail.test.com", true},
+		{"PostMaster@MAIL.TEST.COM", true},
+		{"postmaster@example.com", false},
+		{"user@mail.test.com", false},
+		{"postmasters", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			t.Parallel()
+			if got := isPostmaster(tt.addr, "mail.test.com"); got != tt.want {
+				t.Errorf("isPostmaster(%q): got %v, want %v", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSession_STARTTLSLogsNegotiatedProtocol(t *testing.T) {
+	logs := captureLogs(t)
+
+	cert, err := smtptls.GenerateSelfSignedCert()
+	if err != nil {
+		t.Fatalf("failed to generate certificate: %v", err)
+	}
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{*cert}}
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	prov := &mockProvider{}
+	auth := NewAuthenticator("", "")
+	sess := NewSession(server, auth, prov, "mail.test.com", serverTLS)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		sess.Handle(ctx)
+		close(done)
+	}()
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "STARTTLS")
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "220 ") {
+		t.Fatalf("STARTTLS response: got %q, want prefix '220 '", resp)
+	}
+
+	tlsClient := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsClient.Handshake(); err != nil {
+		t.Fatalf("client TLS handshake failed: %v", err)
+	}
+
+	sendCmd(t, tlsClient, "QUIT")
+	readLine(t, bufio.NewReader(tlsClient)) // 221 Bye
+	<-done
+
+	output := logs.String()
+	if !strings.Contains(output, `"msg":"TLS handshake completed"`) {
+		t.Fatalf("missing TLS handshake log record, got: %s", output)
+	}
+	if !strings.Contains(output, `"alpn":""`) {
+		t.Errorf("TLS handshake log missing alpn field, got: %s", output)
+	}
+	if !strings.Contains(output, `"tls_version":"TLS 1.3"`) {
+		t.Errorf("TLS handshake log missing tls_version field, got: %s", output)
+	}
+}
+
+// classifiedError is a provider error that reports whether it is permanent.
+type classifiedError struct {
+	permanent bool
+}
+
+func (e *classifiedError) Error() string   { return "provider error" }
+func (e *classifiedError) Permanent() bool { return e.permanent }
+
+func TestSession_ProviderErrorResponse(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		sendErr error
+		want    string
+	}{
+		{"permanent", &classifiedError{permanent: true}, "550 5.0.0 "},
+		{"wrapped permanent", fmt.Errorf("chain: %w", &classifiedError{permanent: true}), "550 5.0.0 "},
+		{"transient", &classifiedError{permanent: false}, "451 4.3.0 "},
+		{"unclassified", errors.New("connection reset"), "451 4.3.0 "},
+		{"too large", &provider.MessageTooLargeError{Reason: "Message too big for Graph sendMail"}, "552 5.3.4 Message too big for Graph sendMail"},
+		{"policy", &provider.PolicyError{Reason: "Attachment type .exe is not allowed"}, "550 5.7.1 Attachment type .exe is not allowed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			client, server := connPair(t)
+			defer client.Close()
+
+			prov := &mockProvider{sendErr: tt.sendErr}
+			sess := NewSession(server, NewAuthenticator("", ""), prov, "mail.test.com", nil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			go sess.Handle(ctx)
+
+			reader := bufio.NewReader(client)
+			readLine(t, reader) // Skip greeting
+
+			sendCmd(t, client, "EHLO client.test.com")
+			readEHLO(t, reader)
+			sendCmd(t, client, "MAIL FROM:<sender@example.com>")
+			readLine(t, reader)
+			sendCmd(t, client, "RCPT TO:<recipient@example.com>")
+			readLine(t, reader)
+			sendCmd(t, client, "DATA")
+			readLine(t, reader)
+
+			sendCmd(t, client, "Subject: Test\r\n\r\nHello\r\n.")
+			if resp := readLine(t, reader); !strings.HasPrefix(resp, tt.want) {
+				t.Errorf("end of DATA: got %q, want prefix %q", resp, tt.want)
+			}
+		})
+	}
+}
+
+func TestSession_QueuesTransientFailure(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		sendErr    error
+		want       string
+		wantQueued int
+	}{
+		{"transient", &classifiedError{permanent: false}, "250 OK message queued for retry", 1},
+		{"permanent", &classifiedError{permanent: true}, "550 5.0.0 ", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			client, server := connPair(t)
+			defer client.Close()
+
+			prov := &mockProvider{sendErr: tt.sendErr}
+			spool, err := queue.New(queue.Config{Dir: t.TempDir(), Provider: prov})
+			if err != nil {
+				t.Fatalf("queue.New: %v", err)
+			}
+			sess := NewSession(server, NewAuthenticator("", ""), prov, "mail.test.com", nil)
+			sess.queue = spool
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			go sess.Handle(ctx)
+
+			reader := bufio.NewReader(client)
+			readLine(t, reader) // Skip greeting
+
+			sendCmd(t, client, "EHLO client.test.com")
+			readEHLO(t, reader)
+			sendCmd(t, client, "MAIL FROM:<sender@example.com>")
+			readLine(t, reader)
+			sendCmd(t, client, "RCPT TO:<recipient@example.com>")
+			readLine(t, reader)
+			sendCmd(t, client, "DATA")
+			readLine(t, reader)
+
+			sendCmd(t, client, "Subject: Test\r\n\r\nHello\r\n.")
+			if resp := readLine(t, reader); !strings.HasPrefix(resp, tt.want) {
+				t.Errorf("end of DATA: got %q, want prefix %q", resp, tt.want)
+			}
+			if got := spool.Len(); got != tt.wantQueued {
+				t.Errorf("queued messages: got %d, want %d", got, tt.wantQueued)
+			}
+		})
+	}
+}
+
+func TestSession_DataSpan(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		sendErr    error
+		wantCode   int64
+		wantStatus codes.Code
+	}{
+		{"delivered", nil, 250, codes.Unset},
+		{"rejected", &provider.PolicyError{Reason: "Blocked"}, 550, codes.Error},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			client, server := connPair(t)
+			defer client.Close()
+
+			recorder := tracetest.NewSpanRecorder()
+			tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+			sess := NewSession(server, NewAuthenticator("", ""), &mockProvider{sendErr: tt.sendErr}, "mail.test.com", nil)
+			sess.tracer = tp.Tracer("test")
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			go sess.Handle(ctx)
+
+			reader := bufio.NewReader(client)
+			readLine(t, reader) // Skip greeting
+
+			sendCmd(t, client, "EHLO client.test.com")
+			readEHLO(t, reader)
+			sendCmd(t, client, "MAIL FROM:<sender@example.com>")
+			readLine(t, reader)
+			sendCmd(t, client, "RCPT TO:<recipient@example.com>")
+			readLine(t, reader)
+			sendCmd(t, client, "DATA")
+			readLine(t, reader)
+
+			message := "Subject: Test\r\n\r\nHello\r\n"
+			sendCmd(t, client, message+".")
+			readLine(t, reader)
+			sendCmd(t, client, "QUIT")
+			readLine(t, reader)
+
+			spans := recorder.Ended()
+			if len(spans) != 1 {
+				t.Fatalf("ended spans: got %d, want 1", len(spans))
+			}
+			span := spans[0]
+			if span.Name() != "smtp.data" {
+				t.Errorf("span name: got %q, want %q", span.Name(), "smtp.data")
+			}
+			attrs := make(map[attribute.Key]attribute.Value)
+			for _, kv := range span.Attributes() {
+				attrs[kv.Key] = kv.Value
+			}
+			if got := attrs["smtp.provider"].AsString(); got != "mock" {
+				t.Errorf("smtp.provider: got %q, want %q", got, "mock")
+			}
+			if got := attrs["smtp.recipients"].AsInt64(); got != 1 {
+				t.Errorf("smtp.recipients: got %d, want 1", got)
+			}
+			// The size includes the Received header the proxy prepends
+			if got := attrs["smtp.size_bytes"].AsInt64(); got <= int64(len(message)) {
+				t.Errorf("smtp.size_bytes: got %d, want more than %d", got, len(message))
+			}
+			if got := attrs["smtp.reply_code"].AsInt64(); got != tt.wantCode {
+				t.Errorf("smtp.reply_code: got %d, want %d", got, tt.wantCode)
+			}
+			if got := span.Status().Code; got != tt.wantStatus {
+				t.Errorf("status: got %v, want %v", got, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestSession_LogsShareSessionID(t *testing.T) {
+	logs := captureLogs(t)
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	sess := NewSession(server, NewAuthenticator("", ""), &mockProvider{}, "mail.test.com", nil)
+
+	done := make(chan struct{})
+	go func() {
+		sess.Handle(context.Background())
+		close(done)
+	}()
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	for _, cmd := range []string{
+		"EHLO client.test.com",
+		"MAIL FROM:<sender@example.com>",
+		"RCPT TO:<recipient@example.com>",
+		"DATA",
+		"Subject: Test\r\n\r\nHello\r\n.",
+		"QUIT",
+	} {
+		sendCmd(t, client, cmd)
+		if cmd == "EHLO client.test.com" {
+			readEHLO(t, reader)
+		} else {
+			readLine(t, reader)
+		}
+	}
+	<-done
+
+	var records int
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid log record %q: %v", line, err)
+		}
+		records++
+		if record["session_id"] != sess.id {
+			t.Errorf("record %q: session_id %v, want %q", record["msg"], record["session_id"], sess.id)
+		}
+	}
+	if records < 2 {
+		t.Errorf("got %d log records, want the session start and the delivery", records)
+	}
+}
+
+func TestSession_DeliveryLogged(t *testing.T) {
+	logs := captureLogs(t)
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	auth := NewAuthenticator("", "")
+	sess := NewSession(server, auth, &mockProvider{}, "mail.test.com", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go sess.Handle(ctx)
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "EHLO client.test.com")
+	readEHLO(t, reader)
+
+	sendCmd(t, client, "MAIL FROM:<sender@example.com>")
+	readLine(t, reader)
+	sendCmd(t, client, "RCPT TO:<recipient@example.com>")
+	readLine(t, reader)
+	sendCmd(t, client, "DATA")
+	readLine(t, reader)
+
+	message := strings.Join([]string{
+		"From: author@example.com",
+		"To: recipient@example.com",
+		"Message-ID: <id@test>",
+		"Subject: Test",
+		"",
+		"Hello",
+		".",
+	}, "\r\n")
+	if _, err := client.Write([]byte(message + "\r\n")); err != nil {
+		t.Fatalf("failed to write DATA: %v", err)
+	}
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "250 ") {
+		t.Fatalf("DATA completion response: got %q, want prefix '250 '", resp)
+	}
+
+	output := logs.String()
+	if !strings.Contains(output, `"msg":"message delivered"`) {
+		t.Fatalf("missing delivery log record, got: %s", output)
+	}
+	for _, want := range []string{
+		`"provider":"mock"`,
+		`"message_id":"<id@test>"`,
+		`"from":"author@example.com"`,
+		`"recipients":1`,
+		`"size_bytes":`,
+		`"latency_ms":`,
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("delivery log missing %s, got: %s", want, output)
+		}
+	}
+}
+
+func TestSession_LifecycleLogged(t *testing.T) {
+	logs := captureLogs(t)
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	sess := NewSession(server, NewAuthenticator("alice", "correct-horse"), &mockProvider{}, "mail.test.com", nil)
+
+	done := make(chan struct{})
+	go func() {
+		sess.Handle(context.Background())
+		close(done)
+	}()
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "EHLO client.test.com")
+	readEHLO(t, reader)
+
+	wrong := base64.StdEncoding.EncodeToString([]byte("\x00alice\x00battery-staple"))
+	sendCmd(t, client, "AUTH PLAIN "+wrong)
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "535 ") {
+		t.Fatalf("AUTH with wrong password: got %q, want prefix '535 '", resp)
+	}
+	right := base64.StdEncoding.EncodeToString([]byte("\x00alice\x00correct-horse"))
+	sendCmd(t, client, "AUTH PLAIN "+right)
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "235 ") {
+		t.Fatalf("AUTH: got %q, want prefix '235 '", resp)
+	}
+	sendCmd(t, client, "QUIT")
+	readLine(t, reader)
+	<-done
+
+	records := make(map[string]map[string]any)
+	var order []string
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid log record %q: %v", line, err)
+		}
+		msg, _ := record["msg"].(string)
+		records[msg] = record
+		order = append(order, msg)
+	}
+
+	want := []string{"connection accepted", "authentication failed", "authentication succeeded", "connection closed"}
+	if !slices.Equal(order, want) {
+		t.Fatalf("log records: got %q, want %q", order, want)
+	}
+	if records["connection accepted"]["remote_addr"] != client.LocalAddr().String() {
+		t.Errorf("connection accepted remote_addr: got %v, want %s", records["connection accepted"]["remote_addr"], client.LocalAddr())
+	}
+	for _, msg := range []string{"authentication failed", "authentication succeeded"} {
+		if records[msg]["username"] != "alice" || records[msg]["mechanism"] != "PLAIN" {
+			t.Errorf("%s record: got %v, want username alice and mechanism PLAIN", msg, records[msg])
+		}
+	}
+	if records["connection closed"]["reason"] != "quit" {
+		t.Errorf("connection closed reason: got %v, want quit", records["connection closed"]["reason"])
+	}
+	if _, ok := records["connection closed"]["duration"]; !ok {
+		t.Errorf("connection closed record missing duration: %v", records["connection closed"])
+	}
+	for _, secret := range []string{"battery-staple", "correct-horse", wrong, right} {
+		if strings.Contains(logs.String(), secret) {
+			t.Errorf("logs contain credential %q", secret)
+		}
+	}
+}
+
+func TestSession_RequireTLSForAuth(t *testing.T) {
+	t.Parallel()
+
+	cert, err := smtptls.GenerateSelfSignedCert()
+	if err != nil {
+		t.Fatalf("failed to generate certificate: %v", err)
+	}
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{*cert}}
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	prov := &mockProvider{}
+	auth := NewAuthenticator("user", "pass")
+	sess := NewSession(server, auth, prov, "mail.test.com", serverTLS)
+	sess.requireTLSForAuth = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go sess.Handle(ctx)
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "EHLO client.test.com")
+	for _, line := range readEHLO(t, reader) {
+		if strings.Contains(line, "AUTH") {
+			t.Errorf("AUTH advertised before STARTTLS: %q", line)
+		}
+	}
+
+	// AUTH over plaintext is refused
+	sendCmd(t, client, "AUTH PLAIN AHVzZXIAcGFzcw==")
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "538 ") {
+		t.Errorf("plaintext AUTH: got %q, want prefix '538 '", resp)
+	}
+
+	sendCmd(t, client, "STARTTLS")
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "220 ") {
+		t.Fatalf("STARTTLS response: got %q, want prefix '220 '", resp)
+	}
+
+	tlsClient := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsClient.Handshake(); err != nil {
+		t.Fatalf("client TLS handshake failed: %v", err)
+	}
+	tlsReader := bufio.NewReader(tlsClient)
+
+	sendCmd(t, tlsClient, "EHLO client.test.com")
+	foundAuth := false
+	for _, line := range readEHLO(t, tlsReader) {
+		if strings.Contains(line, "AUTH PLAIN LOGIN") {
+			foundAuth = true
+		}
+	}
+	if !foundAuth {
+		t.Error("AUTH not advertised after STARTTLS")
+	}
+
+	// AUTH after STARTTLS succeeds
+	sendCmd(t, tlsClient, "AUTH PLAIN AHVzZXIAcGFzcw==")
+	if resp := readLine(t, tlsReader); !strings.HasPrefix(resp, "235 ") {
+		t.Errorf("AUTH after STARTTLS: got %q, want prefix '235 '", resp)
+	}
+}
+
+func TestSession_EarlyTalkerCommandsProcessedInOrder(t *testing.T) {
+	t.Parallel()
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	// Send commands before the session is even started, so they are
+	// waiting in the socket buffer ahead of the greeting.
+	sendCmd(t, client, "EHLO client.test.com")
+	sendCmd(t, client, "NOOP")
+
+	prov := &mockProvider{}
+	auth := NewAuthenticator("", "")
+	sess := NewSession(server, auth, prov, "mail.test.com", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go sess.Handle(ctx)
+
+	reader := bufio.NewReader(client)
+	if greeting := readLine(t, reader); !strings.HasPrefix(greeting, "220 ") {
+		t.Fatalf("first line: got %q, want greeting with prefix '220 '", greeting)
+	}
+
+	ehlo := readEHLO(t, reader)
+	if !strings.HasPrefix(ehlo[0], "250-mail.test.com") {
+		t.Errorf("EHLO response: got %q, want prefix '250-mail.test.com'", ehlo[0])
+	}
+
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "250 ") {
+		t.Errorf("NOOP response: got %q, want prefix '250 '", resp)
+	}
+}
+
+func TestSession_TooManyAuthFailuresDisconnects(t *testing.T) {
+	t.Parallel()
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	prov := &mockProvider{}
+	auth := NewAuthenticator("user", "pass")
+	sess := NewSession(server, auth, prov, "mail.test.com", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		sess.Handle(ctx)
+		close(done)
+	}()
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "EHLO client.test.com")
+	readEHLO(t, reader)
+
+	// base64("\x00user\x00wrong")
+	const badCreds = "AHVzZXIAd3Jvbmc="
+	for i := 1; i < defaultMaxAuthAttempts; i++ {
+		sendCmd(t, client, "AUTH PLAIN "+badCreds)
+		if resp := readLine(t, reader); resp != "535 Authentication failed" {
+			t.Fatalf("attempt %d: got %q, want %q", i, resp, "535 Authentication failed")
+		}
+	}
+
+	sendCmd(t, client, "AUTH PLAIN "+badCreds)
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "535 5.7.8") {
+		t.Fatalf("final attempt: got %q, want prefix '535 5.7.8'", resp)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("session was not closed after too many authentication failures")
+	}
+
+	// One more attempt finds the connection closed
+	client.Write([]byte("AUTH PLAIN " + badCreds + "\r\n"))
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Error("expected connection to be closed, but read succeeded")
+	}
+}
+
+func TestSession_DataBufferReuse(t *testing.T) {
+	t.Parallel()
+
+	// deliver sends one message over a new session and returns what the
+	// provider received.
+	deliver := func(body string) *email.Email {
+		client, server := connPair(t)
+		defer client.Close()
+
+		prov := &mockProvider{}
+		sess := NewSession(server, NewAuthenticator("", ""), prov, "mail.test.com", nil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		go sess.Handle(ctx)
+
+		reader := bufio.NewReader(client)
+		readLine(t, reader) // Skip greeting
+
+		sendCmd(t, client, "EHLO client.test.com")
+		readEHLO(t, reader)
+		sendCmd(t, client, "MAIL FROM:<sender@example.com>")
+		readLine(t, reader)
+		sendCmd(t, client, "RCPT TO:<user@example.org>")
+		readLine(t, reader)
+		sendCmd(t, client, "DATA")
+		readLine(t, reader)
+		sendCmd(t, client, "Subject: Test\r\n\r\n"+body+"\r\n.")
+		if resp := readLine(t, reader); !strings.HasPrefix(resp, "250") {
+			t.Fatalf("DATA: got %q, want 250", resp)
+		}
+		return prov.lastMsg
+	}
+
+	// A later message written into a reused buffer must not show through
+	// an earlier one
+	long := strings.Repeat("a", 4000)
+	first := deliver(long)
+	deliver(strings.Repeat("b", 4000))
+	if first.TextBody != long+"\r\n" {
+		t.Errorf("first message body changed after a later message: got %.20q...", first.TextBody)
+	}
+}
+
+// BenchmarkSession_DATA measures many small mail transactions over one
+// session.
+func BenchmarkSession_DATA(b *testing.B) {
+	client, server := connPair(b)
+	defer client.Close()
+
+	sess := NewSession(server, NewAuthenticator("", ""), &mockProvider{}, "mail.test.com", nil)
+	// Keep per-message logging out of the measurement
+	sess.logger = slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go sess.Handle(ctx)
+
+	reader := bufio.NewReader(client)
+	readLine(b, reader) // Skip greeting
+
+	sendCmd(b, client, "EHLO client.test.com")
+	readEHLO(b, reader)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		sendCmd(b, client, "MAIL FROM:<sender@example.com>\r\nRCPT TO:<user@example.org>\r\nDATA")
+		readLine(b, reader)
+		readLine(b, reader)
+		readLine(b, reader)
+		sendCmd(b, client, "From: sender@example.com\r\nSubject: Test\r\n\r\nHello\r\n.")
+		if resp := readLine(b, reader); !strings.HasPrefix(resp, "250") {
+			b.Fatalf("DATA: got %q, want 250", resp)
+		}
+	}
+}
+
+func TestSession_TooManyTransactionsDisconnects(t *testing.T) {
+	t.Parallel()
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	prov := &mockProvider{}
+	sess := NewSession(server, NewAuthenticator("", ""), prov, "mail.test.com", nil)
+	sess.maxTransactions = 2
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		sess.Handle(ctx)
+		close(done)
+	}()
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "EHLO client.test.com")
+	readEHLO(t, reader)
+
+	for i := 1; i <= 2; i++ {
+		sendCmd(t, client, "MAIL FROM:<sender@example.com>")
+		readLine(t, reader)
+		sendCmd(t, client, "RCPT TO:<user@example.org>")
+		readLine(t, reader)
+		sendCmd(t, client, "DATA")
+		readLine(t, reader)
+		sendCmd(t, client, "Subject: Test\r\n\r\nBody\r\n.")
+		if resp := readLine(t, reader); !strings.HasPrefix(resp, "250") {
+			t.Fatalf("message %d: got %q, want 250", i, resp)
+		}
+	}
+
+	if resp := readLine(t, reader); resp != "421 4.7.0 Too many messages this session" {
+		t.Fatalf("after the limit: got %q, want %q", resp, "421 4.7.0 Too many messages this session")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("session was not closed after the transaction limit")
+	}
+
+	// A third transaction finds the connection closed
+	client.Write([]byte("MAIL FROM:<sender@example.com>\r\n"))
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Error("expected connection to be closed, but read succeeded")
+	}
+}
+
+func TestSession_SenderDomainRestrictedPerUser(t *testing.T) {
+	t.Parallel()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword: %v", err)
+	}
+	users := []User{
+		{Name: "alice", PasswordHash: hash, AllowedDomains: []string{"alpha.example"}},
+		{Name: "bob", PasswordHash: hash, AllowedDomains: []string{"beta.example"}},
+	}
+
+	tests := []struct {
+		user    string
+		allowed string
+		denied  string
+	}{
+		{user: "alice", allowed: "alice@alpha.example", denied: "alice@beta.example"},
+		{user: "bob", allowed: "bob@Beta.Example", denied: "bob@alpha.example"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.user, func(t *testing.T) {
+			t.Parallel()
+
+			client, server := connPair(t)
+			defer client.Close()
+
+			auth := NewAuthenticator("", "", users...)
+			sess := NewSession(server, auth, &mockProvider{}, "mail.test.com", nil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			go sess.Handle(ctx)
+
+			reader := bufio.NewReader(client)
+			readLine(t, reader) // Skip greeting
+
+			sendCmd(t, client, "EHLO client.test.com")
+			readEHLO(t, reader)
+
+			creds := base64.StdEncoding.EncodeToString([]byte("\x00" + tt.user + "\x00secret"))
+			sendCmd(t, client, "AUTH PLAIN "+creds)
+			if resp := readLine(t, reader); !strings.HasPrefix(resp, "235 ") {
+				t.Fatalf("AUTH: got %q, want prefix '235 '", resp)
+			}
+
+			sendCmd(t, client, "MAIL FROM:<"+tt.denied+">")
+			if resp := readLine(t, reader); resp != "550 5.7.1 From not authorized for this user" {
+				t.Errorf("MAIL FROM %s: got %q, want 550 5.7.1", tt.denied, resp)
+			}
+
+			sendCmd(t, client, "MAIL FROM:<"+tt.allowed+">")
+			if resp := readLine(t, reader); resp != "250 OK" {
+				t.Errorf("MAIL FROM %s: got %q, want %q", tt.allowed, resp, "250 OK")
+			}
+		})
+	}
+}
+
+// newClientCert creates a throwaway CA and a client certificate signed by it.
+func newClientCert(t *testing.T) (*x509.CertPool, tls.Certificate) {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate CA key: %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %v", err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("failed to parse CA certificate: %v", err)
+	}
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate client key: %v", err)
+	}
+	clientTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "relay.internal"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTemplate, caCert, &clientKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("failed to create client certificate: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	return pool, tls.Certificate{Certificate: [][]byte{clientDER}, PrivateKey: clientKey}
+}
+
+func TestSession_ClientCertSatisfiesAuth(t *testing.T) {
+	t.Parallel()
+
+	cert, err := smtptls.GenerateSelfSignedCert()
+	if err != nil {
+		t.Fatalf("failed to generate certificate: %v", err)
+	}
+	caPool, clientCert := newClientCert(t)
+	serverTLS := &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		ClientCAs:    caPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	prov := &mockProvider{}
+	auth := NewAuthenticator("user", "pass")
+	sess := NewSession(server, auth, prov, "mail.test.com", serverTLS)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go sess.Handle(ctx)
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "EHLO client.test.com")
+	readEHLO(t, reader)
+
+	// Without AUTH or a client certificate, MAIL FROM is refused
+	sendCmd(t, client, "MAIL FROM:<sender@test.com>")
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "530 ") {
+		t.Fatalf("MAIL FROM before auth: got %q, want prefix '530 '", resp)
+	}
+
+	sendCmd(t, client, "STARTTLS")
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "220 ") {
+		t.Fatalf("STARTTLS response: got %q, want prefix '220 '", resp)
+	}
+
+	tlsClient := tls.Client(client, &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{clientCert},
+	})
+	if err := tlsClient.Handshake(); err != nil {
+		t.Fatalf("client TLS handshake failed: %v", err)
+	}
+	tlsReader := bufio.NewReader(tlsClient)
+
+	// STARTTLS resets the session, so the client must greet again even
+	// though its certificate authenticates it
+	sendCmd(t, tlsClient, "MAIL FROM:<sender@test.com>")
+	if resp := readLine(t, tlsReader); !strings.HasPrefix(resp, "503 ") {
+		t.Fatalf("MAIL FROM before EHLO after mTLS: got %q, want prefix '503 '", resp)
+	}
+
+	sendCmd(t, tlsClient, "EHLO client.test.com")
+	readEHLO(t, tlsReader)
+
+	// The verified client certificate stands in for AUTH
+	sendCmd(t, tlsClient, "MAIL FROM:<sender@test.com>")
+	if resp := readLine(t, tlsReader); !strings.HasPrefix(resp, "250 ") {
+		t.Errorf("MAIL FROM after mTLS: got %q, want prefix '250 '", resp)
+	}
+}
+
+func TestSession_EmptyMessageRejected(t *testing.T) {
+	t.Parallel()
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	prov := &mockProvider{}
+	auth := NewAuthenticator("", "")
+	sess := NewSession(server, auth, prov, "mail.test.com", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go sess.Handle(ctx)
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "EHLO client.test.com")
+	readEHLO(t, reader)
+
+	sendCmd(t, client, "MAIL FROM:<sender@example.com>")
+	readLine(t, reader)
+	sendCmd(t, client, "RCPT TO:<recipient@example.com>")
+	readLine(t, reader)
+	sendCmd(t, client, "DATA")
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "354 ") {
+		t.Fatalf("DATA response: got %q, want prefix '354 '", resp)
+	}
+
+	// Headers only, no subject and a whitespace-only body
+	message := strings.Join([]string{
+		"Content-Type: text/plain",
+		"",
+		"  ",
+		".",
+	}, "\r\n")
+	if _, err := client.Write([]byte(message + "\r\n")); err != nil {
+		t.Fatalf("failed to write DATA: %v", err)
+	}
+
+	if resp := readLine(t, reader); resp != "550 5.6.0 Empty message" {
+		t.Errorf("DATA completion response: got %q, want %q", resp, "550 5.6.0 Empty message")
+	}
+	if prov.lastMsg != nil {
+		t.Error("provider received an empty message")
+	}
+
+	// The session stays usable after the rejection
+	sendCmd(t, client, "MAIL FROM:<sender@example.com>")
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "250 ") {
+		t.Errorf("MAIL FROM after rejection: got %q, want prefix '250 '", resp)
+	}
+}
+
+func TestSession_NoRecipientsRejected(t *testing.T) {
+	t.Parallel()
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	prov := &mockProvider{}
+	auth := NewAuthenticator("", "")
+	sess := NewSession(server, auth, prov, "mail.test.com", nil)
+	// Reach DATA with an empty envelope, as a state bug would
+	sess.state = stateRcptTo
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go sess.Handle(ctx)
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "DATA")
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "354 ") {
+		t.Fatalf("DATA response: got %q, want prefix '354 '", resp)
+	}
+
+	// A body but no To, Cc or Bcc headers
+	message := strings.Join([]string{
+		"From: sender@example.com",
+		"Subject: Nobody",
+		"",
+		"Hello",
+		".",
+	}, "\r\n")
+	if _, err := client.Write([]byte(message + "\r\n")); err != nil {
+		t.Fatalf("failed to write DATA: %v", err)
+	}
+
+	if resp := readLine(t, reader); resp != "554 5.5.0 No valid recipients" {
+		t.Errorf("DATA completion response: got %q, want %q", resp, "554 5.5.0 No valid recipients")
+	}
+	if prov.lastMsg != nil {
+		t.Error("provider received a message without recipients")
+	}
+}
+
+func TestSession_EnvelopeOnlyRecipientAddedToBcc(t *testing.T) {
+	t.Parallel()
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	prov := &mockProvider{}
+	auth := NewAuthenticator("", "")
+	sess := NewSession(server, auth, prov, "mail.test.com", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go sess.Handle(ctx)
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "EHLO client.test.com")
+	readEHLO(t, reader)
+
+	sendCmd(t, client, "MAIL FROM:<sender@example.com>")
+	readLine(t, reader)
+	for _, rcpt := range []string{"to@example.com", "CC@example.com", "hidden@example.com"} {
+		sendCmd(t, client, "RCPT TO:<"+rcpt+">")
+		readLine(t, reader)
+	}
+	sendCmd(t, client, "DATA")
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "354 ") {
+		t.Fatalf("DATA response: got %q, want prefix '354 '", resp)
+	}
+
+	message := strings.Join([]string{
+		"From: sender@example.com",
+		"To: to@example.com",
+		"Cc: cc@example.com",
+		"Subject: Bcc",
+		"",
+		"Hello",
+		".",
+	}, "\r\n")
+	if _, err := client.Write([]byte(message + "\r\n")); err != nil {
+		t.Fatalf("failed to write DATA: %v", err)
+	}
+
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "250 ") {
+		t.Fatalf("DATA completion response: got %q, want prefix '250 '", resp)
+	}
+	if prov.lastMsg == nil {
+		t.Fatal("provider did not receive the message")
+	}
+	if got := prov.lastMsg.Bcc; len(got) != 1 || got[0] != "hidden@example.com" {
+		t.Errorf("Bcc: got %v, want [hidden@example.com]", got)
+	}
+}
+
+func TestSession_TooManyRecipients(t *testing.T) {
+	t.Parallel()
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	prov := &mockProvider{}
+	auth := NewAuthenticator("", "")
+	sess := NewSession(server, auth, prov, "mail.test.com", nil)
+	sess.maxRecipients = 2
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go sess.Handle(ctx)
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "EHLO client.test.com")
+	readEHLO(t, reader)
+
+	sendCmd(t, client, "MAIL FROM:<sender@example.com>")
+	readLine(t, reader)
+
+	for i, rcpt := range []string{"a@example.com", "b@example.com"} {
+		sendCmd(t, client, "RCPT TO:<"+rcpt+">")
+		if resp := readLine(t, reader); resp != "250 OK" {
+			t.Errorf("RCPT %d: got %q, want %q", i+1, resp, "250 OK")
+		}
+	}
+	for _, rcpt := range []string{"c@example.com", "d@example.com"} {
+		sendCmd(t, client, "RCPT TO:<"+rcpt+">")
+		if resp := readLine(t, reader); resp != "452 4.5.3 Too many recipients" {
+			t.Errorf("RCPT %s over limit: got %q, want %q", rcpt, resp, "452 4.5.3 Too many recipients")
+		}
+	}
+
+	sendCmd(t, client, "DATA")
+	readLine(t, reader)
+	message := "Subject: Limit\r\n\r\nHello\r\n.\r\n"
+	if _, err := client.Write([]byte(message)); err != nil {
+		t.Fatalf("failed to write DATA: %v", err)
+	}
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "250 ") {
+		t.Fatalf("DATA completion response: got %q, want prefix '250 '", resp)
+	}
+	if got := prov.lastMsg.To; len(got) != 2 {
+		t.Errorf("delivered recipients: got %v, want the first 2", got)
+	}
+}
+
+func TestSession_ReceivedHeaderAdded(t *testing.T) {
+	t.Parallel()
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	prov := &mockProvider{}
+	auth := NewAuthenticator("", "")
+	sess := NewSession(server, auth, prov, "mail.test.com", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go sess.Handle(ctx)
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "EHLO client.test.com")
+	readEHLO(t, reader)
+	sendCmd(t, client, "MAIL FROM:<sender@example.com>")
+	readLine(t, reader)
+	sendCmd(t, client, "RCPT TO:<recipient@example.com>")
+	readLine(t, reader)
+	sendCmd(t, client, "DATA")
+	readLine(t, reader)
+
+	message := "Received: from upstream.example by client.test.com; Mon, 2 Jan 2006 15:04:05 +0000\r\n" +
+		"Subject: Trace\r\n\r\nHello\r\n.\r\n"
+	if _, err := client.Write([]byte(message)); err != nil {
+		t.Fatalf("failed to write DATA: %v", err)
+	}
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "250 ") {
+		t.Fatalf("DATA completion response: got %q, want prefix '250 '", resp)
+	}
+
+	received := prov.lastMsg.RawHeaders["Received"]
+	if len(received) != 2 {
+		t.Fatalf("Received headers: got %d, want 2 (ours prepended to the existing one)", len(received))
+	}
+
+	pattern := regexp.MustCompile(`^from client\.test\.com \(\[127\.0\.0\.1\]\) by mail\.test\.com with ESMTP id [0-9A-F]{16}; (.+)$`)
+	m := pattern.FindStringSubmatch(received[0])
+	if m == nil {
+		t.Fatalf("Received header malformed: %q", received[0])
+	}
+	if _, err := time.Parse(time.RFC1123Z, m[1]); err != nil {
+		t.Errorf("Received date %q is not RFC 1123Z: %v", m[1], err)
+	}
+}
+
+func TestSession_ReceivedHeaderAddressLiteral(t *testing.T) {
+	t.Parallel()
+
+	_, server := connPair(t)
+
+	tests := []struct {
+		name string
+		ip   string
+		want string
+	}{
+		{"IPv4", "192.0.2.1", "from client.test.com ([192.0.2.1])"},
+		{"IPv6", "2001:db8::1", "from client.test.com ([IPv6:2001:db8::1])"},
+		{"IPv6 loopback", "::1", "from client.test.com ([IPv6:::1])"},
+	}
+
+	for _, tt := range tests {
+		conn := &proxyConn{Conn: server, remote: &net.TCPAddr{IP: net.ParseIP(tt.ip), Port: 51234}}
+		sess := NewSession(conn, NewAuthenticator("", ""), &mockProvider{}, "mail.test.com", nil)
+		sess.heloName = "client.test.com"
+
+		if got := sess.receivedHeader(time.Now()); !strings.HasPrefix(got, "Received: "+tt.want+"\r\n") {
+			t.Errorf("%s: got %q, want it to start with %q", tt.name, got, "Received: "+tt.want)
+		}
+	}
+}
+
+func TestSession_SMTPUTF8Addresses(t *testing.T) {
+	t.Parallel()
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	prov := &mockProvider{}
+	auth := NewAuthenticator("", "")
+	sess := NewSession(server, auth, prov, "mail.test.com", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go sess.Handle(ctx)
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "EHLO client.test.com")
+	if lines := readEHLO(t, reader); !slices.Contains(lines, "250 SMTPUTF8") {
+		t.Errorf("EHLO does not advertise SMTPUTF8: %q", lines)
+	}
+
+	sendCmd(t, client, "MAIL FROM:<jürgen@example.com> SMTPUTF8")
+	if resp := readLine(t, reader); resp != "250 OK" {
+		t.Fatalf("MAIL FROM: got %q, want %q", resp, "250 OK")
+	}
+	sendCmd(t, client, "RCPT TO:<user@münchen.example>")
+	if resp := readLine(t, reader); resp != "250 OK" {
+		t.Fatalf("RCPT TO: got %q, want %q", resp, "250 OK")
+	}
+	sendCmd(t, client, "DATA")
+	readLine(t, reader)
+
+	message := "From: Jürgen <jürgen@example.com>\r\n" +
+		"To: user@münchen.example\r\n" +
+		"Subject: Grüße\r\n\r\nHallo\r\n.\r\n"
+	if _, err := client.Write([]byte(message)); err != nil {
+		t.Fatalf("failed to write DATA: %v", err)
+	}
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "250 ") {
+		t.Fatalf("DATA completion response: got %q, want prefix '250 '", resp)
+	}
+
+	if got := prov.lastMsg.To; len(got) != 1 || got[0] != "user@münchen.example" {
+		t.Errorf("To: got %q, want [user@münchen.example]", got)
+	}
+	if len(prov.lastMsg.Bcc) != 0 {
+		t.Errorf("Bcc: got %q, want none (recipient is in To)", prov.lastMsg.Bcc)
+	}
+}
+
+func TestSession_8BITMIME(t *testing.T) {
+	t.Parallel()
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	auth := NewAuthenticator("", "")
+	sess := NewSession(server, auth, &mockProvider{}, "mail.test.com", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go sess.Handle(ctx)
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "EHLO client.test.com")
+	if lines := readEHLO(t, reader); !slices.Contains(lines, "250-8BITMIME") {
+		t.Errorf("EHLO does not advertise 8BITMIME: %q", lines)
+	}
+
+	steps := []struct {
+		cmd  string
+		want string
+	}{
+		{"MAIL FROM:<a@example.com> BODY=8BITMIME", "250 OK"},
+		{"MAIL FROM:<a@example.com> body=7bit", "250 OK"},
+		{"MAIL FROM:<a@example.com> BODY=BINARYMIME", "501 5.5.4 Unsupported BODY parameter"},
+	}
+	for _, step := range steps {
+		sendCmd(t, client, step.cmd)
+		if resp := readLine(t, reader); resp != step.want {
+			t.Errorf("%s: got %q, want %q", step.cmd, resp, step.want)
+		}
+	}
+}
+
+func TestSession_DotUnstuffing(t *testing.T) {
+	t.Parallel()
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	prov := &mockProvider{}
+	auth := NewAuthenticator("", "")
+	sess := NewSession(server, auth, prov, "mail.test.com", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go sess.Handle(ctx)
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "EHLO client.test.com")
+	readEHLO(t, reader)
+
+	sendCmd(t, client, "MAIL FROM:<sender@example.com>")
+	readLine(t, reader)
+	sendCmd(t, client, "RCPT TO:<recipient@example.com>")
+	readLine(t, reader)
+	sendCmd(t, client, "DATA")
+	readLine(t, reader)
+
+	// The body lines ".", "..foo" and ".bar", dot-stuffed by the client
+	message := strings.Join([]string{
+		"Subject: Dots",
+		"",
+		"..",
+		"...foo",
+		"..bar",
+		".",
+	}, "\r\n")
+	if _, err := client.Write([]byte(message + "\r\n")); err != nil {
+		t.Fatalf("failed to write DATA: %v", err)
+	}
+
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "250 ") {
+		t.Fatalf("DATA completion response: got %q, want prefix '250 '", resp)
+	}
+	if prov.lastMsg == nil {
+		t.Fatal("provider did not receive the message")
+	}
+	if want := ".\r\n..foo\r\n.bar\r\n"; prov.lastMsg.TextBody != want {
+		t.Errorf("TextBody: got %q, want %q", prov.lastMsg.TextBody, want)
+	}
+}
+
+func TestSession_BareLFLineEndings(t *testing.T) {
+	t.Parallel()
+
+	client, server := connPair(t)
+	defer client.Close()
+
+	prov := &mockProvider{}
+	auth := NewAuthenticator("", "")
+	sess := NewSession(server, auth, prov, "mail.test.com", nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go sess.Handle(ctx)
+
+	reader := bufio.NewReader(client)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, client, "EHLO client.test.com")
+	readEHLO(t, reader)
+
+	sendCmd(t, client, "MAIL FROM:<sender@example.com>")
+	readLine(t, reader)
+	sendCmd(t, client, "RCPT TO:<recipient@example.com>")
+	readLine(t, reader)
+	sendCmd(t, client, "DATA")
+	readLine(t, reader)
+
+	// Bare LF endings, mixed with CRLF, including a stuffed line and the
+	// terminator
+	message := "Subject: Bare LF\n" +
+		"To: recipient@example.com\r\n" +
+		"\n" +
+		"first line\n" +
+		"second line\r\n" +
+		"..third line\n" +
+		".\n"
+	if _, err := client.Write([]byte(message)); err != nil {
+		t.Fatalf("failed to write DATA: %v", err)
+	}
+
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "250 ") {
+		t.Fatalf("DATA completion response: got %q, want prefix '250 '", resp)
+	}
+	if prov.lastMsg == nil {
+		t.Fatal("provider did not receive the message")
+	}
+	if prov.lastMsg.Subject != "Bare LF" {
+		t.Errorf("Subject: got %q, want %q", prov.lastMsg.Subject, "Bare LF")
+	}
+	if want := "first line\r\nsecond line\r\n.third line\r\n"; prov.lastMsg.TextBody != want {
+		t.Errorf("TextBody: got %q, want %q", prov.lastMsg.TextBody, want)
+	}
+}
+
+func TestAddEnvelopeBcc(t *testing.T) {
+	t.Parallel()
+
+	msg := &email.Email{
+		To:  []string{"to@example.com"},
+		Bcc: []string{"known@example.com"},
+	}
+	addEnvelopeBcc(msg, []string{"TO@example.com", "known@example.com", "new@example.com", "new@example.com"})
+
+	want := []string{"known@example.com", "new@example.com"}
+	if len(msg.Bcc) != len(want) {
+		t.Fatalf("Bcc: got %v, want %v", msg.Bcc, want)
+	}
+	for i := range want {
+		if msg.Bcc[i] != want[i] {
+			t.Errorf("Bcc[%d]: got %q, want %q", i, msg.Bcc[i], want[i])
+		}
+	}
+	if len(msg.To) != 1 {
+		t.Errorf("To: got %v, want unchanged", msg.To)
+	}
+}
+
+func TestHasRecipients(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		msg  email.Email
+		want bool
+	}{
+		{"none", email.Email{TextBody: "hi"}, false},
+		{"to", email.Email{To: []string{"a@example.com"}}, true},
+		{"cc", email.Email{Cc: []string{"a@example.com"}}, true},
+		{"bcc", email.Email{Bcc: []string{"a@example.com"}}, true},
+	}
+
+	for _, tt := range tests {
+		if got := hasRecipients(&tt.msg); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIsEmptyMessage(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		msg  email.Email
+		want bool
+	}{
+		{"nothing", email.Email{}, true},
+		{"recipients only", email.Email{To: []string{"a@example.com"}}, true},
+		{"whitespace body", email.Email{To: []string{"a@example.com"}, TextBody: " \r\n"}, true},
+		{"text body", email.Email{To: []string{"a@example.com"}, TextBody: "hi"}, false},
+		{"html body to cc", email.Email{Cc: []string{"a@example.com"}, HtmlBody: "<p>hi</p>"}, false},
+		{"attachment only", email.Email{
+			Bcc:         []string{"a@example.com"},
+			Attachments: []email.Attachment{{Filename: "a.txt", Content: []byte("x")}},
+		}, false},
+	}
+
+	for _, tt := range tests {
+		if got := isEmptyMessage(&tt.msg); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/shineum/smtp-proxy-lite/internal/provider"
+)
+
+// defaultStreamThreshold is the message size above which DATA is streamed
+// to a provider that supports it.
+const defaultStreamThreshold = 1 << 20
+
+// streamBufferSize is the size of the buffer DATA lines are gathered in
+// before being handed to a streaming provider.
+const streamBufferSize = 64 * 1024
+
+// errRoutingLoop aborts a streamed message that carries too many Received
+// headers.
+var errRoutingLoop = errors.New("routing loop detected")
+
+// headerScan follows the header section of a message as DATA arrives,
+// counting the Received headers the client sent for routing loop
+// detection. The one the proxy prepends is not counted, so a message
+// arriving with exactly the maximum is still accepted.
+type headerScan struct {
+	hops      int
+	inHeaders bool
+}
+
+// newHeaderScan returns a headerScan for a message about to be read.
+func newHeaderScan() headerScan {
+	return headerScan{inHeaders: true}
+}
+
+// scan takes the next line of the message.
+func (h *headerScan) scan(line string) {
+	if !h.inHeaders {
+		return
+	}
+	if line == "" {
+		h.inHeaders = false
+	} else if len(line) > len("Received:") && strings.EqualFold(line[:len("Received:")], "Received:") {
+		h.hops++
+	}
+}
+
+// streamDATA pipes the message to sp as it arrives, so memory use does not
+// grow with the message size. head is the message read so far, scanned
+// into headers; the rest is read from the client. The message is not
+// parsed, so only the checks that need no more than its headers apply.
+// handleDATA streams only when there are recipients and no retry queue,
+// and a message past the stream threshold is not empty.
+func (s *Session) streamDATA(ctx context.Context, sp provider.StreamingProvider, head []byte, headers headerScan) {
+	env := provider.Envelope{From: s.mailFrom, Recipients: slices.Clone(s.rcptTo)}
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.Bool("smtp.streamed", true))
+
+	pr, pw := io.Pipe()
+	result := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		err := sp.SendRaw(ctx, env, pr)
+		// Unblock the session if the provider stopped reading early; the
+		// rest of DATA is then read and dropped
+		pr.Close()
+		result <- err
+	}()
+
+	// Write errors are sticky in w; once the provider has stopped reading,
+	// the rest of the message is discarded
+	w := bufio.NewWriterSize(pw, streamBufferSize)
+	w.Write(head)
+	size := int64(len(head))
+
+	loop := false
+	for {
+		if headers.hops > s.maxReceivedHeaders && !loop {
+			loop = true
+			pw.CloseWithError(errRoutingLoop)
+		}
+
+		line, end, err := s.readDataLine()
+		if err != nil {
+			s.logger.Error("error reading DATA", "error", err)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "error reading DATA")
+			pw.CloseWithError(err)
+			<-result
+			return
+		}
+		if end {
+			break
+		}
+		headers.scan(line)
+		w.WriteString(line)
+		w.WriteString("\r\n")
+		size += int64(len(line)) + 2
+	}
+	w.Flush()
+	pw.Close()
+
+	err := <-result
+	latency := time.Since(start)
+	span.SetAttributes(attribute.Int64("smtp.size_bytes", size))
+
+	if loop {
+		s.logger.Warn("routing loop detected",
+			"received_headers", headers.hops,
+			"max_received_headers", s.maxReceivedHeaders,
+		)
+		s.writeLine("554 5.4.6 Routing loop detected")
+		s.resetTransaction()
+		return
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		s.logger.Error("provider send failed",
+			"provider", s.provider.Name(),
+			"streamed", true,
+			"latency_ms", latency.Milliseconds(),
+			"permanent", provider.IsPermanent(err),
+			"error", err,
+		)
+		s.writeSendFailure(err)
+		s.resetTransaction()
+		return
+	}
+
+	s.logDSNRequest()
+	s.logger.Info("message delivered",
+		"provider", s.provider.Name(),
+		"streamed", true,
+		"remote_addr", s.conn.RemoteAddr().String(),
+		"helo", s.heloName,
+		"mail_from", s.mailFrom,
+		"recipients", len(s.rcptTo),
+		"size_bytes", size,
+		"latency_ms", latency.Milliseconds(),
+	)
+	s.transactions++
+	s.writeLine("250 OK message queued")
+	s.resetTransaction()
+}
@@ -0,0 +1,279 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+	"github.com/shineum/smtp-proxy-lite/internal/provider"
+	"github.com/shineum/smtp-proxy-lite/internal/queue"
+)
+
+// rawProvider is a StreamingProvider that records what SendRaw reads.
+type rawProvider struct {
+	env  provider.Envelope
+	raw  []byte
+	size int64
+	sent bool
+
+	// discard counts the message bytes instead of keeping them.
+	discard bool
+	// onRead, if set, is called as the message is read.
+	onRead func()
+	err    error
+}
+
+func (p *rawProvider) Send(_ context.Context, _ *email.Email) error {
+	p.sent = true
+	return p.err
+}
+
+func (p *rawProvider) SendRaw(_ context.Context, env provider.Envelope, r io.Reader) error {
+	p.env = env
+	if p.discard {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := r.Read(buf)
+			p.size += int64(n)
+			if p.onRead != nil {
+				p.onRead()
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		raw, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		p.raw = raw
+	}
+	return p.err
+}
+
+func (p *rawProvider) Name() string {
+	return "raw"
+}
+
+// startStreamSession opens a session with prov that streams messages
+// larger than threshold and sends the envelope, leaving the client ready
+// to send DATA. setup, if given, adjusts the session before it starts.
+func startStreamSession(t *testing.T, prov provider.Provider, threshold int, setup ...func(*Session)) (client io.Writer, reader *bufio.Reader) {
+	t.Helper()
+
+	conn, server := connPair(t)
+	t.Cleanup(func() { conn.Close() })
+
+	sess := NewSession(server, NewAuthenticator("", ""), prov, "mail.test.com", nil)
+	sess.streamThreshold = threshold
+	for _, f := range setup {
+		f(sess)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	t.Cleanup(cancel)
+
+	go sess.Handle(ctx)
+
+	reader = bufio.NewReader(conn)
+	readLine(t, reader) // Skip greeting
+
+	sendCmd(t, conn, "EHLO client.test.com")
+	readEHLO(t, reader)
+	sendCmd(t, conn, "MAIL FROM:<sender@example.com>")
+	readLine(t, reader)
+	sendCmd(t, conn, "RCPT TO:<user@example.org>")
+	readLine(t, reader)
+	sendCmd(t, conn, "RCPT TO:<hidden@example.org>")
+	readLine(t, reader)
+	sendCmd(t, conn, "DATA")
+	if resp := readLine(t, reader); !strings.HasPrefix(resp, "354") {
+		t.Fatalf("DATA: got %q, want 354", resp)
+	}
+	return conn, reader
+}
+
+func TestSession_StreamsToStreamingProvider(t *testing.T) {
+	t.Parallel()
+
+	prov := &rawProvider{}
+	client, reader := startStreamSession(t, prov, 0)
+
+	client.Write([]byte("Subject: Test\r\n\r\n..leading dot\nbare LF\r\n.\r\n"))
+	if resp := readLine(t, reader); resp != "250 OK message queued" {
+		t.Fatalf("end of DATA: got %q, want %q", resp, "250 OK message queued")
+	}
+
+	if prov.sent {
+		t.Error("Send was called for a streaming provider")
+	}
+	wantEnv := provider.Envelope{From: "sender@example.com", Recipients: []string{"user@example.org", "hidden@example.org"}}
+	if prov.env.From != wantEnv.From || !slices.Equal(prov.env.Recipients, wantEnv.Recipients) {
+		t.Errorf("envelope: got %+v, want %+v", prov.env, wantEnv)
+	}
+
+	raw := string(prov.raw)
+	if !strings.HasPrefix(raw, "Received: from ") {
+		t.Errorf("message does not start with a Received header: %q", raw)
+	}
+	if want := "Subject: Test\r\n\r\n.leading dot\r\nbare LF\r\n"; !strings.HasSuffix(raw, want) {
+		t.Errorf("message: got %q, want suffix %q", raw, want)
+	}
+}
+
+func TestSession_StreamDispatch(t *testing.T) {
+	t.Parallel()
+
+	const threshold = 1024
+	small := "Subject: Small\r\n\r\nHello\r\n"
+	large := "Subject: Large\r\n\r\n" + strings.Repeat("Hello, world\r\n", threshold/10)
+
+	tests := []struct {
+		name       string
+		streaming  bool
+		message    string
+		wantStream bool
+	}{
+		{"small message to streaming provider", true, small, false},
+		{"large message to streaming provider", true, large, true},
+		{"large message to other provider", false, large, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			raw := &rawProvider{}
+			var prov provider.Provider = raw
+			if !tt.streaming {
+				// Hide SendRaw behind a wrapper, as middleware does
+				prov = provider.Wrap(raw, provider.DenyAttachmentExtensions(nil))
+			}
+
+			client, reader := startStreamSession(t, prov, threshold)
+			client.Write([]byte(tt.message + ".\r\n"))
+			if resp := readLine(t, reader); resp != "250 OK message queued" {
+				t.Fatalf("end of DATA: got %q, want %q", resp, "250 OK message queued")
+			}
+
+			if streamed := raw.raw != nil; streamed != tt.wantStream {
+				t.Errorf("streamed: got %v, want %v", streamed, tt.wantStream)
+			}
+			if raw.sent == tt.wantStream {
+				t.Errorf("Send called: got %v, want %v", raw.sent, !tt.wantStream)
+			}
+			if tt.wantStream && !strings.HasSuffix(string(raw.raw), tt.message) {
+				t.Errorf("streamed message does not end with the DATA sent (%d bytes)", len(raw.raw))
+			}
+		})
+	}
+}
+
+func TestSession_StreamFailures(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		err     error
+		message string
+		want    string
+	}{
+		{"permanent", &provider.PolicyError{Reason: "Blocked"}, "Subject: Test\r\n\r\nBody\r\n", "550 5.7.1 Blocked"},
+		{"transient", errors.New("connection refused"), "Subject: Test\r\n\r\nBody\r\n", "451 4.3.0 Temporary failure, please try again later"},
+		{"routing loop", nil, strings.Repeat("Received: from relay\r\n", defaultMaxReceivedHeaders+1) + "\r\nBody\r\n", "554 5.4.6 Routing loop detected"},
+		{"most hops allowed", nil, strings.Repeat("Received: from relay\r\n", defaultMaxReceivedHeaders) + "\r\nBody\r\n", "250 OK message queued"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			client, reader := startStreamSession(t, &rawProvider{err: tt.err}, 0)
+			client.Write([]byte(tt.message + ".\r\n"))
+			if resp := readLine(t, reader); resp != tt.want {
+				t.Errorf("end of DATA: got %q, want %q", resp, tt.want)
+			}
+		})
+	}
+}
+
+func TestSession_NoStreamWithRetryQueue(t *testing.T) {
+	t.Parallel()
+
+	prov := &rawProvider{err: errors.New("connection refused")}
+	spool, err := queue.New(queue.Config{Dir: t.TempDir(), Provider: prov})
+	if err != nil {
+		t.Fatalf("queue.New: %v", err)
+	}
+	client, reader := startStreamSession(t, prov, 0, func(s *Session) { s.queue = spool })
+
+	client.Write([]byte("Subject: Test\r\n\r\nBody\r\n.\r\n"))
+	if resp := readLine(t, reader); resp != "250 OK message queued for retry" {
+		t.Fatalf("end of DATA: got %q, want %q", resp, "250 OK message queued for retry")
+	}
+	if prov.raw != nil {
+		t.Error("message was streamed despite the retry queue")
+	}
+	if got := spool.Len(); got != 1 {
+		t.Errorf("queued messages: got %d, want 1", got)
+	}
+}
+
+func TestSession_StreamLargeMessageBoundedMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("sends a 64 MB message")
+	}
+
+	const messageSize = 64 << 20
+	const maxHeapGrowth = 16 << 20
+
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	baseline := stats.HeapAlloc
+
+	// Sample the heap as the provider reads, every few megabytes
+	var peak uint64
+	var reads int
+	prov := &rawProvider{discard: true, onRead: func() {
+		reads++
+		if reads%128 != 0 {
+			return
+		}
+		runtime.ReadMemStats(&stats)
+		peak = max(peak, stats.HeapAlloc)
+	}}
+	client, reader := startStreamSession(t, prov, defaultStreamThreshold)
+
+	line := []byte(strings.Repeat("x", 998) + "\r\n")
+	w := bufio.NewWriter(client)
+	w.WriteString("Subject: Large\r\n\r\n")
+	for range messageSize / len(line) {
+		w.Write(line)
+	}
+	w.WriteString(".\r\n")
+	if err := w.Flush(); err != nil {
+		t.Fatalf("failed to send message: %v", err)
+	}
+
+	if resp := readLine(t, reader); resp != "250 OK message queued" {
+		t.Fatalf("end of DATA: got %q, want %q", resp, "250 OK message queued")
+	}
+	if prov.size < messageSize-int64(len(line)) {
+		t.Errorf("provider read %d bytes, want at least %d", prov.size, messageSize-len(line))
+	}
+	if peak > baseline+maxHeapGrowth {
+		t.Errorf("heap grew by %d MB while streaming, want under %d MB", (peak-baseline)>>20, maxHeapGrowth>>20)
+	}
+}
@@ -12,8 +12,13 @@ import (
 	"fmt"
 	"math/big"
 	"net"
+	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
+
+	"golang.org/x/crypto/acme/autocert"
 )
 
 // GenerateSelfSignedCert generates an in-memory ECDSA P-256 self-signed certificate
@@ -67,22 +72,150 @@ func GenerateSelfSignedCert() (*tls.Certificate, error) {
 	return &cert, nil
 }
 
-// LoadOrGenerateTLS loads TLS certificates from the given file paths, or generates
-// a self-signed certificate if the paths are empty. Returns a configured tls.Config
-// ready for use with the SMTP server.
-func LoadOrGenerateTLS(certFile, keyFile string) (*tls.Config, error) {
+// CertManager obtains and renews certificates on demand. It is implemented
+// by *autocert.Manager.
+type CertManager interface {
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+	HTTPHandler(fallback http.Handler) http.Handler
+}
+
+// Options configures how the server certificate is obtained.
+type Options struct {
+	// CertFile and KeyFile are paths to a PEM certificate and key.
+	CertFile string
+	KeyFile  string
+
+	// Reloader, if set, serves the certificate from a CertReloader so it
+	// can be swapped at runtime. It takes precedence over CertFile/KeyFile.
+	Reloader *CertReloader
+
+	// ACME, if set, obtains certificates automatically (e.g. from Let's
+	// Encrypt) and takes precedence over CertFile/KeyFile.
+	ACME CertManager
+
+	// ACMEDomain is the certificate name served to clients that send no
+	// SNI, as many SMTP clients do; ACME cannot pick a certificate without
+	// one.
+	ACMEDomain string
+
+	// MinVersion is the minimum accepted TLS version (a tls.Version*
+	// constant). Zero uses TLS 1.2.
+	MinVersion uint16
+
+	// CipherSuites restricts the cipher suites offered for TLS 1.2 and
+	// below. Empty uses Go's defaults. TLS 1.3 suites are not configurable.
+	CipherSuites []uint16
+}
+
+// defaultMinVersion is the minimum TLS version used when none is configured.
+const defaultMinVersion = tls.VersionTLS12
+
+// tlsVersions maps configuration values to TLS protocol versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseMinVersion maps a version string ("1.0", "1.1", "1.2" or "1.3") to
+// the corresponding tls.Version* constant. An empty string yields the
+// default (TLS 1.2); an unrecognized value also yields the default and
+// ok is false.
+func ParseMinVersion(s string) (version uint16, ok bool) {
+	if s == "" {
+		return defaultMinVersion, true
+	}
+	if v, found := tlsVersions[strings.TrimSpace(s)]; found {
+		return v, true
+	}
+	return defaultMinVersion, false
+}
+
+// ParseCipherSuites maps cipher suite names (e.g.
+// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256") to their IDs. Only suites Go
+// considers secure are accepted.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, found := known[name]
+		if !found {
+			return nil, fmt.Errorf("unknown or insecure cipher suite: %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// NewACMEManager creates an autocert manager that obtains Let's Encrypt
+// certificates for domain, caching them in cacheDir. The manager answers
+// HTTP-01 challenges through its HTTPHandler, which must be reachable on
+// port 80 of the domain.
+func NewACMEManager(domain, cacheDir, email string) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domain),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+	}
+}
+
+// LoadOrGenerateTLS returns a tls.Config ready for use with the SMTP server.
+// Certificates come from the ACME manager if configured, otherwise from the
+// given certificate files, otherwise a self-signed certificate is generated.
+// The minimum version and cipher suites from opts are applied to the result.
+func LoadOrGenerateTLS(opts Options) (*tls.Config, error) {
+	cfg, err := loadCertificates(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.MinVersion = opts.MinVersion
+	if cfg.MinVersion == 0 {
+		cfg.MinVersion = defaultMinVersion
+	}
+	cfg.CipherSuites = opts.CipherSuites
+	return cfg, nil
+}
+
+// loadCertificates returns a tls.Config carrying the server certificate
+// source selected by opts.
+func loadCertificates(opts Options) (*tls.Config, error) {
+	if opts.ACME != nil {
+		manager, domain := opts.ACME, opts.ACMEDomain
+		return &tls.Config{
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				if hello.ServerName == "" {
+					hello.ServerName = domain
+				}
+				return manager.GetCertificate(hello)
+			},
+		}, nil
+	}
+
+	if opts.Reloader != nil {
+		return &tls.Config{
+			GetCertificate: opts.Reloader.GetCertificate,
+		}, nil
+	}
+
 	var cert tls.Certificate
 
-	if certFile != "" && keyFile != "" {
+	if opts.CertFile != "" && opts.KeyFile != "" {
 		// Validate that files exist before attempting to load
-		if _, err := os.Stat(certFile); err != nil {
+		if _, err := os.Stat(opts.CertFile); err != nil {
 			return nil, fmt.Errorf("certificate file not found: %w", err)
 		}
-		if _, err := os.Stat(keyFile); err != nil {
+		if _, err := os.Stat(opts.KeyFile); err != nil {
 			return nil, fmt.Errorf("key file not found: %w", err)
 		}
 
-		loaded, err := tls.LoadX509KeyPair(certFile, keyFile)
+		loaded, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
 		if err != nil {
 			return nil, fmt.Errorf("failed to load TLS key pair: %w", err)
 		}
@@ -97,6 +230,62 @@ func LoadOrGenerateTLS(certFile, keyFile string) (*tls.Config, error) {
 
 	return &tls.Config{
 		Certificates: []tls.Certificate{cert},
-		MinVersion:   tls.VersionTLS12,
 	}, nil
 }
+
+// LoadClientCAs reads a PEM bundle of CA certificates used to verify client
+// certificates for mutual TLS.
+func LoadClientCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in client CA file %s", path)
+	}
+	return pool, nil
+}
+
+// CertReloader holds a certificate loaded from files and allows it to be
+// reloaded at runtime (e.g. on SIGHUP after an external renewal) without
+// restarting the server. It is safe for concurrent use.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewCertReloader loads the certificate and key from the given files.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload re-reads the certificate and key files and swaps them in. If
+// loading fails, the current certificate is kept and the error is returned.
+func (r *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS key pair: %w", err)
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return nil
+}
+
+// GetCertificate returns the current certificate. It matches the signature
+// of tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
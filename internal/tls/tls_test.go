@@ -1,10 +1,16 @@
 package tls
 
 import (
+	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	standardtls "crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -80,7 +86,7 @@ func TestGenerateSelfSignedCert(t *testing.T) {
 func TestLoadOrGenerateTLS_SelfSigned(t *testing.T) {
 	t.Parallel()
 
-	tlsConfig, err := LoadOrGenerateTLS("", "")
+	tlsConfig, err := LoadOrGenerateTLS(Options{})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -95,11 +101,305 @@ func TestLoadOrGenerateTLS_SelfSigned(t *testing.T) {
 	}
 }
 
+func TestLoadOrGenerateTLS_VersionAndCipherSuites(t *testing.T) {
+	t.Parallel()
+
+	suites := []uint16{standardtls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	tlsConfig, err := LoadOrGenerateTLS(Options{
+		MinVersion:   standardtls.VersionTLS13,
+		CipherSuites: suites,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tlsConfig.MinVersion != standardtls.VersionTLS13 {
+		t.Errorf("MinVersion: got %d, want TLS 1.3 (%d)", tlsConfig.MinVersion, standardtls.VersionTLS13)
+	}
+	if len(tlsConfig.CipherSuites) != 1 || tlsConfig.CipherSuites[0] != suites[0] {
+		t.Errorf("CipherSuites: got %v, want %v", tlsConfig.CipherSuites, suites)
+	}
+}
+
+func TestParseMinVersion(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		input  string
+		want   uint16
+		wantOK bool
+	}{
+		{"", standardtls.VersionTLS12, true},
+		{"1.0", standardtls.VersionTLS10, true},
+		{"1.1", standardtls.VersionTLS11, true},
+		{"1.2", standardtls.VersionTLS12, true},
+		{"1.3", standardtls.VersionTLS13, true},
+		{" 1.3 ", standardtls.VersionTLS13, true},
+		{"1.4", standardtls.VersionTLS12, false},
+		{"TLS1.3", standardtls.VersionTLS12, false},
+		{"ssl3", standardtls.VersionTLS12, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := ParseMinVersion(tt.input)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("ParseMinVersion(%q): got (%d, %v), want (%d, %v)", tt.input, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	t.Parallel()
+
+	ids, err := ParseCipherSuites([]string{
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+		"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []uint16{
+		standardtls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		standardtls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	}
+	if len(ids) != len(want) || ids[0] != want[0] || ids[1] != want[1] {
+		t.Errorf("ParseCipherSuites: got %v, want %v", ids, want)
+	}
+
+	if _, err := ParseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"}); err == nil {
+		t.Error("expected error for insecure cipher suite, got nil")
+	}
+	if _, err := ParseCipherSuites([]string{"NOT_A_SUITE"}); err == nil {
+		t.Error("expected error for unknown cipher suite, got nil")
+	}
+}
+
 func TestLoadOrGenerateTLS_FileNotFound(t *testing.T) {
 	t.Parallel()
 
-	_, err := LoadOrGenerateTLS("/nonexistent/cert.pem", "/nonexistent/key.pem")
+	_, err := LoadOrGenerateTLS(Options{
+		CertFile: "/nonexistent/cert.pem",
+		KeyFile:  "/nonexistent/key.pem",
+	})
 	if err == nil {
 		t.Error("expected error for nonexistent files, got nil")
 	}
 }
+
+// mockCertManager implements CertManager for testing.
+type mockCertManager struct {
+	cert       *standardtls.Certificate
+	calls      int
+	serverName string
+}
+
+func (m *mockCertManager) GetCertificate(hello *standardtls.ClientHelloInfo) (*standardtls.Certificate, error) {
+	m.calls++
+	m.serverName = hello.ServerName
+	return m.cert, nil
+}
+
+func (m *mockCertManager) HTTPHandler(fallback http.Handler) http.Handler {
+	return fallback
+}
+
+func TestLoadOrGenerateTLS_ACME(t *testing.T) {
+	t.Parallel()
+
+	cert, err := GenerateSelfSignedCert()
+	if err != nil {
+		t.Fatalf("failed to generate cert: %v", err)
+	}
+	manager := &mockCertManager{cert: cert}
+
+	// ACME takes precedence even when certificate files are configured
+	tlsConfig, err := LoadOrGenerateTLS(Options{
+		CertFile: "/nonexistent/cert.pem",
+		KeyFile:  "/nonexistent/key.pem",
+		ACME:     manager,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(tlsConfig.Certificates) != 0 {
+		t.Errorf("Certificates: got %d, want 0 (served by ACME manager)", len(tlsConfig.Certificates))
+	}
+	if tlsConfig.GetCertificate == nil {
+		t.Fatal("GetCertificate is nil, want ACME manager callback")
+	}
+
+	got, err := tlsConfig.GetCertificate(&standardtls.ClientHelloInfo{ServerName: "mail.example.com"})
+	if err != nil {
+		t.Fatalf("GetCertificate: unexpected error: %v", err)
+	}
+	if got != cert {
+		t.Error("GetCertificate did not return the ACME manager's certificate")
+	}
+	if manager.calls != 1 {
+		t.Errorf("manager calls: got %d, want 1", manager.calls)
+	}
+}
+
+func TestLoadOrGenerateTLS_ACMEWithoutSNI(t *testing.T) {
+	t.Parallel()
+
+	cert, err := GenerateSelfSignedCert()
+	if err != nil {
+		t.Fatalf("failed to generate cert: %v", err)
+	}
+	manager := &mockCertManager{cert: cert}
+	tlsConfig, err := LoadOrGenerateTLS(Options{ACME: manager, ACMEDomain: "mail.example.com"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		sni  string
+		want string
+	}{
+		{"", "mail.example.com"},
+		{"other.example.com", "other.example.com"},
+	}
+	for _, tt := range tests {
+		if _, err := tlsConfig.GetCertificate(&standardtls.ClientHelloInfo{ServerName: tt.sni}); err != nil {
+			t.Fatalf("GetCertificate(%q): unexpected error: %v", tt.sni, err)
+		}
+		if manager.serverName != tt.want {
+			t.Errorf("SNI %q: manager asked for %q, want %q", tt.sni, manager.serverName, tt.want)
+		}
+	}
+}
+
+func TestNewACMEManager(t *testing.T) {
+	t.Parallel()
+
+	cacheDir := t.TempDir()
+	manager := NewACMEManager("mail.example.com", cacheDir, "ops@example.com")
+
+	if manager.Email != "ops@example.com" {
+		t.Errorf("Email: got %q, want %q", manager.Email, "ops@example.com")
+	}
+	if err := manager.HostPolicy(context.Background(), "mail.example.com"); err != nil {
+		t.Errorf("HostPolicy rejected configured domain: %v", err)
+	}
+	if err := manager.HostPolicy(context.Background(), "other.example.com"); err == nil {
+		t.Error("HostPolicy accepted a domain that was not configured")
+	}
+}
+
+// writeCertFiles writes a freshly generated self-signed certificate and key
+// as PEM files in dir and returns their paths and the certificate DER.
+func writeCertFiles(t *testing.T, dir string) (certPath, keyPath string, der []byte) {
+	t.Helper()
+
+	cert, err := GenerateSelfSignedCert()
+	if err != nil {
+		t.Fatalf("failed to generate cert: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	certPath = filepath.Join(dir, "cert.pem")
+	keyPath = filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(certPath, certPEM, 0600); err != nil {
+		t.Fatalf("failed to write cert: %v", err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return certPath, keyPath, cert.Certificate[0]
+}
+
+func TestCertReloader_Reload(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certPath, keyPath, firstDER := writeCertFiles(t, dir)
+
+	reloader, err := NewCertReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tlsConfig, err := LoadOrGenerateTLS(Options{Reloader: reloader})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, err := tlsConfig.GetCertificate(&standardtls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("GetCertificate: unexpected error: %v", err)
+	}
+	if !bytes.Equal(got.Certificate[0], firstDER) {
+		t.Fatal("GetCertificate did not return the initial certificate")
+	}
+
+	// Swap the files on disk and reload
+	_, _, secondDER := writeCertFiles(t, dir)
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("Reload: unexpected error: %v", err)
+	}
+
+	got, _ = tlsConfig.GetCertificate(&standardtls.ClientHelloInfo{})
+	if !bytes.Equal(got.Certificate[0], secondDER) {
+		t.Error("GetCertificate did not return the reloaded certificate")
+	}
+}
+
+func TestCertReloader_ReloadFailureKeepsCurrentCert(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certPath, keyPath, der := writeCertFiles(t, dir)
+
+	reloader, err := NewCertReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := os.WriteFile(certPath, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("failed to corrupt cert: %v", err)
+	}
+	if err := reloader.Reload(); err == nil {
+		t.Fatal("Reload: expected error for invalid certificate, got nil")
+	}
+
+	got, _ := reloader.GetCertificate(&standardtls.ClientHelloInfo{})
+	if !bytes.Equal(got.Certificate[0], der) {
+		t.Error("failed reload should keep the previous certificate")
+	}
+}
+
+func TestNewCertReloader_FileNotFound(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewCertReloader("/nonexistent/cert.pem", "/nonexistent/key.pem"); err == nil {
+		t.Error("expected error for nonexistent files, got nil")
+	}
+}
+
+func TestLoadClientCAs(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certPath, keyPath, _ := writeCertFiles(t, dir)
+
+	pool, err := LoadClientCAs(certPath)
+	if err != nil {
+		t.Fatalf("LoadClientCAs returned error: %v", err)
+	}
+	if pool == nil {
+		t.Fatal("LoadClientCAs returned nil pool")
+	}
+
+	// A file without certificates is rejected
+	if _, err := LoadClientCAs(keyPath); err == nil {
+		t.Error("expected error for file without certificates, got nil")
+	}
+	if _, err := LoadClientCAs(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("expected error for nonexistent file, got nil")
+	}
+}
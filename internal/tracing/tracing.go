@@ -0,0 +1,63 @@
+// Package tracing configures the process-wide OpenTelemetry tracer
+// provider. Until Setup is called the global provider is a no-op, so
+// instrumented code costs next to nothing when tracing is disabled.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// serviceName identifies the proxy in exported spans unless
+// OTEL_SERVICE_NAME overrides it.
+const serviceName = "smtp-proxy-lite"
+
+// tracesPath is where an OTLP/HTTP collector receives spans, relative to
+// its base URL.
+const tracesPath = "v1/traces"
+
+// Setup installs a global tracer provider that exports spans in batches
+// over OTLP/HTTP to the collector at endpoint, a base URL such as
+// http://collector:4318. An empty endpoint leaves the choice to the
+// exporter, which reads the standard OTEL_EXPORTER_OTLP_* variables and
+// falls back to localhost. The returned function flushes pending spans and
+// stops the exporter.
+func Setup(ctx context.Context, endpoint string) (shutdown func(context.Context) error, err error) {
+	var opts []otlptracehttp.Option
+	if endpoint != "" {
+		tracesURL, err := url.JoinPath(endpoint, tracesPath)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTLP endpoint: %w", err)
+		}
+		opts = append(opts, otlptracehttp.WithEndpointURL(tracesURL))
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	// Later options win, so OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES
+	// override the built-in service name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(serviceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe tracing resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
@@ -0,0 +1,45 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestSetup_ExportsToEndpoint(t *testing.T) {
+	paths := make(chan string, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case paths <- r.URL.Path:
+		default:
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer collector.Close()
+
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+	shutdown, err := Setup(context.Background(), collector.URL)
+	if err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+
+	_, span := otel.Tracer("test").Start(context.Background(), "test span")
+	span.End()
+
+	// Shutdown flushes the batch to the collector
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	select {
+	case path := <-paths:
+		if path != "/v1/traces" {
+			t.Errorf("export path: got %q, want %q", path, "/v1/traces")
+		}
+	default:
+		t.Fatal("no spans were exported")
+	}
+}
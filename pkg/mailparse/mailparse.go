@@ -0,0 +1,32 @@
+// Package mailparse parses RFC 5322 email messages, including MIME
+// multipart bodies and attachments, for programs embedding the proxy's
+// parser. It is a stable wrapper around the parser the proxy itself uses.
+package mailparse
+
+import (
+	"github.com/shineum/smtp-proxy-lite/internal/email"
+	"github.com/shineum/smtp-proxy-lite/internal/parser"
+)
+
+// Email is a parsed email message: its addresses, subject, text and HTML
+// bodies, attachments and raw headers.
+type Email = email.Email
+
+// Attachment is a file attached to an email message, with its decoded
+// content.
+type Attachment = email.Attachment
+
+// Message importance levels, as reported in Email.Importance.
+const (
+	ImportanceLow    = email.ImportanceLow
+	ImportanceNormal = email.ImportanceNormal
+	ImportanceHigh   = email.ImportanceHigh
+)
+
+// Parse parses a raw RFC 5322 message. Text and HTML bodies are taken from
+// the first text/plain and text/html parts, attachments are decoded, and
+// an attachment declared as application/octet-stream is given the type
+// sniffed from its content.
+func Parse(raw []byte) (*Email, error) {
+	return parser.Parse(raw)
+}
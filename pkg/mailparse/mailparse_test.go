@@ -0,0 +1,74 @@
+package mailparse_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/shineum/smtp-proxy-lite/pkg/mailparse"
+)
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	raw := []byte(strings.Join([]string{
+		"From: Sender <sender@example.com>",
+		"To: a@example.com, b@example.com",
+		"Subject: Report",
+		"Importance: high",
+		"Content-Type: multipart/mixed; boundary=bound",
+		"",
+		"--bound",
+		"Content-Type: text/plain",
+		"",
+		"See attached.",
+		"--bound",
+		"Content-Type: text/csv; name=\"report.csv\"",
+		"Content-Disposition: attachment; filename=\"report.csv\"",
+		"",
+		"a,b",
+		"--bound--",
+	}, "\r\n"))
+
+	msg, err := mailparse.Parse(raw)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	if msg.Subject != "Report" {
+		t.Errorf("Subject: got %q, want %q", msg.Subject, "Report")
+	}
+	if len(msg.To) != 2 {
+		t.Errorf("To: got %v, want 2 addresses", msg.To)
+	}
+	if msg.TextBody != "See attached." {
+		t.Errorf("TextBody: got %q, want %q", msg.TextBody, "See attached.")
+	}
+	if msg.Importance != mailparse.ImportanceHigh {
+		t.Errorf("Importance: got %q, want %q", msg.Importance, mailparse.ImportanceHigh)
+	}
+
+	if len(msg.Attachments) != 1 {
+		t.Fatalf("Attachments: got %d, want 1", len(msg.Attachments))
+	}
+	att := msg.Attachments[0]
+	if att.Filename != "report.csv" || att.ContentType != "text/csv" || string(att.Content) != "a,b" {
+		t.Errorf("attachment: got %q (%s) %q", att.Filename, att.ContentType, att.Content)
+	}
+}
+
+func ExampleParse() {
+	raw := []byte("From: sender@example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: Hello\r\n" +
+		"\r\n" +
+		"Hi there\r\n")
+
+	msg, err := mailparse.Parse(raw)
+	if err != nil {
+		fmt.Println("error:", err)
+		return
+	}
+	fmt.Println(msg.From, msg.To, msg.Subject)
+	// Output: sender@example.com [recipient@example.com] Hello
+}